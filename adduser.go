@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/zzibert/3fs-rest-api/auth"
+	"github.com/zzibert/3fs-rest-api/data"
+)
+
+// adduserStore is the store used by the adduser subcommand
+type adduserStore interface {
+	data.UserStore
+	data.GroupStore
+}
+
+// runAddUser runs the adduser subcommand that creates a user, and its group if it does not exist,
+// so that the first user can log in before anyone holds a token
+// Migrations make no group an admin, the first admins are bootstrapped with -permissions all
+// e.g. adduser -name admin -email admin@3fs.si -password secret -group admins -permissions all
+func runAddUser(store adduserStore, passwords *auth.Passwords, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("adduser", flag.ContinueOnError)
+	fs.SetOutput(w)
+	name := fs.String("name", "", "name of the user")
+	email := fs.String("email", "", "email of the user")
+	password := fs.String("password", "", "password of the user")
+	groupName := fs.String("group", "", "name of the group of the user, created if it does not exist")
+	permissions := fs.String("permissions", "", "comma separated permissions granted to the group, or all")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" || *email == "" || *password == "" || *groupName == "" {
+		return fmt.Errorf("usage: adduser -name NAME -email EMAIL -password PASSWORD -group GROUP [-permissions all|PERMISSION,...]")
+	}
+
+	var grants []string
+	switch *permissions {
+	case "":
+	case "all":
+		grants = data.AllPermissions
+	default:
+		grants = strings.Split(*permissions, ",")
+	}
+	for _, permission := range grants {
+		if !data.ValidPermission(permission) {
+			return fmt.Errorf("%w %s", data.ErrUnknownPermission, permission)
+		}
+	}
+
+	groups, _, err := store.GetGroups(data.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	group := data.Group{Name: *groupName}
+	for _, g := range groups {
+		if g.Name == *groupName {
+			group = *g
+		}
+	}
+	if group.ID == 0 {
+		if err := store.AddGroup(data.System, &group); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "created group %d %s\n", group.ID, group.Name)
+	}
+
+	for _, permission := range grants {
+		if err := store.GrantPermission(data.System, group.ID, permission); err != nil {
+			return err
+		}
+	}
+	if len(grants) > 0 {
+		fmt.Fprintf(w, "granted %s to group %s\n", strings.Join(grants, ","), group.Name)
+	}
+
+	hash, err := passwords.Hash(*password)
+	if err != nil {
+		return err
+	}
+
+	user := data.User{Name: *name, Email: *email, Password: hash, GroupID: group.ID}
+	if err = store.AddUser(data.System, &user); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "created user %d %s\n", user.ID, user.Name)
+	return nil
+}
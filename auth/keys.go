@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+)
+
+// ErrInvalidKey is an error raised when a signing key can not be loaded
+var ErrInvalidKey = fmt.Errorf("invalid signing key, expected an Ed25519 private key in PKCS #8 PEM format")
+
+// Key is an Ed25519 key used for signing tokens
+type Key struct {
+	// ID is the JWK thumbprint of the public key, used as the kid of tokens
+	ID      string
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// KeySet is an ordered set of signing keys
+// The first key signs new tokens, every key verifies tokens,
+// so keys are rotated by adding the new key in front and removing the old key
+// once the tokens it signed have expired
+type KeySet struct {
+	keys []*Key
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewKeySet returns a key set with the given private keys, the first key signs new tokens
+func NewKeySet(keys ...ed25519.PrivateKey) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, ErrInvalidKey
+	}
+
+	ks := &KeySet{}
+	for _, private := range keys {
+		public := private.Public().(ed25519.PublicKey)
+		ks.keys = append(ks.keys, &Key{ID: thumbprint(public), private: private, public: public})
+	}
+	return ks, nil
+}
+
+// GenerateKeySet returns a key set with a single new random key
+func GenerateKeySet() (*KeySet, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeySet(private)
+}
+
+// LoadKeySet returns a key set with the keys from the given PEM files, the first key signs new tokens
+// A key is created with: openssl genpkey -algorithm ed25519
+func LoadKeySet(paths ...string) (*KeySet, error) {
+	keys := make([]ed25519.PrivateKey, 0, len(paths))
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidKey, path)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidKey, path)
+		}
+		private, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidKey, path)
+		}
+		keys = append(keys, private)
+	}
+	return NewKeySet(keys...)
+}
+
+// signing returns the key that signs new tokens
+func (ks *KeySet) signing() *Key {
+	return ks.keys[0]
+}
+
+// find returns the key with the given id
+func (ks *KeySet) find(id string) (*Key, bool) {
+	for _, key := range ks.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// JWKS returns the public keys of the set
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: make([]JWK, 0, len(ks.keys))}
+	for _, key := range ks.keys {
+		jwks.Keys = append(jwks.Keys, JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(key.public),
+			KeyID:     key.ID,
+			Use:       "sig",
+			Algorithm: "EdDSA",
+		})
+	}
+	return jwks
+}
+
+// thumbprint returns the RFC 7638 JWK thumbprint of the public key
+func thumbprint(public ed25519.PublicKey) string {
+	canonical := fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, base64.RawURLEncoding.EncodeToString(public))
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,174 @@
+// Package auth contains password hashing and verification
+// and the signed access and refresh tokens of authenticated users
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUnknownAlgorithm is an error raised when a password hashing algorithm is not supported
+var ErrUnknownAlgorithm = fmt.Errorf("unknown password hashing algorithm")
+
+// Supported password hashing algorithms
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+// hasher hashes passwords with a single algorithm
+type hasher interface {
+	// hash returns the encoded hash of the password
+	hash(password string) (string, error)
+
+	// identifies reports whether the encoded hash was produced by this algorithm
+	identifies(encoded string) bool
+
+	// compare reports whether the password matches the encoded hash
+	compare(encoded, password string) bool
+
+	// current reports whether the encoded hash uses the current parameters of the hasher
+	current(encoded string) bool
+}
+
+// Passwords hashes passwords with the configured algorithm and verifies passwords
+// against hashes of every supported algorithm and against legacy plain text values
+type Passwords struct {
+	hasher  hasher
+	hashers []hasher
+}
+
+// NewPasswords returns a new Passwords hashing with the given algorithm, bcrypt or argon2id
+func NewPasswords(algorithm string) (*Passwords, error) {
+	b := &bcryptHasher{cost: bcrypt.DefaultCost}
+	a := &argon2idHasher{time: 1, memory: 64 * 1024, threads: 4, keyLen: 32, saltLen: 16}
+
+	p := &Passwords{hashers: []hasher{b, a}}
+	switch algorithm {
+	case Bcrypt, "":
+		p.hasher = b
+	case Argon2id:
+		p.hasher = a
+	default:
+		return nil, ErrUnknownAlgorithm
+	}
+	return p, nil
+}
+
+// Hash returns the encoded hash of the password
+func (p *Passwords) Hash(password string) (string, error) {
+	return p.hasher.hash(password)
+}
+
+// Verify reports whether the password matches the stored value
+// rehash is true when the password matched a legacy plain text value
+// or a hash of another algorithm or parameters, and should be hashed again
+func (p *Passwords) Verify(stored, password string) (ok, rehash bool) {
+	for _, h := range p.hashers {
+		if h.identifies(stored) {
+			ok = h.compare(stored, password)
+			return ok, ok && (h != p.hasher || !h.current(stored))
+		}
+	}
+
+	// legacy rows store the password in plain text
+	ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	return ok, ok
+}
+
+// bcryptHasher hashes passwords with bcrypt
+type bcryptHasher struct {
+	cost int
+}
+
+func (b *bcryptHasher) hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.cost)
+	return string(hash), err
+}
+
+func (b *bcryptHasher) identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (b *bcryptHasher) compare(encoded, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil
+}
+
+func (b *bcryptHasher) current(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err == nil && cost == b.cost
+}
+
+// argon2idHasher hashes passwords with argon2id
+// hashes are encoded as $argon2id$v=19$m=65536,t=1,p=4$salt$key
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	keyLen  uint32
+	saltLen int
+}
+
+func (a *argon2idHasher) hash(password string) (string, error) {
+	salt := make([]byte, a.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.time, a.memory, a.threads, a.keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.memory, a.time, a.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a *argon2idHasher) identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (a *argon2idHasher) compare(encoded, password string) bool {
+	params, salt, key, err := a.decode(encoded)
+	if err != nil {
+		return false
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func (a *argon2idHasher) current(encoded string) bool {
+	params, salt, key, err := a.decode(encoded)
+	return err == nil && params.time == a.time && params.memory == a.memory && params.threads == a.threads &&
+		len(salt) == a.saltLen && uint32(len(key)) == a.keyLen
+}
+
+// decode parses the parameters, salt and key of an encoded argon2id hash
+func (a *argon2idHasher) decode(encoded string) (params argon2idHasher, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		err = fmt.Errorf("invalid argon2id hash")
+		return
+	}
+
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return
+	}
+	if version != argon2.Version {
+		err = fmt.Errorf("unsupported argon2 version %d", version)
+		return
+	}
+
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	return
+}
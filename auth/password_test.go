@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+// Creates password test suite
+type PasswordTestSuite struct{}
+
+// Registering test suite
+func init() {
+	Suite(&PasswordTestSuite{})
+}
+
+// integrates with testing package
+func Test(t *testing.T) { TestingT(t) }
+
+// Hashes and verifies a password with every algorithm
+func (s *PasswordTestSuite) TestHashAndVerify(c *C) {
+	for _, algorithm := range []string{Bcrypt, Argon2id} {
+		p, err := NewPasswords(algorithm)
+		c.Assert(err, IsNil)
+
+		hash, err := p.Hash("secret")
+		c.Assert(err, IsNil)
+		c.Check(hash, Not(Equals), "secret")
+
+		ok, rehash := p.Verify(hash, "secret")
+		c.Check(ok, Equals, true)
+		c.Check(rehash, Equals, false)
+
+		ok, _ = p.Verify(hash, "wrong")
+		c.Check(ok, Equals, false)
+	}
+}
+
+// Verifies a legacy plain text password and a hash of another algorithm
+func (s *PasswordTestSuite) TestVerifyRehash(c *C) {
+	p, err := NewPasswords(Argon2id)
+	c.Assert(err, IsNil)
+
+	ok, rehash := p.Verify("secret", "secret")
+	c.Check(ok, Equals, true)
+	c.Check(rehash, Equals, true)
+
+	ok, rehash = p.Verify("secret", "wrong")
+	c.Check(ok, Equals, false)
+	c.Check(rehash, Equals, false)
+
+	b, err := NewPasswords(Bcrypt)
+	c.Assert(err, IsNil)
+	hash, err := b.Hash("secret")
+	c.Assert(err, IsNil)
+
+	ok, rehash = p.Verify(hash, "secret")
+	c.Check(ok, Equals, true)
+	c.Check(rehash, Equals, true)
+}
+
+// Tries to use an unknown algorithm
+func (s *PasswordTestSuite) TestUnknownAlgorithm(c *C) {
+	_, err := NewPasswords("md5")
+	c.Check(err, Equals, ErrUnknownAlgorithm)
+}
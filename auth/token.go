@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is an error raised when a token is malformed, not signed by a known key,
+// expired or of the wrong type
+var ErrInvalidToken = fmt.Errorf("invalid token")
+
+// Token types
+const (
+	AccessToken  = "access"
+	RefreshToken = "refresh"
+)
+
+// Claims are the claims of an access or refresh token
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Type      string `json:"typ"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+
+	// Password is a fingerprint of the user's password hash,
+	// a token stops being valid when the password changes
+	Password string `json:"pwd"`
+}
+
+// UserID returns the id of the user the token was issued to
+func (c *Claims) UserID() int {
+	id, _ := strconv.Atoi(c.Subject)
+	return id
+}
+
+// header is the JOSE header of a token
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// Tokens issues and verifies signed access and refresh tokens (JWT)
+type Tokens struct {
+	keys       *KeySet
+	issuer     string
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	now        func() time.Time
+}
+
+// NewTokens returns a new Tokens signing with the given key set
+func NewTokens(keys *KeySet, issuer string, accessTTL, refreshTTL time.Duration) *Tokens {
+	return &Tokens{keys, issuer, accessTTL, refreshTTL, time.Now}
+}
+
+// Keys returns the key set of the tokens
+func (t *Tokens) Keys() *KeySet {
+	return t.keys
+}
+
+// AccessTTL returns how long access tokens are valid
+func (t *Tokens) AccessTTL() time.Duration {
+	return t.accessTTL
+}
+
+// Issue returns a new access and refresh token for the user with the given id and password hash
+func (t *Tokens) Issue(userID int, passwordHash string) (access, refresh string, err error) {
+	if access, err = t.sign(AccessToken, t.accessTTL, userID, passwordHash); err != nil {
+		return
+	}
+	refresh, err = t.sign(RefreshToken, t.refreshTTL, userID, passwordHash)
+	return
+}
+
+// Verify checks the signature, expiry and type of the token and returns its claims
+func (t *Tokens) Verify(token, typ string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil || h.Algorithm != "EdDSA" {
+		return nil, ErrInvalidToken
+	}
+	key, ok := t.keys.find(h.KeyID)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(key.public, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Type != typ || claims.Issuer != t.issuer || t.now().Unix() >= claims.ExpiresAt {
+		return nil, ErrInvalidToken
+	}
+	return &claims, nil
+}
+
+// PasswordFingerprint returns the fingerprint of a password hash stored in tokens
+func PasswordFingerprint(passwordHash string) string {
+	sum := sha256.Sum256([]byte(passwordHash))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// sign returns a new signed token of the given type
+func (t *Tokens) sign(typ string, ttl time.Duration, userID int, passwordHash string) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	key := t.keys.signing()
+	now := t.now()
+	claims := Claims{
+		Issuer:    t.issuer,
+		Subject:   strconv.Itoa(userID),
+		Type:      typ,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		ID:        base64.RawURLEncoding.EncodeToString(id),
+		Password:  PasswordFingerprint(passwordHash),
+	}
+
+	h, err := encodeSegment(header{Algorithm: "EdDSA", Type: "JWT", KeyID: key.ID})
+	if err != nil {
+		return "", err
+	}
+	c, err := encodeSegment(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signature := ed25519.Sign(key.private, []byte(h+"."+c))
+	return h + "." + c + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func encodeSegment(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// Creates token test suite
+type TokenTestSuite struct {
+	old, new ed25519.PrivateKey
+}
+
+// Registering test suite
+func init() {
+	Suite(&TokenTestSuite{})
+}
+
+func (s *TokenTestSuite) SetUpTest(c *C) {
+	var err error
+	_, s.old, err = ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	_, s.new, err = ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+}
+
+func (s *TokenTestSuite) tokens(c *C, keys ...ed25519.PrivateKey) *Tokens {
+	ks, err := NewKeySet(keys...)
+	c.Assert(err, IsNil)
+	return NewTokens(ks, "test", time.Minute, time.Hour)
+}
+
+// Issues and verifies an access and a refresh token
+func (s *TokenTestSuite) TestIssueAndVerify(c *C) {
+	t := s.tokens(c, s.old)
+	access, refresh, err := t.Issue(7, "hash")
+	c.Assert(err, IsNil)
+
+	claims, err := t.Verify(access, AccessToken)
+	c.Assert(err, IsNil)
+	c.Check(claims.UserID(), Equals, 7)
+	c.Check(claims.Password, Equals, PasswordFingerprint("hash"))
+
+	_, err = t.Verify(access, RefreshToken)
+	c.Check(err, Equals, ErrInvalidToken)
+	_, err = t.Verify(refresh, RefreshToken)
+	c.Check(err, IsNil)
+}
+
+// Tokens of a rotated key verify while the key is still in the set
+func (s *TokenTestSuite) TestKeyRotation(c *C) {
+	access, _, err := s.tokens(c, s.old).Issue(7, "hash")
+	c.Assert(err, IsNil)
+
+	_, err = s.tokens(c, s.new, s.old).Verify(access, AccessToken)
+	c.Check(err, IsNil)
+
+	_, err = s.tokens(c, s.new).Verify(access, AccessToken)
+	c.Check(err, Equals, ErrInvalidToken)
+
+	c.Check(s.tokens(c, s.new, s.old).Keys().JWKS().Keys, HasLen, 2)
+}
+
+// Rejects expired and tampered tokens
+func (s *TokenTestSuite) TestRejected(c *C) {
+	t := s.tokens(c, s.old)
+	access, _, err := t.Issue(7, "hash")
+	c.Assert(err, IsNil)
+
+	parts := strings.Split(access, ".")
+	other, _, err := t.Issue(8, "hash")
+	c.Assert(err, IsNil)
+	tampered := parts[0] + "." + strings.Split(other, ".")[1] + "." + parts[2]
+	_, err = t.Verify(tampered, AccessToken)
+	c.Check(err, Equals, ErrInvalidToken)
+
+	t.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	_, err = t.Verify(access, AccessToken)
+	c.Check(err, Equals, ErrInvalidToken)
+}
@@ -0,0 +1,52 @@
+package data
+
+import "fmt"
+
+// ErrUnknownRole is an error raised when a group admin is given a role that does not exist
+var ErrUnknownRole = fmt.Errorf("unknown role")
+
+// Roles of the admins of a group
+const (
+	// RoleOwner administers the group, it can rename it, change its members, delete it and change its admins,
+	// its parent and rule stay with the admins of groups
+	RoleOwner = "owner"
+
+	// RoleManager can add and remove members and rename the group
+	RoleManager = "manager"
+)
+
+// GroupAdmin is a user administering a group
+// swagger:model
+type GroupAdmin struct {
+	// the id of the user
+	UserID int `json:"userID"`
+
+	// the role of the user in the group
+	//
+	// enum: owner,manager
+	Role string `json:"role"`
+}
+
+// ValidRole reports whether the role exists
+func ValidRole(role string) bool {
+	return role == RoleOwner || role == RoleManager
+}
+
+// RoleAllows reports whether the role grants everything the required role grants,
+// an owner can do everything a manager can
+func RoleAllows(role, required string) bool {
+	return role == required || role == RoleOwner && required == RoleManager
+}
+
+// roleChanges returns the audited changes of the role of a group admin,
+// the role is granted or revoked as the key and the id of the user is the value
+func roleChanges(userID int, before, after string) Changes {
+	changes := Changes{}
+	if before != "" {
+		changes[before] = Change{Before: userID}
+	}
+	if after != "" {
+		changes[after] = Change{After: userID}
+	}
+	return changes
+}
@@ -0,0 +1,320 @@
+package data
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrAttributeNotFound is an error raised when an attribute can not be found in the database
+var ErrAttributeNotFound = fmt.Errorf("Attribute not found")
+
+// ErrAttributeConstraintViolation is an error raised when an attribute can not be defined because of constraint violations
+var ErrAttributeConstraintViolation = fmt.Errorf("attribute has constraints violation")
+
+// Types of the values of attributes
+const (
+	AttributeString  = "string"
+	AttributeInteger = "integer"
+	AttributeBoolean = "boolean"
+)
+
+// AttributeFieldPrefix is the prefix of the list fields of the attributes of users, e.g. attributes.department
+const AttributeFieldPrefix = "attributes."
+
+// maxAttributeValue is the largest number of characters of a string value of an attribute
+const maxAttributeValue = 1024
+
+// attributeName matches the names of attributes
+var attributeName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// Attribute defines a custom attribute of users, the attributes of every user must match their definitions
+// swagger:model
+type Attribute struct {
+	// the id of the attribute
+	//
+	// read only: true
+	ID int `json:"id"`
+
+	// the name of the attribute, the key of its value in the attributes of a user
+	// it starts with a letter followed by letters, digits and underscores
+	//
+	// required: true
+	// max length: 64
+	// pattern: ^[A-Za-z][A-Za-z0-9_]*$
+	Name string `json:"name" validate:"required,max=64"`
+
+	// the type of the values, it can only change while no user has a value
+	//
+	// required: true
+	// enum: string,integer,boolean
+	Type string `json:"type" validate:"required"`
+
+	// every user has a value, deleted users included
+	//
+	// required: false
+	Required bool `json:"required"`
+
+	// no two users that are not deleted have the same value
+	//
+	// required: false
+	Unique bool `json:"unique" gorm:"column:is_unique"`
+
+	// the values of a string attribute, any value is allowed when it is empty
+	//
+	// required: false
+	Enum EnumValues `json:"enum,omitempty" gorm:"column:enum_values"`
+}
+
+// EnumValues are the allowed values of an attribute, they are stored as a JSON column
+type EnumValues []string
+
+// Value encodes the values for the database
+func (e EnumValues) Value() (driver.Value, error) {
+	if len(e) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal([]string(e))
+	return string(b), err
+}
+
+// Scan decodes the values from the database
+func (e *EnumValues) Scan(value interface{}) error {
+	var b []byte
+	switch v := value.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("can not scan %T into enum values", value)
+	}
+	*e = nil
+	if len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, e)
+}
+
+// AttributeStore is the interface that wraps the operations for persisting the attribute schema
+// Operations return an error matching ErrUnavailable when the database can not be reached
+// Changes are recorded in the audit log as made by the given actor
+type AttributeStore interface {
+	// GetAttributes returns every attribute ordered by name
+	GetAttributes() ([]*Attribute, error)
+
+	// PutAttribute defines the attribute or replaces the definition of the attribute with the same name,
+	// sets its id and reports whether it was created
+	// If the users, deleted users included, do not match the new definition it returns a ConstraintError
+	// of ErrAttributeConstraintViolation that matches ErrAttributeMismatch, ErrAttributeMissing or ErrDuplicateAttribute
+	PutAttribute(actor Actor, attribute *Attribute) (bool, error)
+
+	// DeleteAttribute removes the attribute and its values, the users with a value get a new version
+	// If the attribute is not found it returns an ErrAttributeNotFound error
+	DeleteAttribute(actor Actor, name string) error
+}
+
+// ValidateAttribute checks an attribute against the rules of its validate tags, its name, type and enum values
+// The returned error is a ValidationError or nil
+func ValidateAttribute(attribute *Attribute) error {
+	var errs ValidationError
+	if err := Validate(attribute); err != nil {
+		errs = err.(ValidationError)
+	}
+	if attribute.Name != "" && !attributeName.MatchString(attribute.Name) {
+		errs = append(errs, FieldError{Field: "name", Message: "must start with a letter followed by letters, digits and underscores"})
+	}
+	switch attribute.Type {
+	case "", AttributeString, AttributeInteger, AttributeBoolean:
+	default:
+		errs = append(errs, FieldError{Field: "type", Message: "must be string, integer or boolean"})
+	}
+
+	if len(attribute.Enum) > 0 && attribute.Type != AttributeString {
+		errs = append(errs, FieldError{Field: "enum", Message: "can only restrict string attributes"})
+	}
+	seen := map[string]bool{}
+	for i, value := range attribute.Enum {
+		switch {
+		case utf8.RuneCountInString(value) > maxAttributeValue:
+			errs = append(errs, FieldError{Field: fmt.Sprintf("enum[%d]", i), Message: fmt.Sprintf("must be at most %d characters long", maxAttributeValue)})
+		case seen[value]:
+			errs = append(errs, FieldError{Field: fmt.Sprintf("enum[%d]", i), Message: "is a duplicate"})
+		}
+		seen[value] = true
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// allows reports whether the enum values of the attribute allow the value
+func (a *Attribute) allows(value interface{}) bool {
+	if len(a.Enum) == 0 {
+		return true
+	}
+	for _, allowed := range a.Enum {
+		if value == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAttributes checks the attributes of a user against the definitions
+// and returns them with integers as int, nil when the user has none
+// The returned error is a ValidationError or nil
+func checkAttributes(definitions []*Attribute, attributes map[string]interface{}) (map[string]interface{}, error) {
+	byName := make(map[string]*Attribute, len(definitions))
+	for _, definition := range definitions {
+		byName[definition.Name] = definition
+	}
+
+	var errs ValidationError
+	checked := map[string]interface{}{}
+	for name, value := range attributes {
+		field := AttributeFieldPrefix + name
+		definition, ok := byName[name]
+		if !ok {
+			errs = append(errs, FieldError{Field: field, Message: "is unknown"})
+			continue
+		}
+		if value == nil {
+			continue
+		}
+
+		switch v := value.(type) {
+		case string:
+			if definition.Type != AttributeString {
+				break
+			}
+			if utf8.RuneCountInString(v) > maxAttributeValue {
+				errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf("must be at most %d characters long", maxAttributeValue)})
+			} else if !definition.allows(v) {
+				errs = append(errs, FieldError{Field: field, Message: "must be one of " + strings.Join(definition.Enum, ", ")})
+			} else {
+				checked[name] = v
+			}
+			continue
+		case float64:
+			if definition.Type == AttributeInteger && v == float64(int(v)) {
+				checked[name] = int(v)
+				continue
+			}
+		case int:
+			if definition.Type == AttributeInteger {
+				checked[name] = v
+				continue
+			}
+		case bool:
+			if definition.Type == AttributeBoolean {
+				checked[name] = v
+				continue
+			}
+		}
+		errs = append(errs, FieldError{Field: field, Message: "must be of type " + definition.Type})
+	}
+
+	for _, definition := range definitions {
+		if _, ok := checked[definition.Name]; definition.Required && !ok && attributes[definition.Name] == nil {
+			errs = append(errs, FieldError{Field: AttributeFieldPrefix + definition.Name, Message: "is required"})
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		return nil, errs
+	}
+	if len(checked) == 0 {
+		return nil, nil
+	}
+	return checked, nil
+}
+
+// attributeText returns the stored text of a checked value of an attribute
+func attributeText(value interface{}) string {
+	switch v := value.(type) {
+	case int:
+		return strconv.Itoa(v)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return value.(string)
+}
+
+// parseAttribute returns the value of an attribute of the given type from its stored text
+func parseAttribute(attributeType, text string) interface{} {
+	switch attributeType {
+	case AttributeInteger:
+		n, _ := strconv.Atoi(text)
+		return n
+	case AttributeBoolean:
+		b, _ := strconv.ParseBool(text)
+		return b
+	}
+	return text
+}
+
+// copyAttributes returns a copy of the attributes of a user, so that changing it leaves the user alone
+func copyAttributes(attributes map[string]interface{}) map[string]interface{} {
+	if attributes == nil {
+		return nil
+	}
+	copied := make(map[string]interface{}, len(attributes))
+	for name, value := range attributes {
+		copied[name] = value
+	}
+	return copied
+}
+
+// userFields returns the fields the list of users can be filtered and sorted by together with the attributes
+// Attributes are filtered by their stored text, integers by their value, lists are not sorted by them
+func userFields(definitions []*Attribute) ListFields {
+	fields := make(ListFields, len(UserFields)+len(definitions))
+	for name, field := range UserFields {
+		fields[name] = field
+	}
+	for _, definition := range definitions {
+		field := ListField{
+			column:    fmt.Sprintf("(SELECT value FROM user_attributes WHERE user_id = users.id AND attribute_id = %d)", definition.ID),
+			attribute: true,
+			ops:       []string{OpEq},
+		}
+		switch definition.Type {
+		case AttributeString:
+			field.ops = append(field.ops, OpPrefix)
+		case AttributeInteger:
+			field.column = fmt.Sprintf("(SELECT CAST(value AS integer) FROM user_attributes WHERE user_id = users.id AND attribute_id = %d)", definition.ID)
+			field.numeric = true
+		}
+		fields[AttributeFieldPrefix+definition.Name] = field
+	}
+	return fields
+}
+
+// attributeValues returns the audited fields of an attribute, nil for no attribute
+func attributeValues(attribute *Attribute) map[string]interface{} {
+	if attribute == nil {
+		return nil
+	}
+	// no enum values are audited alike, whether they were sent as null or as an empty list
+	var enum []string
+	if len(attribute.Enum) > 0 {
+		enum = attribute.Enum
+	}
+	return map[string]interface{}{
+		"id":       attribute.ID,
+		"name":     attribute.Name,
+		"type":     attribute.Type,
+		"required": attribute.Required,
+		"unique":   attribute.Unique,
+		"enum":     enum,
+	}
+}
@@ -0,0 +1,61 @@
+package data
+
+import (
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+// Creates attributes test suite
+type AttributesTestSuite struct{}
+
+// Registering test suite
+func init() {
+	Suite(&AttributesTestSuite{})
+}
+
+// Checks the definitions of attributes
+func (s *AttributesTestSuite) TestValidateAttribute(c *C) {
+	c.Check(ValidateAttribute(&Attribute{Name: "department", Type: AttributeString, Enum: EnumValues{"sales"}}), IsNil)
+
+	attribute := Attribute{Name: "1st", Type: AttributeInteger, Enum: EnumValues{"a", "a"}}
+	c.Check(ValidateAttribute(&attribute), DeepEquals, ValidationError{
+		{Field: "name", Message: "must start with a letter followed by letters, digits and underscores"},
+		{Field: "enum", Message: "can only restrict string attributes"},
+		{Field: "enum[1]", Message: "is a duplicate"},
+	})
+
+	attribute = Attribute{Name: strings.Repeat("a", 65), Type: "date"}
+	c.Check(ValidateAttribute(&attribute), DeepEquals, ValidationError{
+		{Field: "name", Message: "must be at most 64 characters long"},
+		{Field: "type", Message: "must be string, integer or boolean"},
+	})
+}
+
+// Checks the attributes of users against the definitions
+func (s *AttributesTestSuite) TestCheckAttributes(c *C) {
+	definitions := []*Attribute{
+		{Name: "badge", Type: AttributeInteger, Required: true},
+		{Name: "department", Type: AttributeString, Enum: EnumValues{"sales", "support"}},
+		{Name: "remote", Type: AttributeBoolean},
+	}
+
+	checked, err := checkAttributes(definitions, map[string]interface{}{"badge": float64(7), "remote": false, "department": nil})
+	c.Assert(err, IsNil)
+	c.Check(checked, DeepEquals, map[string]interface{}{"badge": 7, "remote": false})
+
+	_, err = checkAttributes(definitions, map[string]interface{}{"badge": 1.5, "department": "hr", "remote": "yes", "floor": 2})
+	c.Check(err, DeepEquals, ValidationError{
+		{Field: "attributes.badge", Message: "must be of type integer"},
+		{Field: "attributes.department", Message: "must be one of sales, support"},
+		{Field: "attributes.floor", Message: "is unknown"},
+		{Field: "attributes.remote", Message: "must be of type boolean"},
+	})
+
+	_, err = checkAttributes(definitions, nil)
+	c.Check(err, DeepEquals, ValidationError{{Field: "attributes.badge", Message: "is required"}})
+
+	checked, err = checkAttributes(definitions[1:], map[string]interface{}{})
+	c.Check(checked, IsNil)
+	c.Check(err, IsNil)
+}
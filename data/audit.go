@@ -0,0 +1,218 @@
+package data
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Audit actions
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+	AuditGrant   = "grant"
+	AuditRevoke  = "revoke"
+	AuditJoin    = "join"
+	AuditLeave   = "leave"
+)
+
+// Audited entities
+const (
+	AuditUser      = "user"
+	AuditGroup     = "group"
+	AuditAttribute = "attribute"
+)
+
+// redacted replaces passwords in the changes of the audit log
+const redacted = "[REDACTED]"
+
+// Actor is who makes a change, it is recorded in the audit log together with the change
+type Actor struct {
+	// UserID is the id of the authenticated user, 0 for the system
+	UserID int
+
+	// RequestID is the id of the request that makes the change
+	RequestID string
+}
+
+// System is the actor of changes that are not made through the API,
+// like users added by the adduser command and purges of deleted users and groups
+var System = Actor{}
+
+// AuditEntry is an entry of the append-only audit log, it records a single change of a user, group or attribute
+// swagger:model
+type AuditEntry struct {
+	// the id of the entry, entries are numbered in the order they were recorded
+	ID int `json:"id"`
+
+	// when the change was made
+	CreatedAt time.Time `json:"createdAt"`
+
+	// the id of the user that made the change, 0 for the system
+	ActorID int `json:"actorID"`
+
+	// the id of the request that made the change
+	RequestID string `json:"requestID"`
+
+	// what was done: create, update, delete, restore, purge, grant, revoke, join or leave
+	Action string `json:"action"`
+
+	// the kind of the changed entity: user, group or attribute
+	Entity string `json:"entity"`
+
+	// the id of the changed entity before the change
+	EntityID int `json:"entityID"`
+
+	// the changed fields with their values before and after the change, passwords are redacted
+	Changes Changes `json:"changes"`
+}
+
+// Change is the value of a field before and after a change, null when the field did not exist
+type Change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Changes are the changes of the fields of an entity keyed by their JSON name,
+// they are stored as a JSON column
+type Changes map[string]Change
+
+// Value encodes the changes for the database
+func (c Changes) Value() (driver.Value, error) {
+	b, err := json.Marshal(c)
+	return string(b), err
+}
+
+// Scan decodes the changes from the database
+func (c *Changes) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, c)
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	}
+	return fmt.Errorf("can not scan %T into changes", value)
+}
+
+// AuditStore is the interface that wraps the operations for reading the audit log
+// Entries are written by the user and group stores in the same transaction as the change they record
+type AuditStore interface {
+	// GetAuditEntries returns the page of audit entries selected by the options ordered by id
+	// together with the total number of entries
+	GetAuditEntries(opts ListOptions) ([]*AuditEntry, int, error)
+}
+
+// AuditFields are the fields the audit log can be filtered and sorted by
+var AuditFields = ListFields{
+	"id":        {column: "id", numeric: true, ops: []string{OpEq}},
+	"actorID":   {column: "actor_id", numeric: true, ops: []string{OpEq}},
+	"requestID": {column: "request_id", ops: []string{OpEq}},
+	"action":    {column: "action", ops: []string{OpEq}},
+	"entity":    {column: "entity", ops: []string{OpEq}},
+	"entityID":  {column: "entity_id", numeric: true, ops: []string{OpEq}},
+	"createdAt": {column: "created_at", time: true, ops: []string{OpFrom, OpTo}},
+}
+
+func (e *AuditEntry) listValue(field string) interface{} {
+	switch field {
+	case "actorID":
+		return e.ActorID
+	case "requestID":
+		return e.RequestID
+	case "action":
+		return e.Action
+	case "entity":
+		return e.Entity
+	case "entityID":
+		return e.EntityID
+	case "createdAt":
+		return e.CreatedAt
+	}
+	return e.ID
+}
+
+// AuditCursor returns the cursor after the entry in a list sorted by the sort keys
+func AuditCursor(e *AuditEntry, sort []SortKey) Cursor {
+	return newCursor(e, sort)
+}
+
+// newAuditEntry returns the entry recording the change of an entity by the actor
+func newAuditEntry(actor Actor, action, entity string, id int, changes Changes) AuditEntry {
+	return AuditEntry{
+		CreatedAt: time.Now().UTC(),
+		ActorID:   actor.UserID,
+		RequestID: actor.RequestID,
+		Action:    action,
+		Entity:    entity,
+		EntityID:  id,
+		Changes:   changes,
+	}
+}
+
+// userValues returns the audited fields of a user, nil for no user
+// Every attribute is a field of its own, e.g. attributes.department
+func userValues(user *User) map[string]interface{} {
+	if user == nil {
+		return nil
+	}
+	values := map[string]interface{}{
+		"id":        user.ID,
+		"name":      user.Name,
+		"email":     user.Email,
+		"password":  user.Password,
+		"groupID":   user.GroupID,
+		"deletedAt": user.DeletedAt,
+	}
+	for name, value := range user.Attributes {
+		values[AttributeFieldPrefix+name] = value
+	}
+	return values
+}
+
+// groupValues returns the audited fields of a group, nil for no group
+// Its users are audited on their own and its permissions by grants and revokes
+func groupValues(group *Group) map[string]interface{} {
+	if group == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"id":        group.ID,
+		"name":      group.Name,
+		"parentID":  group.ParentID,
+		"rule":      group.Rule,
+		"deletedAt": group.DeletedAt,
+	}
+}
+
+// diff returns the changes between the fields before and after a change with passwords redacted
+func diff(before, after map[string]interface{}) Changes {
+	changes := Changes{}
+	for key, value := range after {
+		if old, ok := before[key]; !ok || !reflect.DeepEqual(old, value) {
+			changes[key] = Change{Before: before[key], After: value}
+		}
+	}
+	for key, value := range before {
+		if _, ok := after[key]; !ok {
+			changes[key] = Change{Before: value}
+		}
+	}
+
+	if change, ok := changes["password"]; ok {
+		changes["password"] = Change{Before: redact(change.Before), After: redact(change.After)}
+	}
+	return changes
+}
+
+// redact hides a password, no password stays visible as such
+func redact(password interface{}) interface{} {
+	if password == nil || password == "" {
+		return password
+	}
+	return redacted
+}
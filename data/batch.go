@@ -0,0 +1,58 @@
+package data
+
+import "fmt"
+
+// ErrBatchAborted is an error raised for the operations of an atomic batch that were rolled back or not run
+// because another operation of the batch failed
+var ErrBatchAborted = fmt.Errorf("batch aborted by a failed operation")
+
+// ErrUnknownOperation is an error raised for an operation of a batch that is not known
+var ErrUnknownOperation = fmt.Errorf("unknown batch operation")
+
+// Batch operations
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// UserOperation is a single change of a batch of changes of users
+type UserOperation struct {
+	// Op is BatchCreate, BatchUpdate or BatchDelete
+	Op string
+
+	// ID is the id of the updated or deleted user
+	ID int
+
+	// Version is the version the user must have to be updated or deleted, 0 requires no version
+	Version int
+
+	// User is the user added by a create operation, its id is set once it is added
+	User *User
+
+	// Values are the values set by an update operation
+	Values map[string]interface{}
+}
+
+// abortBatch returns the errors of the operations of an atomic batch whose transaction failed with err
+// The failed operation keeps its error and every other operation fails with ErrBatchAborted,
+// when no operation failed the transaction itself did and every operation fails with its error
+func abortBatch(errs []error, err error) []error {
+	if err == nil {
+		return errs
+	}
+
+	failed := false
+	for _, e := range errs {
+		failed = failed || e != nil
+	}
+	for i := range errs {
+		switch {
+		case !failed:
+			errs[i] = err
+		case errs[i] == nil:
+			errs[i] = ErrBatchAborted
+		}
+	}
+	return errs
+}
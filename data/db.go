@@ -0,0 +1,53 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+
+	// database drivers supported by Open
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// ErrUnknownDriver is an error raised when a database driver is not supported
+var ErrUnknownDriver = fmt.Errorf("unknown database driver")
+
+// Supported database drivers
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite3"
+)
+
+// Open opens a database connection with the given driver
+// For postgres source is a connection string,
+// for sqlite3 it is the path of the database file or :memory:
+// The schema is created and updated by the migrations package
+func Open(driver, source string) (*gorm.DB, error) {
+	switch driver {
+	case DriverPostgres:
+		return gorm.Open(DriverPostgres, source)
+	case DriverSQLite, "sqlite":
+		return openSQLite(source)
+	default:
+		return nil, ErrUnknownDriver
+	}
+}
+
+// openSQLite opens a SQLite database with foreign keys enforced
+func openSQLite(path string) (*gorm.DB, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+
+	db, err := gorm.Open(DriverSQLite, path+sep+"_foreign_keys=1")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer and every connection to :memory: is a new database
+	db.DB().SetMaxOpenConns(1)
+	return db, nil
+}
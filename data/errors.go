@@ -0,0 +1,238 @@
+package data
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// ErrUnavailable is an error raised when the database can not be reached, the operation can be retried later
+var ErrUnavailable = fmt.Errorf("database unavailable")
+
+// ErrVersionMismatch is an error raised when a user or group is changed while it does not have the expected version
+var ErrVersionMismatch = fmt.Errorf("version mismatch")
+
+// ErrDuplicateID is an error raised when the id of a user or group is already taken
+var ErrDuplicateID = fmt.Errorf("id is already taken")
+
+// ErrDuplicateName is an error raised when the name of a user, group or attribute is already taken
+var ErrDuplicateName = fmt.Errorf("name is already taken")
+
+// ErrDuplicateEmail is an error raised when the email of a user is already taken
+var ErrDuplicateEmail = fmt.Errorf("email is already taken")
+
+// ErrUnknownGroup is an error raised when the group of a user or membership does not exist
+var ErrUnknownGroup = fmt.Errorf("group does not exist")
+
+// ErrGroupReferenced is an error raised when a group that users belong to is deleted or changes its id
+var ErrGroupReferenced = fmt.Errorf("group still has users")
+
+// ErrUnknownParent is an error raised when the parent of a group does not exist
+var ErrUnknownParent = fmt.Errorf("parent group does not exist")
+
+// ErrGroupCycle is an error raised when a group would become its own ancestor
+var ErrGroupCycle = fmt.Errorf("group can not be its own ancestor")
+
+// ErrDynamicGroup is an error raised when the members of a dynamic group are changed by hand
+// or a dynamic group would become the primary group of a user
+var ErrDynamicGroup = fmt.Errorf("members of a dynamic group are computed by its rule")
+
+// ErrGroupHasChildren is an error raised when a group with child groups is deleted without its descendants
+var ErrGroupHasChildren = fmt.Errorf("group still has child groups")
+
+// ErrDuplicateAttribute is an error raised when the value of a unique attribute of a user is already taken
+var ErrDuplicateAttribute = fmt.Errorf("attribute value is already taken")
+
+// ErrAttributeMismatch is an error raised when the values of users do not match the new type or enum values of an attribute
+var ErrAttributeMismatch = fmt.Errorf("values of users do not match the attribute")
+
+// ErrAttributeMissing is an error raised when an attribute becomes required while users have no value of it
+var ErrAttributeMissing = fmt.Errorf("users have no value of the required attribute")
+
+// Constraints of the database schema, named like Postgres names them by default
+const (
+	ConstraintUserID    = "users_pkey"
+	ConstraintUserName  = "users_name_key"
+	ConstraintUserEmail = "users_email_key"
+	ConstraintUserGroup = "users_group_id_fkey"
+	ConstraintGroupID   = "groups_pkey"
+	ConstraintGroupName = "groups_name_key"
+
+	ConstraintMemberGroup = "memberships_group_id_fkey"
+	ConstraintGroupParent = "groups_parent_id_fkey"
+
+	// ConstraintGroupCycle is checked by the stores, the schema only knows the foreign key of the parent
+	ConstraintGroupCycle = "groups_parent_cycle"
+
+	// ConstraintDynamicGroup is checked by the stores, a dynamic group is nobody's primary group
+	ConstraintDynamicGroup = "groups_rule_primary"
+
+	ConstraintAttributeName = "attributes_name_key"
+	ConstraintUserAttribute = "user_attributes_unique_key"
+
+	// ConstraintAttributeValues and ConstraintAttributeRequired are checked by the stores,
+	// the values of users match the type and enum values of their attribute and required attributes have a value
+	ConstraintAttributeValues   = "attributes_values"
+	ConstraintAttributeRequired = "attributes_required"
+)
+
+// constraintReasons are the errors of violated constraints
+var constraintReasons = map[string]error{
+	ConstraintUserID:    ErrDuplicateID,
+	ConstraintUserName:  ErrDuplicateName,
+	ConstraintUserEmail: ErrDuplicateEmail,
+	ConstraintUserGroup: ErrUnknownGroup,
+	ConstraintGroupID:   ErrDuplicateID,
+	ConstraintGroupName: ErrDuplicateName,
+
+	ConstraintMemberGroup: ErrUnknownGroup,
+	ConstraintGroupParent: ErrUnknownParent,
+	ConstraintGroupCycle:  ErrGroupCycle,
+
+	ConstraintDynamicGroup: ErrDynamicGroup,
+
+	ConstraintAttributeName:     ErrDuplicateName,
+	ConstraintUserAttribute:     ErrDuplicateAttribute,
+	ConstraintAttributeValues:   ErrAttributeMismatch,
+	ConstraintAttributeRequired: ErrAttributeMissing,
+}
+
+// sqliteConstraints are the constraints by the columns SQLite reports for a failed unique constraint
+var sqliteConstraints = map[string]string{
+	"users.id":    ConstraintUserID,
+	"users.name":  ConstraintUserName,
+	"users.email": ConstraintUserEmail,
+	"groups.id":   ConstraintGroupID,
+	"groups.name": ConstraintGroupName,
+
+	"attributes.name": ConstraintAttributeName,
+	"user_attributes.attribute_id, user_attributes.unique_value": ConstraintUserAttribute,
+}
+
+// ConstraintError is an error raised when a user, group or attribute violates a constraint of the schema
+// It matches ErrUserConstraintViolation, ErrGroupConstraintViolation or ErrAttributeConstraintViolation
+// and the error of the constraint,
+// e.g. ErrDuplicateEmail, with errors.Is
+type ConstraintError struct {
+	// Err is ErrUserConstraintViolation, ErrGroupConstraintViolation or ErrAttributeConstraintViolation
+	Err error
+
+	// Constraint is the name of the violated constraint, empty when it is not known
+	Constraint string
+
+	// Reason is the error of the constraint, nil when it is not known
+	Reason error
+}
+
+// newConstraintError returns the ConstraintError of the constraint violated by a user or group
+func newConstraintError(violation error, constraint string) *ConstraintError {
+	reason := constraintReasons[constraint]
+
+	// a group violates the foreign keys of its users by going away while they still belong to it
+	if (constraint == ConstraintUserGroup || constraint == ConstraintMemberGroup) && violation == ErrGroupConstraintViolation {
+		reason = ErrGroupReferenced
+	}
+	return &ConstraintError{Err: violation, Constraint: constraint, Reason: reason}
+}
+
+func (e *ConstraintError) Error() string {
+	switch {
+	case e.Reason != nil:
+		return e.Err.Error() + ": " + e.Reason.Error() + " (" + e.Constraint + ")"
+	case e.Constraint != "":
+		return e.Err.Error() + ": " + e.Constraint
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the constraint violation error of the user or group
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the error of the violated constraint
+func (e *ConstraintError) Is(target error) bool {
+	return e.Reason != nil && target == e.Reason
+}
+
+// storeError returns the error of a failed write of a user, group or attribute,
+// violation is ErrUserConstraintViolation, ErrGroupConstraintViolation or ErrAttributeConstraintViolation
+// and foreignKey is the foreign key constraint that the write can violate, empty when it is not known
+// Constraint violations become ConstraintErrors, connection failures wrap ErrUnavailable
+// and any other error is returned unchanged
+func storeError(violation error, foreignKey string, err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Name() {
+		case "unique_violation", "foreign_key_violation":
+			return newConstraintError(violation, pqErr.Constraint)
+		case "check_violation", "not_null_violation", "string_data_right_truncation":
+			return &ConstraintError{Err: violation, Constraint: pqErr.Constraint}
+		}
+		return unavailableError(err)
+	}
+
+	// SQLite only reports the columns of a unique constraint and nothing about a foreign key,
+	// which is why the caller names the foreign key of the write
+	message := err.Error()
+	switch {
+	case strings.HasPrefix(message, "UNIQUE constraint failed: "):
+		return newConstraintError(violation, sqliteConstraints[strings.TrimPrefix(message, "UNIQUE constraint failed: ")])
+	case strings.HasPrefix(message, "FOREIGN KEY constraint failed"):
+		return newConstraintError(violation, foreignKey)
+	case strings.HasPrefix(message, "CHECK constraint failed"), strings.HasPrefix(message, "NOT NULL constraint failed"):
+		return &ConstraintError{Err: violation}
+	}
+	return unavailableError(err)
+}
+
+// unavailableError wraps ErrUnavailable around an error of a lost or refused database connection
+// and returns any other error unchanged
+func unavailableError(err error) error {
+	var pqErr *pq.Error
+	var netErr net.Error
+	switch {
+	case errors.As(err, &pqErr):
+		// connection exceptions, insufficient resources and shutdowns of the server
+		class := pqErr.Code.Class()
+		if class != "08" && class != "53" && class != "57" {
+			return err
+		}
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+	case errors.As(err, &netErr):
+	case strings.HasPrefix(err.Error(), "database is locked"):
+		// SQLite is busy with another writer
+	default:
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrUnavailable, err)
+}
+
+// retryable reports whether an operation failed because of a deadlock, a serialization failure
+// or a concurrent SQLite writer, which a new attempt of its transaction may not run into
+func retryable(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Name() {
+		case "serialization_failure", "deadlock_detected":
+			return true
+		}
+		return false
+	}
+	return strings.Contains(err.Error(), "database is locked")
+}
+
+// lookupError returns notFound when no record was found and the error of the failed lookup otherwise
+func lookupError(notFound error, err error) error {
+	if gorm.IsRecordNotFoundError(err) {
+		return notFound
+	}
+	return unavailableError(err)
+}
@@ -0,0 +1,96 @@
+package data
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	. "gopkg.in/check.v1"
+)
+
+// Creates errors test suite
+type ErrorsTestSuite struct{}
+
+// Registering test suite
+func init() {
+	Suite(&ErrorsTestSuite{})
+}
+
+// Maps Postgres and SQLite errors of writes to the typed errors of the store
+func (s *ErrorsTestSuite) TestStoreError(c *C) {
+	tests := []struct {
+		violation  error
+		foreignKey string
+		err        error
+		expected   error
+	}{
+		{ErrUserConstraintViolation, "", &pq.Error{Code: "23505", Constraint: "users_email_key"}, ErrDuplicateEmail},
+		{ErrUserConstraintViolation, "", &pq.Error{Code: "23505", Constraint: "users_name_key"}, ErrDuplicateName},
+		{ErrUserConstraintViolation, "", &pq.Error{Code: "23503", Constraint: "users_group_id_fkey"}, ErrUnknownGroup},
+		{ErrGroupConstraintViolation, "", &pq.Error{Code: "23503", Constraint: "users_group_id_fkey"}, ErrGroupReferenced},
+		{ErrGroupConstraintViolation, "", &pq.Error{Code: "23505", Constraint: "groups_pkey"}, ErrDuplicateID},
+		{ErrUserConstraintViolation, "", &pq.Error{Code: "22001"}, ErrUserConstraintViolation},
+		{ErrUserConstraintViolation, "", &pq.Error{Code: "57P01"}, ErrUnavailable},
+		{ErrUserConstraintViolation, "", fmt.Errorf("UNIQUE constraint failed: users.email"), ErrDuplicateEmail},
+		{ErrGroupConstraintViolation, "", fmt.Errorf("UNIQUE constraint failed: groups.name"), ErrDuplicateName},
+		{ErrGroupConstraintViolation, ConstraintUserGroup, fmt.Errorf("FOREIGN KEY constraint failed"), ErrGroupReferenced},
+		{ErrGroupConstraintViolation, ConstraintGroupParent, fmt.Errorf("FOREIGN KEY constraint failed"), ErrUnknownParent},
+		{ErrUserConstraintViolation, ConstraintMemberGroup, fmt.Errorf("FOREIGN KEY constraint failed"), ErrUnknownGroup},
+		{ErrUserConstraintViolation, "", driver.ErrBadConn, ErrUnavailable},
+	}
+
+	for _, test := range tests {
+		err := storeError(test.violation, test.foreignKey, test.err)
+		c.Check(errors.Is(err, test.expected), Equals, true, Commentf("%v", err))
+	}
+
+	// errors that are neither constraint violations nor connection failures stay unchanged
+	err := &pq.Error{Code: "42601"}
+	c.Check(storeError(ErrUserConstraintViolation, "", err), Equals, err)
+}
+
+// Retries transactions that failed because of deadlocks, serialization failures and concurrent SQLite writers
+func (s *ErrorsTestSuite) TestRetryable(c *C) {
+	c.Check(retryable(&pq.Error{Code: "40001"}), Equals, true)
+	c.Check(retryable(&pq.Error{Code: "40P01"}), Equals, true)
+	c.Check(retryable(unavailableError(fmt.Errorf("database is locked"))), Equals, true)
+	c.Check(retryable(&pq.Error{Code: "23505"}), Equals, false)
+	c.Check(retryable(newConstraintError(ErrUserConstraintViolation, ConstraintUserName)), Equals, false)
+	c.Check(retryable(ErrUserNotFound), Equals, false)
+}
+
+// Runs a transaction again until it stops failing with a retryable error or runs out of attempts
+func (s *ErrorsTestSuite) TestTransactionRetries(c *C) {
+	db, err := Open(DriverSQLite, ":memory:")
+	c.Assert(err, IsNil)
+	store := NewGormStore(db)
+
+	attempts := 0
+	err = store.transaction(func(tx *gorm.DB) error {
+		attempts++
+		if attempts < 3 {
+			return &pq.Error{Code: "40P01"}
+		}
+		return nil
+	})
+	c.Check(err, IsNil)
+	c.Check(attempts, Equals, 3)
+
+	attempts = 0
+	err = store.transaction(func(tx *gorm.DB) error {
+		attempts++
+		return &pq.Error{Code: "40001"}
+	})
+	c.Check(retryable(err), Equals, true)
+	c.Check(attempts, Equals, maxAttempts)
+
+	attempts = 0
+	err = store.transaction(func(tx *gorm.DB) error {
+		attempts++
+		return ErrVersionMismatch
+	})
+	c.Check(err, Equals, ErrVersionMismatch)
+	c.Check(attempts, Equals, 1)
+}
@@ -0,0 +1,116 @@
+package data
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Errors of a value of an update map that can not be set on its field
+var (
+	errUnknownField = fmt.Errorf("is unknown")
+	errNotString    = fmt.Errorf("must be a string")
+	errNotInteger   = fmt.Errorf("must be an integer")
+	errNotObject    = fmt.Errorf("must be an object")
+)
+
+// setUserFields sets the values of the update map on the user
+// Keys are matched against the field names and column names in the same way as gorm does
+// The returned error is a ValidationError naming the key that can not be set, or nil
+func setUserFields(user *User, userMap map[string]interface{}) error {
+	for key, value := range userMap {
+		var err error
+		switch {
+		case matchesField(key, "ID", "id"):
+			err = setInt(&user.ID, value)
+		case matchesField(key, "Name", "name"):
+			err = setString(&user.Name, value)
+		case matchesField(key, "Email", "email"):
+			err = setString(&user.Email, value)
+		case matchesField(key, "Password", "password"):
+			err = setString(&user.Password, value)
+		case matchesField(key, "GroupID", "group_id"):
+			err = setInt(&user.GroupID, value)
+		case matchesField(key, "Attributes", "attributes"):
+			err = setAttributes(&user.Attributes, value)
+		case matchesField(key, "Group", "group"):
+			// associations are not updated
+		default:
+			err = errUnknownField
+		}
+		if err != nil {
+			return ValidationError{{Field: key, Message: err.Error()}}
+		}
+	}
+	return nil
+}
+
+// setGroupFields sets the values of the update map on the group
+// Keys are matched against the field names and column names in the same way as gorm does
+// The returned error is a ValidationError naming the key that can not be set, or nil
+func setGroupFields(group *Group, groupMap map[string]interface{}) error {
+	for key, value := range groupMap {
+		var err error
+		switch {
+		case matchesField(key, "ID", "id"):
+			err = setInt(&group.ID, value)
+		case matchesField(key, "Name", "name"):
+			err = setString(&group.Name, value)
+		case matchesField(key, "ParentID", "parent_id"):
+			err = setInt(&group.ParentID, value)
+		case matchesField(key, "Rule", "rule"):
+			err = setString(&group.Rule, value)
+		case matchesField(key, "Users", "users"), matchesField(key, "Permissions", "permissions"):
+			// associations and permissions are not updated
+		default:
+			err = errUnknownField
+		}
+		if err != nil {
+			return ValidationError{{Field: key, Message: err.Error()}}
+		}
+	}
+	return nil
+}
+
+// matchesField reports whether the key refers to the field with the given name and column
+func matchesField(key, name, column string) bool {
+	return key == name || key == column || gorm.ToColumnName(key) == column
+}
+
+func setString(field *string, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*field = ""
+	case string:
+		*field = v
+	default:
+		return errNotString
+	}
+	return nil
+}
+
+func setAttributes(field *map[string]interface{}, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*field = nil
+	case map[string]interface{}:
+		*field = copyAttributes(v)
+	default:
+		return errNotObject
+	}
+	return nil
+}
+
+func setInt(field *int, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*field = 0
+	case int:
+		*field = v
+	case float64:
+		*field = int(v)
+	default:
+		return errNotInteger
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package data
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+// Creates fields test suite
+type FieldsTestSuite struct{}
+
+// Registering test suite
+func init() {
+	Suite(&FieldsTestSuite{})
+}
+
+// Sets the values of update maps by field and column names and names the key of a value that can not be set
+func (s *FieldsTestSuite) TestSetFields(c *C) {
+	user := User{ID: 1, Name: "name", GroupID: 2}
+	c.Assert(setUserFields(&user, map[string]interface{}{"Name": "new", "group_id": nil, "email": "new@example.com"}), IsNil)
+	c.Check(user, DeepEquals, User{ID: 1, Name: "new", Email: "new@example.com"})
+
+	c.Check(setUserFields(&user, map[string]interface{}{"groupID": "2"}), DeepEquals, ValidationError{{Field: "groupID", Message: "must be an integer"}})
+	c.Check(setUserFields(&user, map[string]interface{}{"nickname": "new"}), DeepEquals, ValidationError{{Field: "nickname", Message: "is unknown"}})
+
+	group := Group{ID: 1, Name: "name"}
+	c.Assert(setGroupFields(&group, map[string]interface{}{"parentID": float64(2), "rule": "name = 'new'"}), IsNil)
+	c.Check(group, DeepEquals, Group{ID: 1, Name: "name", ParentID: 2, Rule: "name = 'new'"})
+
+	c.Check(setGroupFields(&group, map[string]interface{}{"name": 1}), DeepEquals, ValidationError{{Field: "name", Message: "must be a string"}})
+}
@@ -0,0 +1,1630 @@
+package data
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// maxAttempts is how often a transaction is run before its deadlock or serialization failure is returned
+const maxAttempts = 5
+
+// retryDelay is the delay before the second attempt of a transaction, it grows with every attempt
+const retryDelay = 10 * time.Millisecond
+
+// Row locks taken by the reads of a transaction
+const (
+	// lockUpdate locks the rows that the transaction changes
+	lockUpdate = "FOR UPDATE"
+
+	// lockShare locks the rows that the change depends on, e.g. the group a user joins,
+	// so that they can not be changed or deleted before the transaction ends
+	lockShare = "FOR SHARE"
+)
+
+// GormStore is a UserStore and GroupStore backed by a gorm database connection
+// Users and groups are deleted by setting their deleted_at column, which gorm leaves out of every query
+// of a scope that is not unscoped
+// Every change runs in a transaction that locks the rows it reads before writing them
+// and is run again when it fails because of a deadlock or a concurrent transaction
+type GormStore struct {
+	db *gorm.DB
+}
+
+// NewGormStore returns a new store using the given database connection
+func NewGormStore(db *gorm.DB) *GormStore {
+	return &GormStore{db}
+}
+
+// GetUsers returns a page of users from the database with their attributes and the total number of users
+func (s *GormStore) GetUsers(opts ListOptions) (users []*User, total int, err error) {
+	definitions, err := s.GetAttributes()
+	if err != nil {
+		return
+	}
+	fields := userFields(definitions)
+	if err = fields.check(&opts); err != nil {
+		return
+	}
+
+	db := filter(listed(s.db, opts), fields, opts)
+	if err = db.Model(&User{}).Count(&total).Error; err != nil {
+		return
+	}
+
+	if err = paginate(db, fields, opts).Find(&users).Error; err != nil {
+		return
+	}
+	if opts.Cursor != nil && opts.Cursor.Before {
+		for i, j := 0, len(users)-1; i < j; i, j = i+1, j-1 {
+			users[i], users[j] = users[j], users[i]
+		}
+	}
+	err = loadAttributes(s.db, users...)
+	return
+}
+
+// GetUserById returns a single user with the specified id
+// If the user is not found this func retuns UserNotFound error
+func (s *GormStore) GetUserById(id int) (user User, err error) {
+	user.ID = id
+	if err = s.db.First(&user).Error; err != nil {
+		err = lookupError(ErrUserNotFound, err)
+		return
+	}
+	err = loadAttributes(s.db, &user)
+	return
+}
+
+// GetUserByName returns a single user with the specified name
+// If the user is not found this func retuns UserNotFound error
+func (s *GormStore) GetUserByName(name string) (user User, err error) {
+	if err = s.db.Where("name = ?", name).First(&user).Error; err != nil {
+		err = lookupError(ErrUserNotFound, err)
+		return
+	}
+	err = loadAttributes(s.db, &user)
+	return
+}
+
+// GetUserByEmail returns a single user with the specified email
+// If the user is not found this func retuns UserNotFound error
+func (s *GormStore) GetUserByEmail(email string) (user User, err error) {
+	if err = s.db.Where("email = ?", email).First(&user).Error; err != nil {
+		err = lookupError(ErrUserNotFound, err)
+		return
+	}
+	err = loadAttributes(s.db, &user)
+	return
+}
+
+// UpdateUser replaces the set of values within the given user and increases its version
+// If a user is not found this func returns a UserNotFound error
+// if version is not 0 and the user has another version the func returns an ErrVersionMismatch error
+// if the update would make a constraint violation the func returns a ConstraintError of ErrUserConstraintViolation
+func (s *GormStore) UpdateUser(actor Actor, id, version int, userMap map[string]interface{}) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		return updateUser(tx, actor, id, version, userMap)
+	})
+}
+
+// AddUser adds a user to the database with version 1
+// if the user would make a constraint violation the func returns a ConstraintError of ErrUserConstraintViolation
+func (s *GormStore) AddUser(actor Actor, user *User) error {
+	id := user.ID
+	return s.transaction(func(tx *gorm.DB) error {
+		// a failed attempt leaves the generated id behind
+		user.ID = id
+		return addUser(tx, actor, user)
+	})
+}
+
+// DeleteUser marks an user as deleted and increases its version
+// if version is not 0 and the user has another version the func returns an ErrVersionMismatch error
+func (s *GormStore) DeleteUser(actor Actor, id, version int) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		return deleteUser(tx, actor, id, version)
+	})
+}
+
+// ApplyUsers runs the operations in order and returns the error of every operation, nil when it succeeded
+// Operations of an atomic batch run in a single transaction, every other operation runs in a transaction of its own
+func (s *GormStore) ApplyUsers(actor Actor, ops []UserOperation, atomic bool) []error {
+	// a failed attempt leaves the generated ids behind
+	ids := make([]int, len(ops))
+	for i, op := range ops {
+		if op.User != nil {
+			ids[i] = op.User.ID
+		}
+	}
+	reset := func(i int) {
+		if ops[i].User != nil {
+			ops[i].User.ID = ids[i]
+		}
+	}
+
+	errs := make([]error, len(ops))
+	if !atomic {
+		for i := range ops {
+			errs[i] = s.transaction(func(tx *gorm.DB) error {
+				reset(i)
+				return applyUser(tx, actor, ops[i])
+			})
+		}
+		return errs
+	}
+
+	err := s.transaction(func(tx *gorm.DB) error {
+		for i := range ops {
+			reset(i)
+			errs[i] = nil
+		}
+		for i := range ops {
+			if errs[i] = applyUser(tx, actor, ops[i]); errs[i] != nil {
+				return errs[i]
+			}
+		}
+		return nil
+	})
+	return abortBatch(errs, err)
+}
+
+// applyUser runs a single operation of a batch in the transaction
+func applyUser(tx *gorm.DB, actor Actor, op UserOperation) error {
+	switch op.Op {
+	case BatchCreate:
+		return addUser(tx, actor, op.User)
+	case BatchUpdate:
+		return updateUser(tx, actor, op.ID, op.Version, op.Values)
+	case BatchDelete:
+		return deleteUser(tx, actor, op.ID, op.Version)
+	}
+	return ErrUnknownOperation
+}
+
+// updateUser updates a user in the transaction, see UpdateUser
+func updateUser(tx *gorm.DB, actor Actor, id, version int, userMap map[string]interface{}) error {
+	var user User
+	if err := locked(tx, lockUpdate).First(&user, id).Error; err != nil {
+		return lookupError(ErrUserNotFound, err)
+	}
+	if err := loadAttributes(tx, &user); err != nil {
+		return unavailableError(err)
+	}
+
+	after := user
+	if err := setUserFields(&after, userMap); err != nil {
+		return err
+	}
+	definitions, err := checkUserAttributes(tx, &after)
+	if err != nil {
+		return err
+	}
+	// the update sets the new values on the user, so the changes are taken before it
+	changes := diff(userValues(&user), userValues(&after))
+
+	// only the checked columns of the user are written, never the keys of the update map,
+	// the id and group are only written when they change and a user without a primary group has a NULL group_id
+	values := nextVersion(map[string]interface{}{"name": after.Name, "email": after.Email, "password": after.Password})
+	if after.ID != user.ID {
+		values["id"] = after.ID
+	}
+	former, moved := user.GroupID, after.GroupID != user.GroupID
+	if moved {
+		if err := checkGroup(tx, after.GroupID); err != nil {
+			return err
+		}
+		values["group_id"] = nullableID(after.GroupID)
+	}
+
+	db := versioned(tx, version).Model(&user).Updates(values)
+	if db.Error != nil {
+		return storeError(ErrUserConstraintViolation, ConstraintUserGroup, db.Error)
+	}
+	if db.RowsAffected == 0 {
+		return ErrVersionMismatch
+	}
+
+	if err := saveAttributes(tx, &after, definitions); err != nil {
+		return err
+	}
+
+	// the user leaves its former primary group, the memberships follow a changed id of the user
+	if moved {
+		if err := tx.Exec("DELETE FROM memberships WHERE user_id = ? AND group_id = ?", after.ID, former).Error; err != nil {
+			return unavailableError(err)
+		}
+		if err := addMembership(tx, after.ID, after.GroupID); err != nil {
+			return err
+		}
+	}
+	if err := record(tx, actor, AuditUpdate, AuditUser, id, changes); err != nil {
+		return err
+	}
+	return syncRules(tx, actor, &after)
+}
+
+// addUser adds a user in the transaction, see AddUser
+func addUser(tx *gorm.DB, actor Actor, user *User) error {
+	if err := checkGroup(tx, user.GroupID); err != nil {
+		return err
+	}
+	definitions, err := checkUserAttributes(tx, user)
+	if err != nil {
+		return err
+	}
+
+	// a user without a primary group has no group_id, gorm would still write it for the association
+	db := tx
+	if user.GroupID == 0 {
+		db = tx.Omit("group_id", "Group")
+	}
+
+	// a new user is live and at its first version, whatever the request says
+	user.Version = 1
+	user.DeletedAt = nil
+	if err := db.Create(user).Error; err != nil {
+		return storeError(ErrUserConstraintViolation, ConstraintUserGroup, err)
+	}
+	if err := saveAttributes(tx, user, definitions); err != nil {
+		return err
+	}
+	if err := addMembership(tx, user.ID, user.GroupID); err != nil {
+		return err
+	}
+	if err := record(tx, actor, AuditCreate, AuditUser, user.ID, diff(nil, userValues(user))); err != nil {
+		return err
+	}
+	return syncRules(tx, actor, user)
+}
+
+// deleteUser deletes a user in the transaction, see DeleteUser
+func deleteUser(tx *gorm.DB, actor Actor, id, version int) error {
+	var user User
+	if err := locked(tx, lockUpdate).First(&user, id).Error; err != nil {
+		return lookupError(ErrUserNotFound, err)
+	}
+
+	now := time.Now().UTC()
+	db := versioned(tx, version).Model(&user).Updates(nextVersion(map[string]interface{}{"deleted_at": now}))
+	if db.Error != nil {
+		return unavailableError(db.Error)
+	}
+	if db.RowsAffected == 0 {
+		return ErrVersionMismatch
+	}
+
+	// the values of unique attributes are free for other users until the user is restored
+	if err := tx.Exec("UPDATE user_attributes SET unique_value = NULL WHERE user_id = ?", id).Error; err != nil {
+		return unavailableError(err)
+	}
+	return record(tx, actor, AuditDelete, AuditUser, id, Changes{"deletedAt": {After: now}})
+}
+
+// RestoreUser restores a deleted user and increases its version
+// If a user is not found this func returns a UserNotFound error
+// if the user would make a constraint violation the func returns a ConstraintError of ErrUserConstraintViolation
+func (s *GormStore) RestoreUser(actor Actor, id int) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		var user User
+		if err := locked(tx, lockUpdate).Unscoped().First(&user, id).Error; err != nil {
+			return lookupError(ErrUserNotFound, err)
+		}
+		if user.DeletedAt == nil {
+			return nil
+		}
+		if err := checkGroup(tx, user.GroupID); err != nil {
+			return err
+		}
+
+		deletedAt := user.DeletedAt
+		if err := tx.Unscoped().Model(&user).Updates(nextVersion(map[string]interface{}{"deleted_at": nil})).Error; err != nil {
+			return storeError(ErrUserConstraintViolation, "", err)
+		}
+		err := tx.Exec("UPDATE user_attributes SET unique_value = value WHERE user_id = ? AND attribute_id IN (SELECT id FROM attributes WHERE is_unique = ?)", id, true).Error
+		if err != nil {
+			return storeError(ErrUserConstraintViolation, "", err)
+		}
+		return record(tx, actor, AuditRestore, AuditUser, id, Changes{"deletedAt": {Before: deletedAt}})
+	})
+}
+
+// PurgeUsers removes the users deleted before the given time from the database
+func (s *GormStore) PurgeUsers(before time.Time) (purged int, err error) {
+	err = s.transaction(func(tx *gorm.DB) error {
+		var users []User
+		if err := locked(tx, lockUpdate).Unscoped().Where("deleted_at < ?", before.UTC()).Find(&users).Error; err != nil {
+			return unavailableError(err)
+		}
+		purgedUsers := make([]*User, len(users))
+		for i := range users {
+			purgedUsers[i] = &users[i]
+		}
+		if err := loadAttributes(tx, purgedUsers...); err != nil {
+			return unavailableError(err)
+		}
+		for i := range users {
+			if err := tx.Unscoped().Delete(&users[i]).Error; err != nil {
+				return unavailableError(err)
+			}
+			if err := record(tx, System, AuditPurge, AuditUser, users[i].ID, diff(userValues(&users[i]), nil)); err != nil {
+				return err
+			}
+		}
+		purged = len(users)
+		return nil
+	})
+	return
+}
+
+// checkGroup returns a ConstraintError of ErrUserConstraintViolation when the group of a user does not exist,
+// is deleted or is dynamic, the foreign key of the user only covers the first case, a user without a group passes
+// The group is locked until the transaction ends, so that it can not be deleted while the user joins it
+func checkGroup(tx *gorm.DB, groupID int) error {
+	if groupID == 0 {
+		return nil
+	}
+
+	var group Group
+	err := locked(tx, lockShare).Select("id, rule").Where("id = ?", groupID).First(&group).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return newConstraintError(ErrUserConstraintViolation, ConstraintUserGroup)
+	}
+	if err != nil {
+		return unavailableError(err)
+	}
+	if group.Rule != "" {
+		return newConstraintError(ErrUserConstraintViolation, ConstraintDynamicGroup)
+	}
+	return nil
+}
+
+// GetGroups returns a page of groups from the database and the total number of groups
+func (s *GormStore) GetGroups(opts ListOptions) (groups []*Group, total int, err error) {
+	if err = GroupFields.check(&opts); err != nil {
+		return
+	}
+
+	db := filter(listed(s.db, opts), GroupFields, opts)
+	if err = db.Model(&Group{}).Count(&total).Error; err != nil {
+		return
+	}
+
+	if err = paginate(db, GroupFields, opts).Preload("Users", byID).Find(&groups).Error; err != nil {
+		return
+	}
+	if opts.Cursor != nil && opts.Cursor.Before {
+		for i, j := 0, len(groups)-1; i < j; i, j = i+1, j-1 {
+			groups[i], groups[j] = groups[j], groups[i]
+		}
+	}
+	err = s.loadGroups(groups...)
+	return
+}
+
+// GetGroupById returns a single group with the specified id
+// If a group is not found this func returns a GroupNotFound error
+func (s *GormStore) GetGroupById(id int) (group Group, err error) {
+	group.ID = id
+	if err = s.db.Preload("Users", byID).First(&group).Error; err != nil {
+		err = lookupError(ErrGroupNotFound, err)
+		return
+	}
+	err = s.loadGroups(&group)
+	return
+}
+
+// UpdateGroup replaces the set of values within the given group and increases its version
+// If a group is not found this func returns a GroupNotFound error
+// if version is not 0 and the group has another version the func returns an ErrVersionMismatch error
+// if the update would make a constraint violation or a cycle of parents the func returns a ConstraintError
+// of ErrGroupConstraintViolation
+func (s *GormStore) UpdateGroup(actor Actor, id, version int, groupMap map[string]interface{}) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		var group Group
+		if err := locked(tx, lockUpdate).First(&group, id).Error; err != nil {
+			return lookupError(ErrGroupNotFound, err)
+		}
+
+		after := group
+		if err := setGroupFields(&after, groupMap); err != nil {
+			return err
+		}
+		// the update sets the new values on the group, so the changes are taken before it
+		changes := diff(groupValues(&group), groupValues(&after))
+		ruleChanged := after.Rule != group.Rule
+
+		if after.ParentID != group.ParentID || after.ParentID == after.ID {
+			if err := checkParent(tx, group.ID, after.ID, after.ParentID); err != nil {
+				return err
+			}
+		}
+		if after.Rule != "" && group.Rule == "" {
+			if err := checkDynamic(tx, id); err != nil {
+				return err
+			}
+		}
+
+		// a group without a parent has no parent_id
+		values := nextVersion(nil)
+		for key, value := range groupMap {
+			if matchesField(key, "ParentID", "parent_id") {
+				key, value = "parent_id", nullableID(after.ParentID)
+			}
+			values[key] = value
+		}
+
+		// the parent was checked above, so a failed foreign key is a user still referencing a changed id
+		db := versioned(tx, version).Model(&group).Updates(values)
+		if db.Error != nil {
+			return storeError(ErrGroupConstraintViolation, ConstraintUserGroup, db.Error)
+		}
+		if db.RowsAffected == 0 {
+			return ErrVersionMismatch
+		}
+		if err := record(tx, actor, AuditUpdate, AuditGroup, id, changes); err != nil {
+			return err
+		}
+
+		// a group losing its rule keeps its members
+		if !ruleChanged || after.Rule == "" {
+			return nil
+		}
+		return syncRule(tx, actor, &after)
+	})
+}
+
+// AddGroup adds a group and its users to the database with version 1, the group is the primary group of its users
+// if the group would make a constraint violation the func returns a ConstraintError of ErrGroupConstraintViolation
+func (s *GormStore) AddGroup(actor Actor, group *Group) error {
+	id := group.ID
+	userIDs := make([]int, len(group.Users))
+	for i := range group.Users {
+		userIDs[i] = group.Users[i].ID
+	}
+	return s.transaction(func(tx *gorm.DB) error {
+		// a failed attempt leaves the generated ids behind
+		group.ID = id
+
+		// a new group is live and at its first version, whatever the request says
+		group.Version = 1
+		group.DeletedAt = nil
+		for i := range group.Users {
+			group.Users[i].ID = userIDs[i]
+		}
+		if err := checkParent(tx, 0, group.ID, group.ParentID); err != nil {
+			return err
+		}
+		if group.Rule != "" && len(group.Users) > 0 {
+			return newConstraintError(ErrGroupConstraintViolation, ConstraintDynamicGroup)
+		}
+
+		// a group without a parent has no parent_id
+		db := tx.Set("gorm:save_associations", false)
+		if group.ParentID == 0 {
+			db = db.Omit("parent_id")
+		}
+		if err := db.Create(group).Error; err != nil {
+			return storeError(ErrGroupConstraintViolation, ConstraintGroupParent, err)
+		}
+		if err := record(tx, actor, AuditCreate, AuditGroup, group.ID, diff(nil, groupValues(group))); err != nil {
+			return err
+		}
+		if err := addOwner(tx, actor, group.ID); err != nil {
+			return err
+		}
+		if group.Rule != "" {
+			return syncRule(tx, actor, group)
+		}
+
+		for i := range group.Users {
+			group.Users[i].GroupID = group.ID
+			err := addUser(tx, actor, &group.Users[i])
+			var constraintErr *ConstraintError
+			if errors.As(err, &constraintErr) {
+				return newConstraintError(ErrGroupConstraintViolation, constraintErr.Constraint)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteGroup marks a group as deleted and increases its version, with cascade its descendants are deleted with it
+// if version is not 0 and the group has another version the func returns an ErrVersionMismatch error
+// if users that are not deleted belong to a deleted group or the group has children without cascade
+// the func returns a ConstraintError of ErrGroupConstraintViolation
+func (s *GormStore) DeleteGroup(actor Actor, id, version int, cascade bool) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		// the group is locked before its descendants are read, groups can only be added below it
+		// or moved below it by locking it as an ancestor
+		var group Group
+		if err := locked(tx, lockUpdate).First(&group, id).Error; err != nil {
+			return lookupError(ErrGroupNotFound, err)
+		}
+
+		descendants, err := descendantIDs(tx, id)
+		if err != nil {
+			return err
+		}
+		if len(descendants) > 0 && !cascade {
+			return &ConstraintError{Err: ErrGroupConstraintViolation, Constraint: ConstraintGroupParent, Reason: ErrGroupHasChildren}
+		}
+		var children []Group
+		if len(descendants) > 0 {
+			if err := locked(tx, lockUpdate).Where("id IN (?)", descendants).Order("id").Find(&children).Error; err != nil {
+				return unavailableError(err)
+			}
+		}
+
+		// the members of dynamic groups do not guard them, they are computed again when a group is restored
+		ids := append([]int{id}, descendants...)
+		if err := tx.Exec("DELETE FROM memberships WHERE group_id IN (SELECT id FROM groups WHERE id IN (?) AND rule <> '')", ids).Error; err != nil {
+			return unavailableError(err)
+		}
+
+		// deleted members keep the foreign keys satisfied, so they do not guard the groups anymore
+		var users int
+		if err := tx.Model(&User{}).Where("id IN (SELECT user_id FROM memberships WHERE group_id IN (?))", ids).Count(&users).Error; err != nil {
+			return unavailableError(err)
+		}
+		if users > 0 {
+			return newConstraintError(ErrGroupConstraintViolation, ConstraintUserGroup)
+		}
+
+		now := time.Now().UTC()
+		db := versioned(tx, version).Model(&group).Updates(nextVersion(map[string]interface{}{"deleted_at": now}))
+		if db.Error != nil {
+			return unavailableError(db.Error)
+		}
+		if db.RowsAffected == 0 {
+			return ErrVersionMismatch
+		}
+		if err := record(tx, actor, AuditDelete, AuditGroup, id, Changes{"deletedAt": {After: now}}); err != nil {
+			return err
+		}
+
+		for i := range children {
+			if err := tx.Model(&children[i]).Updates(nextVersion(map[string]interface{}{"deleted_at": now})).Error; err != nil {
+				return unavailableError(err)
+			}
+			if err := record(tx, actor, AuditDelete, AuditGroup, children[i].ID, Changes{"deletedAt": {After: now}}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RestoreGroup restores a deleted group and increases its version
+// If a group is not found this func returns a GroupNotFound error
+// if the group would make a constraint violation the func returns a ConstraintError of ErrGroupConstraintViolation
+func (s *GormStore) RestoreGroup(actor Actor, id int) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		var group Group
+		if err := locked(tx, lockUpdate).Unscoped().First(&group, id).Error; err != nil {
+			return lookupError(ErrGroupNotFound, err)
+		}
+		if group.DeletedAt == nil {
+			return nil
+		}
+		if err := checkParent(tx, group.ID, group.ID, group.ParentID); err != nil {
+			return err
+		}
+
+		deletedAt := group.DeletedAt
+		if err := tx.Unscoped().Model(&group).Updates(nextVersion(map[string]interface{}{"deleted_at": nil})).Error; err != nil {
+			return storeError(ErrGroupConstraintViolation, "", err)
+		}
+		if err := record(tx, actor, AuditRestore, AuditGroup, id, Changes{"deletedAt": {Before: deletedAt}}); err != nil {
+			return err
+		}
+		if group.Rule != "" {
+			return syncRule(tx, actor, &group)
+		}
+		return nil
+	})
+}
+
+// PurgeGroups removes the groups deleted before the given time from the database
+// unless users still belong to them or they have children, their permissions are removed with them
+// The groups are purged from the leaves up, so a purged child no longer keeps its parent
+func (s *GormStore) PurgeGroups(before time.Time) (purged int, err error) {
+	err = s.transaction(func(tx *gorm.DB) error {
+		purged = 0
+		for {
+			var groups []Group
+			err := locked(tx, lockUpdate).Unscoped().
+				Where("deleted_at < ? AND id NOT IN (SELECT group_id FROM memberships)", before.UTC()).
+				Where("id NOT IN (SELECT parent_id FROM groups WHERE parent_id IS NOT NULL)").
+				Find(&groups).Error
+			if err != nil {
+				return unavailableError(err)
+			}
+			if len(groups) == 0 {
+				return nil
+			}
+			for i := range groups {
+				if err := tx.Unscoped().Delete(&groups[i]).Error; err != nil {
+					return unavailableError(err)
+				}
+				if err := record(tx, System, AuditPurge, AuditGroup, groups[i].ID, diff(groupValues(&groups[i]), nil)); err != nil {
+					return err
+				}
+			}
+			purged += len(groups)
+		}
+	})
+	return
+}
+
+// GetGroupAncestors returns the ancestors of the group with the specified id, its parent first
+// If a group is not found this func returns a GroupNotFound error
+func (s *GormStore) GetGroupAncestors(id int) ([]*Group, error) {
+	if err := s.db.Select("id").First(&Group{}, id).Error; err != nil {
+		return nil, lookupError(ErrGroupNotFound, err)
+	}
+	ids, err := queryIDs(s.db, ancestorsSQL, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.groupsByID(ids)
+}
+
+// GetGroupDescendants returns the descendants of the group with the specified id ordered by id
+// If a group is not found this func returns a GroupNotFound error
+func (s *GormStore) GetGroupDescendants(id int) ([]*Group, error) {
+	if err := s.db.Select("id").First(&Group{}, id).Error; err != nil {
+		return nil, lookupError(ErrGroupNotFound, err)
+	}
+	ids, err := descendantIDs(s.db, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.groupsByID(ids)
+}
+
+// GetEffectiveMembers returns the users that belong to the group with the specified id or to its descendants
+// If a group is not found this func returns a GroupNotFound error
+func (s *GormStore) GetEffectiveMembers(id int) ([]*User, error) {
+	if err := s.db.Select("id").First(&Group{}, id).Error; err != nil {
+		return nil, lookupError(ErrGroupNotFound, err)
+	}
+	ids, err := descendantIDs(s.db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []*User{}
+	err = s.db.Where("id IN (SELECT user_id FROM memberships WHERE group_id IN (?))", append([]int{id}, ids...)).Order("id").Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, loadAttributes(s.db, users...)
+}
+
+// ancestorsSQL selects the ids of the ancestors of a group, its parent first
+const ancestorsSQL = `
+WITH RECURSIVE ancestors (id, depth) AS (
+	SELECT parent_id, 1 FROM groups WHERE id = ?
+	UNION ALL
+	SELECT groups.parent_id, ancestors.depth + 1 FROM groups JOIN ancestors ON groups.id = ancestors.id
+)
+SELECT id FROM ancestors WHERE id IS NOT NULL ORDER BY depth`
+
+// descendantsSQL selects the ids of the descendants of a group that are not deleted
+const descendantsSQL = `
+WITH RECURSIVE descendants (id) AS (
+	SELECT id FROM groups WHERE parent_id = ? AND deleted_at IS NULL
+	UNION
+	SELECT groups.id FROM groups JOIN descendants ON groups.parent_id = descendants.id WHERE groups.deleted_at IS NULL
+)
+SELECT id FROM descendants ORDER BY id`
+
+// descendantIDs returns the ids of the descendants of the group that are not deleted ordered by id
+func descendantIDs(db *gorm.DB, id int) ([]int, error) {
+	return queryIDs(db, descendantsSQL, id)
+}
+
+// queryIDs returns the ids selected by the query in their order
+func queryIDs(db *gorm.DB, query string, args ...interface{}) ([]int, error) {
+	rows, err := db.Raw(query, args...).Rows()
+	if err != nil {
+		return nil, unavailableError(err)
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// usersByID returns the users that are not deleted with the given ids in the same order
+// together with their attributes
+func (s *GormStore) usersByID(ids []int) ([]*User, error) {
+	users := []*User{}
+	if len(ids) == 0 {
+		return users, nil
+	}
+
+	var found []*User
+	if err := s.db.Where("id IN (?)", ids).Find(&found).Error; err != nil {
+		return nil, err
+	}
+	byUserID := make(map[int]*User, len(found))
+	for _, user := range found {
+		byUserID[user.ID] = user
+	}
+	for _, id := range ids {
+		if user, ok := byUserID[id]; ok {
+			users = append(users, user)
+		}
+	}
+	return users, loadAttributes(s.db, users...)
+}
+
+// groupsByID returns the groups that are not deleted with the given ids in the same order
+// together with their users and permissions
+func (s *GormStore) groupsByID(ids []int) ([]*Group, error) {
+	groups := []*Group{}
+	if len(ids) == 0 {
+		return groups, nil
+	}
+
+	var found []*Group
+	if err := s.db.Where("id IN (?)", ids).Preload("Users", byID).Find(&found).Error; err != nil {
+		return nil, err
+	}
+	byGroupID := make(map[int]*Group, len(found))
+	for _, group := range found {
+		byGroupID[group.ID] = group
+	}
+	for _, id := range ids {
+		if group, ok := byGroupID[id]; ok {
+			groups = append(groups, group)
+		}
+	}
+	return groups, s.loadGroups(groups...)
+}
+
+// checkParent returns a ConstraintError of ErrGroupConstraintViolation when the parent of a group does not exist,
+// is deleted or is the group itself or one of its descendants, id is the current id of the group, 0 for a new group,
+// and newID its id after the change, a group without a parent passes
+// The ancestors are locked until the transaction ends, so that they can neither be deleted nor moved below the group
+func checkParent(tx *gorm.DB, id, newID, parentID int) error {
+	for ancestor := parentID; ancestor != 0; {
+		if ancestor == id || ancestor == newID {
+			return newConstraintError(ErrGroupConstraintViolation, ConstraintGroupCycle)
+		}
+
+		var group Group
+		err := locked(tx, lockShare).Select("id, parent_id").First(&group, ancestor).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return newConstraintError(ErrGroupConstraintViolation, ConstraintGroupParent)
+		}
+		if err != nil {
+			return unavailableError(err)
+		}
+		ancestor = group.ParentID
+	}
+	return nil
+}
+
+// GetGroupPermissions returns the permissions granted to the group with the specified id
+// If a group is not found this func returns a GroupNotFound error
+func (s *GormStore) GetGroupPermissions(id int) ([]string, error) {
+	group := Group{ID: id}
+	if err := s.db.First(&group).Error; err != nil {
+		return nil, lookupError(ErrGroupNotFound, err)
+	}
+	err := s.loadPermissions(&group)
+	return group.Permissions, err
+}
+
+// GetUserPermissions returns the permissions granted to the groups that the user with the specified id belongs to
+// and to their ancestors
+func (s *GormStore) GetUserPermissions(userID int) ([]string, error) {
+	rows, err := s.db.Raw(`
+WITH RECURSIVE member_groups (id) AS (
+	SELECT group_id FROM memberships WHERE user_id = ?
+	UNION
+	SELECT groups.parent_id FROM groups JOIN member_groups ON groups.id = member_groups.id
+	WHERE groups.parent_id IS NOT NULL AND groups.deleted_at IS NULL
+)
+SELECT DISTINCT permission FROM group_permissions
+JOIN member_groups ON member_groups.id = group_permissions.group_id
+JOIN groups ON groups.id = group_permissions.group_id
+WHERE groups.deleted_at IS NULL
+ORDER BY permission`, userID).Rows()
+	if err != nil {
+		return nil, unavailableError(err)
+	}
+	defer rows.Close()
+
+	permissions := []string{}
+	for rows.Next() {
+		var permission string
+		if err = rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	return permissions, rows.Err()
+}
+
+// GetUserGroups returns the groups that the user with the specified id belongs to
+// If the user is not found this func returns a UserNotFound error
+func (s *GormStore) GetUserGroups(userID int) (groups []*Group, err error) {
+	if _, err = s.GetUserById(userID); err != nil {
+		return
+	}
+
+	err = s.db.Where("id IN (SELECT group_id FROM memberships WHERE user_id = ?)", userID).Order("id").Preload("Users", byID).Find(&groups).Error
+	if err != nil {
+		return
+	}
+	err = s.loadGroups(groups...)
+	return
+}
+
+// AddMember adds the user to the group
+// If a group is not found this func returns a GroupNotFound error, if a user is not found a UserNotFound error
+func (s *GormStore) AddMember(actor Actor, groupID, userID int) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		if _, err := lockMember(tx, groupID, userID); err != nil {
+			return err
+		}
+		return setMember(tx, actor, groupID, userID, true)
+	})
+}
+
+// RemoveMember removes the user from the group, a user leaving its primary group is left without one
+// If a group is not found this func returns a GroupNotFound error, if a user is not found a UserNotFound error
+func (s *GormStore) RemoveMember(actor Actor, groupID, userID int) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		user, err := lockMember(tx, groupID, userID)
+		if err != nil {
+			return err
+		}
+
+		db := tx.Exec("DELETE FROM memberships WHERE user_id = ? AND group_id = ?", userID, groupID)
+		if db.Error != nil {
+			return unavailableError(db.Error)
+		}
+		if db.RowsAffected == 0 {
+			return nil
+		}
+
+		if user.GroupID == groupID {
+			if err := tx.Model(&user).Updates(nextVersion(map[string]interface{}{"group_id": nullableID(0)})).Error; err != nil {
+				return unavailableError(err)
+			}
+			if err := record(tx, actor, AuditUpdate, AuditUser, userID, Changes{"groupID": {Before: groupID, After: 0}}); err != nil {
+				return err
+			}
+		}
+		return record(tx, actor, AuditLeave, AuditUser, userID, Changes{"group": {Before: groupID}})
+	})
+}
+
+// lockMember returns the user joining or leaving the group, the members of a dynamic group can not be changed
+// The group is locked so that it can not be deleted and the user so that it can not change until the transaction ends
+func lockMember(tx *gorm.DB, groupID, userID int) (user User, err error) {
+	var group Group
+	if err = locked(tx, lockShare).Select("id, rule").First(&group, groupID).Error; err != nil {
+		err = lookupError(ErrGroupNotFound, err)
+		return
+	}
+	if err = locked(tx, lockUpdate).First(&user, userID).Error; err != nil {
+		err = lookupError(ErrUserNotFound, err)
+		return
+	}
+	if group.Rule != "" {
+		err = ErrDynamicGroup
+	}
+	return
+}
+
+// setMember adds the user to the group or removes it from the group in the transaction,
+// the user joining or leaving is recorded when the membership changes
+func setMember(tx *gorm.DB, actor Actor, groupID, userID int, member bool) error {
+	statement, action, changes := "DELETE FROM memberships WHERE user_id = ? AND group_id = ?", AuditLeave, Changes{"group": {Before: groupID}}
+	if member {
+		statement, action, changes = "INSERT INTO memberships (user_id, group_id) VALUES (?, ?) ON CONFLICT DO NOTHING", AuditJoin, Changes{"group": {After: groupID}}
+	}
+
+	db := tx.Exec(statement, userID, groupID)
+	if db.Error != nil {
+		return unavailableError(db.Error)
+	}
+	if db.RowsAffected == 0 {
+		return nil
+	}
+	return record(tx, actor, action, AuditUser, userID, changes)
+}
+
+// syncRules makes the user a member of the dynamic groups whose rules it matches and of no other dynamic group
+// The dynamic groups are locked, so that their rules can not change until the transaction ends
+func syncRules(tx *gorm.DB, actor Actor, user *User) error {
+	var groups []Group
+	if err := locked(tx, lockShare).Select("id, rule").Where("rule <> ''").Order("id").Find(&groups).Error; err != nil {
+		return unavailableError(err)
+	}
+	for _, group := range groups {
+		if err := setMember(tx, actor, group.ID, user.ID, matchRule(group.Rule, user)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncRule makes the users matching the rule of the dynamic group its members and removes every other member,
+// deleted users included, so that they are members again when they are restored
+// The users are locked, so that they can not change until the transaction ends
+func syncRule(tx *gorm.DB, actor Actor, group *Group) error {
+	rule, err := ParseRule(group.Rule)
+	if err != nil {
+		return &ConstraintError{Err: ErrGroupConstraintViolation}
+	}
+
+	var users []User
+	if err := locked(tx, lockShare).Unscoped().Order("id").Find(&users).Error; err != nil {
+		return unavailableError(err)
+	}
+	for i := range users {
+		if err := setMember(tx, actor, group.ID, users[i].ID, rule.Match(&users[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDynamic returns a ConstraintError of ErrGroupConstraintViolation when the group is the primary group of a user,
+// deleted users included, so that it can not get a rule
+func checkDynamic(tx *gorm.DB, id int) error {
+	var users int
+	if err := tx.Unscoped().Model(&User{}).Where("group_id = ?", id).Count(&users).Error; err != nil {
+		return unavailableError(err)
+	}
+	if users > 0 {
+		return newConstraintError(ErrGroupConstraintViolation, ConstraintDynamicGroup)
+	}
+	return nil
+}
+
+// addMembership adds the user to its primary group in the transaction, a user without a primary group is left alone
+func addMembership(tx *gorm.DB, userID, groupID int) error {
+	if groupID == 0 {
+		return nil
+	}
+	if err := tx.Exec("INSERT INTO memberships (user_id, group_id) VALUES (?, ?) ON CONFLICT DO NOTHING", userID, groupID).Error; err != nil {
+		return storeError(ErrUserConstraintViolation, ConstraintMemberGroup, err)
+	}
+	return nil
+}
+
+// PreviewRule returns the users that are not deleted and match the rule ordered by id
+// If the rule can not be parsed this func returns an error matching ErrInvalidRule
+func (s *GormStore) PreviewRule(rule string) ([]*User, error) {
+	parsed, err := ParseRule(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*User
+	if err := s.db.Order("id").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	matching := []*User{}
+	for _, user := range users {
+		if parsed.Match(user) {
+			matching = append(matching, user)
+		}
+	}
+	return matching, loadAttributes(s.db, matching...)
+}
+
+// GrantPermission grants the permission to the group and increases its version
+// If a group is not found this func returns a GroupNotFound error
+func (s *GormStore) GrantPermission(actor Actor, id int, permission string) error {
+	return s.changePermissions(actor, AuditGrant, id, permission,
+		"INSERT INTO group_permissions (group_id, permission) VALUES (?, ?) ON CONFLICT DO NOTHING")
+}
+
+// RevokePermission revokes the permission from the group and increases its version
+// If a group is not found this func returns a GroupNotFound error
+func (s *GormStore) RevokePermission(actor Actor, id int, permission string) error {
+	return s.changePermissions(actor, AuditRevoke, id, permission,
+		"DELETE FROM group_permissions WHERE group_id = ? AND permission = ?")
+}
+
+// changePermissions runs the statement granting or revoking the permission of the group
+// and increases the version of the group when the statement changed its permissions
+func (s *GormStore) changePermissions(actor Actor, action string, id int, permission, statement string) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		var group Group
+		if err := locked(tx, lockUpdate).First(&group, id).Error; err != nil {
+			return lookupError(ErrGroupNotFound, err)
+		}
+
+		db := tx.Exec(statement, id, permission)
+		if db.Error != nil {
+			return unavailableError(db.Error)
+		}
+		if db.RowsAffected == 0 {
+			return nil
+		}
+		if err := tx.Exec("UPDATE groups SET version = version + 1 WHERE id = ?", id).Error; err != nil {
+			return unavailableError(err)
+		}
+
+		change := Change{After: permission}
+		if action == AuditRevoke {
+			change = Change{Before: permission}
+		}
+		return record(tx, actor, action, AuditGroup, id, Changes{"permission": change})
+	})
+}
+
+// addOwner makes the user creating a group its owner in the transaction, the system owns no group
+func addOwner(tx *gorm.DB, actor Actor, groupID int) error {
+	db := tx.Exec("INSERT INTO group_admins (group_id, user_id, role) SELECT ?, id, ? FROM users WHERE id = ? AND deleted_at IS NULL", groupID, RoleOwner, actor.UserID)
+	if db.Error != nil {
+		return unavailableError(db.Error)
+	}
+	if db.RowsAffected == 0 {
+		return nil
+	}
+	return record(tx, actor, AuditGrant, AuditGroup, groupID, roleChanges(actor.UserID, "", RoleOwner))
+}
+
+// GetGroupAdmins returns the owners and managers of the group with the specified id ordered by user id
+// If a group is not found this func returns a GroupNotFound error
+func (s *GormStore) GetGroupAdmins(id int) ([]*GroupAdmin, error) {
+	if err := s.db.Select("id").First(&Group{}, id).Error; err != nil {
+		return nil, lookupError(ErrGroupNotFound, err)
+	}
+
+	admins := []*GroupAdmin{}
+	err := s.db.Table("group_admins").Select("user_id, role").Where("group_id = ?", id).Order("user_id").Scan(&admins).Error
+	return admins, err
+}
+
+// GetGroupRole returns the role of the user in the group with the specified id, empty when it is no admin of the group
+func (s *GormStore) GetGroupRole(groupID, userID int) (string, error) {
+	var roles []string
+	err := s.db.Table("group_admins").Where("group_id = ? AND user_id = ?", groupID, userID).Pluck("role", &roles).Error
+	if err != nil || len(roles) == 0 {
+		return "", err
+	}
+	return roles[0], nil
+}
+
+// SetGroupAdmin gives the user the role in the group and increases the version of the group
+// If a group is not found this func returns a GroupNotFound error, if a user is not found a UserNotFound error
+// and if the role does not exist an ErrUnknownRole error
+func (s *GormStore) SetGroupAdmin(actor Actor, groupID, userID int, role string) error {
+	if !ValidRole(role) {
+		return ErrUnknownRole
+	}
+	return s.changeAdmin(actor, groupID, userID, role)
+}
+
+// RemoveGroupAdmin takes the role in the group from the user and increases the version of the group
+// If a group is not found this func returns a GroupNotFound error
+func (s *GormStore) RemoveGroupAdmin(actor Actor, groupID, userID int) error {
+	return s.changeAdmin(actor, groupID, userID, "")
+}
+
+// changeAdmin gives the user the role in the group, no role removes the user from the admins,
+// and increases the version of the group when the role changed
+func (s *GormStore) changeAdmin(actor Actor, groupID, userID int, role string) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		var group Group
+		if err := locked(tx, lockUpdate).First(&group, groupID).Error; err != nil {
+			return lookupError(ErrGroupNotFound, err)
+		}
+		if role != "" {
+			var user User
+			if err := locked(tx, lockShare).Select("id").First(&user, userID).Error; err != nil {
+				return lookupError(ErrUserNotFound, err)
+			}
+		}
+
+		var roles []string
+		if err := tx.Table("group_admins").Where("group_id = ? AND user_id = ?", groupID, userID).Pluck("role", &roles).Error; err != nil {
+			return unavailableError(err)
+		}
+		former := ""
+		if len(roles) > 0 {
+			former = roles[0]
+		}
+		if former == role {
+			return nil
+		}
+
+		statement, values, action := "DELETE FROM group_admins WHERE group_id = ? AND user_id = ?", []interface{}{groupID, userID}, AuditRevoke
+		switch {
+		case role != "" && former == "":
+			statement, values, action = "INSERT INTO group_admins (group_id, user_id, role) VALUES (?, ?, ?)", []interface{}{groupID, userID, role}, AuditGrant
+		case role != "":
+			statement, values, action = "UPDATE group_admins SET role = ? WHERE group_id = ? AND user_id = ?", []interface{}{role, groupID, userID}, AuditGrant
+		}
+		if err := tx.Exec(statement, values...).Error; err != nil {
+			return unavailableError(err)
+		}
+		if err := tx.Exec("UPDATE groups SET version = version + 1 WHERE id = ?", groupID).Error; err != nil {
+			return unavailableError(err)
+		}
+		return record(tx, actor, action, AuditGroup, groupID, roleChanges(userID, former, role))
+	})
+}
+
+// GetAttributes returns the attributes from the database ordered by name
+func (s *GormStore) GetAttributes() (attributes []*Attribute, err error) {
+	err = s.db.Order("name").Find(&attributes).Error
+	return
+}
+
+// PutAttribute defines an attribute or replaces the definition of the attribute with the same name
+// if the users do not match the new definition the func returns a ConstraintError of ErrAttributeConstraintViolation
+func (s *GormStore) PutAttribute(actor Actor, attribute *Attribute) (created bool, err error) {
+	err = s.transaction(func(tx *gorm.DB) error {
+		var current Attribute
+		err := locked(tx, lockUpdate).Where("name = ?", attribute.Name).First(&current).Error
+		if created = gorm.IsRecordNotFoundError(err); err != nil && !created {
+			return unavailableError(err)
+		}
+		if created {
+			current = Attribute{Name: attribute.Name, Type: attribute.Type}
+		}
+		attribute.ID = current.ID
+
+		if err := checkAttribute(tx, &current, attribute); err != nil {
+			return err
+		}
+
+		if created {
+			if err := tx.Create(attribute).Error; err != nil {
+				return storeError(ErrAttributeConstraintViolation, "", err)
+			}
+			return record(tx, actor, AuditCreate, AuditAttribute, attribute.ID, diff(nil, attributeValues(attribute)))
+		}
+
+		// the update sets the new values on the attribute, so the changes are taken before it
+		changes := diff(attributeValues(&current), attributeValues(attribute))
+		unique := current.Unique
+		values := map[string]interface{}{"type": attribute.Type, "required": attribute.Required, "is_unique": attribute.Unique, "enum_values": attribute.Enum}
+		if err := tx.Model(&current).Updates(values).Error; err != nil {
+			return storeError(ErrAttributeConstraintViolation, "", err)
+		}
+
+		// the values of users that are not deleted become unique or stop being unique
+		if attribute.Unique != unique {
+			statement := "UPDATE user_attributes SET unique_value = NULL WHERE attribute_id = ?"
+			if attribute.Unique {
+				statement = "UPDATE user_attributes SET unique_value = value WHERE attribute_id = ? AND user_id IN (SELECT id FROM users WHERE deleted_at IS NULL)"
+			}
+			if err := tx.Exec(statement, attribute.ID).Error; err != nil {
+				return storeError(ErrAttributeConstraintViolation, "", err)
+			}
+		}
+		return record(tx, actor, AuditUpdate, AuditAttribute, attribute.ID, changes)
+	})
+	return
+}
+
+// DeleteAttribute removes an attribute and its values from the database and increases the versions of the users
+// that had a value, the removed values are recorded as updates of these users
+// If the attribute is not found this func returns an ErrAttributeNotFound error
+func (s *GormStore) DeleteAttribute(actor Actor, name string) error {
+	return s.transaction(func(tx *gorm.DB) error {
+		var attribute Attribute
+		if err := locked(tx, lockUpdate).Where("name = ?", name).First(&attribute).Error; err != nil {
+			return lookupError(ErrAttributeNotFound, err)
+		}
+
+		type userValue struct {
+			UserID int
+			Value  string
+		}
+		var values []userValue
+		if err := tx.Raw("SELECT user_id, value FROM user_attributes WHERE attribute_id = ? ORDER BY user_id", attribute.ID).Scan(&values).Error; err != nil {
+			return unavailableError(err)
+		}
+		if err := tx.Exec("UPDATE users SET version = version + 1 WHERE id IN (SELECT user_id FROM user_attributes WHERE attribute_id = ?)", attribute.ID).Error; err != nil {
+			return unavailableError(err)
+		}
+		for _, v := range values {
+			changes := Changes{AttributeFieldPrefix + name: {Before: parseAttribute(attribute.Type, v.Value)}}
+			if err := record(tx, actor, AuditUpdate, AuditUser, v.UserID, changes); err != nil {
+				return err
+			}
+		}
+
+		// the values are deleted with the attribute
+		if err := tx.Delete(&attribute).Error; err != nil {
+			return unavailableError(err)
+		}
+		return record(tx, actor, AuditDelete, AuditAttribute, attribute.ID, diff(attributeValues(&attribute), nil))
+	})
+}
+
+// checkAttribute returns a ConstraintError of ErrAttributeConstraintViolation when the values of users,
+// deleted users included, do not match the definition that replaces the current definition of an attribute
+// A new attribute is given with its current definition without an id
+func checkAttribute(tx *gorm.DB, current, attribute *Attribute) error {
+	var values []string
+	if err := tx.Table("user_attributes").Where("attribute_id = ?", current.ID).Pluck("value", &values).Error; err != nil {
+		return unavailableError(err)
+	}
+	if attribute.Type != current.Type && len(values) > 0 {
+		return newConstraintError(ErrAttributeConstraintViolation, ConstraintAttributeValues)
+	}
+	for _, value := range values {
+		if !attribute.allows(value) {
+			return newConstraintError(ErrAttributeConstraintViolation, ConstraintAttributeValues)
+		}
+	}
+
+	if attribute.Required {
+		var missing int
+		err := tx.Unscoped().Model(&User{}).Where("id NOT IN (SELECT user_id FROM user_attributes WHERE attribute_id = ?)", current.ID).Count(&missing).Error
+		if err != nil {
+			return unavailableError(err)
+		}
+		if missing > 0 {
+			return newConstraintError(ErrAttributeConstraintViolation, ConstraintAttributeRequired)
+		}
+	}
+	return nil
+}
+
+// checkUserAttributes checks the attributes of a user against the attribute schema, sets them with integers as int
+// and returns the definitions of the attributes, which are locked until the transaction ends
+// If the attributes do not match the schema it returns a ValidationError
+func checkUserAttributes(tx *gorm.DB, user *User) ([]*Attribute, error) {
+	var definitions []*Attribute
+	if err := locked(tx, lockShare).Order("name").Find(&definitions).Error; err != nil {
+		return nil, unavailableError(err)
+	}
+	attributes, err := checkAttributes(definitions, user.Attributes)
+	if err != nil {
+		return nil, err
+	}
+	user.Attributes = attributes
+	return definitions, nil
+}
+
+// saveAttributes replaces the stored values of the attributes of a user that is not deleted in the transaction
+// The values of unique attributes are stored in unique_value as well, where the unique index checks them
+func saveAttributes(tx *gorm.DB, user *User, definitions []*Attribute) error {
+	if err := tx.Exec("DELETE FROM user_attributes WHERE user_id = ?", user.ID).Error; err != nil {
+		return unavailableError(err)
+	}
+	for _, definition := range definitions {
+		value, ok := user.Attributes[definition.Name]
+		if !ok {
+			continue
+		}
+
+		text := attributeText(value)
+		unique := gorm.Expr("NULL")
+		if definition.Unique {
+			unique = gorm.Expr("?", text)
+		}
+		err := tx.Exec("INSERT INTO user_attributes (user_id, attribute_id, value, unique_value) VALUES (?, ?, ?, ?)", user.ID, definition.ID, text, unique).Error
+		if err != nil {
+			return storeError(ErrUserConstraintViolation, "", err)
+		}
+	}
+	return nil
+}
+
+// GetAuditEntries returns a page of audit entries from the database and the total number of entries
+func (s *GormStore) GetAuditEntries(opts ListOptions) (entries []*AuditEntry, total int, err error) {
+	if err = AuditFields.check(&opts); err != nil {
+		return
+	}
+
+	db := filter(s.db, AuditFields, opts)
+	if err = db.Model(&AuditEntry{}).Count(&total).Error; err != nil {
+		return
+	}
+
+	if err = paginate(db, AuditFields, opts).Find(&entries).Error; err != nil {
+		return
+	}
+	if opts.Cursor != nil && opts.Cursor.Before {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+	return
+}
+
+// Search returns at most limit users and groups matching the query, best matches first
+// On PostgreSQL the trigram indexes of the pg_trgm extension find the matches,
+// other databases load every user and group and score them in Go
+func (s *GormStore) Search(query string, limit int) ([]SearchResult, error) {
+	if s.db.Dialect().GetName() != DriverPostgres {
+		users, _, err := s.GetUsers(ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		groups, _, err := s.GetGroups(ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return searchItems(query, users, groups, limit), nil
+	}
+
+	type hit struct {
+		ID    int
+		Score float64
+	}
+	pattern := "%" + escapeLike(query) + "%"
+
+	var userHits []hit
+	err := s.db.Raw(`
+SELECT id, greatest(similarity(name, ?), similarity(email, ?)) AS score FROM users
+WHERE (name % ? OR email % ? OR name ILIKE ? OR email ILIKE ?) AND deleted_at IS NULL
+ORDER BY score DESC, id LIMIT ?`, query, query, query, query, pattern, pattern, limit).Scan(&userHits).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var groupHits []hit
+	err = s.db.Raw(`
+SELECT id, similarity(name, ?) AS score FROM groups
+WHERE (name % ? OR name ILIKE ?) AND deleted_at IS NULL
+ORDER BY score DESC, id LIMIT ?`, query, query, pattern, limit).Scan(&groupHits).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// the hits are loaded with one query each for users and groups, hits deleted in the meantime are left out
+	scores := make(map[int]float64, len(userHits))
+	ids := make([]int, 0, len(userHits))
+	for _, h := range userHits {
+		scores[h.ID] = h.Score
+		ids = append(ids, h.ID)
+	}
+	users, err := s.usersByID(ids)
+	if err != nil {
+		return nil, err
+	}
+	var results []SearchResult
+	for _, user := range users {
+		results = append(results, SearchResult{Type: SearchUser, Score: scores[user.ID], User: user})
+	}
+
+	scores = make(map[int]float64, len(groupHits))
+	ids = make([]int, 0, len(groupHits))
+	for _, h := range groupHits {
+		scores[h.ID] = h.Score
+		ids = append(ids, h.ID)
+	}
+	groups, err := s.groupsByID(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		results = append(results, SearchResult{Type: SearchGroup, Score: scores[group.ID], Group: group})
+	}
+	return rankResults(results, limit), nil
+}
+
+// loadGroups sets the permissions of the given groups and the attributes of their users
+func (s *GormStore) loadGroups(groups ...*Group) error {
+	var users []*User
+	for _, group := range groups {
+		for i := range group.Users {
+			users = append(users, &group.Users[i])
+		}
+	}
+	if err := loadAttributes(s.db, users...); err != nil {
+		return err
+	}
+	return s.loadPermissions(groups...)
+}
+
+// loadAttributes sets the attributes of the given users, a user may be given more than once
+func loadAttributes(db *gorm.DB, users ...*User) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	byID := make(map[int][]*User, len(users))
+	ids := make([]int, 0, len(users))
+	for _, user := range users {
+		user.Attributes = nil
+		if byID[user.ID] == nil {
+			ids = append(ids, user.ID)
+		}
+		byID[user.ID] = append(byID[user.ID], user)
+	}
+
+	rows, err := db.Raw(`
+SELECT user_attributes.user_id, attributes.name, attributes.type, user_attributes.value FROM user_attributes
+JOIN attributes ON attributes.id = user_attributes.attribute_id
+WHERE user_attributes.user_id IN (?)`, ids).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var name, attributeType, value string
+		if err = rows.Scan(&id, &name, &attributeType, &value); err != nil {
+			return err
+		}
+		for _, user := range byID[id] {
+			if user.Attributes == nil {
+				user.Attributes = map[string]interface{}{}
+			}
+			user.Attributes[name] = parseAttribute(attributeType, value)
+		}
+	}
+	return rows.Err()
+}
+
+// loadPermissions sets the permissions of the given groups
+func (s *GormStore) loadPermissions(groups ...*Group) error {
+	if len(groups) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*Group, len(groups))
+	ids := make([]int, 0, len(groups))
+	for _, group := range groups {
+		group.Permissions = []string{}
+		byID[group.ID] = group
+		ids = append(ids, group.ID)
+	}
+
+	rows, err := s.db.Raw("SELECT group_id, permission FROM group_permissions WHERE group_id IN (?) ORDER BY permission", ids).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var permission string
+		if err = rows.Scan(&id, &permission); err != nil {
+			return err
+		}
+		byID[id].Permissions = append(byID[id].Permissions, permission)
+	}
+	return rows.Err()
+}
+
+// filter applies the filters of the options to the query
+func filter(db *gorm.DB, fields ListFields, opts ListOptions) *gorm.DB {
+	if len(opts.Filters) == 0 {
+		return db
+	}
+	condition, args := fields.filterSQL(opts.Filters)
+	return db.Where(condition, args...)
+}
+
+// paginate orders the query by the sort keys and applies the cursor, offset and limit of the options
+// A query with a before cursor is ordered in the opposite direction, its results must be reversed
+func paginate(db *gorm.DB, fields ListFields, opts ListOptions) *gorm.DB {
+	keys := sortKeys(opts.Sort)
+	if opts.Cursor != nil {
+		if opts.Cursor.Before {
+			keys = reverse(keys)
+		}
+		condition, args := fields.cursorSQL(keys, opts.Cursor.Values)
+		db = db.Where(condition, args...)
+	}
+	db = db.Order(fields.orderSQL(keys))
+
+	if opts.Offset > 0 {
+		db = db.Offset(opts.Offset)
+	}
+	if opts.Limit > 0 {
+		db = db.Limit(opts.Limit)
+	}
+	return db
+}
+
+// transaction runs fn in a database transaction, which is rolled back when fn returns an error
+// A transaction failing because of a deadlock or a concurrent transaction is run again after a growing delay
+// up to maxAttempts times, so fn must not have side effects outside of the transaction
+func (s *GormStore) transaction(fn func(tx *gorm.DB) error) (err error) {
+	for attempt := 1; ; attempt++ {
+		if err = s.attempt(fn); err == nil || !retryable(err) || attempt == maxAttempts {
+			return
+		}
+		delay := retryDelay * time.Duration(attempt)
+		time.Sleep(delay + time.Duration(rand.Int63n(int64(delay))))
+	}
+}
+
+// attempt runs fn in a single database transaction
+// Beginning or committing the transaction fails with an error matching ErrUnavailable
+func (s *GormStore) attempt(fn func(tx *gorm.DB) error) error {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return unavailableError(tx.Error)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return unavailableError(err)
+	}
+	return nil
+}
+
+// locked returns the scope of a query that locks the rows it reads until the transaction ends
+// SQLite has no row locks, it allows a single writing transaction at a time instead
+func locked(tx *gorm.DB, lock string) *gorm.DB {
+	if tx.Dialect().GetName() != DriverPostgres {
+		return tx
+	}
+	return tx.Set("gorm:query_option", lock)
+}
+
+// record writes the entry of a change to the audit log in the transaction of the change
+func record(tx *gorm.DB, actor Actor, action, entity string, id int, changes Changes) error {
+	entry := newAuditEntry(actor, action, entity, id, changes)
+	if err := tx.Create(&entry).Error; err != nil {
+		return unavailableError(err)
+	}
+	return nil
+}
+
+// byID orders the preloaded users of groups by id
+func byID(db *gorm.DB) *gorm.DB {
+	return db.Order("users.id")
+}
+
+// nullableID returns the value of a nullable reference to the given id, NULL for 0
+// gorm would write nil as the zero value of the field
+func nullableID(id int) interface{} {
+	if id == 0 {
+		return gorm.Expr("NULL")
+	}
+	return id
+}
+
+// listed returns the database scope of a list, which includes deleted rows when the options include them
+func listed(db *gorm.DB, opts ListOptions) *gorm.DB {
+	if opts.IncludeDeleted {
+		return db.Unscoped()
+	}
+	return db
+}
+
+// versioned returns the database scope of a change that requires the version, 0 requires no version
+func versioned(db *gorm.DB, version int) *gorm.DB {
+	if version == 0 {
+		return db
+	}
+	return db.Where("version = ?", version)
+}
+
+// nextVersion returns the values of an update together with the increased version
+func nextVersion(values map[string]interface{}) map[string]interface{} {
+	next := map[string]interface{}{"version": gorm.Expr("version + 1")}
+	for key, value := range values {
+		next[key] = value
+	}
+	return next
+}
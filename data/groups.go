@@ -2,8 +2,7 @@ package data
 
 import (
 	"fmt"
-
-	"github.com/jinzhu/gorm"
+	"time"
 )
 
 // ErrGroupNotFound is an error raised when a group can not be found in the database
@@ -19,71 +18,169 @@ type Group struct {
 	//
 	// required: false
 	// min: 1
-	ID int `json:"id"`
+	ID int `json:"id" validate:"min=1"`
 
 	// the name for the group
 	//
 	// required: true
 	// max length: 255
-	Name string `json:"name"`
+	Name string `json:"name" validate:"required,max=255"`
+
+	// the id of the parent group, 0 for a group without a parent
+	// the members of a group are members of its ancestors as well
+	//
+	// required: false
+	// min: 1
+	ParentID int `json:"parentID" validate:"min=1"`
+
+	// the membership rule of a dynamic group, e.g. email endsWith "@3fs.si", empty for a group with manual members
+	// the users matching the rule are the members of the group, they can neither join nor leave it by hand
+	//
+	// required: false
+	// max length: 1024
+	// swagger:strfmt rule
+	Rule string `json:"rule" validate:"max=1024,rule"`
+
+	// the version of the group, increased by every change of the group or its permissions
+	//
+	// read only: true
+	Version int `json:"version"`
+
+	// when the group was deleted, deleted groups are purged after a while and can be restored until then
+	//
+	// read only: true
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
 
 	// the list of users belonging to this group
+	// users given with a new group get it as their primary group, so their group id is not checked
 	//
 	// required: false
-	Users []User `json:"users"`
-}
+	Users []User `json:"users" gorm:"many2many:memberships" validate:"dive=groupID"`
 
-// GetGroups returns all groups from the database
-func GetGroups(db *gorm.DB) (groups []*Group) {
-	db.Preload("Users").Find(&groups)
-	return
+	// the permissions granted to the members of this group
+	//
+	// required: false
+	Permissions []string `json:"permissions" gorm:"-"`
 }
 
-// GetGroupById returns a single group with the specified id
-// If a group is not found this func returns a GroupNotFound error
-func GetGroupById(id int, db *gorm.DB) (group Group, err error) {
-	group.ID = id
-	if err = db.Preload("Users").First(&group).Error; err != nil {
-		err = ErrGroupNotFound
-	}
-	return
-}
+// GroupStore is the interface that wraps the operations for persisting groups
+// Operations return an error matching ErrUnavailable when the database can not be reached
+// Changes are recorded in the audit log as made by the given actor
+// The members of a dynamic group are the users matching its rule, deleted users included,
+// they are computed when the rule is set and whenever a user is added or updated
+type GroupStore interface {
+	// GetGroups returns the page of groups selected by the options ordered by id
+	// together with their users and permissions and the total number of groups
+	// Deleted groups are only returned when the options include them, deleted users never are
+	GetGroups(opts ListOptions) ([]*Group, int, error)
 
-// UpdateGroup replaces the set of values within the given group
-// If a group is not found this func returns a GroupNotFound error
-// if the update would make a constraint violation the func returns a ErrGroupConstraintViolation error
-func UpdateGroup(id int, groupMap map[string]interface{}, db *gorm.DB) (err error) {
-	var group Group
-	if err = db.First(&group, id).Error; err != nil {
-		err = ErrGroupNotFound
-		return
-	}
-
-	if err = db.Model(&group).Updates(groupMap).Error; err != nil {
-		err = ErrGroupConstraintViolation
-	}
-	return
-}
+	// GetGroupById returns a single group with the specified id together with its users and permissions
+	// If the group is not found or deleted it returns an ErrGroupNotFound error
+	GetGroupById(id int) (Group, error)
 
-// AddGroup adds a group to the database
-// if the group would make a constraint violation the func returns a ErrGroupConstraintViolation error
-func AddGroup(group *Group, db *gorm.DB) (err error) {
-	if err = db.Create(group).Error; err != nil {
-		err = ErrGroupConstraintViolation
-	}
-	return
-}
+	// GetGroupAncestors returns the ancestors of the group with the specified id, its parent first,
+	// together with their users and permissions
+	// If the group is not found or deleted it returns an ErrGroupNotFound error
+	GetGroupAncestors(id int) ([]*Group, error)
+
+	// GetGroupDescendants returns the descendants of the group with the specified id ordered by id
+	// together with their users and permissions
+	// If the group is not found or deleted it returns an ErrGroupNotFound error
+	GetGroupDescendants(id int) ([]*Group, error)
+
+	// GetEffectiveMembers returns the members of the group with the specified id and of its descendants ordered by id
+	// If the group is not found or deleted it returns an ErrGroupNotFound error
+	GetEffectiveMembers(id int) ([]*User, error)
+
+	// UpdateGroup replaces the set of values within the given group and increases its version
+	// If the group is not found it returns an ErrGroupNotFound error
+	// if version is not 0 and the group has another version it returns an ErrVersionMismatch error
+	// if a value can not be set it returns a ValidationError
+	// if the update would make a constraint violation it returns a ConstraintError of ErrGroupConstraintViolation
+	// that matches ErrDuplicateID, ErrDuplicateName, ErrGroupReferenced, ErrUnknownParent, ErrGroupCycle
+	// or ErrDynamicGroup when the primary group of a user gets a rule
+	// A group losing its rule keeps its members as manual members
+	UpdateGroup(actor Actor, id, version int, groupMap map[string]interface{}) error
+
+	// AddGroup adds a group, the user adding it becomes its owner
+	// The group is added at version 1 and not deleted, whatever its Version and DeletedAt are
+	// if the group would make a constraint violation it returns a ConstraintError of ErrGroupConstraintViolation,
+	// a dynamic group given with users returns one that matches ErrDynamicGroup
+	AddGroup(actor Actor, group *Group) error
+
+	// DeleteGroup marks a group as deleted and increases its version,
+	// when cascade is true its descendants are deleted with it
+	// If the group is not found or already deleted it returns an ErrGroupNotFound error
+	// if version is not 0 and the group has another version it returns an ErrVersionMismatch error
+	// if members that are not deleted still belong to a deleted group it returns a ConstraintError of ErrGroupConstraintViolation
+	// that matches ErrGroupReferenced, without cascade a group with child groups returns one that matches ErrGroupHasChildren
+	// The members of a deleted dynamic group are removed from it and computed again when it is restored
+	DeleteGroup(actor Actor, id, version int, cascade bool) error
+
+	// RestoreGroup restores a deleted group and increases its version, restoring a group that is not deleted has no effect
+	// its descendants stay deleted
+	// If the group is not found it returns an ErrGroupNotFound error
+	// if its name has been taken or its parent deleted in the meantime it returns a ConstraintError of ErrGroupConstraintViolation
+	// that matches ErrDuplicateName or ErrUnknownParent
+	RestoreGroup(actor Actor, id int) error
+
+	// PurgeGroups removes the groups deleted before the given time for good and returns how many were removed,
+	// groups that users still belong to are kept until the users are purged and parents are kept until their children are purged,
+	// the purges are recorded as made by the system
+	PurgeGroups(before time.Time) (int, error)
+
+	// GetGroupPermissions returns the permissions granted to the group with the specified id
+	// If the group is not found it returns an ErrGroupNotFound error
+	GetGroupPermissions(id int) ([]string, error)
+
+	// GetUserPermissions returns the permissions granted to the groups that the user with the specified id belongs to
+	// and to their ancestors, deleted groups grant no permissions
+	GetUserPermissions(userID int) ([]string, error)
+
+	// GetUserGroups returns the groups that the user with the specified id belongs to ordered by id
+	// together with their users and permissions
+	// If the user is not found or deleted it returns an ErrUserNotFound error
+	GetUserGroups(userID int) ([]*Group, error)
+
+	// AddMember adds the user to the group, adding a member again has no effect
+	// If the group is not found it returns an ErrGroupNotFound error, if the user is not found an ErrUserNotFound error
+	// and if the group is dynamic an ErrDynamicGroup error
+	AddMember(actor Actor, groupID, userID int) error
+
+	// RemoveMember removes the user from the group, removing a user that is not a member has no effect
+	// A user leaving its primary group is left without a primary group and its version is increased
+	// If the group is not found it returns an ErrGroupNotFound error, if the user is not found an ErrUserNotFound error
+	// and if the group is dynamic an ErrDynamicGroup error
+	RemoveMember(actor Actor, groupID, userID int) error
+
+	// PreviewRule returns the users that are not deleted and match the rule ordered by id,
+	// the members a dynamic group with the rule would have
+	// If the rule can not be parsed it returns an error matching ErrInvalidRule
+	PreviewRule(rule string) ([]*User, error)
+
+	// GrantPermission grants the permission to the group, granting it again has no effect
+	// If the group is not found it returns an ErrGroupNotFound error
+	GrantPermission(actor Actor, id int, permission string) error
+
+	// RevokePermission revokes the permission from the group, revoking it again has no effect
+	// If the group is not found it returns an ErrGroupNotFound error
+	RevokePermission(actor Actor, id int, permission string) error
+
+	// GetGroupAdmins returns the owners and managers of the group with the specified id ordered by user id
+	// If the group is not found or deleted it returns an ErrGroupNotFound error
+	GetGroupAdmins(id int) ([]*GroupAdmin, error)
+
+	// GetGroupRole returns the role of the user in the group with the specified id, empty when the user is no admin of it
+	GetGroupRole(groupID, userID int) (string, error)
+
+	// SetGroupAdmin gives the user the role in the group and increases the version of the group,
+	// giving the same role again has no effect
+	// If the group is not found or deleted it returns an ErrGroupNotFound error, if the user is not found or deleted
+	// an ErrUserNotFound error and if the role does not exist an ErrUnknownRole error
+	SetGroupAdmin(actor Actor, groupID, userID int, role string) error
 
-// DeleteGroup deletes a group from the database
-// if the deletion of the group would make a constraint violation the func returns a ErrGroupConstraintViolation error
-func DeleteGroup(id int, db *gorm.DB) (err error) {
-	var group Group
-	if err = db.First(&group, id).Error; err != nil {
-		err = ErrGroupNotFound
-		return
-	}
-	if err = db.Delete(&group).Error; err != nil {
-		err = ErrGroupConstraintViolation
-	}
-	return
+	// RemoveGroupAdmin takes the role in the group from the user and increases the version of the group,
+	// removing a user that is no admin has no effect
+	// If the group is not found or deleted it returns an ErrGroupNotFound error
+	RemoveGroupAdmin(actor Actor, groupID, userID int) error
 }
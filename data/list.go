@@ -0,0 +1,400 @@
+package data
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrInvalidListOption is an error raised when a list is filtered or sorted by an unknown field,
+// with an unsupported operator or an invalid value, or when a cursor does not match the sort
+var ErrInvalidListOption = fmt.Errorf("invalid list option")
+
+// Filter operators
+const (
+	// OpEq selects the items with a field equal to the value
+	OpEq = "eq"
+
+	// OpPrefix selects the items with a field starting with the value
+	OpPrefix = "prefix"
+
+	// OpDomain selects the items with an email address at the domain of the value
+	OpDomain = "domain"
+
+	// OpFrom selects the items with a time at or after the RFC 3339 time of the value
+	OpFrom = "from"
+
+	// OpTo selects the items with a time before the RFC 3339 time of the value
+	OpTo = "to"
+)
+
+// ListOptions select the page of a list that is returned
+type ListOptions struct {
+	// Limit is the maximum number of items returned, 0 returns all items
+	Limit int
+
+	// Offset is the number of items skipped
+	Offset int
+
+	// Cursor selects the items after or before an item, it is applied before Offset
+	Cursor *Cursor
+
+	// Sort orders the items, items with equal values are ordered by id
+	Sort []SortKey
+
+	// Filters select the items of the list, an item has to match every filter
+	Filters []Filter
+
+	// IncludeDeleted lists deleted items together with the others
+	IncludeDeleted bool
+}
+
+// SortKey orders a list by a field
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// Filter selects the items of a list by the value of a field
+type Filter struct {
+	Field string
+	Op    string
+	Value string
+}
+
+// Cursor is a position in a list between two items
+type Cursor struct {
+	// Values are the values of the sort fields of the item next to the position,
+	// the last value is its id
+	Values []interface{} `json:"v"`
+
+	// Before selects the items before the item instead of the items after it
+	Before bool `json:"b,omitempty"`
+}
+
+// ListField is a field a list can be filtered and sorted by
+// Time fields can only be filtered by a time range, lists are not sorted by them
+// Attribute fields are the custom attributes of users, lists are not sorted by them either
+type ListField struct {
+	column    string
+	numeric   bool
+	time      bool
+	attribute bool
+	ops       []string
+}
+
+// ListFields are the fields a list can be filtered and sorted by, keyed by their JSON name
+type ListFields map[string]ListField
+
+// UserFields are the fields the list of users can be filtered and sorted by
+var UserFields = ListFields{
+	"id":      {column: "id", numeric: true, ops: []string{OpEq}},
+	"name":    {column: "name", ops: []string{OpEq, OpPrefix}},
+	"email":   {column: "email", ops: []string{OpEq, OpPrefix, OpDomain}},
+	"groupID": {column: "group_id", numeric: true, ops: []string{OpEq}},
+}
+
+// GroupFields are the fields the list of groups can be filtered and sorted by
+var GroupFields = ListFields{
+	"id":   {column: "id", numeric: true, ops: []string{OpEq}},
+	"name": {column: "name", ops: []string{OpEq, OpPrefix}},
+}
+
+// listItem is an item of a list
+type listItem interface {
+	// listValue returns the value of the field with the given JSON name
+	listValue(field string) interface{}
+}
+
+func (u *User) listValue(field string) interface{} {
+	if name := strings.TrimPrefix(field, AttributeFieldPrefix); name != field {
+		// booleans are filtered by their text, a missing attribute matches no filter
+		if b, ok := u.Attributes[name].(bool); ok {
+			return strconv.FormatBool(b)
+		}
+		return u.Attributes[name]
+	}
+
+	switch field {
+	case "name":
+		return u.Name
+	case "email":
+		return u.Email
+	case "groupID":
+		return u.GroupID
+	}
+	return u.ID
+}
+
+func (g *Group) listValue(field string) interface{} {
+	if field == "name" {
+		return g.Name
+	}
+	return g.ID
+}
+
+// UserCursor returns the cursor after the user in a list sorted by the sort keys
+func UserCursor(u *User, sort []SortKey) Cursor {
+	return newCursor(u, sort)
+}
+
+// GroupCursor returns the cursor after the group in a list sorted by the sort keys
+func GroupCursor(g *Group, sort []SortKey) Cursor {
+	return newCursor(g, sort)
+}
+
+func newCursor(item listItem, sort []SortKey) Cursor {
+	var cursor Cursor
+	for _, key := range sortKeys(sort) {
+		cursor.Values = append(cursor.Values, item.listValue(key.Field))
+	}
+	return cursor
+}
+
+// check validates the sort keys, filters and cursor of the options
+// Numeric cursor values decoded from JSON are converted to int
+func (f ListFields) check(opts *ListOptions) error {
+	seen := map[string]bool{}
+	for _, key := range opts.Sort {
+		if field, ok := f[key.Field]; !ok || field.time || field.attribute {
+			return fmt.Errorf("%w: unknown sort field %q", ErrInvalidListOption, key.Field)
+		}
+		if seen[key.Field] {
+			return fmt.Errorf("%w: duplicate sort field %q", ErrInvalidListOption, key.Field)
+		}
+		seen[key.Field] = true
+	}
+
+	for _, filter := range opts.Filters {
+		field, ok := f[filter.Field]
+		if !ok {
+			return fmt.Errorf("%w: unknown filter field %q", ErrInvalidListOption, filter.Field)
+		}
+		if !field.supports(filter.Op) {
+			return fmt.Errorf("%w: unsupported operator %q for field %q", ErrInvalidListOption, filter.Op, filter.Field)
+		}
+		if _, err := strconv.Atoi(filter.Value); field.numeric && err != nil {
+			return fmt.Errorf("%w: invalid value %q for field %q", ErrInvalidListOption, filter.Value, filter.Field)
+		}
+		if _, err := time.Parse(time.RFC3339, filter.Value); field.time && err != nil {
+			return fmt.Errorf("%w: invalid value %q for field %q", ErrInvalidListOption, filter.Value, filter.Field)
+		}
+	}
+
+	if opts.Cursor == nil {
+		return nil
+	}
+	keys := sortKeys(opts.Sort)
+	if len(opts.Cursor.Values) != len(keys) {
+		return fmt.Errorf("%w: cursor does not match the sort", ErrInvalidListOption)
+	}
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		switch v := opts.Cursor.Values[i].(type) {
+		case string:
+			if f[key.Field].numeric {
+				return fmt.Errorf("%w: cursor does not match the sort", ErrInvalidListOption)
+			}
+			values[i] = v
+		case float64:
+			if !f[key.Field].numeric || v != float64(int(v)) {
+				return fmt.Errorf("%w: cursor does not match the sort", ErrInvalidListOption)
+			}
+			values[i] = int(v)
+		case int:
+			if !f[key.Field].numeric {
+				return fmt.Errorf("%w: cursor does not match the sort", ErrInvalidListOption)
+			}
+			values[i] = v
+		default:
+			return fmt.Errorf("%w: cursor does not match the sort", ErrInvalidListOption)
+		}
+	}
+	opts.Cursor = &Cursor{Values: values, Before: opts.Cursor.Before}
+	return nil
+}
+
+func (f ListField) supports(op string) bool {
+	for _, supported := range f.ops {
+		if op == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// sortKeys returns the sort keys up to the id, the id is appended when it is missing
+// so that the order of the items is unique
+func sortKeys(sort []SortKey) []SortKey {
+	keys := []SortKey{}
+	for _, key := range sort {
+		keys = append(keys, key)
+		if key.Field == "id" {
+			return keys
+		}
+	}
+	return append(keys, SortKey{Field: "id"})
+}
+
+// matches reports whether the item matches every filter
+func (f ListFields) matches(item listItem, filters []Filter) bool {
+	for _, filter := range filters {
+		value := item.listValue(filter.Field)
+		if f[filter.Field].numeric {
+			n, _ := strconv.Atoi(filter.Value)
+			if value != n {
+				return false
+			}
+			continue
+		}
+		if f[filter.Field].time {
+			t, _ := time.Parse(time.RFC3339, filter.Value)
+			if filter.Op == OpFrom && value.(time.Time).Before(t) || filter.Op == OpTo && !value.(time.Time).Before(t) {
+				return false
+			}
+			continue
+		}
+
+		s, ok := value.(string)
+		if !ok {
+			return false
+		}
+		switch filter.Op {
+		case OpEq:
+			if s != filter.Value {
+				return false
+			}
+		case OpPrefix:
+			if !strings.HasPrefix(s, filter.Value) {
+				return false
+			}
+		case OpDomain:
+			if !strings.HasSuffix(strings.ToLower(s), "@"+strings.ToLower(filter.Value)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compareValues compares two values of the same field, it returns -1, 0 or 1
+func compareValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case int:
+		b := b.(int)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+	return 0
+}
+
+// compareItems compares two items by the sort keys, it returns -1, 0 or 1
+func compareItems(a, b listItem, keys []SortKey) int {
+	return compareCursor(a, newCursor(b, keys).Values, keys)
+}
+
+// compareCursor compares an item with the values of a cursor by the sort keys, it returns -1, 0 or 1
+func compareCursor(item listItem, values []interface{}, keys []SortKey) int {
+	for i, key := range keys {
+		c := compareValues(item.listValue(key.Field), values[i])
+		if key.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// filterSQL returns the SQL condition and arguments of the filters
+func (f ListFields) filterSQL(filters []Filter) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	for _, filter := range filters {
+		column := f[filter.Field].column
+		switch filter.Op {
+		case OpEq:
+			conditions = append(conditions, column+" = ?")
+			if f[filter.Field].numeric {
+				n, _ := strconv.Atoi(filter.Value)
+				args = append(args, n)
+			} else {
+				args = append(args, filter.Value)
+			}
+		case OpPrefix:
+			// substr instead of LIKE, which ignores case in SQLite but not in PostgreSQL
+			conditions = append(conditions, "substr("+column+", 1, ?) = ?")
+			args = append(args, utf8.RuneCountInString(filter.Value), filter.Value)
+		case OpDomain:
+			conditions = append(conditions, "lower("+column+") LIKE ? ESCAPE '\\'")
+			args = append(args, "%@"+escapeLike(strings.ToLower(filter.Value)))
+		case OpFrom, OpTo:
+			// times are stored in UTC, which keeps their text in SQLite in order
+			t, _ := time.Parse(time.RFC3339, filter.Value)
+			op := " >= ?"
+			if filter.Op == OpTo {
+				op = " < ?"
+			}
+			conditions = append(conditions, column+op)
+			args = append(args, t.UTC())
+		}
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// cursorSQL returns the SQL condition and arguments selecting the items after the cursor
+// in the order of the sort keys
+func (f ListFields) cursorSQL(keys []SortKey, values []interface{}) (string, []interface{}) {
+	var alternatives []string
+	var args []interface{}
+	for i, key := range keys {
+		var conditions []string
+		for j := 0; j < i; j++ {
+			conditions = append(conditions, f[keys[j].Field].column+" = ?")
+			args = append(args, values[j])
+		}
+		op := " > ?"
+		if key.Desc {
+			op = " < ?"
+		}
+		conditions = append(conditions, f[key.Field].column+op)
+		args = append(args, values[i])
+		alternatives = append(alternatives, "("+strings.Join(conditions, " AND ")+")")
+	}
+	return strings.Join(alternatives, " OR "), args
+}
+
+// orderSQL returns the SQL order of the sort keys
+func (f ListFields) orderSQL(keys []SortKey) string {
+	order := make([]string, len(keys))
+	for i, key := range keys {
+		order[i] = f[key.Field].column
+		if key.Desc {
+			order[i] += " DESC"
+		}
+	}
+	return strings.Join(order, ", ")
+}
+
+// reverse returns the sort keys in the opposite direction
+func reverse(keys []SortKey) []SortKey {
+	reversed := make([]SortKey, len(keys))
+	for i, key := range keys {
+		reversed[i] = SortKey{Field: key.Field, Desc: !key.Desc}
+	}
+	return reversed
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,1336 @@
+package data
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MemoryStore is a UserStore, GroupStore and AttributeStore that keeps all users, groups and attributes in memory
+// It is safe for concurrent use and enforces the same constraints as the database schema:
+// unique user names, unique user emails, unique group names, the groups of a user must exist,
+// unique attribute values and names, emails and passwords are at most 255 characters long
+// Deleted users and groups stay in the store with their DeletedAt time set until they are purged
+// Every operation holds the lock from its first read to its last write, so operations never interleave
+// and every change is appended to the audit log under the same lock
+type MemoryStore struct {
+	mu          sync.RWMutex
+	users       map[int]User
+	groups      map[int]Group
+	memberships map[membership]bool
+	admins      map[membership]string
+	attributes  map[string]Attribute
+	audit       []AuditEntry
+	nextUserID  int
+	nextGroupID int
+
+	nextAttributeID int
+}
+
+// membership is a user belonging to a group or administering it
+type membership struct {
+	userID  int
+	groupID int
+}
+
+// NewMemoryStore returns a new empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:       make(map[int]User),
+		groups:      make(map[int]Group),
+		memberships: make(map[membership]bool),
+		admins:      make(map[membership]string),
+		attributes:  make(map[string]Attribute),
+		nextUserID:  1,
+		nextGroupID: 1,
+
+		nextAttributeID: 1,
+	}
+}
+
+// GetUsers returns a page of the users matching the filters of the options
+// and the total number of matching users
+func (s *MemoryStore) GetUsers(opts ListOptions) ([]*User, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fields := userFields(s.sortedAttributes())
+	if err := fields.check(&opts); err != nil {
+		return nil, 0, err
+	}
+
+	items := make([]listItem, 0, len(s.users))
+	for _, user := range s.users {
+		user := user
+		if user.DeletedAt == nil || opts.IncludeDeleted {
+			items = append(items, &user)
+		}
+	}
+
+	page, total := list(fields, items, opts)
+	users := make([]*User, len(page))
+	for i, item := range page {
+		users[i] = item.(*User)
+	}
+	return users, total, nil
+}
+
+// GetUserById returns a single user with the specified id
+// If the user is not found this func retuns UserNotFound error
+func (s *MemoryStore) GetUserById(id int) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[id]
+	if !ok || user.DeletedAt != nil {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// GetUserByName returns a single user with the specified name
+// If the user is not found this func retuns UserNotFound error
+func (s *MemoryStore) GetUserByName(name string) (User, error) {
+	return s.findUser(func(user User) bool { return user.Name == name })
+}
+
+// GetUserByEmail returns a single user with the specified email
+// If the user is not found this func retuns UserNotFound error
+func (s *MemoryStore) GetUserByEmail(email string) (User, error) {
+	return s.findUser(func(user User) bool { return user.Email == email })
+}
+
+// UpdateUser replaces the set of values within the given user and increases its version
+// If a user is not found this func returns a UserNotFound error
+// if version is not 0 and the user has another version the func returns an ErrVersionMismatch error
+// if the update would make a constraint violation the func returns a ConstraintError of ErrUserConstraintViolation
+func (s *MemoryStore) UpdateUser(actor Actor, id, version int, userMap map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.updateUser(actor, id, version, userMap)
+}
+
+// updateUser updates a user while the write lock is held, see UpdateUser
+func (s *MemoryStore) updateUser(actor Actor, id, version int, userMap map[string]interface{}) error {
+	user, ok := s.users[id]
+	if !ok || user.DeletedAt != nil {
+		return ErrUserNotFound
+	}
+	if version != 0 && user.Version != version {
+		return ErrVersionMismatch
+	}
+	before := user
+	user.Version++
+
+	if err := setUserFields(&user, userMap); err != nil {
+		return err
+	}
+	attributes, err := checkAttributes(s.sortedAttributes(), user.Attributes)
+	if err != nil {
+		return err
+	}
+	user.Attributes = attributes
+
+	if err := s.checkUser(id, user); err != nil {
+		return err
+	}
+
+	delete(s.users, id)
+	s.users[user.ID] = user
+
+	// the memberships and roles follow a changed id and the user leaves its former primary group
+	for m := range s.memberships {
+		if m.userID == id && user.ID != id {
+			delete(s.memberships, m)
+			s.memberships[membership{user.ID, m.groupID}] = true
+		}
+	}
+	for m, role := range s.admins {
+		if m.userID == id && user.ID != id {
+			delete(s.admins, m)
+			s.admins[membership{user.ID, m.groupID}] = role
+		}
+	}
+	if user.GroupID != before.GroupID {
+		delete(s.memberships, membership{user.ID, before.GroupID})
+		s.addMembership(user)
+	}
+	s.record(actor, AuditUpdate, AuditUser, id, diff(userValues(&before), userValues(&user)))
+	s.syncRules(actor, user)
+	return nil
+}
+
+// AddUser adds a user to the store with version 1 and sets its id
+// if the user would make a constraint violation the func returns a ConstraintError of ErrUserConstraintViolation
+func (s *MemoryStore) AddUser(actor Actor, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addUser(actor, user)
+}
+
+// DeleteUser marks an user as deleted and increases its version
+// if version is not 0 and the user has another version the func returns an ErrVersionMismatch error
+func (s *MemoryStore) DeleteUser(actor Actor, id, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.deleteUser(actor, id, version)
+}
+
+// deleteUser deletes a user while the write lock is held, see DeleteUser
+func (s *MemoryStore) deleteUser(actor Actor, id, version int) error {
+	user, ok := s.users[id]
+	if !ok || user.DeletedAt != nil {
+		return ErrUserNotFound
+	}
+	if version != 0 && user.Version != version {
+		return ErrVersionMismatch
+	}
+
+	now := time.Now().UTC()
+	user.DeletedAt = &now
+	user.Version++
+	s.users[id] = user
+	s.record(actor, AuditDelete, AuditUser, id, Changes{"deletedAt": {After: user.DeletedAt}})
+	return nil
+}
+
+// ApplyUsers runs the operations in order and returns the error of every operation, nil when it succeeded
+// A failed atomic batch is rolled back by restoring the users, their memberships, roles and the audit log from before the batch
+func (s *MemoryStore) ApplyUsers(actor Actor, ops []UserOperation, atomic bool) []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make(map[int]User, len(s.users))
+	for id, user := range s.users {
+		users[id] = user
+	}
+	memberships := make(map[membership]bool, len(s.memberships))
+	for m := range s.memberships {
+		memberships[m] = true
+	}
+	admins := make(map[membership]string, len(s.admins))
+	for m, role := range s.admins {
+		admins[m] = role
+	}
+	nextUserID, recorded := s.nextUserID, len(s.audit)
+
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		switch op.Op {
+		case BatchCreate:
+			errs[i] = s.addUser(actor, op.User)
+		case BatchUpdate:
+			errs[i] = s.updateUser(actor, op.ID, op.Version, op.Values)
+		case BatchDelete:
+			errs[i] = s.deleteUser(actor, op.ID, op.Version)
+		default:
+			errs[i] = ErrUnknownOperation
+		}
+
+		if errs[i] != nil && atomic {
+			s.users, s.memberships, s.admins, s.nextUserID, s.audit = users, memberships, admins, nextUserID, s.audit[:recorded]
+			return abortBatch(errs, errs[i])
+		}
+	}
+	return errs
+}
+
+// RestoreUser restores a deleted user and increases its version
+// If a user is not found this func returns a UserNotFound error
+// if the user would make a constraint violation the func returns a ConstraintError of ErrUserConstraintViolation
+func (s *MemoryStore) RestoreUser(actor Actor, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if user.DeletedAt == nil {
+		return nil
+	}
+
+	deletedAt := user.DeletedAt
+	user.DeletedAt = nil
+	user.Version++
+	if err := s.checkUser(id, user); err != nil {
+		return err
+	}
+	s.users[id] = user
+	s.record(actor, AuditRestore, AuditUser, id, Changes{"deletedAt": {Before: deletedAt}})
+	return nil
+}
+
+// PurgeUsers removes the users deleted before the given time from the store
+func (s *MemoryStore) PurgeUsers(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for id, user := range s.users {
+		if user.DeletedAt != nil && user.DeletedAt.Before(before) {
+			delete(s.users, id)
+			for m := range s.memberships {
+				if m.userID == id {
+					delete(s.memberships, m)
+				}
+			}
+			for m := range s.admins {
+				if m.userID == id {
+					delete(s.admins, m)
+				}
+			}
+			s.record(System, AuditPurge, AuditUser, id, diff(userValues(&user), nil))
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// GetGroups returns a page of the groups matching the filters of the options together with their users
+// and the total number of matching groups
+func (s *MemoryStore) GetGroups(opts ListOptions) ([]*Group, int, error) {
+	if err := GroupFields.check(&opts); err != nil {
+		return nil, 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	items := make([]listItem, 0, len(s.groups))
+	for _, group := range s.groups {
+		group := group
+		if group.DeletedAt == nil || opts.IncludeDeleted {
+			items = append(items, &group)
+		}
+	}
+
+	page, total := list(GroupFields, items, opts)
+	groups := make([]*Group, len(page))
+	for i, item := range page {
+		group := s.groupWithUsers(item.(*Group).ID)
+		groups[i] = &group
+	}
+	return groups, total, nil
+}
+
+// GetGroupById returns a single group with the specified id together with its users
+// If a group is not found this func returns a GroupNotFound error
+func (s *MemoryStore) GetGroupById(id int) (Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if group, ok := s.groups[id]; !ok || group.DeletedAt != nil {
+		return Group{}, ErrGroupNotFound
+	}
+	return s.groupWithUsers(id), nil
+}
+
+// UpdateGroup replaces the set of values within the given group and increases its version
+// If a group is not found this func returns a GroupNotFound error
+// if version is not 0 and the group has another version the func returns an ErrVersionMismatch error
+// if the update would make a constraint violation the func returns a ConstraintError of ErrGroupConstraintViolation
+func (s *MemoryStore) UpdateGroup(actor Actor, id, version int, groupMap map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, ok := s.groups[id]
+	if !ok || group.DeletedAt != nil {
+		return ErrGroupNotFound
+	}
+	if version != 0 && group.Version != version {
+		return ErrVersionMismatch
+	}
+	before := group
+	group.Version++
+
+	if err := setGroupFields(&group, groupMap); err != nil {
+		return err
+	}
+
+	if err := s.checkGroup(id, group); err != nil {
+		return err
+	}
+	if err := s.checkParent(id, group.ID, group.ParentID); err != nil {
+		return err
+	}
+	rule, err := s.checkRule(id, before.Rule, group.Rule)
+	if err != nil {
+		return err
+	}
+
+	// the id of a group can only change while no user references it, not even a deleted one
+	if group.ID != id && s.groupReferenced(id, true) {
+		return newConstraintError(ErrGroupConstraintViolation, ConstraintUserGroup)
+	}
+
+	delete(s.groups, id)
+	s.groups[group.ID] = group
+
+	// the children and admins follow a changed id of their group
+	for childID, child := range s.groups {
+		if child.ParentID == id && group.ID != id {
+			child.ParentID = group.ID
+			s.groups[childID] = child
+		}
+	}
+	for m, role := range s.admins {
+		if m.groupID == id && group.ID != id {
+			delete(s.admins, m)
+			s.admins[membership{m.userID, group.ID}] = role
+		}
+	}
+	s.record(actor, AuditUpdate, AuditGroup, id, diff(groupValues(&before), groupValues(&group)))
+
+	// a group losing its rule keeps its members
+	if group.Rule != before.Rule && rule != nil {
+		s.syncRule(actor, group.ID, rule)
+	}
+	return nil
+}
+
+// AddGroup adds a group to the store with version 1 and sets its id
+// Users given with the group are added with the new group as their primary group
+// if the group would make a constraint violation the func returns a ConstraintError of ErrGroupConstraintViolation
+func (s *MemoryStore) AddGroup(actor Actor, group *Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := group.ID
+	if id == 0 {
+		id = s.nextID(&s.nextGroupID, func(id int) bool { _, ok := s.groups[id]; return ok })
+	}
+
+	stored := Group{ID: id, Name: group.Name, ParentID: group.ParentID, Rule: group.Rule, Version: 1, Permissions: []string{}}
+	if err := s.checkGroup(0, stored); err != nil {
+		return err
+	}
+	if err := s.checkParent(0, id, stored.ParentID); err != nil {
+		return err
+	}
+	rule, err := s.checkRule(0, "", stored.Rule)
+	if err != nil {
+		return err
+	}
+	if rule != nil && len(group.Users) > 0 {
+		return newConstraintError(ErrGroupConstraintViolation, ConstraintDynamicGroup)
+	}
+	s.groups[id] = stored
+	recorded := len(s.audit)
+	s.record(actor, AuditCreate, AuditGroup, id, diff(nil, groupValues(&stored)))
+
+	// the system owns no group
+	if owner, ok := s.users[actor.UserID]; ok && owner.DeletedAt == nil {
+		s.admins[membership{actor.UserID, id}] = RoleOwner
+		s.record(actor, AuditGrant, AuditGroup, id, roleChanges(actor.UserID, "", RoleOwner))
+	}
+	if rule != nil {
+		s.syncRule(actor, id, rule)
+	}
+
+	// add the users of the group, removing everything again if one of them fails
+	for i := range group.Users {
+		group.Users[i].GroupID = id
+		if err := s.addUser(actor, &group.Users[i]); err != nil {
+			for _, added := range group.Users[:i] {
+				delete(s.users, added.ID)
+				delete(s.memberships, membership{added.ID, id})
+			}
+			delete(s.groups, id)
+			delete(s.admins, membership{actor.UserID, id})
+			s.audit = s.audit[:recorded]
+			var constraintErr *ConstraintError
+			if !errors.As(err, &constraintErr) {
+				return err
+			}
+			return newConstraintError(ErrGroupConstraintViolation, constraintErr.Constraint)
+		}
+	}
+
+	group.ID = id
+	group.Version = 1
+	group.DeletedAt = nil
+	return nil
+}
+
+// DeleteGroup marks a group as deleted and increases its version, with cascade its descendants are deleted with it
+// if version is not 0 and the group has another version the func returns an ErrVersionMismatch error
+// if users that are not deleted belong to a deleted group or the group has children without cascade
+// the func returns a ConstraintError of ErrGroupConstraintViolation
+func (s *MemoryStore) DeleteGroup(actor Actor, id, version int, cascade bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, ok := s.groups[id]
+	if !ok || group.DeletedAt != nil {
+		return ErrGroupNotFound
+	}
+	if version != 0 && group.Version != version {
+		return ErrVersionMismatch
+	}
+	descendants := s.descendants(id)
+	if len(descendants) > 0 && !cascade {
+		return &ConstraintError{Err: ErrGroupConstraintViolation, Constraint: ConstraintGroupParent, Reason: ErrGroupHasChildren}
+	}
+	// the members of dynamic groups do not guard them, they are computed again when a group is restored
+	for _, groupID := range append([]int{id}, descendants...) {
+		if s.groups[groupID].Rule == "" && s.groupReferenced(groupID, false) {
+			return newConstraintError(ErrGroupConstraintViolation, ConstraintUserGroup)
+		}
+	}
+
+	now := time.Now().UTC()
+	for _, groupID := range append([]int{id}, descendants...) {
+		group := s.groups[groupID]
+		for m := range s.memberships {
+			if m.groupID == groupID && group.Rule != "" {
+				delete(s.memberships, m)
+			}
+		}
+		group.DeletedAt = &now
+		group.Version++
+		s.groups[groupID] = group
+		s.record(actor, AuditDelete, AuditGroup, groupID, Changes{"deletedAt": {After: group.DeletedAt}})
+	}
+	return nil
+}
+
+// RestoreGroup restores a deleted group and increases its version
+// If a group is not found this func returns a GroupNotFound error
+// if the group would make a constraint violation the func returns a ConstraintError of ErrGroupConstraintViolation
+func (s *MemoryStore) RestoreGroup(actor Actor, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, ok := s.groups[id]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	if group.DeletedAt == nil {
+		return nil
+	}
+
+	deletedAt := group.DeletedAt
+	group.DeletedAt = nil
+	group.Version++
+	if err := s.checkGroup(id, group); err != nil {
+		return err
+	}
+	if err := s.checkParent(id, id, group.ParentID); err != nil {
+		return err
+	}
+	s.groups[id] = group
+	s.record(actor, AuditRestore, AuditGroup, id, Changes{"deletedAt": {Before: deletedAt}})
+	if rule, err := ParseRule(group.Rule); err == nil {
+		s.syncRule(actor, id, rule)
+	}
+	return nil
+}
+
+// PurgeGroups removes the groups deleted before the given time from the store
+// unless users still belong to them or they have children, the groups are purged from the leaves up
+func (s *MemoryStore) PurgeGroups(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parents := make(map[int]int)
+	for _, group := range s.groups {
+		parents[group.ParentID]++
+	}
+
+	purged := 0
+	for removed := true; removed; {
+		removed = false
+		for id, group := range s.groups {
+			if group.DeletedAt != nil && group.DeletedAt.Before(before) && parents[id] == 0 && !s.groupReferenced(id, true) {
+				delete(s.groups, id)
+				for m := range s.admins {
+					if m.groupID == id {
+						delete(s.admins, m)
+					}
+				}
+				parents[group.ParentID]--
+				s.record(System, AuditPurge, AuditGroup, id, diff(groupValues(&group), nil))
+				purged++
+				removed = true
+			}
+		}
+	}
+	return purged, nil
+}
+
+// GetGroupAncestors returns the ancestors of the group with the specified id, its parent first
+// If a group is not found this func returns a GroupNotFound error
+func (s *MemoryStore) GetGroupAncestors(id int) ([]*Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	group, ok := s.groups[id]
+	if !ok || group.DeletedAt != nil {
+		return nil, ErrGroupNotFound
+	}
+
+	groups := []*Group{}
+	for parentID := group.ParentID; parentID != 0; parentID = s.groups[parentID].ParentID {
+		parent := s.groupWithUsers(parentID)
+		groups = append(groups, &parent)
+	}
+	return groups, nil
+}
+
+// GetGroupDescendants returns the descendants of the group with the specified id ordered by id
+// If a group is not found this func returns a GroupNotFound error
+func (s *MemoryStore) GetGroupDescendants(id int) ([]*Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if group, ok := s.groups[id]; !ok || group.DeletedAt != nil {
+		return nil, ErrGroupNotFound
+	}
+
+	groups := []*Group{}
+	for _, descendantID := range s.descendants(id) {
+		descendant := s.groupWithUsers(descendantID)
+		groups = append(groups, &descendant)
+	}
+	return groups, nil
+}
+
+// GetEffectiveMembers returns the users that belong to the group with the specified id or to its descendants
+// If a group is not found this func returns a GroupNotFound error
+func (s *MemoryStore) GetEffectiveMembers(id int) ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if group, ok := s.groups[id]; !ok || group.DeletedAt != nil {
+		return nil, ErrGroupNotFound
+	}
+
+	groupIDs := append([]int{id}, s.descendants(id)...)
+	users := []*User{}
+	for _, user := range s.sortedUsers() {
+		if user.DeletedAt != nil {
+			continue
+		}
+		for _, groupID := range groupIDs {
+			if s.memberships[membership{user.ID, groupID}] {
+				user := user
+				users = append(users, &user)
+				break
+			}
+		}
+	}
+	return users, nil
+}
+
+// Search returns at most limit users and groups matching the query, best matches first
+func (s *MemoryStore) Search(query string, limit int) ([]SearchResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var users []*User
+	for _, user := range s.sortedUsers() {
+		user := user
+		if user.DeletedAt == nil {
+			users = append(users, &user)
+		}
+	}
+
+	var groups []*Group
+	for id, group := range s.groups {
+		if group.DeletedAt != nil {
+			continue
+		}
+		group := s.groupWithUsers(id)
+		groups = append(groups, &group)
+	}
+	return searchItems(query, users, groups, limit), nil
+}
+
+// GetAuditEntries returns a page of the audit entries matching the filters of the options
+// and the total number of matching entries
+func (s *MemoryStore) GetAuditEntries(opts ListOptions) ([]*AuditEntry, int, error) {
+	if err := AuditFields.check(&opts); err != nil {
+		return nil, 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	items := make([]listItem, len(s.audit))
+	for i := range s.audit {
+		entry := s.audit[i]
+		items[i] = &entry
+	}
+
+	page, total := list(AuditFields, items, opts)
+	entries := make([]*AuditEntry, len(page))
+	for i, item := range page {
+		entries[i] = item.(*AuditEntry)
+	}
+	return entries, total, nil
+}
+
+// record appends the entry of a change to the audit log while the write lock is held
+func (s *MemoryStore) record(actor Actor, action, entity string, id int, changes Changes) {
+	entry := newAuditEntry(actor, action, entity, id, changes)
+	entry.ID = len(s.audit) + 1
+	s.audit = append(s.audit, entry)
+}
+
+// findUser returns the user matching the given func
+func (s *MemoryStore) findUser(match func(user User) bool) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.DeletedAt == nil && match(user) {
+			return user, nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+// GetGroupPermissions returns the permissions granted to the group with the specified id
+// If a group is not found this func returns a GroupNotFound error
+func (s *MemoryStore) GetGroupPermissions(id int) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	group, ok := s.groups[id]
+	if !ok || group.DeletedAt != nil {
+		return nil, ErrGroupNotFound
+	}
+	return append([]string{}, group.Permissions...), nil
+}
+
+// GetUserPermissions returns the permissions granted to the groups that the user with the specified id belongs to
+// and to their ancestors
+func (s *MemoryStore) GetUserPermissions(userID int) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	permissions := []string{}
+	for m := range s.memberships {
+		if m.userID != userID {
+			continue
+		}
+		for group, ok := s.groups[m.groupID]; ok && group.DeletedAt == nil; group, ok = s.groups[group.ParentID] {
+			for _, p := range group.Permissions {
+				if !HasPermission(permissions, p) {
+					permissions = append(permissions, p)
+				}
+			}
+		}
+	}
+	sort.Strings(permissions)
+	return permissions, nil
+}
+
+// GetUserGroups returns the groups that the user with the specified id belongs to
+// If the user is not found this func returns a UserNotFound error
+func (s *MemoryStore) GetUserGroups(userID int) ([]*Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if user, ok := s.users[userID]; !ok || user.DeletedAt != nil {
+		return nil, ErrUserNotFound
+	}
+
+	groups := []*Group{}
+	for m := range s.memberships {
+		if group, ok := s.groups[m.groupID]; m.userID == userID && ok && group.DeletedAt == nil {
+			group := s.groupWithUsers(m.groupID)
+			groups = append(groups, &group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	return groups, nil
+}
+
+// AddMember adds the user to the group
+// If a group is not found this func returns a GroupNotFound error, if a user is not found a UserNotFound error
+func (s *MemoryStore) AddMember(actor Actor, groupID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.member(groupID, userID); err != nil {
+		return err
+	}
+	s.setMember(actor, groupID, userID, true)
+	return nil
+}
+
+// RemoveMember removes the user from the group, a user leaving its primary group is left without one
+// If a group is not found this func returns a GroupNotFound error, if a user is not found a UserNotFound error
+func (s *MemoryStore) RemoveMember(actor Actor, groupID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.member(groupID, userID)
+	if err != nil {
+		return err
+	}
+
+	m := membership{userID, groupID}
+	if !s.memberships[m] {
+		return nil
+	}
+	delete(s.memberships, m)
+
+	if user.GroupID == groupID {
+		user.GroupID = 0
+		user.Version++
+		s.users[userID] = user
+		s.record(actor, AuditUpdate, AuditUser, userID, Changes{"groupID": {Before: groupID, After: 0}})
+	}
+	s.record(actor, AuditLeave, AuditUser, userID, Changes{"group": {Before: groupID}})
+	return nil
+}
+
+// member returns the user joining or leaving the group while the write lock is held,
+// the members of a dynamic group can not be changed
+func (s *MemoryStore) member(groupID, userID int) (User, error) {
+	group, ok := s.groups[groupID]
+	if !ok || group.DeletedAt != nil {
+		return User{}, ErrGroupNotFound
+	}
+	user, ok := s.users[userID]
+	if !ok || user.DeletedAt != nil {
+		return User{}, ErrUserNotFound
+	}
+	if group.Rule != "" {
+		return User{}, ErrDynamicGroup
+	}
+	return user, nil
+}
+
+// setMember adds the user to the group or removes it from the group while the write lock is held,
+// the user joining or leaving is recorded when the membership changes
+func (s *MemoryStore) setMember(actor Actor, groupID, userID int, member bool) {
+	m := membership{userID, groupID}
+	switch {
+	case member && !s.memberships[m]:
+		s.memberships[m] = true
+		s.record(actor, AuditJoin, AuditUser, userID, Changes{"group": {After: groupID}})
+	case !member && s.memberships[m]:
+		delete(s.memberships, m)
+		s.record(actor, AuditLeave, AuditUser, userID, Changes{"group": {Before: groupID}})
+	}
+}
+
+// syncRules makes the user a member of the dynamic groups whose rules it matches and of no other dynamic group
+// while the write lock is held
+func (s *MemoryStore) syncRules(actor Actor, user User) {
+	var ids []int
+	for id, group := range s.groups {
+		if group.Rule != "" && group.DeletedAt == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		s.setMember(actor, id, user.ID, matchRule(s.groups[id].Rule, &user))
+	}
+}
+
+// syncRule makes the users matching the rule the members of the dynamic group with the given id
+// and removes every other member while the write lock is held, deleted users included
+func (s *MemoryStore) syncRule(actor Actor, id int, rule *Rule) {
+	for _, user := range s.sortedUsers() {
+		s.setMember(actor, id, user.ID, rule.Match(&user))
+	}
+}
+
+// checkRule returns the parsed rule of a group that replaces the group with the given id and its former rule,
+// nil for a group without a rule, id is 0 for a new group
+// A rule that can not be parsed or the primary group of a user getting a rule return a ConstraintError
+func (s *MemoryStore) checkRule(id int, former, rule string) (*Rule, error) {
+	if rule == "" {
+		return nil, nil
+	}
+	parsed, err := ParseRule(rule)
+	if err != nil {
+		return nil, &ConstraintError{Err: ErrGroupConstraintViolation}
+	}
+	for _, user := range s.users {
+		if former == "" && id != 0 && user.GroupID == id {
+			return nil, newConstraintError(ErrGroupConstraintViolation, ConstraintDynamicGroup)
+		}
+	}
+	return parsed, nil
+}
+
+// PreviewRule returns the users that are not deleted and match the rule ordered by id
+// If the rule can not be parsed this func returns an error matching ErrInvalidRule
+func (s *MemoryStore) PreviewRule(rule string) ([]*User, error) {
+	parsed, err := ParseRule(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := []*User{}
+	for _, user := range s.sortedUsers() {
+		user := user
+		if user.DeletedAt == nil && parsed.Match(&user) {
+			users = append(users, &user)
+		}
+	}
+	return users, nil
+}
+
+// GrantPermission grants the permission to the group and increases its version
+// If a group is not found this func returns a GroupNotFound error
+func (s *MemoryStore) GrantPermission(actor Actor, id int, permission string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, ok := s.groups[id]
+	if !ok || group.DeletedAt != nil {
+		return ErrGroupNotFound
+	}
+	if HasPermission(group.Permissions, permission) {
+		return nil
+	}
+
+	group.Permissions = append(append([]string{}, group.Permissions...), permission)
+	sort.Strings(group.Permissions)
+	group.Version++
+	s.groups[id] = group
+	s.record(actor, AuditGrant, AuditGroup, id, Changes{"permission": {After: permission}})
+	return nil
+}
+
+// RevokePermission revokes the permission from the group and increases its version
+// If a group is not found this func returns a GroupNotFound error
+func (s *MemoryStore) RevokePermission(actor Actor, id int, permission string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group, ok := s.groups[id]
+	if !ok || group.DeletedAt != nil {
+		return ErrGroupNotFound
+	}
+
+	permissions := []string{}
+	for _, p := range group.Permissions {
+		if p != permission {
+			permissions = append(permissions, p)
+		}
+	}
+	if len(permissions) == len(group.Permissions) {
+		return nil
+	}
+	group.Permissions = permissions
+	group.Version++
+	s.groups[id] = group
+	s.record(actor, AuditRevoke, AuditGroup, id, Changes{"permission": {Before: permission}})
+	return nil
+}
+
+// GetAttributes returns the attributes ordered by name
+func (s *MemoryStore) GetAttributes() ([]*Attribute, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.sortedAttributes(), nil
+}
+
+// PutAttribute defines an attribute or replaces the definition of the attribute with the same name
+// if the users do not match the new definition the func returns a ConstraintError of ErrAttributeConstraintViolation
+func (s *MemoryStore) PutAttribute(actor Actor, attribute *Attribute) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.attributes[attribute.Name]
+	if !ok {
+		current = Attribute{ID: s.nextAttributeID, Name: attribute.Name, Type: attribute.Type}
+	}
+	stored := *attribute
+	stored.ID = current.ID
+	stored.Enum = append(EnumValues{}, attribute.Enum...)
+
+	// the users, deleted users included, must match the new definition
+	seen := map[interface{}]bool{}
+	for _, user := range s.sortedUsers() {
+		value, has := user.Attributes[stored.Name]
+		switch {
+		case !has && stored.Required:
+			return false, newConstraintError(ErrAttributeConstraintViolation, ConstraintAttributeRequired)
+		case !has:
+		case stored.Type != current.Type || !stored.allows(value):
+			return false, newConstraintError(ErrAttributeConstraintViolation, ConstraintAttributeValues)
+		case stored.Unique && user.DeletedAt == nil && seen[value]:
+			return false, newConstraintError(ErrAttributeConstraintViolation, ConstraintUserAttribute)
+		case user.DeletedAt == nil:
+			seen[value] = true
+		}
+	}
+
+	s.attributes[stored.Name] = stored
+	attribute.ID = stored.ID
+	if !ok {
+		s.nextAttributeID++
+		s.record(actor, AuditCreate, AuditAttribute, stored.ID, diff(nil, attributeValues(&stored)))
+		return true, nil
+	}
+	s.record(actor, AuditUpdate, AuditAttribute, stored.ID, diff(attributeValues(&current), attributeValues(&stored)))
+	return false, nil
+}
+
+// DeleteAttribute removes an attribute and its values and increases the versions of the users that had a value
+// If the attribute is not found this func returns an ErrAttributeNotFound error
+func (s *MemoryStore) DeleteAttribute(actor Actor, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attribute, ok := s.attributes[name]
+	if !ok {
+		return ErrAttributeNotFound
+	}
+	for _, user := range s.sortedUsers() {
+		value, has := user.Attributes[name]
+		if !has {
+			continue
+		}
+		user.Attributes = copyAttributes(user.Attributes)
+		delete(user.Attributes, name)
+		if len(user.Attributes) == 0 {
+			user.Attributes = nil
+		}
+		user.Version++
+		s.users[user.ID] = user
+		s.record(actor, AuditUpdate, AuditUser, user.ID, Changes{AttributeFieldPrefix + name: {Before: value}})
+	}
+
+	delete(s.attributes, name)
+	s.record(actor, AuditDelete, AuditAttribute, attribute.ID, diff(attributeValues(&attribute), nil))
+	return nil
+}
+
+// GetGroupAdmins returns the owners and managers of the group with the specified id ordered by user id
+// If a group is not found this func returns a GroupNotFound error
+func (s *MemoryStore) GetGroupAdmins(id int) ([]*GroupAdmin, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	group, ok := s.groups[id]
+	if !ok || group.DeletedAt != nil {
+		return nil, ErrGroupNotFound
+	}
+	admins := []*GroupAdmin{}
+	for m, role := range s.admins {
+		if m.groupID == id {
+			admins = append(admins, &GroupAdmin{UserID: m.userID, Role: role})
+		}
+	}
+	sort.Slice(admins, func(i, j int) bool { return admins[i].UserID < admins[j].UserID })
+	return admins, nil
+}
+
+// GetGroupRole returns the role of the user in the group with the specified id, empty when it is no admin of the group
+func (s *MemoryStore) GetGroupRole(groupID, userID int) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.admins[membership{userID, groupID}], nil
+}
+
+// SetGroupAdmin gives the user the role in the group and increases the version of the group
+// If a group is not found this func returns a GroupNotFound error, if a user is not found a UserNotFound error
+// and if the role does not exist an ErrUnknownRole error
+func (s *MemoryStore) SetGroupAdmin(actor Actor, groupID, userID int, role string) error {
+	if !ValidRole(role) {
+		return ErrUnknownRole
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.changeAdmin(actor, groupID, userID, role)
+}
+
+// RemoveGroupAdmin takes the role in the group from the user and increases the version of the group
+// If a group is not found this func returns a GroupNotFound error
+func (s *MemoryStore) RemoveGroupAdmin(actor Actor, groupID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.changeAdmin(actor, groupID, userID, "")
+}
+
+// changeAdmin gives the user the role in the group while the write lock is held,
+// no role removes the user from the admins
+func (s *MemoryStore) changeAdmin(actor Actor, groupID, userID int, role string) error {
+	group, ok := s.groups[groupID]
+	if !ok || group.DeletedAt != nil {
+		return ErrGroupNotFound
+	}
+	if user, ok := s.users[userID]; (!ok || user.DeletedAt != nil) && role != "" {
+		return ErrUserNotFound
+	}
+
+	m := membership{userID, groupID}
+	former := s.admins[m]
+	if former == role {
+		return nil
+	}
+	action := AuditGrant
+	if role == "" {
+		action = AuditRevoke
+		delete(s.admins, m)
+	} else {
+		s.admins[m] = role
+	}
+	group.Version++
+	s.groups[groupID] = group
+	s.record(actor, action, AuditGroup, groupID, roleChanges(userID, former, role))
+	return nil
+}
+
+// addUser adds a user with version 1 while the write lock is held
+func (s *MemoryStore) addUser(actor Actor, user *User) error {
+	// a new user is live and at its first version, whatever the request says
+	stored := *user
+	stored.Group = Group{}
+	stored.Version = 1
+	stored.DeletedAt = nil
+	if stored.ID == 0 {
+		stored.ID = s.nextID(&s.nextUserID, func(id int) bool { _, ok := s.users[id]; return ok })
+	}
+	attributes, err := checkAttributes(s.sortedAttributes(), stored.Attributes)
+	if err != nil {
+		return err
+	}
+	stored.Attributes = attributes
+
+	if err := s.checkUser(0, stored); err != nil {
+		return err
+	}
+
+	s.users[stored.ID] = stored
+	s.addMembership(stored)
+	s.record(actor, AuditCreate, AuditUser, stored.ID, diff(nil, userValues(&stored)))
+	s.syncRules(actor, stored)
+	user.ID = stored.ID
+	user.Version = 1
+	user.DeletedAt = nil
+	user.Attributes = copyAttributes(attributes)
+	return nil
+}
+
+// checkUser checks the constraints for a user that replaces the user with the given id
+// id is 0 for a new user
+// Names, emails and the values of unique attributes only have to be unique among the users that are not deleted
+func (s *MemoryStore) checkUser(id int, user User) error {
+	if user.ID < 1 || tooLong(user.Name) || tooLong(user.Email) || tooLong(user.Password) {
+		return &ConstraintError{Err: ErrUserConstraintViolation}
+	}
+	for otherID, other := range s.users {
+		if otherID == id {
+			continue
+		}
+		switch {
+		case other.ID == user.ID:
+			return newConstraintError(ErrUserConstraintViolation, ConstraintUserID)
+		case other.DeletedAt != nil:
+		case other.Name == user.Name:
+			return newConstraintError(ErrUserConstraintViolation, ConstraintUserName)
+		case other.Email == user.Email:
+			return newConstraintError(ErrUserConstraintViolation, ConstraintUserEmail)
+		case user.DeletedAt == nil && s.sharesUniqueValue(user, other):
+			return newConstraintError(ErrUserConstraintViolation, ConstraintUserAttribute)
+		}
+	}
+	group, ok := s.groups[user.GroupID]
+	switch {
+	case user.GroupID == 0:
+	case !ok || group.DeletedAt != nil:
+		return newConstraintError(ErrUserConstraintViolation, ConstraintUserGroup)
+	case group.Rule != "":
+		return newConstraintError(ErrUserConstraintViolation, ConstraintDynamicGroup)
+	}
+	return nil
+}
+
+// sharesUniqueValue reports whether two users have the same value of a unique attribute
+func (s *MemoryStore) sharesUniqueValue(user, other User) bool {
+	for name, value := range user.Attributes {
+		if s.attributes[name].Unique && other.Attributes[name] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// addMembership adds the user to its primary group while the write lock is held,
+// a user without a primary group is left alone
+func (s *MemoryStore) addMembership(user User) {
+	if user.GroupID != 0 {
+		s.memberships[membership{user.ID, user.GroupID}] = true
+	}
+}
+
+// checkGroup checks the constraints for a group that replaces the group with the given id
+// id is 0 for a new group
+// Names only have to be unique among the groups that are not deleted
+func (s *MemoryStore) checkGroup(id int, group Group) error {
+	if group.ID < 1 || tooLong(group.Name) {
+		return &ConstraintError{Err: ErrGroupConstraintViolation}
+	}
+	for otherID, other := range s.groups {
+		if otherID == id {
+			continue
+		}
+		switch {
+		case other.ID == group.ID:
+			return newConstraintError(ErrGroupConstraintViolation, ConstraintGroupID)
+		case other.DeletedAt != nil:
+		case other.Name == group.Name:
+			return newConstraintError(ErrGroupConstraintViolation, ConstraintGroupName)
+		}
+	}
+	return nil
+}
+
+// checkParent checks the parent of a group while the write lock is held, id is the current id of the group,
+// 0 for a new group, and newID its id after the change, a group without a parent passes
+// The parent must exist, must not be deleted and must be neither the group itself nor one of its descendants
+func (s *MemoryStore) checkParent(id, newID, parentID int) error {
+	for ancestor := parentID; ancestor != 0; ancestor = s.groups[ancestor].ParentID {
+		if ancestor == id || ancestor == newID {
+			return newConstraintError(ErrGroupConstraintViolation, ConstraintGroupCycle)
+		}
+		if group, ok := s.groups[ancestor]; !ok || group.DeletedAt != nil {
+			return newConstraintError(ErrGroupConstraintViolation, ConstraintGroupParent)
+		}
+	}
+	return nil
+}
+
+// descendants returns the ids of the descendants of the group with the given id that are not deleted ordered by id
+func (s *MemoryStore) descendants(id int) []int {
+	ids := []int{}
+	for parents := []int{id}; len(parents) > 0; {
+		var children []int
+		for childID, child := range s.groups {
+			for _, parentID := range parents {
+				if child.ParentID == parentID && child.DeletedAt == nil {
+					children = append(children, childID)
+				}
+			}
+		}
+		ids = append(ids, children...)
+		parents = children
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// tooLong reports whether the value does not fit into a varchar(255) column
+func tooLong(value string) bool {
+	return utf8.RuneCountInString(value) > 255
+}
+
+// groupReferenced reports whether any user belongs to the group with the given id,
+// deleted users only count when deleted is true
+func (s *MemoryStore) groupReferenced(id int, deleted bool) bool {
+	for m := range s.memberships {
+		if m.groupID == id && (s.users[m.userID].DeletedAt == nil || deleted) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupWithUsers returns a copy of the group with the given id with its users loaded
+func (s *MemoryStore) groupWithUsers(id int) Group {
+	group := s.groups[id]
+	group.Permissions = append([]string{}, group.Permissions...)
+	group.Users = []User{}
+	for _, user := range s.sortedUsers() {
+		if s.memberships[membership{user.ID, id}] && user.DeletedAt == nil {
+			group.Users = append(group.Users, user)
+		}
+	}
+	return group
+}
+
+// sortedAttributes returns copies of all attributes ordered by name
+func (s *MemoryStore) sortedAttributes() []*Attribute {
+	attributes := make([]*Attribute, 0, len(s.attributes))
+	for _, attribute := range s.attributes {
+		attribute := attribute
+		attributes = append(attributes, &attribute)
+	}
+	sort.Slice(attributes, func(i, j int) bool { return attributes[i].Name < attributes[j].Name })
+	return attributes
+}
+
+// sortedUsers returns copies of all users ordered by id
+func (s *MemoryStore) sortedUsers() []User {
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+// list returns the page of the items selected by the options and the number of items matching the filters
+func list(fields ListFields, items []listItem, opts ListOptions) ([]listItem, int) {
+	matching := []listItem{}
+	for _, item := range items {
+		if fields.matches(item, opts.Filters) {
+			matching = append(matching, item)
+		}
+	}
+
+	// a before cursor selects the page closest to the cursor, so the items are ordered
+	// in the opposite direction and the page is reversed
+	keys := sortKeys(opts.Sort)
+	if opts.Cursor != nil && opts.Cursor.Before {
+		keys = reverse(keys)
+	}
+	sort.Slice(matching, func(i, j int) bool { return compareItems(matching[i], matching[j], keys) < 0 })
+
+	page := []listItem{}
+	for _, item := range matching {
+		if opts.Cursor == nil || compareCursor(item, opts.Cursor.Values, keys) > 0 {
+			page = append(page, item)
+		}
+	}
+
+	if opts.Offset >= len(page) {
+		return []listItem{}, len(matching)
+	}
+	page = page[opts.Offset:]
+	if opts.Limit > 0 && opts.Limit < len(page) {
+		page = page[:opts.Limit]
+	}
+
+	if opts.Cursor != nil && opts.Cursor.Before {
+		for i, j := 0, len(page)-1; i < j; i, j = i+1, j-1 {
+			page[i], page[j] = page[j], page[i]
+		}
+	}
+	return page, len(matching)
+}
+
+// nextID returns the next free id from the given sequence
+func (s *MemoryStore) nextID(seq *int, taken func(id int) bool) int {
+	for taken(*seq) {
+		*seq++
+	}
+	id := *seq
+	*seq++
+	return id
+}
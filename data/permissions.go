@@ -0,0 +1,42 @@
+package data
+
+import (
+	"fmt"
+)
+
+// ErrUnknownPermission is an error raised when a permission does not exist
+var ErrUnknownPermission = fmt.Errorf("unknown permission")
+
+// Permissions that can be granted to a group, every member of the group holds them
+const (
+	PermUsersRead   = "users:read"
+	PermUsersWrite  = "users:write"
+	PermUsersAdmin  = "users:admin"
+	PermGroupsRead  = "groups:read"
+	PermGroupsWrite = "groups:write"
+	PermGroupsAdmin = "groups:admin"
+	PermAuditRead   = "audit:read"
+)
+
+// AllPermissions is the list of every permission
+var AllPermissions = []string{PermUsersRead, PermUsersWrite, PermUsersAdmin, PermGroupsRead, PermGroupsWrite, PermGroupsAdmin, PermAuditRead}
+
+// ValidPermission reports whether the permission exists
+func ValidPermission(permission string) bool {
+	for _, p := range AllPermissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether the permission is in the list of permissions
+func HasPermission(permissions []string, permission string) bool {
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,322 @@
+package data
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidRule is an error raised when the membership rule of a dynamic group can not be parsed
+var ErrInvalidRule = fmt.Errorf("invalid rule")
+
+// Rule is the parsed membership rule of a dynamic group, the users matching it are the members of the group
+//
+// A rule compares fields of a user with values and combines the comparisons with and, or, not and parentheses,
+// e.g. email endsWith "@3fs.si" and not (id == 1 or name startsWith "test")
+//
+// The fields are id, name, email and groupID, strings are double quoted with the escapes of Go
+// and numbers are integers. Every field can be compared with ==, !=, <, <=, > and >=,
+// name and email also with contains, startsWith and endsWith. Comparisons of strings are case sensitive
+type Rule struct {
+	expr ruleExpr
+}
+
+// ParseRule parses the membership rule of a dynamic group
+// If the rule can not be parsed it returns an error matching ErrInvalidRule
+func ParseRule(rule string) (*Rule, error) {
+	expr, err := parseRule(rule)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+	}
+	return &Rule{expr}, nil
+}
+
+// Match reports whether the user matches the rule
+func (r *Rule) Match(user *User) bool {
+	return r.expr.match(user)
+}
+
+// matchRule reports whether the user matches the rule of a group, a rule that can not be parsed matches nobody
+func matchRule(rule string, user *User) bool {
+	parsed, err := ParseRule(rule)
+	return err == nil && parsed.Match(user)
+}
+
+// ruleFields are the fields of a user that rules compare, the string fields return their value as a string
+var ruleFields = map[string]func(user *User) (string, int){
+	"id":      func(user *User) (string, int) { return "", user.ID },
+	"name":    func(user *User) (string, int) { return user.Name, 0 },
+	"email":   func(user *User) (string, int) { return user.Email, 0 },
+	"groupID": func(user *User) (string, int) { return "", user.GroupID },
+}
+
+// stringOps are the operators that only compare strings
+var stringOps = map[string]func(value, operand string) bool{
+	"contains":   strings.Contains,
+	"startsWith": strings.HasPrefix,
+	"endsWith":   strings.HasSuffix,
+}
+
+// ruleExpr is a node of a parsed rule
+type ruleExpr interface {
+	match(user *User) bool
+}
+
+type ruleAnd struct{ left, right ruleExpr }
+
+func (e ruleAnd) match(user *User) bool { return e.left.match(user) && e.right.match(user) }
+
+type ruleOr struct{ left, right ruleExpr }
+
+func (e ruleOr) match(user *User) bool { return e.left.match(user) || e.right.match(user) }
+
+type ruleNot struct{ expr ruleExpr }
+
+func (e ruleNot) match(user *User) bool { return !e.expr.match(user) }
+
+// ruleComparison compares a field of the user with a string or a number
+type ruleComparison struct {
+	field  string
+	op     string
+	str    string
+	num    int
+	string bool
+}
+
+func (e ruleComparison) match(user *User) bool {
+	str, num := ruleFields[e.field](user)
+	if compare, ok := stringOps[e.op]; ok {
+		return compare(str, e.str)
+	}
+
+	c := 0
+	switch {
+	case e.string:
+		c = strings.Compare(str, e.str)
+	case num < e.num:
+		c = -1
+	case num > e.num:
+		c = 1
+	}
+	switch e.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+// ruleToken is a token of a rule, a word, a quoted string, a number, an operator or a parenthesis
+type ruleToken struct {
+	text string
+	pos  int
+}
+
+// ruleParser is a recursive descent parser of rules
+//
+//	or         = and { "or" and }
+//	and        = unary { "and" unary }
+//	unary      = "not" unary | "(" or ")" | comparison
+//	comparison = field operator value
+type ruleParser struct {
+	tokens []ruleToken
+	next   int
+}
+
+// parseRule returns the expression of the rule or an error describing where it can not be parsed
+func parseRule(rule string) (ruleExpr, error) {
+	tokens, err := tokenizeRule(rule)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty rule")
+	}
+
+	p := &ruleParser{tokens: tokens}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.next < len(p.tokens) {
+		return nil, p.errorf("unexpected %s", p.tokens[p.next].text)
+	}
+	return expr, nil
+}
+
+func (p *ruleParser) or() (ruleExpr, error) {
+	left, err := p.and()
+	for err == nil && p.accept("or") {
+		var right ruleExpr
+		if right, err = p.and(); err == nil {
+			left = ruleOr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *ruleParser) and() (ruleExpr, error) {
+	left, err := p.unary()
+	for err == nil && p.accept("and") {
+		var right ruleExpr
+		if right, err = p.unary(); err == nil {
+			left = ruleAnd{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *ruleParser) unary() (ruleExpr, error) {
+	switch {
+	case p.accept("not"):
+		expr, err := p.unary()
+		return ruleNot{expr}, err
+	case p.accept("("):
+		expr, err := p.or()
+		if err == nil && !p.accept(")") {
+			err = p.errorf("expected )")
+		}
+		return expr, err
+	}
+	return p.comparison()
+}
+
+func (p *ruleParser) comparison() (ruleExpr, error) {
+	field, ok := p.take()
+	if !ok {
+		return nil, p.errorf("expected a field")
+	}
+	if _, known := ruleFields[field]; !known {
+		return nil, p.errorfAt(p.next-1, "unknown field %s", field)
+	}
+
+	op, ok := p.take()
+	if !ok {
+		return nil, p.errorf("expected an operator")
+	}
+	_, stringOp := stringOps[op]
+	if !stringOp && !isComparison(op) {
+		return nil, p.errorfAt(p.next-1, "expected an operator")
+	}
+
+	value, ok := p.take()
+	if !ok {
+		return nil, p.errorf("expected a value")
+	}
+
+	e := ruleComparison{field: field, op: op}
+	switch {
+	case field == "name" || field == "email":
+		if e.str, ok = unquote(value); !ok {
+			return nil, p.errorfAt(p.next-1, "expected a string")
+		}
+		e.string = true
+	case stringOp:
+		return nil, p.errorfAt(p.next-2, "%s only compares strings", op)
+	default:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, p.errorfAt(p.next-1, "expected a number")
+		}
+		e.num = n
+	}
+	return e, nil
+}
+
+// accept skips the next token if it is the given one
+func (p *ruleParser) accept(text string) bool {
+	if p.next < len(p.tokens) && p.tokens[p.next].text == text {
+		p.next++
+		return true
+	}
+	return false
+}
+
+// take returns the next token
+func (p *ruleParser) take() (string, bool) {
+	if p.next == len(p.tokens) {
+		return "", false
+	}
+	p.next++
+	return p.tokens[p.next-1].text, true
+}
+
+// errorf returns an error at the next token or the end of the rule
+func (p *ruleParser) errorf(format string, args ...interface{}) error {
+	return p.errorfAt(p.next, format, args...)
+}
+
+// errorfAt returns an error at the token with the given index or the end of the rule
+func (p *ruleParser) errorfAt(i int, format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+	if i >= len(p.tokens) {
+		return fmt.Errorf("%s at the end", message)
+	}
+	return fmt.Errorf("%s at position %d", message, p.tokens[i].pos+1)
+}
+
+// isComparison reports whether op compares any value
+func isComparison(op string) bool {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+// unquote returns the value of a quoted string token
+func unquote(token string) (string, bool) {
+	if !strings.HasPrefix(token, `"`) {
+		return "", false
+	}
+	value, err := strconv.Unquote(token)
+	return value, err == nil
+}
+
+// tokenizeRule splits a rule into its tokens
+func tokenizeRule(rule string) ([]ruleToken, error) {
+	var tokens []ruleToken
+	runes := []rune(rule)
+	for i := 0; i < len(runes); {
+		start := i
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '(' || r == ')':
+			i++
+		case r == '"':
+			for i++; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start+1)
+			}
+			i++
+		case strings.ContainsRune("=!<>", r):
+			for i++; i < len(runes) && runes[i] == '='; i++ {
+			}
+		case r == '-' || unicode.IsDigit(r):
+			for i++; i < len(runes) && unicode.IsDigit(runes[i]); i++ {
+			}
+		case unicode.IsLetter(r):
+			for i++; i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])); i++ {
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %c at position %d", r, start+1)
+		}
+		tokens = append(tokens, ruleToken{text: string(runes[start:i]), pos: start})
+	}
+	return tokens, nil
+}
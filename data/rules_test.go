@@ -0,0 +1,74 @@
+package data
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+)
+
+// Creates rules test suite
+type RulesTestSuite struct{}
+
+// Registering test suite
+func init() {
+	Suite(&RulesTestSuite{})
+}
+
+// Matches users against rules with every operator and the precedence of and over or
+func (s *RulesTestSuite) TestMatch(c *C) {
+	user := User{ID: 7, Name: "Ana", Email: "ana@3fs.si", GroupID: 2}
+
+	tests := []struct {
+		rule    string
+		matches bool
+	}{
+		{`email endsWith "@3fs.si"`, true},
+		{`email endsWith "@3FS.si"`, false},
+		{`name startsWith "An" and email contains "@"`, true},
+		{`name == "Ana"`, true},
+		{`name != "Ana"`, false},
+		{`name < "Bob"`, true},
+		{`id >= 7 and id <= 7 and id > 6 and id < 8`, true},
+		{`groupID == 1 or groupID == 2`, true},
+		{`not groupID == 2`, false},
+		{`id == 1 or id == 7 and name == "Bob"`, false},
+		{`(id == 1 or id == 7) and not (name == "Bob")`, true},
+		{`id == -7 or name == "A\"na"`, false},
+	}
+	for _, test := range tests {
+		rule, err := ParseRule(test.rule)
+		c.Assert(err, IsNil, Commentf(test.rule))
+		c.Check(rule.Match(&user), Equals, test.matches, Commentf(test.rule))
+	}
+}
+
+// Reports where a rule can not be parsed
+func (s *RulesTestSuite) TestParseFail(c *C) {
+	tests := []struct {
+		rule    string
+		message string
+	}{
+		{``, "invalid rule: empty rule"},
+		{`password == "pass"`, "invalid rule: unknown field password at position 1"},
+		{`email is "a"`, "invalid rule: expected an operator at position 7"},
+		{`email endsWith`, "invalid rule: expected a value at the end"},
+		{`email == 1`, "invalid rule: expected a string at position 10"},
+		{`id == "1"`, "invalid rule: expected a number at position 7"},
+		{`id contains 1`, "invalid rule: contains only compares strings at position 4"},
+		{`(id == 1`, "invalid rule: expected ) at the end"},
+		{`id == 1 id == 2`, "invalid rule: unexpected id at position 9"},
+		{`name == "ana`, "invalid rule: unterminated string at position 9"},
+		{`name == 'ana'`, "invalid rule: unexpected ' at position 9"},
+	}
+	for _, test := range tests {
+		_, err := ParseRule(test.rule)
+		c.Assert(err, NotNil, Commentf(test.rule))
+		c.Check(errors.Is(err, ErrInvalidRule), Equals, true)
+		c.Check(err.Error(), Equals, test.message)
+	}
+
+	group := Group{Name: "staff", Rule: "email endsWith"}
+	c.Check(Validate(&group), DeepEquals, ValidationError{
+		{Field: "rule", Message: "must be a valid rule, expected a value at the end"},
+	})
+}
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Search result types
+const (
+	SearchUser  = "user"
+	SearchGroup = "group"
+)
+
+// searchThreshold is the smallest similarity of a matching field,
+// it equals the default similarity threshold of the PostgreSQL pg_trgm extension
+const searchThreshold = 0.3
+
+// SearchResult is a user or group matching a search query
+// swagger:model
+type SearchResult struct {
+	// the type of the result, user or group
+	Type string `json:"type"`
+
+	// the trigram similarity of the best matching field to the query, between 0 and 1
+	Score float64 `json:"score"`
+
+	// the matching user, set for results of type user
+	User *User `json:"user,omitempty"`
+
+	// the matching group, set for results of type group
+	Group *Group `json:"group,omitempty"`
+}
+
+// Searcher searches users by name and email and groups by name
+type Searcher interface {
+	// Search returns at most limit users and groups matching the query, best matches first
+	// A field matches when it contains the query or is similar to it, which tolerates typos
+	Search(query string, limit int) ([]SearchResult, error)
+}
+
+// searchItems scores the users and groups against the query
+// and returns at most limit matches, best matches first
+func searchItems(query string, users []*User, groups []*Group, limit int) []SearchResult {
+	var results []SearchResult
+	for _, user := range users {
+		if score, ok := matchScore(query, user.Name, user.Email); ok {
+			results = append(results, SearchResult{Type: SearchUser, Score: score, User: user})
+		}
+	}
+	for _, group := range groups {
+		if score, ok := matchScore(query, group.Name); ok {
+			results = append(results, SearchResult{Type: SearchGroup, Score: score, Group: group})
+		}
+	}
+	return rankResults(results, limit)
+}
+
+// rankResults orders the results by descending score, users before groups and by id,
+// and returns at most limit results
+func rankResults(results []SearchResult, limit int) []SearchResult {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Type != b.Type {
+			return a.Type == SearchUser
+		}
+		return a.id() < b.id()
+	})
+
+	if results == nil {
+		results = []SearchResult{}
+	}
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+func (r SearchResult) id() int {
+	if r.User != nil {
+		return r.User.ID
+	}
+	return r.Group.ID
+}
+
+// matchScore returns the highest similarity of the values to the query
+// and whether one of the values matches
+func matchScore(query string, values ...string) (score float64, ok bool) {
+	for _, value := range values {
+		s := similarity(query, value)
+		if s > score {
+			score = s
+		}
+		ok = ok || s >= searchThreshold || strings.Contains(strings.ToLower(value), strings.ToLower(query))
+	}
+	return
+}
+
+// similarity returns the trigram similarity of two strings like the similarity function of pg_trgm,
+// the number of shared trigrams divided by the number of distinct trigrams of both strings
+func similarity(a, b string) float64 {
+	ta, tb := trigrams(a), trigrams(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for trigram := range ta {
+		if tb[trigram] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(ta)+len(tb)-shared)
+}
+
+// trigrams returns the trigrams of the lower case words of the string,
+// each word is padded with two spaces in front and one behind
+func trigrams(s string) map[string]bool {
+	set := map[string]bool{}
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	for _, word := range words {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			set[string(padded[i:i+3])] = true
+		}
+	}
+	return set
+}
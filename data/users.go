@@ -1,9 +1,9 @@
 package data
 
 import (
+	"encoding/json"
 	"fmt"
-
-	"github.com/jinzhu/gorm"
+	"time"
 )
 
 // ErrUserNotFound is an error raised when a user can not be found in the database
@@ -18,87 +18,124 @@ type User struct {
 	// the id of the user
 	//
 	// required: false
-	// min:1
-	ID int `json:"id"`
+	// min: 1
+	ID int `json:"id" validate:"min=1"`
 
 	// the name of the user
 	//
 	// required: true
 	// max length: 255
-	Name string `json:"name"`
+	Name string `json:"name" validate:"required,max=255"`
 
 	// the email of the user
 	//
 	// required: true
 	// max length: 255
-	Email string `json:"email"`
+	// swagger:strfmt email
+	Email string `json:"email" validate:"required,max=255,email"`
 
-	// the password of the user
+	// the password of the user, it is stored hashed and never returned
 	//
 	// required: true
 	// max length: 255
-	Password string `json:"password"`
+	Password string `json:"password" validate:"required,max=255"`
 
-	// the id of the group that the user belongs to
+	// the id of the primary group of the user, 0 when it has none
+	// the user is a member of its primary group, changing it moves the user out of the former primary group
 	//
-	// required: true
+	// required: false
 	// min: 1
-	GroupID int `json:"groupID"`
+	GroupID int `json:"groupID" validate:"min=1"`
 
-	// The group that the user belongs to
+	// the values of the custom attributes of the user by their name, they must match the attribute schema
 	//
 	// required: false
-	Group Group `json:"-"`
-}
+	Attributes map[string]interface{} `json:"attributes,omitempty" gorm:"-"`
 
-// GetUsers returns all users from the database
-func GetUsers(db *gorm.DB) (users []*User) {
-	db.Find(&users)
-	return
-}
+	// the version of the user, increased by every change and sent as its ETag
+	//
+	// read only: true
+	Version int `json:"version"`
 
-// GetUserById returns a single user with the specified id
-// If the user is not found this func retuns UserNotFound error
-func GetUserById(id int, db *gorm.DB) (user User, err error) {
-	user.ID = id
-	if err = db.First(&user).Error; err != nil {
-		err = ErrUserNotFound
-	}
-	return
-}
+	// when the user was deleted, deleted users are purged after a while and can be restored until then
+	//
+	// read only: true
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
 
-// UpdateUser replaces the set of values within the given user
-// If a user is not found this func returns a UserNotFound error
-// if the update would make a constraint violation the func returns a ErrUserConstraintViolation error
-func UpdateUser(id int, userMap map[string]interface{}, db *gorm.DB) (err error) {
-	var user User
-	if err = db.First(&user, id).Error; err != nil {
-		err = ErrUserNotFound
-		return
-	}
-
-	if err = db.Model(&user).Updates(userMap).Error; err != nil {
-		err = ErrUserConstraintViolation
-	}
-	return
+	// The primary group of the user
+	//
+	// required: false
+	Group Group `json:"-"`
 }
 
-// AddUser adds a user to the database
-// if the user would make a constraint violation the func returns a ErrUserConstraintViolation error
-func AddUser(user *User, db *gorm.DB) (err error) {
-	if err = db.Create(user).Error; err != nil {
-		err = ErrUserConstraintViolation
-	}
-	return
+// MarshalJSON encodes the user without its password, which is write only
+func (u User) MarshalJSON() ([]byte, error) {
+	type user User
+	return json.Marshal(struct {
+		user
+		Password string `json:"password,omitempty"`
+	}{user: user(u)})
 }
 
-// DeleteUser deletes an user from the database
-func DeleteUser(id int, db *gorm.DB) (err error) {
-	var user User
-	if err = db.First(&user, id).Error; err != nil {
-		err = ErrUserNotFound
-	} else {
-		db.Delete(&user)
-	}
-	return
+// UserStore is the interface that wraps the operations for persisting users
+// Operations return an error matching ErrUnavailable when the database can not be reached
+// Changes are recorded in the audit log as made by the given actor
+type UserStore interface {
+	// GetUsers returns the page of users selected by the options ordered by id
+	// together with the total number of users
+	// Deleted users are only returned when the options include them
+	// The users can be filtered by their attributes with the fields prefixed by AttributeFieldPrefix
+	GetUsers(opts ListOptions) ([]*User, int, error)
+
+	// GetUserById returns a single user with the specified id
+	// If the user is not found or deleted it returns an ErrUserNotFound error
+	GetUserById(id int) (User, error)
+
+	// GetUserByName returns a single user with the specified name
+	// If the user is not found it returns an ErrUserNotFound error
+	GetUserByName(name string) (User, error)
+
+	// GetUserByEmail returns a single user with the specified email
+	// If the user is not found it returns an ErrUserNotFound error
+	GetUserByEmail(email string) (User, error)
+
+	// UpdateUser replaces the set of values within the given user and increases its version
+	// If the user is not found it returns an ErrUserNotFound error
+	// if version is not 0 and the user has another version it returns an ErrVersionMismatch error
+	// if a value can not be set or the attributes do not match the attribute schema it returns a ValidationError
+	// if the update would make a constraint violation it returns a ConstraintError of ErrUserConstraintViolation
+	// that matches ErrDuplicateID, ErrDuplicateName, ErrDuplicateEmail, ErrDuplicateAttribute, ErrUnknownGroup
+	// or ErrDynamicGroup
+	// The user joins and leaves the dynamic groups whose rules it starts or stops matching
+	UpdateUser(actor Actor, id, version int, userMap map[string]interface{}) error
+
+	// AddUser adds a user, which joins the dynamic groups whose rules it matches
+	// The user is added at version 1 and not deleted, whatever its Version and DeletedAt are
+	// if the attributes do not match the attribute schema it returns a ValidationError
+	// if the user would make a constraint violation it returns a ConstraintError of ErrUserConstraintViolation
+	// that matches ErrDuplicateID, ErrDuplicateName, ErrDuplicateEmail, ErrDuplicateAttribute, ErrUnknownGroup
+	// or ErrDynamicGroup
+	AddUser(actor Actor, user *User) error
+
+	// DeleteUser marks a user as deleted and increases its version
+	// If the user is not found or already deleted it returns an ErrUserNotFound error
+	// if version is not 0 and the user has another version it returns an ErrVersionMismatch error
+	DeleteUser(actor Actor, id, version int) error
+
+	// RestoreUser restores a deleted user and increases its version, restoring a user that is not deleted has no effect
+	// If the user is not found it returns an ErrUserNotFound error
+	// if its name, email or the value of a unique attribute has been taken or its group deleted in the meantime
+	// it returns a ConstraintError of ErrUserConstraintViolation that matches ErrDuplicateName, ErrDuplicateEmail,
+	// ErrDuplicateAttribute or ErrUnknownGroup
+	RestoreUser(actor Actor, id int) error
+
+	// ApplyUsers runs the operations in order and returns the error of every operation, nil when it succeeded
+	// Each operation fails like the single operation would, with ErrUnknownOperation for an unknown one
+	// When atomic is true either every operation succeeds or none does, the operations that were rolled back
+	// or not run because of a failure fail with ErrBatchAborted
+	ApplyUsers(actor Actor, ops []UserOperation, atomic bool) []error
+
+	// PurgeUsers removes the users deleted before the given time for good and returns how many were removed,
+	// the purges are recorded as made by the system
+	PurgeUsers(before time.Time) (int, error)
 }
@@ -0,0 +1,140 @@
+package data
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError is a validation rule a field of a request breaks
+type FieldError struct {
+	// the JSON path of the field, e.g. users[0].email
+	Field string `json:"field"`
+
+	// what is wrong with the value of the field
+	Message string `json:"message"`
+}
+
+// ValidationError is an error raised when a user or group breaks the rules of its validate tags
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	messages := make([]string, len(e))
+	for i, f := range e {
+		messages[i] = f.Field + " " + f.Message
+	}
+	return "validation failed: " + strings.Join(messages, ", ")
+}
+
+// Validate checks the fields of a struct against the rules of their validate tags,
+// the same rules are declared as swagger annotations and in swagger.yaml
+// When fields are given only the fields with these JSON names are checked
+//
+// The rules are
+//
+//	required   the field must not be empty
+//	max=N      a string has at most N characters
+//	min=N      a number is at least N, an empty optional field is not checked
+//	email      a string is an email address without a display name
+//	rule       a string is a membership rule of a dynamic group, see Rule
+//	dive       every element of a slice of structs is validated
+//	dive=F     like dive, but the field F of the elements is not checked
+//
+// The returned error is a ValidationError or nil
+func Validate(v interface{}, fields ...string) error {
+	errs := validateStruct(reflect.Indirect(reflect.ValueOf(v)), "", fields, "")
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func validateStruct(value reflect.Value, prefix string, only []string, skip string) ValidationError {
+	var errs ValidationError
+	for i := 0; i < value.NumField(); i++ {
+		f := value.Type().Field(i)
+		tag, ok := f.Tag.Lookup("validate")
+		if !ok {
+			continue
+		}
+
+		name := jsonName(f)
+		if name == skip || (len(only) > 0 && !contains(only, name)) {
+			continue
+		}
+
+		for _, rule := range strings.Split(tag, ",") {
+			if message := checkRule(value.Field(i), rule, prefix+name, &errs); message != "" {
+				errs = append(errs, FieldError{Field: prefix + name, Message: message})
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// checkRule returns the message of a broken rule or an empty string,
+// errors of nested structs are appended to errs
+func checkRule(value reflect.Value, rule, path string, errs *ValidationError) string {
+	name, arg := rule, ""
+	if i := strings.Index(rule, "="); i >= 0 {
+		name, arg = rule[:i], rule[i+1:]
+	}
+	n, _ := strconv.Atoi(arg)
+
+	switch name {
+	case "required":
+		if value.IsZero() {
+			return "is required"
+		}
+	case "max":
+		if value.Kind() == reflect.String && utf8.RuneCountInString(value.String()) > n {
+			return fmt.Sprintf("must be at most %d characters long", n)
+		}
+	case "min":
+		if value.Kind() == reflect.Int && !value.IsZero() && value.Int() < int64(n) {
+			return fmt.Sprintf("must be at least %d", n)
+		}
+	case "email":
+		if value.String() != "" {
+			address, err := mail.ParseAddress(value.String())
+			if err != nil || address.Address != value.String() {
+				return "must be a valid email address"
+			}
+		}
+	case "rule":
+		if value.String() != "" {
+			if _, err := parseRule(value.String()); err != nil {
+				return "must be a valid rule, " + err.Error()
+			}
+		}
+	case "dive":
+		for i := 0; i < value.Len(); i++ {
+			*errs = append(*errs, validateStruct(value.Index(i), fmt.Sprintf("%s[%d].", path, i), nil, arg)...)
+		}
+	default:
+		panic("unknown validation rule " + rule)
+	}
+	return ""
+}
+
+// jsonName returns the name of the struct field in JSON
+func jsonName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
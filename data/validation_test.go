@@ -0,0 +1,161 @@
+package data
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// Creates validation test suite
+type ValidationTestSuite struct{}
+
+// Registering test suite
+func init() {
+	Suite(&ValidationTestSuite{})
+}
+
+// integrates with testing package
+func Test(t *testing.T) { TestingT(t) }
+
+// models are the validated structs by their name in swagger.yaml and the file declaring them
+var models = []struct {
+	name string
+	file string
+	v    interface{}
+}{
+	{"User", "users.go", User{}},
+	{"Group", "groups.go", Group{}},
+	{"Attribute", "attributes.go", Attribute{}},
+}
+
+// rules returns the validate rules of the fields of v by their JSON name, e.g. {"name": {"required": "", "max": "255"}}
+func rules(v interface{}) map[string]map[string]string {
+	fields := map[string]map[string]string{}
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		tag, ok := t.Field(i).Tag.Lookup("validate")
+		if !ok {
+			continue
+		}
+
+		fieldRules := map[string]string{}
+		for _, rule := range strings.Split(tag, ",") {
+			parts := strings.SplitN(rule, "=", 2)
+			if parts[0] != "dive" {
+				fieldRules[parts[0]] = strings.Join(parts[1:], "")
+			}
+		}
+		fields[jsonName(t.Field(i))] = fieldRules
+	}
+	return fields
+}
+
+// Checks that the validate tags declare the rules of swagger.yaml
+func (s *ValidationTestSuite) TestRulesMatchSwagger(c *C) {
+	b, err := ioutil.ReadFile("../swagger.yaml")
+	c.Assert(err, IsNil)
+
+	var spec struct {
+		Definitions map[string]struct {
+			Required   []string
+			Properties map[string]struct {
+				MaxLength *int `yaml:"maxLength"`
+				Minimum   *int
+				Format    string
+			}
+		}
+	}
+	c.Assert(yaml.Unmarshal(b, &spec), IsNil)
+
+	for _, model := range models {
+		definition := spec.Definitions[model.name]
+		fields := rules(model.v)
+		for name, property := range definition.Properties {
+			expected := map[string]string{}
+			for _, required := range definition.Required {
+				if required == name {
+					expected["required"] = ""
+				}
+			}
+			if property.MaxLength != nil {
+				expected["max"] = strconv.Itoa(*property.MaxLength)
+			}
+			if property.Minimum != nil {
+				expected["min"] = strconv.Itoa(*property.Minimum)
+			}
+			if property.Format == "email" || property.Format == "rule" {
+				expected[property.Format] = ""
+			}
+
+			if fields[name] == nil {
+				fields[name] = map[string]string{}
+			}
+			c.Check(fields[name], DeepEquals, expected, Commentf("%s.%s", model.name, name))
+		}
+	}
+}
+
+// annotation matches the swagger annotations of a field that declare validation rules
+var annotation = regexp.MustCompile(`(?m)^\s*(required: true|max length: (\d+)|min: (\d+)|swagger:strfmt (email|rule))\s*$`)
+
+// Checks that the validate tags declare the rules of the swagger annotations of the fields
+func (s *ValidationTestSuite) TestRulesMatchAnnotations(c *C) {
+	for _, model := range models {
+		file, err := parser.ParseFile(token.NewFileSet(), model.file, nil, parser.ParseComments)
+		c.Assert(err, IsNil)
+
+		spec := file.Scope.Lookup(model.name).Decl.(*ast.TypeSpec)
+		structType := spec.Type.(*ast.StructType)
+		t := reflect.TypeOf(model.v)
+
+		fields := rules(model.v)
+		for _, f := range structType.Fields.List {
+			sf, _ := t.FieldByName(f.Names[0].Name)
+			name := jsonName(sf)
+
+			expected := map[string]string{}
+			for _, match := range annotation.FindAllStringSubmatch(f.Doc.Text(), -1) {
+				switch {
+				case match[1] == "required: true":
+					expected["required"] = ""
+				case match[2] != "":
+					expected["max"] = match[2]
+				case match[3] != "":
+					expected["min"] = match[3]
+				default:
+					expected[match[4]] = ""
+				}
+			}
+
+			if fields[name] == nil {
+				fields[name] = map[string]string{}
+			}
+			c.Check(fields[name], DeepEquals, expected, Commentf("%s.%s", model.name, name))
+		}
+	}
+}
+
+// Validates a user with broken rules and only selected fields
+func (s *ValidationTestSuite) TestValidate(c *C) {
+	user := User{ID: -1, Name: strings.Repeat("ä", 256), Email: "user@", Password: "pass", GroupID: -1}
+
+	c.Check(Validate(&user), DeepEquals, ValidationError{
+		{Field: "id", Message: "must be at least 1"},
+		{Field: "name", Message: "must be at most 255 characters long"},
+		{Field: "email", Message: "must be a valid email address"},
+		{Field: "groupID", Message: "must be at least 1"},
+	})
+	c.Check(Validate(&user, "password"), IsNil)
+
+	user = User{Name: strings.Repeat("ä", 255), Email: "user@email.com", Password: "pass", GroupID: 1}
+	c.Check(Validate(&user), IsNil)
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/zzibert/3fs-rest-api/data"
+)
+
+// Attributes handler for reading and changing the schema of the custom attributes of users
+type Attributes struct {
+	l     *log.Logger
+	store data.AttributeStore
+}
+
+// NewAttributes returns a new attributes handler with the given logger and attribute store
+func NewAttributes(l *log.Logger, s data.AttributeStore) *Attributes {
+	return &Attributes{l, s}
+}
+
+// swagger:route GET /attributes attributes ListAttributes
+// Returns the custom attributes of users ordered by name
+// responses:
+//  200: attributesResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
+
+// ListAll handles GET requests and returns every attribute
+func (a *Attributes) ListAll(rw http.ResponseWriter, r *http.Request) {
+	a.l.Println("get all attributes")
+
+	attributes, err := a.store.GetAttributes()
+	if err != nil {
+		a.l.Println("Error fetching attributes", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = data.ToJSON(&attributes, rw)
+	if err != nil {
+		a.l.Println("error encoding attributes")
+	}
+}
+
+// swagger:route PUT /attributes/{name} attributes putAttribute
+// Define a custom attribute of users or replace its definition, the users must match the new definition
+//
+// responses:
+//  200: attributeResponse
+//  201: attributeResponse
+//  400: errorResponse
+//  409: errorResponse
+//  422: validationErrorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
+
+// Put handles PUT requests to define attributes
+func (a *Attributes) Put(rw http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	a.l.Println("Put attribute", name)
+
+	var attribute data.Attribute
+	err := data.FromJSON(&attribute, r.Body)
+	if err != nil {
+		a.l.Println("Error couldnt parse attribute from request body", err)
+
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeMalformedBody, err))
+		return
+	}
+
+	// the name of the path is the name of the attribute
+	attribute.Name = name
+	if err = data.ValidateAttribute(&attribute); err != nil {
+		a.l.Println("Error invalid attribute", err)
+
+		writeError(rw, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	created, err := a.store.PutAttribute(actor(r), &attribute)
+	switch {
+	case err == nil:
+
+	case errors.Is(err, data.ErrAttributeConstraintViolation):
+		a.l.Println("Error putting attribute", err)
+
+		writeError(rw, r, http.StatusConflict, err)
+		return
+	default:
+		a.l.Println("Error putting attribute", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	err = data.ToJSON(&attribute, rw)
+	if err != nil {
+		a.l.Println("error encoding attribute")
+	}
+}
+
+// swagger:route DELETE /attributes/{name} attributes deleteAttribute
+// Deletes a custom attribute together with the values of every user
+//
+// responses:
+//  204: noContentResponse
+//  404: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
+
+// Delete handles DELETE requests to delete attributes
+func (a *Attributes) Delete(rw http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	a.l.Println("Delete attribute", name)
+
+	err := a.store.DeleteAttribute(actor(r), name)
+	switch err {
+	case nil:
+
+	case data.ErrAttributeNotFound:
+		a.l.Println("Error deleting attribute", err)
+
+		writeError(rw, r, http.StatusNotFound, err)
+		return
+	default:
+		a.l.Println("Error deleting attribute", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/zzibert/3fs-rest-api/data"
+)
+
+// Audit handler for reading the audit log
+type Audit struct {
+	l      *log.Logger
+	store  data.AuditStore
+	paging Paging
+}
+
+// NewAudit returns a new audit handler with the given logger, store and paging
+func NewAudit(l *log.Logger, s data.AuditStore, pg Paging) *Audit {
+	return &Audit{l, s, pg}
+}
+
+// swagger:route GET /audit audit ListAudit
+// Returns a page of the audit log, the changes of users and groups in the order they were made
+// responses:
+//  200: auditResponse
+//  400: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+
+// ListAll handles GET requests and returns a page of the audit log
+func (a *Audit) ListAll(rw http.ResponseWriter, r *http.Request) {
+	a.l.Println("Get audit log")
+
+	pg, err := a.paging.parsePage(r)
+	if err != nil {
+		a.l.Println("Error parsing page", err)
+
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeInvalidParameter, err))
+		return
+	}
+
+	entries, total, err := a.store.GetAuditEntries(pg.listOptions())
+	if errors.Is(err, data.ErrInvalidListOption) {
+		a.l.Println("Error invalid list options", err)
+
+		writeError(rw, r, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		a.l.Println("Error fetching audit log", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	start, end, more := pg.trim(len(entries))
+	entries = entries[start:end]
+
+	pg.writeHeaders(rw, r, total, len(entries), func(i int) data.Cursor { return data.AuditCursor(entries[i], pg.sort) }, more)
+
+	err = data.ToJSON(&entries, rw)
+	if err != nil {
+		a.l.Println("Error encoding audit log", err)
+	}
+}
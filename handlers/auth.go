@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/zzibert/3fs-rest-api/auth"
+	"github.com/zzibert/3fs-rest-api/data"
+)
+
+// errInvalidCredentials is returned for every failed login
+// so that a caller can not tell whether the account exists
+var errInvalidCredentials = fmt.Errorf("invalid credentials")
+
+// Credentials are the user name or email and the password of a login request
+// swagger:model
+type Credentials struct {
+	// the name of the user, used when set
+	//
+	// required: false
+	Name string `json:"name"`
+
+	// the email of the user, used when name is not set
+	//
+	// required: false
+	Email string `json:"email"`
+
+	// the password of the user
+	//
+	// required: true
+	Password string `json:"password"`
+}
+
+// Tokens are the signed tokens issued to an authenticated user
+// swagger:model
+type Tokens struct {
+	// the access token, sent as Authorization: Bearer header
+	AccessToken string `json:"accessToken"`
+
+	// the refresh token, exchanged for new tokens at /auth/refresh
+	RefreshToken string `json:"refreshToken"`
+
+	// the type of the tokens, always Bearer
+	TokenType string `json:"tokenType"`
+
+	// the number of seconds the access token is valid
+	ExpiresIn int `json:"expiresIn"`
+}
+
+// Refresh is the request to exchange a refresh token for new tokens
+// swagger:model
+type Refresh struct {
+	// the refresh token
+	//
+	// required: true
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Login is the response to a successful login
+type Login struct {
+	// the authenticated user
+	User data.User `json:"user"`
+
+	// the primary group of the user, without its users, missing when the user has no primary group
+	Group *data.Group `json:"group,omitempty"`
+
+	Tokens
+}
+
+// Auth handler for verifying user credentials and tokens
+type Auth struct {
+	l         *log.Logger
+	users     data.UserStore
+	groups    data.GroupStore
+	passwords *auth.Passwords
+	tokens    *auth.Tokens
+	dummy     string
+}
+
+// NewAuth returns a new auth handler with the given logger, stores, password hasher and token issuer
+func NewAuth(l *log.Logger, us data.UserStore, gs data.GroupStore, p *auth.Passwords, t *auth.Tokens) *Auth {
+	// dummy is verified when no user matches, so a login takes as long for unknown accounts
+	dummy, err := p.Hash("dummy password")
+	if err != nil {
+		panic(err)
+	}
+
+	return &Auth{l, us, gs, p, t, dummy}
+}
+
+// swagger:route POST /auth/login auth login
+// Verifies the name or email and password of a user
+//
+// responses:
+//  200: loginResponse
+//  400: errorResponse
+//  401: errorResponse
+
+// Login handles POST requests to verify user credentials
+func (a *Auth) Login(rw http.ResponseWriter, r *http.Request) {
+	var credentials Credentials
+	err := data.FromJSON(&credentials, r.Body)
+	if err != nil {
+		a.l.Println("Error couldnt parse credentials from request body", err)
+
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeMalformedBody, err))
+		return
+	}
+
+	var user data.User
+	if credentials.Name != "" {
+		user, err = a.users.GetUserByName(credentials.Name)
+	} else {
+		user, err = a.users.GetUserByEmail(credentials.Email)
+	}
+
+	switch err {
+	case nil:
+
+	case data.ErrUserNotFound:
+		a.passwords.Verify(a.dummy, credentials.Password)
+		a.unauthorized(rw, r, "Error login for unknown user")
+		return
+	default:
+		a.l.Println("Error fetching user", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	ok, rehash := a.passwords.Verify(user.Password, credentials.Password)
+	if !ok {
+		a.unauthorized(rw, r, "Error login with wrong password for user id", user.ID)
+		return
+	}
+
+	// legacy plain text passwords and outdated hashes are replaced on a successful login
+	if rehash {
+		user.Password = a.rehash(r, user, credentials.Password)
+	}
+
+	tokens, err := a.issue(user)
+	if err != nil {
+		a.l.Println("Error issuing tokens", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	login := Login{User: user, Tokens: tokens}
+	if user.GroupID != 0 {
+		group, err := a.groups.GetGroupById(user.GroupID)
+		if err != nil {
+			a.l.Println("Error fetching group", err)
+
+			writeError(rw, r, http.StatusInternalServerError, err)
+			return
+		}
+		group.Users = nil
+		login.Group = &group
+	}
+
+	a.l.Println("Login user id", user.ID)
+
+	err = data.ToJSON(&login, rw)
+	if err != nil {
+		a.l.Println("Error encoding login", err)
+	}
+}
+
+// swagger:route POST /auth/refresh auth refresh
+// Exchanges a refresh token for new tokens
+//
+// responses:
+//  200: tokensResponse
+//  400: errorResponse
+//  401: errorResponse
+
+// Refresh handles POST requests to exchange a refresh token for new tokens
+func (a *Auth) Refresh(rw http.ResponseWriter, r *http.Request) {
+	var refresh Refresh
+	err := data.FromJSON(&refresh, r.Body)
+	if err != nil {
+		a.l.Println("Error couldnt parse refresh token from request body", err)
+
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeMalformedBody, err))
+		return
+	}
+
+	user, err := a.verify(refresh.RefreshToken, auth.RefreshToken)
+	if err != nil {
+		a.tokenError(rw, r, err, "Error refreshing tokens")
+		return
+	}
+
+	tokens, err := a.issue(user)
+	if err != nil {
+		a.l.Println("Error issuing tokens", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = data.ToJSON(&tokens, rw)
+	if err != nil {
+		a.l.Println("Error encoding tokens", err)
+	}
+}
+
+// swagger:route GET /.well-known/jwks.json auth jwks
+// Returns the public keys that verify the signature of tokens
+//
+// responses:
+//  200: jwksResponse
+
+// JWKS handles GET requests for the public keys of the token signing keys
+func (a *Auth) JWKS(rw http.ResponseWriter, r *http.Request) {
+	jwks := a.tokens.Keys().JWKS()
+
+	err := data.ToJSON(&jwks, rw)
+	if err != nil {
+		a.l.Println("Error encoding jwks", err)
+	}
+}
+
+// verify checks the token and returns the user it was issued to
+// Tokens of deleted users and tokens issued before a password change are rejected
+func (a *Auth) verify(token, typ string) (data.User, error) {
+	claims, err := a.tokens.Verify(token, typ)
+	if err != nil {
+		return data.User{}, err
+	}
+
+	user, err := a.users.GetUserById(claims.UserID())
+	if err != nil {
+		return data.User{}, err
+	}
+
+	if claims.Password != auth.PasswordFingerprint(user.Password) {
+		return data.User{}, auth.ErrInvalidToken
+	}
+	return user, nil
+}
+
+// issue returns new tokens for the user
+func (a *Auth) issue(user data.User) (Tokens, error) {
+	access, refresh, err := a.tokens.Issue(user.ID, user.Password)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	return Tokens{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(a.tokens.AccessTTL().Seconds()),
+	}, nil
+}
+
+// tokenError writes a 401 response for an invalid token or a token of a deleted user
+// and a 500 response for any other error
+func (a *Auth) tokenError(rw http.ResponseWriter, r *http.Request, err error, v ...interface{}) {
+	if err == auth.ErrInvalidToken || err == data.ErrUserNotFound {
+		a.unauthorized(rw, r, append(v, err)...)
+		return
+	}
+
+	a.l.Println(append(v, err)...)
+
+	writeError(rw, r, http.StatusInternalServerError, err)
+}
+
+// unauthorized logs the reason of a failed login and writes the generic 401 response
+func (a *Auth) unauthorized(rw http.ResponseWriter, r *http.Request, v ...interface{}) {
+	a.l.Println(v...)
+
+	rw.Header().Set("WWW-Authenticate", "Bearer")
+	writeError(rw, r, http.StatusUnauthorized, errInvalidCredentials)
+}
+
+// rehash stores a new hash of the password for the user and returns the stored password,
+// the change is made by the user logging in and failures only get logged
+func (a *Auth) rehash(r *http.Request, user data.User, password string) string {
+	hash, err := a.passwords.Hash(password)
+	if err == nil {
+		err = a.users.UpdateUser(data.Actor{UserID: user.ID, RequestID: RequestIDOf(r)}, user.ID, 0, map[string]interface{}{"password": hash})
+	}
+	if err != nil {
+		a.l.Println("Error rehashing password for user id", user.ID, err)
+		return user.Password
+	}
+	return hash
+}
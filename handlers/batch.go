@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/zzibert/3fs-rest-api/data"
+)
+
+// Batch modes
+const (
+	// BatchAtomic runs every operation of a batch or none of them
+	BatchAtomic = "atomic"
+
+	// BatchBestEffort runs every operation of a batch that succeeds
+	BatchBestEffort = "best-effort"
+)
+
+// DefaultMaxBatch is the largest number of operations of a batch when nothing else is configured
+const DefaultMaxBatch = 100
+
+// errBatchMode is returned for a batch with an unknown mode
+var errBatchMode = fmt.Errorf("mode must be %s or %s", BatchAtomic, BatchBestEffort)
+
+// errEmptyBatch is returned for a batch without operations
+var errEmptyBatch = fmt.Errorf("batch has no operations")
+
+// UserBatch is a batch of changes of users
+// swagger:model
+type UserBatch struct {
+	// how the operations run, atomic runs every operation or none of them and best-effort runs every operation that succeeds
+	//
+	// required: false
+	// enum: atomic,best-effort
+	Mode string `json:"mode"`
+
+	// the operations, run in order
+	//
+	// required: true
+	Operations []UserBatchOperation `json:"operations"`
+}
+
+// UserBatchOperation is a single change of a batch of changes of users
+// Updates and deletes are checked against the users as they were before the batch
+// swagger:model
+type UserBatchOperation struct {
+	// the kind of change
+	//
+	// required: true
+	// enum: create,update,delete
+	Op string `json:"op"`
+
+	// the id of the updated or deleted user
+	ID int `json:"id,omitempty"`
+
+	// the version the updated or deleted user must have like in an If-Match header, required when If-Match is required
+	Version int `json:"version,omitempty"`
+
+	// the new user of a create or the JSON Merge Patch of the user of an update
+	User json.RawMessage `json:"user,omitempty"`
+}
+
+// BatchResult is the result of a single operation of a batch
+// swagger:model
+type BatchResult struct {
+	// the position of the operation in the batch
+	Index int `json:"index"`
+
+	// the status of the operation, the status of the same single request
+	Status int `json:"status"`
+
+	// the id of the created, updated or deleted user
+	ID int `json:"id,omitempty"`
+
+	// the problem details of a failed operation
+	Problem *Problem `json:"problem,omitempty"`
+}
+
+// swagger:route POST /users:batch users batchUsers
+// Create, update and delete users with a single request
+// The operations get the statuses and problem details of the same single requests,
+// the operations of a failed atomic batch that were not applied fail with 424 BATCH_ABORTED
+//
+// responses:
+//  200: batchResponse
+//  207: batchResponse
+//  400: errorResponse
+//  413: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+
+// Batch handles POST requests with a batch of changes of users,
+// the response is 200 when every operation succeeded and 207 otherwise
+func (u *Users) Batch(rw http.ResponseWriter, r *http.Request) {
+	var batch UserBatch
+	if err := data.FromJSON(&batch, r.Body); err != nil {
+		u.l.Println("Error couldnt parse batch from request body", err)
+
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeMalformedBody, err))
+		return
+	}
+
+	u.l.Println("Batch of", len(batch.Operations), "user operations")
+
+	if batch.Mode == "" {
+		batch.Mode = BatchAtomic
+	}
+	switch {
+	case batch.Mode != BatchAtomic && batch.Mode != BatchBestEffort:
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeInvalidParameter, errBatchMode))
+		return
+	case len(batch.Operations) == 0:
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeInvalidParameter, errEmptyBatch))
+		return
+	case len(batch.Operations) > u.maxBatch:
+		err := fmt.Errorf("batch has %d operations, at most %d are allowed", len(batch.Operations), u.maxBatch)
+		writeError(rw, r, http.StatusRequestEntityTooLarge, withCode(CodeBatchTooLarge, err))
+		return
+	}
+
+	// the operations that can not be prepared fail without reaching the store
+	results := make([]BatchResult, len(batch.Operations))
+	var ops []data.UserOperation
+	var indexes []int
+	for i, operation := range batch.Operations {
+		results[i] = BatchResult{Index: i, ID: operation.ID}
+		op, status, err := u.prepare(r, operation)
+		if err != nil {
+			u.fail(r, &results[i], status, err)
+			continue
+		}
+		ops = append(ops, op)
+		indexes = append(indexes, i)
+	}
+
+	atomic := batch.Mode == BatchAtomic
+	if atomic && len(ops) < len(batch.Operations) {
+		for _, i := range indexes {
+			u.fail(r, &results[i], http.StatusFailedDependency, data.ErrBatchAborted)
+		}
+		ops, indexes = nil, nil
+	}
+
+	for j, err := range u.store.ApplyUsers(actor(r), ops, atomic) {
+		result := &results[indexes[j]]
+		switch {
+		case err == nil && ops[j].Op == data.BatchCreate:
+			result.Status = http.StatusOK
+			result.ID = ops[j].User.ID
+		case err == nil:
+			result.Status = http.StatusNoContent
+		case err == data.ErrUserNotFound:
+			u.fail(r, result, http.StatusNotFound, err)
+		case errors.Is(err, data.ErrUserConstraintViolation), errors.As(err, new(data.ValidationError)):
+			u.fail(r, result, http.StatusUnprocessableEntity, err)
+		default:
+			u.fail(r, result, http.StatusInternalServerError, err)
+		}
+	}
+
+	status := http.StatusOK
+	for _, result := range results {
+		if result.Problem != nil {
+			status = http.StatusMultiStatus
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	err := data.ToJSON(&results, rw)
+	if err != nil {
+		u.l.Println("Error encoding batch results", err)
+	}
+}
+
+// prepare checks an operation of a batch like the single request would be checked
+// and returns the store operation, or the status and error of the failed check
+func (u *Users) prepare(r *http.Request, operation UserBatchOperation) (data.UserOperation, int, error) {
+	switch operation.Op {
+	case data.BatchCreate:
+		var user data.User
+		if err := json.Unmarshal(operation.User, &user); err != nil {
+			return data.UserOperation{}, http.StatusBadRequest, withCode(CodeMalformedBody, err)
+		}
+		if err := data.Validate(&user); err != nil {
+			return data.UserOperation{}, http.StatusUnprocessableEntity, err
+		}
+		if status, err := checkJoin(u.groups, r, user.GroupID); err != nil {
+			return data.UserOperation{}, status, err
+		}
+
+		var err error
+		if user.Password, err = u.passwords.Hash(user.Password); err != nil {
+			return data.UserOperation{}, http.StatusInternalServerError, err
+		}
+		return data.UserOperation{Op: data.BatchCreate, User: &user}, 0, nil
+
+	case data.BatchUpdate:
+		current, err := u.store.GetUserById(operation.ID)
+		switch {
+		case err == data.ErrUserNotFound:
+			return data.UserOperation{}, http.StatusNotFound, err
+		case err != nil:
+			return data.UserOperation{}, http.StatusInternalServerError, err
+		}
+		if status, err := u.checkVersion(operation.Version, current.Version); err != nil {
+			return data.UserOperation{}, status, err
+		}
+
+		doc, err := toDocument(current)
+		if err != nil {
+			return data.UserOperation{}, http.StatusInternalServerError, err
+		}
+		var patch interface{}
+		if err = json.Unmarshal(operation.User, &patch); err != nil {
+			return data.UserOperation{}, http.StatusBadRequest, withCode(CodeInvalidPatch, err)
+		}
+		patched, ok := mergePatch(map[string]interface{}(doc), patch).(map[string]interface{})
+		if !ok {
+			return data.UserOperation{}, http.StatusBadRequest, withCode(CodeInvalidPatch, fmt.Errorf("document must be an object"))
+		}
+
+		userMap, err := userSchema.check(doc, patched, &data.User{})
+		if err != nil {
+			return data.UserOperation{}, http.StatusUnprocessableEntity, err
+		}
+		if groupID, moved := movedTo(doc, userMap); moved {
+			if status, err := checkJoin(u.groups, r, groupID); err != nil {
+				return data.UserOperation{}, status, err
+			}
+		}
+		if password, ok := userMap["password"].(string); ok {
+			if userMap["password"], err = u.passwords.Hash(password); err != nil {
+				return data.UserOperation{}, http.StatusInternalServerError, err
+			}
+		}
+
+		// like a PATCH the update fails when the user changes after it was read
+		return data.UserOperation{Op: data.BatchUpdate, ID: operation.ID, Version: current.Version, Values: userMap}, 0, nil
+
+	case data.BatchDelete:
+		if operation.Version == 0 && u.requireIfMatch {
+			return data.UserOperation{}, http.StatusPreconditionRequired, errPreconditionRequired
+		}
+		return data.UserOperation{Op: data.BatchDelete, ID: operation.ID, Version: operation.Version}, 0, nil
+	}
+	return data.UserOperation{}, http.StatusBadRequest, withCode(CodeInvalidParameter, data.ErrUnknownOperation)
+}
+
+// checkVersion checks the version of an operation against the current version of the user like an If-Match header
+func (u *Users) checkVersion(version, current int) (int, error) {
+	switch {
+	case version == 0 && u.requireIfMatch:
+		return http.StatusPreconditionRequired, errPreconditionRequired
+	case version != 0 && version != current:
+		return http.StatusPreconditionFailed, errPreconditionFailed
+	}
+	return 0, nil
+}
+
+// fail sets the problem details of a failed operation on its result
+func (u *Users) fail(r *http.Request, result *BatchResult, status int, err error) {
+	u.l.Println("Error in operation", result.Index, "of batch", err)
+
+	p := problem(r, status, err)
+	result.Status = p.Status
+	result.Problem = &p
+}
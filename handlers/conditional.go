@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+
+	"github.com/zzibert/3fs-rest-api/data"
+)
+
+// errPreconditionFailed is an error raised when the If-Match header does not match the current entity tag
+var errPreconditionFailed = fmt.Errorf("If-Match does not match the current version")
+
+// errPreconditionRequired is an error raised when a change is sent without an If-Match header while it is required
+var errPreconditionRequired = fmt.Errorf("If-Match header is required")
+
+// userETag returns the entity tag of a user, its version
+func userETag(user data.User) string {
+	return fmt.Sprintf(`"%d"`, user.Version)
+}
+
+// groupETag returns the entity tag of a group, its version and a hash of the versions of its users
+// so that the tag changes when users join, leave or change
+func groupETag(group data.Group) string {
+	h := fnv.New32a()
+	for _, user := range group.Users {
+		fmt.Fprintf(h, "%d:%d,", user.ID, user.Version)
+	}
+	return fmt.Sprintf(`"%d-%x"`, group.Version, h.Sum32())
+}
+
+// matchETag reports whether the list of entity tags in a conditional header matches etag
+// weak tags compare equal to strong tags with the same value when weak is true
+func matchETag(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified writes a 304 response and returns true when the If-None-Match header matches etag
+func notModified(rw http.ResponseWriter, r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" || !matchETag(header, etag, true) {
+		return false
+	}
+
+	rw.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// checkIfMatch writes an error response and returns false when the If-Match header does not match etag
+// or when it is missing and required
+func checkIfMatch(rw http.ResponseWriter, r *http.Request, etag string, required bool) bool {
+	header := r.Header.Get("If-Match")
+	switch {
+	case header == "" && required:
+		writeError(rw, r, http.StatusPreconditionRequired, errPreconditionRequired)
+		return false
+	case header != "" && !matchETag(header, etag, false):
+		writeError(rw, r, http.StatusPreconditionFailed, errPreconditionFailed)
+		return false
+	}
+	return true
+}
@@ -11,58 +11,397 @@
 //
 //	Produces:
 //	- application/json
+//	- application/problem+json
+//
+//	Security:
+//	- bearer:
+//
+//	SecurityDefinitions:
+//	bearer:
+//	  type: apiKey
+//	  name: Authorization
+//	  in: header
 //
 // swagger:meta
 package handlers
 
-import "github.com/zzibert/3fs-rest-api/data"
+import (
+	"github.com/zzibert/3fs-rest-api/auth"
+	"github.com/zzibert/3fs-rest-api/data"
+)
 
-// Generic error message returned as a string
+// Problem details of an error
 // swagger:response errorResponse
 type errorResponseWrapper struct {
 	// Description of the error
 	// in: body
-	Body GenericError
+	Body Problem
 }
 
-// GenericError is a generic error message
-type GenericError struct {
-	Message string `json:"message"`
+// Problem details of a request with invalid fields
+// swagger:response validationErrorResponse
+type validationErrorResponseWrapper struct {
+	// Description of the invalid fields
+	// in: body
+	Body Problem
 }
 
-// A list of groups
+// A page of groups
 // swagger:response groupsResponse
 type groupsResponseWrapper struct {
-	// All current groups
+	// The total number of groups
+	XTotalCount int `json:"X-Total-Count"`
+
+	// Links to the next and previous pages
+	Link string
+
+	// The groups of the page
 	// in: body
 	Body []data.Group
 }
 
-// A list of users
+// A page of users
 // swagger:response usersResponse
 type usersResponseWrapper struct {
-	// All current users
+	// The total number of users
+	XTotalCount int `json:"X-Total-Count"`
+
+	// Links to the next and previous pages
+	Link string
+
+	// The users of the page
 	// in: body
 	Body []data.User
 }
 
+// A page of the audit log
+// swagger:response auditResponse
+type auditResponseWrapper struct {
+	// The total number of entries
+	XTotalCount int `json:"X-Total-Count"`
+
+	// Links to the next and previous pages
+	Link string
+
+	// The entries of the page
+	// in: body
+	Body []data.AuditEntry
+}
+
+// The page of a list
+// swagger:parameters ListUsers ListGroups ListAudit
+type pageParamsWrapper struct {
+	// the number of items on the page, at most the configured maximum
+	// in: query
+	Limit int `json:"limit"`
+
+	// the number of items skipped, can not be combined with cursor
+	// in: query
+	Offset int `json:"offset"`
+
+	// the opaque cursor from the Link header of a previous page
+	// in: query
+	Cursor string `json:"cursor"`
+
+	// comma separated fields the items are ordered by, descending with a leading -, e.g. name,-id
+	// in: query
+	Sort string `json:"sort"`
+}
+
+// The flag that includes deleted users or groups
+// swagger:parameters ListUsers ListGroups ListUser ListGroup
+type includeDeletedParamsWrapper struct {
+	// include deleted users or groups, requires the users:admin or groups:admin permission
+	// in: query
+	IncludeDeleted bool `json:"include_deleted"`
+}
+
+// The flag that deletes the descendants of a group
+// swagger:parameters deleteGroup
+type cascadeParamsWrapper struct {
+	// delete the descendants of the group as well, without it a group with child groups is not deleted
+	// in: query
+	Cascade bool `json:"cascade"`
+}
+
+// The filters of the list of users
+// swagger:parameters ListUsers
+type userFilterParamsWrapper struct {
+	// the exact name
+	// in: query
+	Name string `json:"name"`
+
+	// the start of the name
+	// in: query
+	NamePrefix string `json:"name[prefix]"`
+
+	// the exact email
+	// in: query
+	Email string `json:"email"`
+
+	// the start of the email
+	// in: query
+	EmailPrefix string `json:"email[prefix]"`
+
+	// the domain of the email
+	// in: query
+	EmailDomain string `json:"email[domain]"`
+
+	// the id of the group
+	// in: query
+	GroupID int `json:"groupID"`
+}
+
+// The filters of the list of groups
+// swagger:parameters ListGroups
+type groupFilterParamsWrapper struct {
+	// the exact name
+	// in: query
+	Name string `json:"name"`
+
+	// the start of the name
+	// in: query
+	NamePrefix string `json:"name[prefix]"`
+}
+
+// The filters of the audit log
+// swagger:parameters ListAudit
+type auditFilterParamsWrapper struct {
+	// the kind of the changed entity, user, group or attribute
+	// in: query
+	Entity string `json:"entity"`
+
+	// the id of the changed entity
+	// in: query
+	EntityID int `json:"entityID"`
+
+	// the id of the user that made the change, 0 for the system
+	// in: query
+	ActorID int `json:"actorID"`
+
+	// the action, one of create, update, delete, restore, purge, grant or revoke
+	// in: query
+	Action string `json:"action"`
+
+	// the id of the request that made the change
+	// in: query
+	RequestID string `json:"requestID"`
+
+	// the RFC 3339 time the changes were made at or after
+	// in: query
+	// swagger:strfmt date-time
+	CreatedAtFrom string `json:"createdAt[from]"`
+
+	// the RFC 3339 time the changes were made before
+	// in: query
+	// swagger:strfmt date-time
+	CreatedAtTo string `json:"createdAt[to]"`
+}
+
+// The users and groups matching a search
+// swagger:response searchResponse
+type searchResponseWrapper struct {
+	// matching users and groups, best matches first
+	// in: body
+	Body []data.SearchResult
+}
+
+// The query of a search
+// swagger:parameters search
+type searchParamsWrapper struct {
+	// a fragment of a user name or email or of a group name, typos are tolerated
+	// in: query
+	// required: true
+	Q string `json:"q"`
+
+	// the maximum number of results, at most the configured maximum
+	// in: query
+	Limit int `json:"limit"`
+}
+
+// The user that replaces a user
+// swagger:parameters updateUser
+type userParamsWrapper struct {
+	// the full user, a missing password keeps the current password
+	// in: body
+	// required: true
+	Body data.User
+}
+
+// The group that replaces a group
+// swagger:parameters updateGroup
+type groupParamsWrapper struct {
+	// the full group, its users and permissions are read only
+	// in: body
+	// required: true
+	Body data.Group
+}
+
+// The batch of changes of users
+// swagger:parameters batchUsers
+type userBatchParamsWrapper struct {
+	// the mode and operations of the batch, at most the configured maximum of operations
+	// in: body
+	// required: true
+	Body UserBatch
+}
+
+// The definition of an attribute
+// swagger:parameters putAttribute
+type attributeParamsWrapper struct {
+	// the attribute, its name is the name of the path
+	// in: body
+	// required: true
+	Body data.Attribute
+}
+
+// The rule of a previewed dynamic group
+// swagger:parameters previewRule
+type rulePreviewParamsWrapper struct {
+	// the rule the members are previewed of
+	// in: body
+	// required: true
+	Body RulePreview
+}
+
+// The results of the operations of a batch
+// swagger:response batchResponse
+type batchResponseWrapper struct {
+	// the result of every operation in the order of the operations
+	// in: body
+	Body []BatchResult
+}
+
+// The patch of a user or group
+// swagger:parameters patchUser patchGroup
+type patchParamsWrapper struct {
+	// a JSON Merge Patch object or a JSON Patch array of operations, depending on the Content-Type
+	// in: body
+	// required: true
+	Body interface{}
+}
+
 // A single group
 // swagger:response groupResponse
 type groupResponseWrapper struct {
+	// The entity tag of the group, its version and a hash of the versions of its users
+	ETag string
+
 	// a single group
 	// in: body
 	Body data.Group
 }
 
+// The custom attributes of users
+// swagger:response attributesResponse
+type attributesResponseWrapper struct {
+	// every attribute ordered by name
+	// in: body
+	Body []data.Attribute
+}
+
+// The admins of a group
+// swagger:response adminsResponse
+type adminsResponseWrapper struct {
+	// the owners and managers ordered by user id
+	// in: body
+	Body []data.GroupAdmin
+}
+
+// The role of an admin of a group
+// swagger:parameters setAdmin
+type adminRoleParamsWrapper struct {
+	// the role given to the user
+	// in: body
+	// required: true
+	Body AdminRole
+}
+
+// A single attribute
+// swagger:response attributeResponse
+type attributeResponseWrapper struct {
+	// the attribute with its id
+	// in: body
+	Body data.Attribute
+}
+
 // A single user
 // swagger:response userResponse
 type userResponseWrapper struct {
+	// The entity tag of the user, its version
+	ETag string
+
 	// a single user
 	// in: body
 	Body data.User
 }
 
+// The user and group of a successful login
+// swagger:response loginResponse
+type loginResponseWrapper struct {
+	// the authenticated user and their group
+	// in: body
+	Body Login
+}
+
+// The credentials of a login request
+// swagger:parameters login
+type credentialsParamsWrapper struct {
+	// user name or email and password
+	// in: body
+	// required: true
+	Body Credentials
+}
+
+// The tokens issued for a refresh token
+// swagger:response tokensResponse
+type tokensResponseWrapper struct {
+	// new access and refresh tokens
+	// in: body
+	Body Tokens
+}
+
+// The refresh token of a refresh request
+// swagger:parameters refresh
+type refreshParamsWrapper struct {
+	// refresh token
+	// in: body
+	// required: true
+	Body Refresh
+}
+
+// The public keys of the token signing keys
+// swagger:response jwksResponse
+type jwksResponseWrapper struct {
+	// JSON Web Key Set
+	// in: body
+	Body auth.JWKS
+}
+
 // No content is returned by this API endpoint
 // swagger:response noContentResponse
 type noContentResponseWrapper struct {
 }
+
+// The user or group did not change since the version in the If-None-Match header
+// swagger:response notModifiedResponse
+type notModifiedResponseWrapper struct {
+	// The entity tag of the user or group
+	ETag string
+}
+
+// The version a user or group is read with
+// swagger:parameters ListUser ListGroup
+type ifNoneMatchParamsWrapper struct {
+	// entity tags of cached versions, a match returns 304 without a body
+	// in: header
+	IfNoneMatch string `json:"If-None-Match"`
+}
+
+// The version a user or group is changed from
+// swagger:parameters updateUser patchUser deleteUser updateGroup patchGroup deleteGroup
+type ifMatchParamsWrapper struct {
+	// the entity tag of the current version, another version returns 412 and a missing tag returns 428 when it is required
+	// in: header
+	IfMatch string `json:"If-Match"`
+}
@@ -1,54 +1,126 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"reflect"
+	"strconv"
 
-	"github.com/jinzhu/gorm"
+	"github.com/gorilla/mux"
 	"github.com/zzibert/3fs-rest-api/data"
 )
 
+// CascadeParam is the query flag that deletes a group together with its descendants
+const CascadeParam = "cascade"
+
+// errRenameOnly is returned when an owner or manager of a group changes more than its name
+var errRenameOnly = fmt.Errorf("owners and managers can only rename the group")
+
+// errPlaceGroup is returned when a group gets a parent or rule without groups:admin,
+// the members of a group hold the permissions of its ancestors and a rule makes users members
+var errPlaceGroup = fmt.Errorf("missing permission %s to change the parent or rule of a group", data.PermGroupsAdmin)
+
+// errCascadeOwner is returned when an owner of a group deletes it together with its descendants
+var errCascadeOwner = fmt.Errorf("owners can not delete the descendants of the group")
+
+// AdminRole is the role given to an admin of a group
+// swagger:model
+type AdminRole struct {
+	// the role of the user in the group
+	//
+	// required: true
+	// enum: owner,manager
+	Role string `json:"role"`
+}
+
 // Groups Handler for getting and updating groups
 type Groups struct {
-	l  *log.Logger
-	Db *gorm.DB
+	l      *log.Logger
+	store  data.GroupStore
+	paging Paging
+
+	// requireIfMatch rejects changes without an If-Match header
+	requireIfMatch bool
 }
 
-// NewGroups returns a new groups handler
-func NewGroups(l *log.Logger, db *gorm.DB) *Groups {
-	return &Groups{l, db}
+// NewGroups returns a new groups handler with the given logger, group store and paging
+// When requireIfMatch is true updates and deletes must send the ETag of the group in an If-Match header
+func NewGroups(l *log.Logger, s data.GroupStore, pg Paging, requireIfMatch bool) *Groups {
+	return &Groups{l, s, pg, requireIfMatch}
 }
 
 // swagger:route GET /groups groups ListGroups
 // Return a list of groups from the database
 // responses:
 //  200: groupsResponse
+//  400: errorResponse
+//  401: errorResponse
+//  403: errorResponse
 
-// ListAll handles GET requests and returns all groups
+// ListAll handles GET requests and returns a page of groups
 func (g *Groups) ListAll(rw http.ResponseWriter, r *http.Request) {
 	g.l.Println("get all groups")
 
-	groups := data.GetGroups(g.Db)
+	pg, err := g.paging.parsePage(r)
+	if err != nil {
+		g.l.Println("Error parsing page", err)
+
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeInvalidParameter, err))
+		return
+	}
+
+	groups, total, err := g.store.GetGroups(pg.listOptions())
+	if errors.Is(err, data.ErrInvalidListOption) {
+		g.l.Println("Error invalid list options", err)
+
+		writeError(rw, r, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		g.l.Println("Error fetching groups", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	start, end, more := pg.trim(len(groups))
+	groups = groups[start:end]
 
-	err := data.ToJSON(&groups, rw)
+	pg.writeHeaders(rw, r, total, len(groups), func(i int) data.Cursor { return data.GroupCursor(groups[i], pg.sort) }, more)
+
+	err = data.ToJSON(&groups, rw)
 	if err != nil {
 		g.l.Println("error encoding groups")
 	}
 }
 
 // swagger:route GET /groups/{id} groups ListGroup
-// returns a single group from the database
+// returns a single group from the database with its ETag
 // responses:
 //  200: groupResponse
+//  304: notModifiedResponse
+//  400: errorResponse
 //  404: errorResponse
+//  401: errorResponse
+//  403: errorResponse
 
-// ListSingle handles GET requests with id parameter
+// ListSingle handles GET requests with id parameter, a matching If-None-Match header gets a 304 response
 func (g *Groups) ListSingle(rw http.ResponseWriter, r *http.Request) {
 	id := getId(r)
 
 	g.l.Println("get group id", id)
 
-	group, err := data.GetGroupById(id, g.Db)
+	include, err := includeDeleted(r)
+	if err != nil {
+		g.l.Println("Error parsing include_deleted", err)
+
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeInvalidParameter, err))
+		return
+	}
+
+	group, err := g.group(id, include)
 
 	switch err {
 	case nil:
@@ -56,14 +128,18 @@ func (g *Groups) ListSingle(rw http.ResponseWriter, r *http.Request) {
 	case data.ErrGroupNotFound:
 		g.l.Println("Error fetching group", err)
 
-		rw.WriteHeader(http.StatusNotFound)
-		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		writeError(rw, r, http.StatusNotFound, err)
 		return
 	default:
 		g.l.Println("Error fetching group", err)
 
-		rw.WriteHeader(http.StatusInternalServerError)
-		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	etag := groupETag(group)
+	rw.Header().Set("ETag", etag)
+	if notModified(rw, r, etag) {
 		return
 	}
 
@@ -73,56 +149,241 @@ func (g *Groups) ListSingle(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// swagger:route PUT /groups groups updateGroup
-// Update a group
+// swagger:route PUT /groups/{id} groups updateGroup
+// Replace a group, its users and permissions are not changed, owners and managers of the group can only change its name
+// Changing the parent or rule of the group takes groups:admin
 //
 // responses:
-// 204: noContentResponse
-// 404: errorResponse
-
-// Update handles PUT requests to update group
+//  204: noContentResponse
+//  400: errorResponse
+//  404: errorResponse
+//  409: errorResponse
+//  412: errorResponse
+//  422: validationErrorResponse
+//  428: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
+
+// Update handles PUT requests to replace groups
 func (g *Groups) Update(rw http.ResponseWriter, r *http.Request) {
 	id := getId(r)
 
 	g.l.Println("Update Group id: ", id)
 
-	groupMap := make(map[string]interface{})
-	err := data.FromJSON(&groupMap, r.Body)
+	current, version, ok := g.document(rw, r, id)
+	if !ok {
+		return
+	}
+
+	doc, err := readDocument(r.Body)
 	if err != nil {
-		g.l.Println("Error couldnt parse group map from request body", err)
+		g.l.Println("Error couldnt parse group from request body", err)
 
-		rw.WriteHeader(http.StatusBadRequest)
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeMalformedBody, err))
 		return
 	}
 
-	err = data.UpdateGroup(id, groupMap, g.Db)
+	g.replace(rw, r, id, version, current, doc)
+}
+
+// swagger:route PATCH /groups/{id} groups patchGroup
+// Change fields of a group with a JSON Merge Patch or a JSON Patch, owners and managers of the group can only change its name
+// Changing the parent or rule of the group takes groups:admin
+//
+// consumes:
+// - application/merge-patch+json
+// - application/json-patch+json
+//
+// responses:
+//  204: noContentResponse
+//  400: errorResponse
+//  404: errorResponse
+//  409: errorResponse
+//  412: errorResponse
+//  415: errorResponse
+//  422: validationErrorResponse
+//  428: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
+
+// Patch handles PATCH requests to change groups
+func (g *Groups) Patch(rw http.ResponseWriter, r *http.Request) {
+	id := getId(r)
+
+	g.l.Println("Patch Group id: ", id)
+
+	current, version, ok := g.document(rw, r, id)
+	if !ok {
+		return
+	}
+
+	doc, err := toDocument(current)
+	if err == nil {
+		doc, err = applyPatch(r, doc)
+	}
+	if err != nil {
+		g.l.Println("Error applying patch", err)
+
+		writePatchError(rw, r, err)
+		return
+	}
+
+	g.replace(rw, r, id, version, current, doc)
+}
+
+// document returns the group as a document with its version,
+// it writes an error response and returns false when the group can not be fetched or does not match the If-Match header
+func (g *Groups) document(rw http.ResponseWriter, r *http.Request, id int) (document, int, bool) {
+	group, err := g.store.GetGroupById(id)
 
 	switch err {
 	case nil:
 
 	case data.ErrGroupNotFound:
+		g.l.Println("Error fetching group", err)
+
+		writeError(rw, r, http.StatusNotFound, err)
+		return nil, 0, false
+	default:
+		g.l.Println("Error fetching group", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return nil, 0, false
+	}
+
+	if !checkIfMatch(rw, r, groupETag(group), g.requireIfMatch) {
+		g.l.Println("Error precondition of group failed")
+		return nil, 0, false
+	}
+
+	doc, err := toDocument(group)
+	if err != nil {
+		g.l.Println("Error encoding group", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return nil, 0, false
+	}
+	return doc, group.Version, true
+}
+
+// group returns the group with the given id, a deleted group is only returned when includeDeleted is true
+func (g *Groups) group(id int, includeDeleted bool) (data.Group, error) {
+	if !includeDeleted {
+		return g.store.GetGroupById(id)
+	}
+
+	filter := data.Filter{Field: "id", Op: data.OpEq, Value: strconv.Itoa(id)}
+	groups, _, err := g.store.GetGroups(data.ListOptions{Filters: []data.Filter{filter}, IncludeDeleted: true})
+	if err != nil {
+		return data.Group{}, err
+	}
+	if len(groups) == 0 {
+		return data.Group{}, data.ErrGroupNotFound
+	}
+	return *groups[0], nil
+}
+
+// replace checks the new document of the group against the group schema and stores it
+// if the group no longer has the given version a 412 response is written
+func (g *Groups) replace(rw http.ResponseWriter, r *http.Request, id, version int, current, doc document) {
+	groupMap, err := groupSchema.check(current, doc, &data.Group{})
+	if err != nil {
+		g.l.Println("Error invalid group", err)
+
+		writeError(rw, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	if GroupRole(r) != "" && !renamesOnly(current, groupMap) {
+		g.l.Println("Error", GroupRole(r), "changing group id", id)
+
+		writeError(rw, r, http.StatusForbidden, errRenameOnly)
+		return
+	}
+	if changesField(current, groupMap, "parentID") || changesField(current, groupMap, "rule") {
+		permitted, err := holdsPermission(g.store, r, data.PermGroupsAdmin)
+		if err != nil {
+			g.l.Println("Error fetching permissions", err)
+
+			writeError(rw, r, http.StatusInternalServerError, err)
+			return
+		}
+		if !permitted {
+			g.l.Println("Error changing parent or rule of group id", id)
+
+			writeError(rw, r, http.StatusForbidden, errPlaceGroup)
+			return
+		}
+	}
+
+	err = g.store.UpdateGroup(actor(r), id, version, groupMap)
+
+	switch {
+	case err == nil:
+
+	case err == data.ErrGroupNotFound:
 		g.l.Println("Error updating group", err)
 
-		rw.WriteHeader(http.StatusNotFound)
-		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		writeError(rw, r, http.StatusNotFound, err)
+		return
+	case err == data.ErrVersionMismatch:
+		g.l.Println("Error group changed while updating", err)
+
+		writeError(rw, r, http.StatusPreconditionFailed, err)
+		return
+	case errors.Is(err, data.ErrGroupConstraintViolation), errors.As(err, new(data.ValidationError)):
+		g.l.Println("Error updating group", err)
+
+		writeError(rw, r, http.StatusUnprocessableEntity, err)
 		return
 	default:
 		g.l.Println("Error updating group", err)
 
-		rw.WriteHeader(http.StatusInternalServerError)
-		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		writeError(rw, r, http.StatusInternalServerError, err)
 		return
 	}
 
 	rw.WriteHeader(http.StatusNoContent)
 }
 
+// renamesOnly reports whether the values of the group change nothing but its name
+func renamesOnly(current document, groupMap map[string]interface{}) bool {
+	for name := range groupMap {
+		if name != "name" && changesField(current, groupMap, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// changesField reports whether the checked values of a group document change the field with the given name
+func changesField(current document, groupMap map[string]interface{}, name string) bool {
+	value, ok := groupMap[name]
+	if !ok {
+		return false
+	}
+
+	// the numbers of the current document are decoded from JSON
+	if n, ok := value.(int); ok {
+		value = float64(n)
+	}
+	return !reflect.DeepEqual(value, current[name])
+}
+
 // swagger:route POST /groups groups createGroup
-// Create a new group
+// Create a new group, the user creating it becomes its owner
+// Creating the group below a parent takes groups:admin
 //
 // responses:
 //  200: noContentResponse
 //  400: errorResponse
+//  409: errorResponse
+//  422: validationErrorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
 
 // Create handles POST requests to add a new group
 func (g *Groups) Create(rw http.ResponseWriter, r *http.Request) {
@@ -131,25 +392,64 @@ func (g *Groups) Create(rw http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		g.l.Println("Error couldnt parse group from request body", err)
 
-		rw.WriteHeader(http.StatusBadRequest)
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeMalformedBody, err))
+		return
+	}
+
+	if err = data.Validate(&group); err != nil {
+		g.l.Println("Error invalid group", err)
+
+		writeError(rw, r, http.StatusUnprocessableEntity, err)
 		return
 	}
 
-	if err = data.AddGroup(&group, g.Db); err != nil {
+	// the creator owns the group, so placing it below a parent takes the permission to change parents
+	if group.ParentID != 0 {
+		permitted, err := holdsPermission(g.store, r, data.PermGroupsAdmin)
+		if err != nil {
+			g.l.Println("Error fetching permissions", err)
+
+			writeError(rw, r, http.StatusInternalServerError, err)
+			return
+		}
+		if !permitted {
+			g.l.Println("Error creating group below group id", group.ParentID)
+
+			writeError(rw, r, http.StatusForbidden, errPlaceGroup)
+			return
+		}
+	}
+
+	err = g.store.AddGroup(actor(r), &group)
+	switch {
+	case err == nil:
+
+	case errors.Is(err, data.ErrGroupConstraintViolation):
+		g.l.Println("Error creating group", err)
+
+		writeError(rw, r, http.StatusUnprocessableEntity, err)
+	default:
 		g.l.Println("Error creating group", err)
 
-		rw.WriteHeader(http.StatusBadRequest)
-		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		writeError(rw, r, http.StatusInternalServerError, err)
 	}
 }
 
 // swagger:route DELETE /groups/{id} groups deleteGroup
-// Delete a group
+// Delete a group, it can be restored until it is purged
+// A group with child groups is only deleted with the cascade flag, which deletes its descendants as well
+// and requires the groups:write permission, owners of the group can not use it
 //
 // responses:
 //  200: noContentResponse
-//  404: errorResponse
 //  400: errorResponse
+//  404: errorResponse
+//  409: errorResponse
+//  412: errorResponse
+//  428: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
 
 // Delete handles DELETE requests and deletes group from the database
 func (g *Groups) Delete(rw http.ResponseWriter, r *http.Request) {
@@ -157,28 +457,521 @@ func (g *Groups) Delete(rw http.ResponseWriter, r *http.Request) {
 
 	g.l.Println("deleting group with id ", id)
 
-	err := data.DeleteGroup(id, g.Db)
-	switch err {
-	case nil:
+	cascade, err := queryFlag(r, CascadeParam)
+	if err != nil {
+		g.l.Println("Error parsing cascade", err)
 
-	case data.ErrGroupNotFound:
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeInvalidParameter, err))
+		return
+	}
+	if cascade && GroupRole(r) != "" {
+		g.l.Println("Error owner deleting descendants of group id", id)
+
+		writeError(rw, r, http.StatusForbidden, errCascadeOwner)
+		return
+	}
+
+	// without an If-Match header the group is deleted whatever its version
+	version := 0
+	if r.Header.Get("If-Match") != "" || g.requireIfMatch {
+		_, v, ok := g.document(rw, r, id)
+		if !ok {
+			return
+		}
+		version = v
+	}
+
+	err = g.store.DeleteGroup(actor(r), id, version, cascade)
+	switch {
+	case err == nil:
+
+	case err == data.ErrGroupNotFound:
 		g.l.Println("Error deleting group id does not exist")
 
-		rw.WriteHeader(http.StatusNotFound)
-		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		writeError(rw, r, http.StatusNotFound, err)
 		return
-	case data.ErrGroupConstraintViolation:
+	case err == data.ErrVersionMismatch:
+		g.l.Println("Error group changed while deleting", err)
+
+		writeError(rw, r, http.StatusPreconditionFailed, err)
+		return
+	case errors.Is(err, data.ErrGroupConstraintViolation):
 		g.l.Println("Error deleting group", err)
 
-		rw.WriteHeader(http.StatusBadRequest)
-		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		writeError(rw, r, http.StatusConflict, err)
 		return
 	default:
 		g.l.Println("Error deleting group", err)
 
-		rw.WriteHeader(http.StatusInternalServerError)
-		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// swagger:route POST /groups/{id}/restore groups restoreGroup
+// Restore a deleted group, restoring a group that is not deleted has no effect
+// Its descendants stay deleted and a group whose parent is deleted can not be restored
+//
+// responses:
+//  204: noContentResponse
+//  404: errorResponse
+//  409: errorResponse
+//  422: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
+
+// Restore handles POST requests to restore deleted groups
+func (g *Groups) Restore(rw http.ResponseWriter, r *http.Request) {
+	id := getId(r)
+
+	g.l.Println("restoring group with id", id)
+
+	err := g.store.RestoreGroup(actor(r), id)
+	switch {
+	case err == nil:
+
+	case err == data.ErrGroupNotFound:
+		g.l.Println("Error restoring group id does not exist")
+
+		writeError(rw, r, http.StatusNotFound, err)
+		return
+	case errors.Is(err, data.ErrGroupConstraintViolation):
+		g.l.Println("Error restoring group", err)
+
+		writeError(rw, r, http.StatusConflict, err)
+		return
+	default:
+		g.l.Println("Error restoring group", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// swagger:route PUT /groups/{id}/permissions/{permission} groups grantPermission
+// Grant a permission to a group
+//
+// responses:
+//  204: noContentResponse
+//  400: errorResponse
+//  404: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+
+// GrantPermission handles PUT requests to grant a permission to a group
+func (g *Groups) GrantPermission(rw http.ResponseWriter, r *http.Request) {
+	g.changePermission(rw, r, g.store.GrantPermission)
+}
+
+// swagger:route DELETE /groups/{id}/permissions/{permission} groups revokePermission
+// Revoke a permission from a group
+//
+// responses:
+//  204: noContentResponse
+//  400: errorResponse
+//  404: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+
+// RevokePermission handles DELETE requests to revoke a permission from a group
+func (g *Groups) RevokePermission(rw http.ResponseWriter, r *http.Request) {
+	g.changePermission(rw, r, g.store.RevokePermission)
+}
+
+// changePermission grants or revokes the permission in the URL with the given store func
+func (g *Groups) changePermission(rw http.ResponseWriter, r *http.Request, change func(actor data.Actor, id int, permission string) error) {
+	id := getId(r)
+	permission := mux.Vars(r)["permission"]
+
+	g.l.Println(r.Method, "permission", permission, "of group id", id)
+
+	if !data.ValidPermission(permission) {
+		g.l.Println("Error unknown permission", permission)
+
+		writeError(rw, r, http.StatusBadRequest, data.ErrUnknownPermission)
 		return
 	}
+
+	err := change(actor(r), id, permission)
+	switch err {
+	case nil:
+
+	case data.ErrGroupNotFound:
+		g.l.Println("Error changing permission", err)
+
+		writeError(rw, r, http.StatusNotFound, err)
+		return
+	default:
+		g.l.Println("Error changing permission", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// swagger:route GET /users/{id}/groups groups ListUserGroups
+// Returns the groups that a user belongs to
+// responses:
+//  200: groupsResponse
+//  404: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+
+// ListUserGroups handles GET requests and returns the groups of the user with the id
+func (g *Groups) ListUserGroups(rw http.ResponseWriter, r *http.Request) {
+	id := getId(r)
+
+	g.l.Println("get groups of user id", id)
+
+	groups, err := g.store.GetUserGroups(id)
+	switch err {
+	case nil:
+
+	case data.ErrUserNotFound:
+		g.l.Println("Error fetching groups of user", err)
+
+		writeError(rw, r, http.StatusNotFound, err)
+		return
+	default:
+		g.l.Println("Error fetching groups of user", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = data.ToJSON(&groups, rw)
+	if err != nil {
+		g.l.Println("Error encoding groups", err)
+	}
+}
+
+// swagger:route GET /groups/{id}/ancestors groups ListGroupAncestors
+// Returns the ancestors of a group, its parent first
+// responses:
+//  200: groupsResponse
+//  404: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+
+// ListAncestors handles GET requests and returns the ancestors of the group with the id
+func (g *Groups) ListAncestors(rw http.ResponseWriter, r *http.Request) {
+	g.listRelatives(rw, r, "ancestors", g.store.GetGroupAncestors)
+}
+
+// swagger:route GET /groups/{id}/descendants groups ListGroupDescendants
+// Returns the descendants of a group ordered by id
+// responses:
+//  200: groupsResponse
+//  404: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+
+// ListDescendants handles GET requests and returns the descendants of the group with the id
+func (g *Groups) ListDescendants(rw http.ResponseWriter, r *http.Request) {
+	g.listRelatives(rw, r, "descendants", g.store.GetGroupDescendants)
+}
+
+// listRelatives writes the groups related to the group with the id in the URL
+func (g *Groups) listRelatives(rw http.ResponseWriter, r *http.Request, relation string, get func(id int) ([]*data.Group, error)) {
+	id := getId(r)
+
+	g.l.Println("get", relation, "of group id", id)
+
+	groups, err := get(id)
+	switch err {
+	case nil:
+
+	case data.ErrGroupNotFound:
+		g.l.Println("Error fetching", relation, "of group", err)
+
+		writeError(rw, r, http.StatusNotFound, err)
+		return
+	default:
+		g.l.Println("Error fetching", relation, "of group", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = data.ToJSON(&groups, rw)
+	if err != nil {
+		g.l.Println("Error encoding groups", err)
+	}
+}
+
+// swagger:route GET /groups/{id}/members groups ListGroupMembers
+// Returns the effective members of a group, the users that belong to it or to one of its descendants
+// responses:
+//  200: usersResponse
+//  404: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+
+// ListMembers handles GET requests and returns the effective members of the group with the id
+func (g *Groups) ListMembers(rw http.ResponseWriter, r *http.Request) {
+	id := getId(r)
+
+	g.l.Println("get members of group id", id)
+
+	users, err := g.store.GetEffectiveMembers(id)
+	switch err {
+	case nil:
+
+	case data.ErrGroupNotFound:
+		g.l.Println("Error fetching members of group", err)
+
+		writeError(rw, r, http.StatusNotFound, err)
+		return
+	default:
+		g.l.Println("Error fetching members of group", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = data.ToJSON(&users, rw)
+	if err != nil {
+		g.l.Println("Error encoding users", err)
+	}
+}
+
+// swagger:route POST /groups/{id}/members/{userId} groups addMember
+// Add a user to a group, the members of a dynamic group can not be changed
+// Adding a user to a group that grants a permission the caller does not hold takes groups:write
+//
+// responses:
+//  204: noContentResponse
+//  404: errorResponse
+//  409: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
+
+// AddMember handles POST requests to add a user to a group
+func (g *Groups) AddMember(rw http.ResponseWriter, r *http.Request) {
+	// a manager of the group only adds members to it while holding what the group grants
+	if status, err := checkJoin(g.store, r, getId(r)); err != nil {
+		g.l.Println("Error adding member to group id", getId(r), err)
+
+		writeError(rw, r, status, err)
+		return
+	}
+
+	g.changeMember(rw, r, g.store.AddMember)
+}
+
+// swagger:route DELETE /groups/{id}/members/{userId} groups removeMember
+// Remove a user from a group, a user removed from its primary group is left without one
+//
+// responses:
+//  204: noContentResponse
+//  404: errorResponse
+//  409: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
+
+// RemoveMember handles DELETE requests to remove a user from a group
+func (g *Groups) RemoveMember(rw http.ResponseWriter, r *http.Request) {
+	g.changeMember(rw, r, g.store.RemoveMember)
+}
+
+// changeMember adds or removes the user in the URL with the given store func
+func (g *Groups) changeMember(rw http.ResponseWriter, r *http.Request, change func(actor data.Actor, groupID, userID int) error) {
+	id := getId(r)
+	userID := getIntVar(r, "userId")
+
+	g.l.Println(r.Method, "member user id", userID, "of group id", id)
+
+	err := change(actor(r), id, userID)
+	switch err {
+	case nil:
+
+	case data.ErrGroupNotFound, data.ErrUserNotFound:
+		g.l.Println("Error changing member", err)
+
+		writeError(rw, r, http.StatusNotFound, err)
+		return
+	case data.ErrDynamicGroup:
+		g.l.Println("Error changing member", err)
+
+		writeError(rw, r, http.StatusConflict, err)
+		return
+	default:
+		g.l.Println("Error changing member", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// RulePreview is the membership rule of a dynamic group whose members are previewed
+// swagger:model
+type RulePreview struct {
+	// the rule, e.g. email endsWith "@3fs.si"
+	//
+	// required: true
+	Rule string `json:"rule"`
+}
+
+// swagger:route POST /groups:preview groups previewRule
+// Returns the users that a dynamic group with the rule would have, nothing is changed
+// responses:
+//  200: usersResponse
+//  400: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  422: errorResponse
+
+// PreviewRule handles POST requests with a rule and returns the users matching it
+func (g *Groups) PreviewRule(rw http.ResponseWriter, r *http.Request) {
+	var preview RulePreview
+	if err := data.FromJSON(&preview, r.Body); err != nil {
+		g.l.Println("Error couldnt parse rule from request body", err)
+
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeMalformedBody, err))
+		return
+	}
+
+	g.l.Println("preview rule", preview.Rule)
+
+	users, err := g.store.PreviewRule(preview.Rule)
+	switch {
+	case err == nil:
+
+	case errors.Is(err, data.ErrInvalidRule):
+		g.l.Println("Error invalid rule", err)
+
+		writeError(rw, r, http.StatusUnprocessableEntity, err)
+		return
+	default:
+		g.l.Println("Error previewing rule", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = data.ToJSON(&users, rw)
+	if err != nil {
+		g.l.Println("Error encoding users", err)
+	}
+}
+
+// swagger:route GET /groups/{id}/admins groups ListAdmins
+// Returns the owners and managers of a group ordered by user id
+// responses:
+//  200: adminsResponse
+//  404: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
+
+// ListAdmins handles GET requests and returns the admins of a group
+func (g *Groups) ListAdmins(rw http.ResponseWriter, r *http.Request) {
+	id := getId(r)
+
+	g.l.Println("get admins of group id", id)
+
+	admins, err := g.store.GetGroupAdmins(id)
+	switch err {
+	case nil:
+
+	case data.ErrGroupNotFound:
+		g.l.Println("Error fetching admins", err)
+
+		writeError(rw, r, http.StatusNotFound, err)
+		return
+	default:
+		g.l.Println("Error fetching admins", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = data.ToJSON(&admins, rw)
+	if err != nil {
+		g.l.Println("Error encoding admins", err)
+	}
+}
+
+// swagger:route PUT /groups/{id}/admins/{userId} groups setAdmin
+// Make a user an owner or manager of a group or change its role, owners of the group can change its admins
+//
+// responses:
+//  204: noContentResponse
+//  400: errorResponse
+//  404: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
+
+// SetAdmin handles PUT requests to give a user a role in a group
+func (g *Groups) SetAdmin(rw http.ResponseWriter, r *http.Request) {
+	var role AdminRole
+	err := data.FromJSON(&role, r.Body)
+	if err != nil {
+		g.l.Println("Error couldnt parse role from request body", err)
+
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeMalformedBody, err))
+		return
+	}
+	if !data.ValidRole(role.Role) {
+		g.l.Println("Error unknown role", role.Role)
+
+		writeError(rw, r, http.StatusBadRequest, data.ErrUnknownRole)
+		return
+	}
+
+	g.changeAdmin(rw, r, func(actor data.Actor, groupID, userID int) error {
+		return g.store.SetGroupAdmin(actor, groupID, userID, role.Role)
+	})
+}
+
+// swagger:route DELETE /groups/{id}/admins/{userId} groups removeAdmin
+// Take the role in a group from a user
+//
+// responses:
+//  204: noContentResponse
+//  404: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
+
+// RemoveAdmin handles DELETE requests to take a role in a group from a user
+func (g *Groups) RemoveAdmin(rw http.ResponseWriter, r *http.Request) {
+	g.changeAdmin(rw, r, g.store.RemoveGroupAdmin)
+}
+
+// changeAdmin gives a role to the user in the URL or takes it with the given store func
+func (g *Groups) changeAdmin(rw http.ResponseWriter, r *http.Request, change func(actor data.Actor, groupID, userID int) error) {
+	id := getId(r)
+	userID := getIntVar(r, "userId")
+
+	g.l.Println(r.Method, "admin user id", userID, "of group id", id)
+
+	err := change(actor(r), id, userID)
+	switch err {
+	case nil:
+
+	case data.ErrGroupNotFound, data.ErrUserNotFound:
+		g.l.Println("Error changing admin", err)
+
+		writeError(rw, r, http.StatusNotFound, err)
+		return
+	default:
+		g.l.Println("Error changing admin", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
 	rw.WriteHeader(http.StatusNoContent)
 }
@@ -10,14 +10,20 @@ import (
 // getId returnes the Id from the URL
 // panics if it cannot convert the id into an integer
 func getId(r *http.Request) int {
-	// parse the user id from the url
+	return getIntVar(r, "id")
+}
+
+// getIntVar returns the integer variable with the given name from the URL
+// panics if it cannot convert the variable into an integer
+func getIntVar(r *http.Request, name string) int {
+	// parse the variable from the url
 	vars := mux.Vars(r)
 
-	// convert the id into an integer
-	id, err := strconv.Atoi(vars["id"])
+	// convert the variable into an integer
+	value, err := strconv.Atoi(vars[name])
 	if err != nil {
 		panic(err)
 	}
 
-	return id
+	return value
 }
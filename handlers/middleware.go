@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/zzibert/3fs-rest-api/auth"
+	"github.com/zzibert/3fs-rest-api/data"
+)
+
+// contextKey is the type of the keys of values stored in the request context
+type contextKey int
+
+// Context keys
+const (
+	// userKey is the context key of the authenticated user
+	userKey contextKey = iota
+
+	// requestIDKey is the context key of the id of the request
+	requestIDKey
+
+	// groupRoleKey is the context key of the role a request changing a group is allowed with
+	groupRoleKey
+)
+
+// RequestIDHeader is the header carrying the id of a request, it is recorded in the audit log
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID matches the request ids accepted from clients
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestID is a middleware that stores the id of the request in the request context
+// and returns it in the X-Request-ID header, the id sent by the client is kept when it is valid
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+
+		rw.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// newRequestID returns a random request id
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestIDOf returns the id of the request, empty when the RequestID middleware did not run
+func RequestIDOf(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// actor returns the actor of the changes made by the request, its authenticated user
+func actor(r *http.Request) data.Actor {
+	user, _ := CurrentUser(r)
+	return data.Actor{UserID: user.ID, RequestID: RequestIDOf(r)}
+}
+
+// Authenticate is a middleware that requires a valid access token in the Authorization header
+// and stores the authenticated user in the request context
+func (a *Auth) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			a.unauthorized(rw, r, "Error missing bearer token for", r.Method, r.URL.Path)
+			return
+		}
+
+		user, err := a.verify(strings.TrimPrefix(header, "Bearer "), auth.AccessToken)
+		if err != nil {
+			a.tokenError(rw, r, err, "Error verifying access token for", r.Method, r.URL.Path)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userKey, user)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// CurrentUser returns the authenticated user of the request
+func CurrentUser(r *http.Request) (data.User, bool) {
+	user, ok := r.Context().Value(userKey).(data.User)
+	return user, ok
+}
+
+// Require is a middleware that only calls the handler when one of the groups of the authenticated user
+// holds the permission, it must run after Authenticate
+func (a *Auth) Require(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		user, ok := CurrentUser(r)
+		if !ok {
+			a.unauthorized(rw, r, "Error no authenticated user for", r.Method, r.URL.Path)
+			return
+		}
+
+		permitted, err := a.hasPermission(user.ID, permission)
+		if err != nil {
+			a.l.Println("Error fetching permissions", err)
+
+			writeError(rw, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		if !permitted {
+			a.l.Println("Error user id", user.ID, "lacks permission", permission, "for", r.Method, r.URL.Path)
+
+			writeError(rw, r, http.StatusForbidden, fmt.Errorf("missing permission %s", permission))
+			return
+		}
+
+		next(rw, r)
+	}
+}
+
+// RequireGroupRole is a middleware like Require that also calls the handler when the authenticated user
+// administers the group with the id of the URL with the role, or as its owner, it must run after Authenticate
+// The role the handler is called with is stored in the request context, see GroupRole
+func (a *Auth) RequireGroupRole(permission, role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		user, ok := CurrentUser(r)
+		if !ok {
+			a.unauthorized(rw, r, "Error no authenticated user for", r.Method, r.URL.Path)
+			return
+		}
+
+		permitted, err := a.hasPermission(user.ID, permission)
+		if err != nil {
+			a.l.Println("Error fetching permissions", err)
+
+			writeError(rw, r, http.StatusInternalServerError, err)
+			return
+		}
+		if permitted {
+			next(rw, r)
+			return
+		}
+
+		granted, err := a.groups.GetGroupRole(getId(r), user.ID)
+		if err != nil {
+			a.l.Println("Error fetching group role", err)
+
+			writeError(rw, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		if !data.RoleAllows(granted, role) {
+			a.l.Println("Error user id", user.ID, "lacks permission", permission, "and role", role, "for", r.Method, r.URL.Path)
+
+			writeError(rw, r, http.StatusForbidden, fmt.Errorf("missing permission %s or role %s of the group", permission, role))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), groupRoleKey, granted)
+		next(rw, r.WithContext(ctx))
+	}
+}
+
+// GroupRole returns the role of the authenticated user the request changing a group is allowed with,
+// empty when the user holds the permission of the group route
+func GroupRole(r *http.Request) string {
+	role, _ := r.Context().Value(groupRoleKey).(string)
+	return role
+}
+
+// hasPermission reports whether one of the groups of the user holds the permission
+func (a *Auth) hasPermission(userID int, permission string) (bool, error) {
+	permissions, err := a.groups.GetUserPermissions(userID)
+	if err != nil {
+		return false, err
+	}
+	return data.HasPermission(permissions, permission), nil
+}
+
+// holdsPermission reports whether one of the groups of the authenticated user of the request holds the permission,
+// a request without an authenticated user, like one of the system, holds every permission
+func holdsPermission(groups data.GroupStore, r *http.Request, permission string) (bool, error) {
+	user, ok := CurrentUser(r)
+	if !ok {
+		return true, nil
+	}
+	permissions, err := groups.GetUserPermissions(user.ID)
+	if err != nil {
+		return false, err
+	}
+	return data.HasPermission(permissions, permission), nil
+}
+
+// errJoinGroup is returned when a user is put into a group granting permissions the authenticated user does not hold
+var errJoinGroup = fmt.Errorf("missing permission %s or a permission the group grants", data.PermGroupsWrite)
+
+// checkJoin checks that the authenticated user of the request may put a user into the group with the given id,
+// which takes groups:write unless the authenticated user already holds every permission the group and its ancestors grant
+// It returns the status and error of a failed check, a missing or unknown group passes and is left to the store
+func checkJoin(groups data.GroupStore, r *http.Request, groupID int) (int, error) {
+	user, ok := CurrentUser(r)
+	if !ok || groupID == 0 {
+		return 0, nil
+	}
+
+	held, err := groups.GetUserPermissions(user.ID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if data.HasPermission(held, data.PermGroupsWrite) {
+		return 0, nil
+	}
+
+	group, err := groups.GetGroupById(groupID)
+	if err == data.ErrGroupNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	ancestors, err := groups.GetGroupAncestors(groupID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	granted := group.Permissions
+	for _, ancestor := range ancestors {
+		granted = append(granted, ancestor.Permissions...)
+	}
+	for _, permission := range granted {
+		if !data.HasPermission(held, permission) {
+			return http.StatusForbidden, errJoinGroup
+		}
+	}
+	return 0, nil
+}
+
+// RequireIncludeDeleted is a middleware like Require that only requires the permission
+// when the request includes deleted users or groups with the include_deleted query flag
+func (a *Auth) RequireIncludeDeleted(permission string, next http.HandlerFunc) http.HandlerFunc {
+	require := a.Require(permission, next)
+	return func(rw http.ResponseWriter, r *http.Request) {
+		// an invalid flag is rejected by the handler
+		if include, _ := includeDeleted(r); include {
+			require(rw, r)
+			return
+		}
+		next(rw, r)
+	}
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/zzibert/3fs-rest-api/data"
+)
+
+// Paging configures the page size of the list endpoints
+type Paging struct {
+	// DefaultLimit is the page size when the request has no limit
+	DefaultLimit int
+
+	// MaxLimit is the largest page size, larger limits are lowered to it
+	MaxLimit int
+}
+
+// DefaultPaging is the paging used when nothing else is configured
+var DefaultPaging = Paging{DefaultLimit: 50, MaxLimit: 100}
+
+// IncludeDeletedParam is the query flag that includes deleted users and groups in a response
+const IncludeDeletedParam = "include_deleted"
+
+// page is the page of a list requested with the limit, offset, cursor, sort and include_deleted query parameters
+// and the filters given by every other query parameter
+// Without an offset the Link header of the response uses cursors
+type page struct {
+	limit          int
+	offset         int
+	cursor         *data.Cursor
+	useOffset      bool
+	sort           []data.SortKey
+	filters        []data.Filter
+	includeDeleted bool
+}
+
+// filterParam matches the name of a filter query parameter, field or field[operator]
+// the fields of the attributes of users contain a dot, e.g. attributes.department
+var filterParam = regexp.MustCompile(`^([\w.]+)(?:\[(\w+)\])?$`)
+
+// parsePage parses the pagination, sort and filter query parameters of the request
+// The fields and operators are checked by the store
+func (p Paging) parsePage(r *http.Request) (pg page, err error) {
+	query := r.URL.Query()
+
+	for name, values := range query {
+		switch name {
+		case "limit", "offset", "cursor", "sort", IncludeDeletedParam:
+			continue
+		}
+
+		match := filterParam.FindStringSubmatch(name)
+		if match == nil {
+			return pg, fmt.Errorf("invalid query parameter %q", name)
+		}
+		op := match[2]
+		if op == "" {
+			op = data.OpEq
+		}
+		for _, value := range values {
+			pg.filters = append(pg.filters, data.Filter{Field: match[1], Op: op, Value: value})
+		}
+	}
+
+	if value := query.Get("sort"); value != "" {
+		for _, field := range strings.Split(value, ",") {
+			key := data.SortKey{Field: strings.TrimPrefix(field, "-"), Desc: strings.HasPrefix(field, "-")}
+			if key.Field == "" {
+				return pg, fmt.Errorf("invalid sort %q", value)
+			}
+			pg.sort = append(pg.sort, key)
+		}
+	}
+
+	if pg.includeDeleted, err = includeDeleted(r); err != nil {
+		return pg, err
+	}
+
+	pg.limit = p.DefaultLimit
+	if value := query.Get("limit"); value != "" {
+		if pg.limit, err = strconv.Atoi(value); err != nil || pg.limit < 1 {
+			return pg, fmt.Errorf("invalid limit %q", value)
+		}
+	}
+	if pg.limit > p.MaxLimit {
+		pg.limit = p.MaxLimit
+	}
+
+	if value := query.Get("offset"); value != "" {
+		if pg.offset, err = strconv.Atoi(value); err != nil || pg.offset < 0 {
+			return pg, fmt.Errorf("invalid offset %q", value)
+		}
+		pg.useOffset = true
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		if pg.useOffset {
+			return pg, fmt.Errorf("offset and cursor can not be combined")
+		}
+		if pg.cursor, err = decodeCursor(value); err != nil {
+			return pg, fmt.Errorf("invalid cursor %q", value)
+		}
+	}
+	return pg, nil
+}
+
+// listOptions returns the options for the store
+// one item more than the limit is requested to find out whether there is a further page
+func (pg page) listOptions() data.ListOptions {
+	return data.ListOptions{Limit: pg.limit + 1, Offset: pg.offset, Cursor: pg.cursor, Sort: pg.sort, Filters: pg.filters, IncludeDeleted: pg.includeDeleted}
+}
+
+// includeDeleted parses the include_deleted query flag of the request
+func includeDeleted(r *http.Request) (bool, error) {
+	return queryFlag(r, IncludeDeletedParam)
+}
+
+// queryFlag parses the query flag of the request with the given name, a flag without a value is true
+func queryFlag(r *http.Request, name string) (bool, error) {
+	values, ok := r.URL.Query()[name]
+	if !ok {
+		return false, nil
+	}
+	if values[0] == "" {
+		return true, nil
+	}
+
+	flag, err := strconv.ParseBool(values[0])
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", name, values[0])
+	}
+	return flag, nil
+}
+
+// trim returns the range of the n returned items that is on the page
+// and whether there are further items in the direction of the request
+func (pg page) trim(n int) (start, end int, more bool) {
+	if n <= pg.limit {
+		return 0, n, false
+	}
+
+	// the extra item of a before cursor is the first one
+	if pg.cursor != nil && pg.cursor.Before {
+		return 1, n, true
+	}
+	return 0, pg.limit, true
+}
+
+// writeHeaders sets the X-Total-Count header and the Link header with the next and previous pages
+// n is the number of items on the page and cursor returns the cursor after the item at index i
+func (pg page) writeHeaders(rw http.ResponseWriter, r *http.Request, total, n int, cursor func(i int) data.Cursor, more bool) {
+	rw.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	var links []string
+	link := func(rel, param, value string) {
+		query := r.URL.Query()
+		query.Del("offset")
+		query.Del("cursor")
+		query.Set("limit", strconv.Itoa(pg.limit))
+		query.Set(param, value)
+		u := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		links = append(links, fmt.Sprintf("<%s>; rel=\"%s\"", u.String(), rel))
+	}
+
+	switch {
+	case pg.useOffset:
+		if more {
+			link("next", "offset", strconv.Itoa(pg.offset+pg.limit))
+		}
+		if pg.offset > 0 {
+			prev := pg.offset - pg.limit
+			if prev < 0 {
+				prev = 0
+			}
+			link("prev", "offset", strconv.Itoa(prev))
+		}
+	case n == 0:
+	default:
+		before := pg.cursor != nil && pg.cursor.Before
+		if more || before {
+			link("next", "cursor", encodeCursor(cursor(n-1)))
+		}
+		if (more && before) || (pg.cursor != nil && !before) {
+			prev := cursor(0)
+			prev.Before = true
+			link("prev", "cursor", encodeCursor(prev))
+		}
+	}
+
+	if len(links) > 0 {
+		rw.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+// encodeCursor returns the opaque string representation of the cursor
+func encodeCursor(cursor data.Cursor) string {
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parses a cursor returned by encodeCursor
+func decodeCursor(value string) (*data.Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor data.Cursor
+	if err = json.Unmarshal(b, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
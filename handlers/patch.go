@@ -0,0 +1,462 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zzibert/3fs-rest-api/data"
+)
+
+// Media types of PATCH request bodies
+const (
+	// MergePatchType is a JSON Merge Patch (RFC 7396)
+	MergePatchType = "application/merge-patch+json"
+
+	// JSONPatchType is a JSON Patch (RFC 6902)
+	JSONPatchType = "application/json-patch+json"
+)
+
+// errUnsupportedPatch is returned for a PATCH request body of another media type
+var errUnsupportedPatch = fmt.Errorf("unsupported patch media type, expected %s or %s", MergePatchType, JSONPatchType)
+
+// errPatchTest is returned when a test operation of a JSON Patch fails
+var errPatchTest = fmt.Errorf("test operation failed")
+
+// document is the JSON representation of a user or group
+type document map[string]interface{}
+
+// field is a field of a document schema
+type field struct {
+	// kind is the JSON type of the field, string, integer, array or object
+	kind string
+
+	// nullable fields are cleared by null or by leaving them out of a full document
+	nullable bool
+
+	// required fields must be part of every full document
+	required bool
+
+	// readOnly fields can not be changed, they may only be sent with their current value
+	readOnly bool
+}
+
+// schema are the fields of a document by their JSON name
+type schema map[string]field
+
+// userSchema is the schema of a user document, a missing password keeps the current password
+var userSchema = schema{
+	"id":         {kind: "integer", readOnly: true},
+	"name":       {kind: "string", required: true},
+	"email":      {kind: "string", required: true},
+	"groupID":    {kind: "integer", nullable: true},
+	"password":   {kind: "string"},
+	"attributes": {kind: "object", nullable: true},
+	"version":    {kind: "integer", readOnly: true},
+}
+
+// groupSchema is the schema of a group document, members and permissions are changed by their own routes
+var groupSchema = schema{
+	"id":          {kind: "integer", readOnly: true},
+	"name":        {kind: "string", required: true},
+	"parentID":    {kind: "integer"},
+	"rule":        {kind: "string"},
+	"users":       {kind: "array", readOnly: true},
+	"permissions": {kind: "array", readOnly: true},
+	"version":     {kind: "integer", readOnly: true},
+}
+
+// toDocument returns the JSON representation of v
+func toDocument(v interface{}) (document, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc document
+	err = json.Unmarshal(b, &doc)
+	return doc, err
+}
+
+// readDocument decodes a full document from the request body
+func readDocument(r io.Reader) (document, error) {
+	var doc document
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("document must be an object")
+	}
+	return doc, nil
+}
+
+// check validates the full document against the schema and the validate tags of v,
+// and returns the values of its writable fields
+// Read only fields must be missing or equal to their value in the current document
+// The returned error is a data.ValidationError
+func (s schema) check(current, doc document, v interface{}) (map[string]interface{}, error) {
+	var errs data.ValidationError
+	changes := map[string]interface{}{}
+	for name, value := range doc {
+		f, ok := s[name]
+		if !ok {
+			errs = append(errs, data.FieldError{Field: name, Message: "is unknown"})
+			continue
+		}
+		if f.readOnly {
+			if !reflect.DeepEqual(value, current[name]) {
+				errs = append(errs, data.FieldError{Field: name, Message: "is read only"})
+			}
+			continue
+		}
+
+		switch v := value.(type) {
+		case nil:
+			if f.nullable {
+				changes[name] = nil
+				continue
+			}
+		case string:
+			if f.kind == "string" {
+				changes[name] = v
+				continue
+			}
+		case float64:
+			if f.kind == "integer" && v == float64(int(v)) {
+				changes[name] = int(v)
+				continue
+			}
+		case map[string]interface{}:
+			if f.kind == "object" {
+				changes[name] = v
+				continue
+			}
+		}
+		errs = append(errs, data.FieldError{Field: name, Message: "must be of type " + f.kind})
+	}
+
+	for name, f := range s {
+		_, ok := doc[name]
+		switch {
+		case f.required && !ok:
+			errs = append(errs, data.FieldError{Field: name, Message: "is required"})
+		case f.nullable && !ok:
+			changes[name] = nil
+		}
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		return nil, errs
+	}
+
+	// the rules of the validate tags are checked on the changed fields
+	fields := make([]string, 0, len(changes))
+	for name := range changes {
+		fields = append(fields, name)
+	}
+	b, err := json.Marshal(changes)
+	if err == nil {
+		err = json.Unmarshal(b, v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return changes, data.Validate(v, fields...)
+}
+
+// applyPatch applies the JSON Merge Patch or JSON Patch of the request body to the document
+// and returns the patched document, the patch is applied completely or not at all
+func applyPatch(r *http.Request, doc document) (document, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var patched interface{}
+	switch mediaType {
+	case MergePatchType:
+		var patch interface{}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			return nil, err
+		}
+		patched = mergePatch(map[string]interface{}(doc), patch)
+	case JSONPatchType:
+		var operations []patchOperation
+		if err := json.NewDecoder(r.Body).Decode(&operations); err != nil {
+			return nil, err
+		}
+		var err error
+		if patched, err = jsonPatch(map[string]interface{}(doc), operations); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errUnsupportedPatch
+	}
+
+	object, ok := patched.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("document must be an object")
+	}
+	return object, nil
+}
+
+// writePatchError writes the response to a patch that can not be applied
+func writePatchError(rw http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errUnsupportedPatch:
+		writeError(rw, r, http.StatusUnsupportedMediaType, err)
+	case errPatchTest:
+		writeError(rw, r, http.StatusConflict, err)
+	default:
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeInvalidPatch, err))
+	}
+}
+
+// mergePatch applies a JSON Merge Patch to the target as described in RFC 7396
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for name, value := range p {
+		if value == nil {
+			delete(t, name)
+		} else {
+			t[name] = mergePatch(t[name], value)
+		}
+	}
+	return t
+}
+
+// patchOperation is an operation of a JSON Patch
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// jsonPatch applies the operations of a JSON Patch to the document as described in RFC 6902
+func jsonPatch(doc interface{}, operations []patchOperation) (interface{}, error) {
+	for i, operation := range operations {
+		var err error
+		if doc, err = operation.apply(doc); err != nil {
+			if err == errPatchTest {
+				return nil, err
+			}
+			return nil, fmt.Errorf("operation %d %s %q: %v", i, operation.Op, operation.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func (o patchOperation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(o.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch o.Op {
+	case "add", "replace", "test":
+		if len(o.Value) == 0 {
+			return nil, fmt.Errorf("missing value")
+		}
+		var value interface{}
+		if err = json.Unmarshal(o.Value, &value); err != nil {
+			return nil, err
+		}
+
+		switch o.Op {
+		case "add":
+			return pointerAdd(doc, path, value)
+		case "replace":
+			if doc, _, err = pointerRemove(doc, path); err != nil {
+				return nil, err
+			}
+			return pointerAdd(doc, path, value)
+		}
+
+		current, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, errPatchTest
+		}
+		return doc, nil
+	case "remove":
+		doc, _, err = pointerRemove(doc, path)
+		return doc, err
+	case "move", "copy":
+		from, err := parsePointer(o.From)
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		if o.Op == "move" {
+			if len(from) < len(path) && reflect.DeepEqual(from, path[:len(from)]) {
+				return nil, fmt.Errorf("can not move a value into itself")
+			}
+			if doc, value, err = pointerRemove(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			if value, err = pointerGet(doc, from); err != nil {
+				return nil, err
+			}
+			// the copy must not share maps and slices with the original
+			b, _ := json.Marshal(value)
+			json.Unmarshal(b, &value)
+		}
+		return pointerAdd(doc, path, value)
+	}
+	return nil, fmt.Errorf("unknown operation")
+}
+
+// parsePointer returns the reference tokens of a JSON Pointer (RFC 6901)
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid path %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+// pointerGet returns the value at the path
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path not found")
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("path not found")
+		}
+	}
+	return doc, nil
+}
+
+// pointerAdd adds the value at the path and returns the changed document
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i := len(node)
+			if token != "-" {
+				var err error
+				if i, err = arrayIndex(token, len(node)); err != nil {
+					return nil, err
+				}
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("path not found")
+	})
+}
+
+// pointerRemove removes the value at the path and returns the changed document and the removed value
+func pointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+
+	var removed interface{}
+	doc, err := pointerParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path not found")
+			}
+			removed = value
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[i]
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("path not found")
+	})
+	return doc, removed, err
+}
+
+// pointerParent calls change with the parent of the location of a non empty path and its last token,
+// and returns the document with the changed parent
+func pointerParent(doc interface{}, path []string, change func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return change(doc, path[0])
+	}
+
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("path not found")
+		}
+		child, err := pointerParent(child, path[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		node[path[0]] = child
+		return node, nil
+	case []interface{}:
+		i, err := arrayIndex(path[0], len(node)-1)
+		if err != nil {
+			return nil, err
+		}
+		child, err := pointerParent(node[i], path[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = child
+		return node, nil
+	}
+	return nil, fmt.Errorf("path not found")
+}
+
+// arrayIndex parses an array index of a JSON Pointer that must be at most max
+func arrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || strings.Trim(token, "0123456789") != "" || i > max || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return i, nil
+}
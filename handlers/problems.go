@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/zzibert/3fs-rest-api/data"
+)
+
+// ProblemType is the media type of every error response, problem details as described in RFC 7807
+const ProblemType = "application/problem+json"
+
+// Problem codes, stable machine readable identifiers of the errors of the API
+const (
+	CodeBadRequest           = "BAD_REQUEST"
+	CodeMalformedBody        = "MALFORMED_BODY"
+	CodeInvalidParameter     = "INVALID_PARAMETER"
+	CodeValidationFailed     = "VALIDATION_FAILED"
+	CodeUnauthenticated      = "UNAUTHENTICATED"
+	CodePermissionDenied     = "PERMISSION_DENIED"
+	CodeNotFound             = "NOT_FOUND"
+	CodeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	CodeConflict             = "CONFLICT"
+	CodePreconditionFailed   = "PRECONDITION_FAILED"
+	CodePreconditionRequired = "PRECONDITION_REQUIRED"
+	CodeUserNotFound         = "USER_NOT_FOUND"
+	CodeUserIDTaken          = "USER_ID_TAKEN"
+	CodeUserNameTaken        = "USER_NAME_TAKEN"
+	CodeUserEmailTaken       = "USER_EMAIL_TAKEN"
+	CodeUserGroupUnknown     = "USER_GROUP_UNKNOWN"
+	CodeUserConstraint       = "USER_CONSTRAINT_VIOLATION"
+	CodeGroupNotFound        = "GROUP_NOT_FOUND"
+	CodeGroupIDTaken         = "GROUP_ID_TAKEN"
+	CodeGroupNameTaken       = "GROUP_NAME_TAKEN"
+	CodeGroupHasUsers        = "GROUP_HAS_USERS"
+	CodeGroupHasChildren     = "GROUP_HAS_CHILDREN"
+	CodeGroupParentUnknown   = "GROUP_PARENT_UNKNOWN"
+	CodeGroupCycle           = "GROUP_CYCLE"
+	CodeGroupDynamic         = "GROUP_DYNAMIC"
+	CodeInvalidRule          = "INVALID_RULE"
+	CodeGroupConstraint      = "GROUP_CONSTRAINT_VIOLATION"
+	CodeUnknownPermission    = "UNKNOWN_PERMISSION"
+	CodeUnknownRole          = "UNKNOWN_ROLE"
+	CodeUserAttributeTaken   = "USER_ATTRIBUTE_TAKEN"
+	CodeAttributeNotFound    = "ATTRIBUTE_NOT_FOUND"
+	CodeAttributeNameTaken   = "ATTRIBUTE_NAME_TAKEN"
+	CodeAttributeMismatch    = "ATTRIBUTE_MISMATCH"
+	CodeAttributeMissing     = "ATTRIBUTE_MISSING"
+	CodeAttributeConstraint  = "ATTRIBUTE_CONSTRAINT_VIOLATION"
+	CodeInvalidPatch         = "INVALID_PATCH"
+	CodeUnsupportedPatch     = "UNSUPPORTED_PATCH_TYPE"
+	CodePatchTestFailed      = "PATCH_TEST_FAILED"
+	CodeBatchTooLarge        = "BATCH_TOO_LARGE"
+	CodeBatchAborted         = "BATCH_ABORTED"
+	CodeInternalServerError  = "INTERNAL_SERVER_ERROR"
+	CodeServiceUnavailable   = "SERVICE_UNAVAILABLE"
+)
+
+// Problem is the body of every error response, the problem details of RFC 7807
+// swagger:model
+type Problem struct {
+	// a URI reference that identifies the kind of problem, /problems/ followed by the code in kebab case
+	Type string `json:"type"`
+
+	// the text of the HTTP status
+	Title string `json:"title"`
+
+	// the HTTP status
+	Status int `json:"status"`
+
+	// what went wrong in this occurrence of the problem
+	Detail string `json:"detail,omitempty"`
+
+	// the path of the request
+	Instance string `json:"instance,omitempty"`
+
+	// the stable machine readable code of the problem, e.g. USER_EMAIL_TAKEN
+	Code string `json:"code"`
+
+	// the invalid fields of a VALIDATION_FAILED problem
+	Errors []data.FieldError `json:"errors,omitempty"`
+}
+
+// knownError is the status and problem code of an error
+type knownError struct {
+	err error
+
+	// status is the status the error is always written with, 0 when it keeps the status of the handler
+	status int
+
+	// code is the problem code of the error, empty when it has the code of its constraint or status
+	code string
+}
+
+// knownErrors are the errors with a status or problem code of their own, most specific first,
+// the first error that an error matches decides its status and code
+var knownErrors = []knownError{
+	// the reasons of constraint violations
+	{data.ErrDuplicateID, http.StatusConflict, ""},
+	{data.ErrDuplicateName, http.StatusConflict, ""},
+	{data.ErrDuplicateEmail, http.StatusConflict, ""},
+	{data.ErrUnknownGroup, http.StatusUnprocessableEntity, CodeUserGroupUnknown},
+	{data.ErrGroupReferenced, http.StatusConflict, CodeGroupHasUsers},
+	{data.ErrGroupHasChildren, http.StatusConflict, CodeGroupHasChildren},
+	{data.ErrUnknownParent, http.StatusUnprocessableEntity, CodeGroupParentUnknown},
+	{data.ErrGroupCycle, http.StatusUnprocessableEntity, CodeGroupCycle},
+	{data.ErrDynamicGroup, http.StatusConflict, CodeGroupDynamic},
+
+	// the values of users do not fit a changed attribute
+	{data.ErrDuplicateAttribute, http.StatusConflict, ""},
+	{data.ErrAttributeMismatch, http.StatusConflict, CodeAttributeMismatch},
+	{data.ErrAttributeMissing, http.StatusConflict, CodeAttributeMissing},
+
+	{data.ErrVersionMismatch, http.StatusPreconditionFailed, ""},
+	{data.ErrUserNotFound, 0, CodeUserNotFound},
+	{data.ErrGroupNotFound, 0, CodeGroupNotFound},
+	{data.ErrAttributeNotFound, 0, CodeAttributeNotFound},
+	{data.ErrInvalidListOption, 0, CodeInvalidParameter},
+	{data.ErrInvalidRule, 0, CodeInvalidRule},
+	{data.ErrUnknownPermission, 0, CodeUnknownPermission},
+	{data.ErrUnknownRole, 0, CodeUnknownRole},
+	{errUnsupportedPatch, 0, CodeUnsupportedPatch},
+	{errPatchTest, 0, CodePatchTestFailed},
+
+	// failures of whole requests that any other error can cause
+	{data.ErrBatchAborted, http.StatusFailedDependency, CodeBatchAborted},
+	{data.ErrUnavailable, http.StatusServiceUnavailable, CodeServiceUnavailable},
+}
+
+// findKnownError returns the first known error that err matches
+func findKnownError(err error) (knownError, bool) {
+	for _, known := range knownErrors {
+		if errors.Is(err, known.err) {
+			return known, true
+		}
+	}
+	return knownError{}, false
+}
+
+// constraintCodes are the problem codes of the unique constraints of users, groups and attributes
+var constraintCodes = map[string]string{
+	data.ConstraintUserID:    CodeUserIDTaken,
+	data.ConstraintUserName:  CodeUserNameTaken,
+	data.ConstraintUserEmail: CodeUserEmailTaken,
+	data.ConstraintGroupID:   CodeGroupIDTaken,
+	data.ConstraintGroupName: CodeGroupNameTaken,
+
+	data.ConstraintUserAttribute: CodeUserAttributeTaken,
+	data.ConstraintAttributeName: CodeAttributeNameTaken,
+}
+
+// statusCodes are the problem codes of errors without a code of their own
+var statusCodes = map[int]string{
+	http.StatusBadRequest:           CodeBadRequest,
+	http.StatusUnauthorized:         CodeUnauthenticated,
+	http.StatusForbidden:            CodePermissionDenied,
+	http.StatusNotFound:             CodeNotFound,
+	http.StatusMethodNotAllowed:     CodeMethodNotAllowed,
+	http.StatusConflict:             CodeConflict,
+	http.StatusPreconditionFailed:   CodePreconditionFailed,
+	http.StatusPreconditionRequired: CodePreconditionRequired,
+	http.StatusUnprocessableEntity:  CodeValidationFailed,
+	http.StatusServiceUnavailable:   CodeServiceUnavailable,
+}
+
+// codeError is an error that is reported with the given problem code
+type codeError struct {
+	code string
+	err  error
+}
+
+func (e *codeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codeError) Unwrap() error {
+	return e.err
+}
+
+// withCode returns err with the problem code it is reported with
+func withCode(code string, err error) error {
+	return &codeError{code, err}
+}
+
+// errorCode returns the problem code of err, or the code of the status when err has no code of its own
+func errorCode(err error, status int) string {
+	var ce *codeError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+
+	var constraint *data.ConstraintError
+	if errors.As(err, &constraint) {
+		if code, ok := constraintCodes[constraint.Constraint]; ok {
+			return code
+		}
+		if constraint.Reason == nil && errors.Is(err, data.ErrUserConstraintViolation) {
+			return CodeUserConstraint
+		}
+		if constraint.Reason == nil && errors.Is(err, data.ErrAttributeConstraintViolation) {
+			return CodeAttributeConstraint
+		}
+		if constraint.Reason == nil {
+			return CodeGroupConstraint
+		}
+	}
+
+	if known, ok := findKnownError(err); ok && known.code != "" {
+		return known.code
+	}
+
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	return CodeInternalServerError
+}
+
+// writeError writes err as problem details with the given status
+func writeError(rw http.ResponseWriter, r *http.Request, status int, err error) {
+	p := problem(r, status, err)
+
+	rw.Header().Set("Content-Type", ProblemType)
+	rw.WriteHeader(p.Status)
+	data.ToJSON(&p, rw)
+}
+
+// problem returns the problem details of err with the given status,
+// errors that always have the same status, like a lost database connection, get it
+// and a validation error gets the list of invalid fields
+func problem(r *http.Request, status int, err error) Problem {
+	if known, ok := findKnownError(err); ok && known.status != 0 {
+		status = known.status
+	}
+
+	p := Problem{Detail: err.Error(), Instance: r.URL.Path}
+	if errs, ok := err.(data.ValidationError); ok {
+		p.Detail = "validation failed"
+		p.Errors = errs
+	}
+
+	p.Status = status
+	p.Title = http.StatusText(status)
+	p.Code = errorCode(err, status)
+	p.Type = "/problems/" + strings.ToLower(strings.Replace(p.Code, "_", "-", -1))
+	return p
+}
+
+// NotFound writes the response to a request for an unknown route
+func NotFound(rw http.ResponseWriter, r *http.Request) {
+	writeError(rw, r, http.StatusNotFound, fmt.Errorf("no route for %s", r.URL.Path))
+}
+
+// MethodNotAllowed writes the response to a request with a method a route does not support
+func MethodNotAllowed(rw http.ResponseWriter, r *http.Request) {
+	writeError(rw, r, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed for %s", r.Method, r.URL.Path))
+}
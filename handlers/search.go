@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zzibert/3fs-rest-api/data"
+)
+
+// Search handler for searching users and groups
+type Search struct {
+	l      *log.Logger
+	store  data.Searcher
+	paging Paging
+}
+
+// NewSearch returns a new search handler with the given logger, searcher and paging
+func NewSearch(l *log.Logger, s data.Searcher, pg Paging) *Search {
+	return &Search{l, s, pg}
+}
+
+// swagger:route GET /search search search
+// Searches users by name and email and groups by name, best matches first
+// responses:
+//  200: searchResponse
+//  400: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+
+// Search handles GET requests with a query and returns the matching users and groups
+func (s *Search) Search(rw http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	s.l.Println("Search", query)
+
+	if query == "" {
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeInvalidParameter, fmt.Errorf("missing query q")))
+		return
+	}
+
+	limit := s.paging.DefaultLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			writeError(rw, r, http.StatusBadRequest, withCode(CodeInvalidParameter, fmt.Errorf("invalid limit %q", value)))
+			return
+		}
+	}
+	if limit > s.paging.MaxLimit {
+		limit = s.paging.MaxLimit
+	}
+
+	results, err := s.store.Search(query, limit)
+	if err != nil {
+		s.l.Println("Error searching", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = data.ToJSON(&results, rw)
+	if err != nil {
+		s.l.Println("Error encoding search results", err)
+	}
+}
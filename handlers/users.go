@@ -1,54 +1,106 @@
 package handlers
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
 
-	"github.com/jinzhu/gorm"
+	"github.com/zzibert/3fs-rest-api/auth"
 	"github.com/zzibert/3fs-rest-api/data"
 )
 
 // Users handler for getting and updating users
 type Users struct {
-	l  *log.Logger
-	Db *gorm.DB
+	l         *log.Logger
+	store     data.UserStore
+	groups    data.GroupStore
+	passwords *auth.Passwords
+	paging    Paging
+
+	// requireIfMatch rejects changes without an If-Match header
+	requireIfMatch bool
+
+	// maxBatch is the largest number of operations of a batch
+	maxBatch int
 }
 
-// NewUsers returns a new users handler with the given logger
-func NewUsers(l *log.Logger, db *gorm.DB) *Users {
-	return &Users{l, db}
+// NewUsers returns a new users handler with the given logger, user store, password hasher, paging and batch size
+// When requireIfMatch is true updates and deletes must send the ETag of the user in an If-Match header
+func NewUsers(l *log.Logger, s data.UserStore, gs data.GroupStore, p *auth.Passwords, pg Paging, requireIfMatch bool, maxBatch int) *Users {
+	return &Users{l, s, gs, p, pg, requireIfMatch, maxBatch}
 }
 
 // swagger:route GET /users users ListUsers
 // Returns a list of users from the database
 // responses:
 //  200: UsersResponse
+//  400: errorResponse
+//  401: errorResponse
+//  403: errorResponse
 
-// ListAll handles GET requests and returns all current users
+// ListAll handles GET requests and returns a page of users
 func (u *Users) ListAll(rw http.ResponseWriter, r *http.Request) {
 	u.l.Println("Get all users")
 
-	users := data.GetUsers(u.Db)
+	pg, err := u.paging.parsePage(r)
+	if err != nil {
+		u.l.Println("Error parsing page", err)
+
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeInvalidParameter, err))
+		return
+	}
+
+	users, total, err := u.store.GetUsers(pg.listOptions())
+	if errors.Is(err, data.ErrInvalidListOption) {
+		u.l.Println("Error invalid list options", err)
+
+		writeError(rw, r, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		u.l.Println("Error fetching users", err)
 
-	err := data.ToJSON(&users, rw)
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	start, end, more := pg.trim(len(users))
+	users = users[start:end]
+
+	pg.writeHeaders(rw, r, total, len(users), func(i int) data.Cursor { return data.UserCursor(users[i], pg.sort) }, more)
+
+	err = data.ToJSON(&users, rw)
 	if err != nil {
 		u.l.Println("error encoding users")
 	}
 }
 
 // swagger:route GET /users/{id} users ListUser
-// Returns a single user from the database
+// Returns a single user from the database with its ETag
 // responses:
 //  200: userResponse
+//  304: notModifiedResponse
+//  400: errorResponse
 //  404: errorResponse
+//  401: errorResponse
+//  403: errorResponse
 
-// ListSingle handles GET requests with id
+// ListSingle handles GET requests with id, a matching If-None-Match header gets a 304 response
 func (u *Users) ListSingle(rw http.ResponseWriter, r *http.Request) {
 	id := getId(r)
 
 	u.l.Println("Get User id: ", id)
 
-	user, err := data.GetUserById(id, u.Db)
+	include, err := includeDeleted(r)
+	if err != nil {
+		u.l.Println("Error parsing include_deleted", err)
+
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeInvalidParameter, err))
+		return
+	}
+
+	user, err := u.user(id, include)
 
 	switch err {
 	case nil:
@@ -56,14 +108,18 @@ func (u *Users) ListSingle(rw http.ResponseWriter, r *http.Request) {
 	case data.ErrUserNotFound:
 		u.l.Println("Error fetching user", err)
 
-		rw.WriteHeader(http.StatusNotFound)
-		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		writeError(rw, r, http.StatusNotFound, err)
 		return
 	default:
 		u.l.Println("Error fetching user", err)
 
-		rw.WriteHeader(http.StatusInternalServerError)
-		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	etag := userETag(user)
+	rw.Header().Set("ETag", etag)
+	if notModified(rw, r, etag) {
 		return
 	}
 
@@ -73,49 +129,194 @@ func (u *Users) ListSingle(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// swagger:route PUT /users users updateUser
-// update an user
+// swagger:route PUT /users/{id} users updateUser
+// Replace a user, a missing password keeps the current password
+// Putting the user into a group that grants a permission the caller does not hold takes groups:write
 //
 // responses:
-//  201: noContentResponse
+//  204: noContentResponse
+//  400: errorResponse
 //  404: errorResponse
-
-// Update handles PUT to update users
+//  409: errorResponse
+//  412: errorResponse
+//  422: validationErrorResponse
+//  428: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
+
+// Update handles PUT requests to replace users
 func (u *Users) Update(rw http.ResponseWriter, r *http.Request) {
 	id := getId(r)
 
 	u.l.Println("Update User id: ", id)
 
-	userMap := make(map[string]interface{})
-	err := data.FromJSON(&userMap, r.Body)
+	current, version, ok := u.document(rw, r, id)
+	if !ok {
+		return
+	}
+
+	doc, err := readDocument(r.Body)
 	if err != nil {
-		u.l.Println("Error couldnt parse user map from request body", err)
+		u.l.Println("Error couldnt parse user from request body", err)
 
-		rw.WriteHeader(http.StatusBadRequest)
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeMalformedBody, err))
 		return
 	}
 
-	err = data.UpdateUser(id, userMap, u.Db)
+	u.replace(rw, r, id, version, current, doc)
+}
+
+// swagger:route PATCH /users/{id} users patchUser
+// Change fields of a user with a JSON Merge Patch or a JSON Patch
+// Putting the user into a group that grants a permission the caller does not hold takes groups:write
+//
+// consumes:
+// - application/merge-patch+json
+// - application/json-patch+json
+//
+// responses:
+//  204: noContentResponse
+//  400: errorResponse
+//  404: errorResponse
+//  409: errorResponse
+//  412: errorResponse
+//  415: errorResponse
+//  422: validationErrorResponse
+//  428: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
+
+// Patch handles PATCH requests to change users
+func (u *Users) Patch(rw http.ResponseWriter, r *http.Request) {
+	id := getId(r)
+
+	u.l.Println("Patch User id: ", id)
+
+	current, version, ok := u.document(rw, r, id)
+	if !ok {
+		return
+	}
+
+	doc, err := toDocument(current)
+	if err == nil {
+		doc, err = applyPatch(r, doc)
+	}
+	if err != nil {
+		u.l.Println("Error applying patch", err)
+
+		writePatchError(rw, r, err)
+		return
+	}
+
+	u.replace(rw, r, id, version, current, doc)
+}
+
+// document returns the user as a document with its version,
+// it writes an error response and returns false when the user can not be fetched or does not match the If-Match header
+func (u *Users) document(rw http.ResponseWriter, r *http.Request, id int) (document, int, bool) {
+	user, err := u.store.GetUserById(id)
 
 	switch err {
 	case nil:
 
 	case data.ErrUserNotFound:
+		u.l.Println("Error fetching user", err)
+
+		writeError(rw, r, http.StatusNotFound, err)
+		return nil, 0, false
+	default:
+		u.l.Println("Error fetching user", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return nil, 0, false
+	}
+
+	if !checkIfMatch(rw, r, userETag(user), u.requireIfMatch) {
+		u.l.Println("Error precondition of user failed")
+		return nil, 0, false
+	}
+
+	doc, err := toDocument(user)
+	if err != nil {
+		u.l.Println("Error encoding user", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return nil, 0, false
+	}
+	return doc, user.Version, true
+}
+
+// user returns the user with the given id, a deleted user is only returned when includeDeleted is true
+func (u *Users) user(id int, includeDeleted bool) (data.User, error) {
+	if !includeDeleted {
+		return u.store.GetUserById(id)
+	}
+
+	filter := data.Filter{Field: "id", Op: data.OpEq, Value: strconv.Itoa(id)}
+	users, _, err := u.store.GetUsers(data.ListOptions{Filters: []data.Filter{filter}, IncludeDeleted: true})
+	if err != nil {
+		return data.User{}, err
+	}
+	if len(users) == 0 {
+		return data.User{}, data.ErrUserNotFound
+	}
+	return *users[0], nil
+}
+
+// replace checks the new document of the user against the user schema and stores it
+// if the user no longer has the given version a 412 response is written
+func (u *Users) replace(rw http.ResponseWriter, r *http.Request, id, version int, current, doc document) {
+	userMap, err := userSchema.check(current, doc, &data.User{})
+	if err != nil {
+		u.l.Println("Error invalid user", err)
+
+		writeError(rw, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if groupID, moved := movedTo(current, userMap); moved {
+		if status, err := checkJoin(u.groups, r, groupID); err != nil {
+			u.l.Println("Error moving user id", id, "to group id", groupID, err)
+
+			writeError(rw, r, status, err)
+			return
+		}
+	}
+
+	if password, ok := userMap["password"].(string); ok {
+		if userMap["password"], err = u.passwords.Hash(password); err != nil {
+			u.l.Println("Error hashing password", err)
+
+			writeError(rw, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	err = u.store.UpdateUser(actor(r), id, version, userMap)
+
+	switch {
+	case err == nil:
+
+	case err == data.ErrUserNotFound:
 		u.l.Println("Error updating user", err)
 
-		rw.WriteHeader(http.StatusNotFound)
-		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		writeError(rw, r, http.StatusNotFound, err)
 		return
-	case data.ErrUserConstraintViolation:
+	case err == data.ErrVersionMismatch:
+		u.l.Println("Error user changed while updating", err)
+
+		writeError(rw, r, http.StatusPreconditionFailed, err)
+		return
+	case errors.Is(err, data.ErrUserConstraintViolation), errors.As(err, new(data.ValidationError)):
 		u.l.Println("Error updating user", err)
-		rw.WriteHeader(http.StatusNotFound)
-		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+
+		writeError(rw, r, http.StatusUnprocessableEntity, err)
 		return
 	default:
 		u.l.Println("Error updating user", err)
 
-		rw.WriteHeader(http.StatusInternalServerError)
-		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		writeError(rw, r, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -124,10 +325,16 @@ func (u *Users) Update(rw http.ResponseWriter, r *http.Request) {
 
 // swagger:route POST /users users createUser
 // Create a new User
+// Putting the user into a group that grants a permission the caller does not hold takes groups:write
 //
 // responses:
 //  200: noContentResponse
 //  400: errorResponse
+//  409: errorResponse
+//  422: validationErrorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
 
 // Create handles POST requests to add new users
 func (u *Users) Create(rw http.ResponseWriter, r *http.Request) {
@@ -136,25 +343,55 @@ func (u *Users) Create(rw http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		u.l.Println("Error couldnt parse user from request body", err)
 
-		rw.WriteHeader(http.StatusBadRequest)
+		writeError(rw, r, http.StatusBadRequest, withCode(CodeMalformedBody, err))
 		return
 	}
 
-	err = data.AddUser(&user, u.Db)
-	if err != nil {
+	if err = data.Validate(&user); err != nil {
+		u.l.Println("Error invalid user", err)
+
+		writeError(rw, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if status, err := checkJoin(u.groups, r, user.GroupID); err != nil {
+		u.l.Println("Error adding user to group id", user.GroupID, err)
+
+		writeError(rw, r, status, err)
+		return
+	}
+
+	if user.Password, err = u.passwords.Hash(user.Password); err != nil {
+		u.l.Println("Error hashing password", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = u.store.AddUser(actor(r), &user)
+	switch {
+	case err == nil:
+
+	case errors.Is(err, data.ErrUserConstraintViolation), errors.As(err, new(data.ValidationError)):
 		u.l.Println("Error adding user: ", err)
 
-		rw.WriteHeader(http.StatusBadRequest)
-		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		writeError(rw, r, http.StatusUnprocessableEntity, err)
+	default:
+		u.l.Println("Error adding user: ", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
 	}
 }
 
 // swagger:route DELETE /users/{id} users deleteUser
-// Deletes an user from the database
+// Deletes an user, it can be restored until it is purged
 //
 // responses:
 //  204: noContentResponse
 //  404: errorResponse
+//  412: errorResponse
+//  428: errorResponse
+//  401: errorResponse
+//  403: errorResponse
 
 // DeleteUser handles DELETE requests for deleting an user from the database
 func (u *Users) Delete(rw http.ResponseWriter, r *http.Request) {
@@ -162,21 +399,86 @@ func (u *Users) Delete(rw http.ResponseWriter, r *http.Request) {
 
 	u.l.Println("Deleting user with id", id)
 
-	err := data.DeleteUser(id, u.Db)
-	switch err {
-	case nil:
+	// without an If-Match header the user is deleted whatever its version
+	version := 0
+	if r.Header.Get("If-Match") != "" || u.requireIfMatch {
+		_, v, ok := u.document(rw, r, id)
+		if !ok {
+			return
+		}
+		version = v
+	}
 
-	case data.ErrUserNotFound:
+	err := u.store.DeleteUser(actor(r), id, version)
+	switch {
+	case err == nil:
+
+	case err == data.ErrUserNotFound:
 		u.l.Println("Error user id does not exist")
 
-		rw.WriteHeader(http.StatusNotFound)
+		writeError(rw, r, http.StatusNotFound, err)
+		return
+	case err == data.ErrVersionMismatch:
+		u.l.Println("Error user changed while deleting", err)
+
+		writeError(rw, r, http.StatusPreconditionFailed, err)
 		return
 	default:
 		u.l.Println("Error deleting user", err)
 
-		rw.WriteHeader(http.StatusInternalServerError)
+		writeError(rw, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// swagger:route POST /users/{id}/restore users restoreUser
+// Restore a deleted user, restoring a user that is not deleted has no effect
+//
+// responses:
+//  204: noContentResponse
+//  404: errorResponse
+//  409: errorResponse
+//  422: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  503: errorResponse
+
+// Restore handles POST requests to restore deleted users
+func (u *Users) Restore(rw http.ResponseWriter, r *http.Request) {
+	id := getId(r)
+
+	u.l.Println("Restoring user with id", id)
+
+	err := u.store.RestoreUser(actor(r), id)
+	switch {
+	case err == nil:
+
+	case err == data.ErrUserNotFound:
+		u.l.Println("Error user id does not exist")
+
+		writeError(rw, r, http.StatusNotFound, err)
+		return
+	case errors.Is(err, data.ErrUserConstraintViolation):
+		u.l.Println("Error restoring user", err)
+
+		writeError(rw, r, http.StatusConflict, err)
+		return
+	default:
+		u.l.Println("Error restoring user", err)
+
+		writeError(rw, r, http.StatusInternalServerError, err)
 		return
 	}
 
 	rw.WriteHeader(http.StatusNoContent)
 }
+
+// movedTo returns the primary group of the checked values of a user document
+// and whether it differs from the primary group of the current document
+func movedTo(current document, userMap map[string]interface{}) (int, bool) {
+	groupID, ok := userMap["groupID"].(int)
+	// the numbers of the current document are decoded from JSON
+	return groupID, ok && float64(groupID) != current["groupID"]
+}
@@ -7,13 +7,16 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/jinzhu/gorm"
-	_ "github.com/lib/pq"
 	"github.com/subosito/gotenv"
+	"github.com/zzibert/3fs-rest-api/auth"
+	"github.com/zzibert/3fs-rest-api/data"
 	"github.com/zzibert/3fs-rest-api/handlers"
+	"github.com/zzibert/3fs-rest-api/migrations"
 )
 
 func main() {
@@ -22,17 +25,22 @@ func main() {
 	gotenv.Load()
 
 	// Getting all environment variables
+	driver := os.Getenv("DB_DRIVER")
 	host := os.Getenv("HOST")
 	port := os.Getenv("PORT")
 	user := os.Getenv("USER")
 	password := os.Getenv("PASSWORD")
 	dbname := os.Getenv("DBNAME")
 
-	// connection string for database
-	connection := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, dbname)
+	// connection string for database, for sqlite the database name is the path of the database file
+	connection := dbname
+	if driver == "" || driver == data.DriverPostgres {
+		driver = data.DriverPostgres
+		connection = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, dbname)
+	}
 
-	// Opening a connection to the postgres database
-	db, err := gorm.Open("postgres", connection)
+	// Opening a connection to the database
+	db, err := data.Open(driver, connection)
 	if err != nil {
 		panic(err)
 	}
@@ -40,40 +48,177 @@ func main() {
 
 	l := log.New(os.Stdout, "3fs-rest-api", log.LstdFlags)
 
-	// Init user and group tables
-	// db.AutoMigrate(&data.User{})
-	// db.AutoMigrate(&data.Group{})
+	migrator := migrations.New(db)
+
+	// create the store backed by the database
+	store := data.NewGormStore(db)
+
+	// create the password hasher, bcrypt or argon2id
+	passwords, err := auth.NewPasswords(os.Getenv("PASSWORD_HASH"))
+	if err != nil {
+		panic(err)
+	}
+
+	// the migrate and adduser subcommands run instead of the server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			err = runMigrate(migrator, os.Args[2:], os.Stdout)
+		case "adduser":
+			err = runAddUser(store, passwords, os.Args[2:], os.Stdout)
+		default:
+			err = fmt.Errorf("unknown command %s, expected migrate or adduser", os.Args[1])
+		}
+		if err != nil {
+			l.Println("Error running", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// apply pending migrations on start, needed for SQLite :memory: databases
+	if os.Getenv("AUTO_MIGRATE") == "true" {
+		if err = migrator.Up(); err != nil {
+			panic(err)
+		}
+	}
+
+	// refuse to start when the schema is not at the version this binary expects
+	if os.Getenv("SCHEMA_CHECK") == "true" {
+		if err = migrator.Check(); err != nil {
+			panic(err)
+		}
+	}
+
+	// load the token signing keys, the first key signs new tokens and the others only verify
+	var keys *auth.KeySet
+	if paths := os.Getenv("JWT_KEYS"); paths != "" {
+		keys, err = auth.LoadKeySet(strings.Split(paths, ",")...)
+	} else {
+		l.Println("JWT_KEYS is not set, tokens are signed with a random key and stop working on restart")
+		keys, err = auth.GenerateKeySet()
+	}
+	if err != nil {
+		panic(err)
+	}
+	tokens := auth.NewTokens(keys, "3fs-rest-api", durationEnv("ACCESS_TOKEN_TTL", 15*time.Minute), durationEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour))
+
+	// page size of the list endpoints
+	paging := handlers.DefaultPaging
+	if value := os.Getenv("MAX_PAGE_SIZE"); value != "" {
+		if paging.MaxLimit, err = strconv.Atoi(value); err != nil || paging.MaxLimit < 1 {
+			panic(fmt.Errorf("invalid MAX_PAGE_SIZE %q", value))
+		}
+		if paging.DefaultLimit > paging.MaxLimit {
+			paging.DefaultLimit = paging.MaxLimit
+		}
+	}
+
+	// purge deleted users and groups once they have been deleted for the configured number of days,
+	// without it they can be restored forever
+	if value := os.Getenv("PURGE_AFTER_DAYS"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 1 {
+			panic(fmt.Errorf("invalid PURGE_AFTER_DAYS %q", value))
+		}
+		go runPurger(l, store, time.Duration(days)*24*time.Hour, time.Hour)
+	}
+
+	// updates and deletes without an If-Match header are rejected when it is required
+	requireIfMatch := os.Getenv("REQUIRE_IF_MATCH") == "true"
+
+	// number of operations of a batch
+	maxBatch := handlers.DefaultMaxBatch
+	if value := os.Getenv("MAX_BATCH_SIZE"); value != "" {
+		if maxBatch, err = strconv.Atoi(value); err != nil || maxBatch < 1 {
+			panic(fmt.Errorf("invalid MAX_BATCH_SIZE %q", value))
+		}
+	}
 
 	// create the user handlers
-	userHandler := handlers.NewUsers(l, db)
+	userHandler := handlers.NewUsers(l, store, store, passwords, paging, requireIfMatch, maxBatch)
 
 	// create the group handlers
-	groupHandler := handlers.NewGroups(l, db)
+	groupHandler := handlers.NewGroups(l, store, paging, requireIfMatch)
+
+	// create the search handler
+	searchHandler := handlers.NewSearch(l, store, paging)
+
+	// create the audit handler
+	auditHandler := handlers.NewAudit(l, store, paging)
+
+	// create the attributes handler
+	attributeHandler := handlers.NewAttributes(l, store)
+
+	// create the auth handlers
+	authHandler := handlers.NewAuth(l, store, store, passwords, tokens)
 
 	// create a new serve mux and register the handlers
 	sm := mux.NewRouter()
 
+	// unknown routes and methods get problem details like every other error
+	sm.NotFoundHandler = http.HandlerFunc(handlers.NotFound)
+	sm.MethodNotAllowedHandler = http.HandlerFunc(handlers.MethodNotAllowed)
+
+	// every request gets an id, changes are recorded in the audit log with it
+	sm.Use(handlers.RequestID)
+
+	// Public routes, registered first so they match before the authenticated subrouters
+	sm.HandleFunc("/auth/login", authHandler.Login).Methods(http.MethodPost)
+	sm.HandleFunc("/auth/refresh", authHandler.Refresh).Methods(http.MethodPost)
+	sm.HandleFunc("/.well-known/jwks.json", authHandler.JWKS).Methods(http.MethodGet)
+
 	// GET Subrouter
 	getRouter := sm.Methods(http.MethodGet).Subrouter()
-	getRouter.HandleFunc("/users", userHandler.ListAll)
-	getRouter.HandleFunc("/users/{id:[0-9]+}", userHandler.ListSingle)
-	getRouter.HandleFunc("/groups", groupHandler.ListAll)
-	getRouter.HandleFunc("/groups/{id:[0-9]+}", groupHandler.ListSingle)
+	getRouter.HandleFunc("/users", authHandler.Require(data.PermUsersRead, authHandler.RequireIncludeDeleted(data.PermUsersAdmin, userHandler.ListAll)))
+	getRouter.HandleFunc("/users/{id:[0-9]+}", authHandler.Require(data.PermUsersRead, authHandler.RequireIncludeDeleted(data.PermUsersAdmin, userHandler.ListSingle)))
+	getRouter.HandleFunc("/groups", authHandler.Require(data.PermGroupsRead, authHandler.RequireIncludeDeleted(data.PermGroupsAdmin, groupHandler.ListAll)))
+	getRouter.HandleFunc("/groups/{id:[0-9]+}", authHandler.Require(data.PermGroupsRead, authHandler.RequireIncludeDeleted(data.PermGroupsAdmin, groupHandler.ListSingle)))
+	getRouter.HandleFunc("/users/{id:[0-9]+}/groups", authHandler.Require(data.PermUsersRead, authHandler.Require(data.PermGroupsRead, groupHandler.ListUserGroups)))
+	getRouter.HandleFunc("/groups/{id:[0-9]+}/ancestors", authHandler.Require(data.PermGroupsRead, groupHandler.ListAncestors))
+	getRouter.HandleFunc("/groups/{id:[0-9]+}/descendants", authHandler.Require(data.PermGroupsRead, groupHandler.ListDescendants))
+	getRouter.HandleFunc("/groups/{id:[0-9]+}/members", authHandler.Require(data.PermUsersRead, authHandler.Require(data.PermGroupsRead, groupHandler.ListMembers)))
+	getRouter.HandleFunc("/groups/{id:[0-9]+}/admins", authHandler.Require(data.PermGroupsRead, groupHandler.ListAdmins))
+	getRouter.HandleFunc("/search", authHandler.Require(data.PermUsersRead, authHandler.Require(data.PermGroupsRead, searchHandler.Search)))
+	getRouter.HandleFunc("/audit", authHandler.Require(data.PermAuditRead, auditHandler.ListAll))
+	getRouter.HandleFunc("/attributes", authHandler.Require(data.PermUsersRead, attributeHandler.ListAll))
+	getRouter.Use(authHandler.Authenticate)
 
 	// PUT Subrouter
 	putRouter := sm.Methods(http.MethodPut).Subrouter()
-	putRouter.HandleFunc("/users/{id:[0-9]+}", userHandler.Update)
-	putRouter.HandleFunc("/groups/{id:[0-9]+}", groupHandler.Update)
+	putRouter.HandleFunc("/users/{id:[0-9]+}", authHandler.Require(data.PermUsersWrite, userHandler.Update))
+	putRouter.HandleFunc("/groups/{id:[0-9]+}", authHandler.RequireGroupRole(data.PermGroupsWrite, data.RoleManager, groupHandler.Update))
+	putRouter.HandleFunc("/groups/{id:[0-9]+}/permissions/{permission}", authHandler.Require(data.PermGroupsAdmin, groupHandler.GrantPermission))
+	putRouter.HandleFunc("/groups/{id:[0-9]+}/admins/{userId:[0-9]+}", authHandler.RequireGroupRole(data.PermGroupsAdmin, data.RoleOwner, groupHandler.SetAdmin))
+	putRouter.HandleFunc("/attributes/{name}", authHandler.Require(data.PermUsersAdmin, attributeHandler.Put))
+	putRouter.Use(authHandler.Authenticate)
+
+	// PATCH Subrouter
+	patchRouter := sm.Methods(http.MethodPatch).Subrouter()
+	patchRouter.HandleFunc("/users/{id:[0-9]+}", authHandler.Require(data.PermUsersWrite, userHandler.Patch))
+	patchRouter.HandleFunc("/groups/{id:[0-9]+}", authHandler.RequireGroupRole(data.PermGroupsWrite, data.RoleManager, groupHandler.Patch))
+	patchRouter.Use(authHandler.Authenticate)
 
 	// POST Subrouter
 	postRouter := sm.Methods(http.MethodPost).Subrouter()
-	postRouter.HandleFunc("/users", userHandler.Create)
-	postRouter.HandleFunc("/groups", groupHandler.Create)
+	postRouter.HandleFunc("/users", authHandler.Require(data.PermUsersWrite, userHandler.Create))
+	postRouter.HandleFunc("/users:batch", authHandler.Require(data.PermUsersWrite, userHandler.Batch))
+	postRouter.HandleFunc("/groups", authHandler.Require(data.PermGroupsWrite, groupHandler.Create))
+	postRouter.HandleFunc("/users/{id:[0-9]+}/restore", authHandler.Require(data.PermUsersAdmin, userHandler.Restore))
+	postRouter.HandleFunc("/groups/{id:[0-9]+}/restore", authHandler.Require(data.PermGroupsAdmin, groupHandler.Restore))
+	postRouter.HandleFunc("/groups/{id:[0-9]+}/members/{userId:[0-9]+}", authHandler.RequireGroupRole(data.PermGroupsWrite, data.RoleManager, groupHandler.AddMember))
+	postRouter.HandleFunc("/groups:preview", authHandler.Require(data.PermUsersRead, authHandler.Require(data.PermGroupsRead, groupHandler.PreviewRule)))
+	postRouter.Use(authHandler.Authenticate)
 
 	// DELETE Subrouter
 	deleteRouter := sm.Methods(http.MethodDelete).Subrouter()
-	deleteRouter.HandleFunc("/users/{id:[0-9]+}", userHandler.Delete)
-	deleteRouter.HandleFunc("/groups/{id:[0-9]+}", groupHandler.Delete)
+	deleteRouter.HandleFunc("/users/{id:[0-9]+}", authHandler.Require(data.PermUsersWrite, userHandler.Delete))
+	deleteRouter.HandleFunc("/groups/{id:[0-9]+}", authHandler.RequireGroupRole(data.PermGroupsWrite, data.RoleOwner, groupHandler.Delete))
+	deleteRouter.HandleFunc("/groups/{id:[0-9]+}/permissions/{permission}", authHandler.Require(data.PermGroupsAdmin, groupHandler.RevokePermission))
+	deleteRouter.HandleFunc("/groups/{id:[0-9]+}/members/{userId:[0-9]+}", authHandler.RequireGroupRole(data.PermGroupsWrite, data.RoleManager, groupHandler.RemoveMember))
+	deleteRouter.HandleFunc("/groups/{id:[0-9]+}/admins/{userId:[0-9]+}", authHandler.RequireGroupRole(data.PermGroupsAdmin, data.RoleOwner, groupHandler.RemoveAdmin))
+	deleteRouter.HandleFunc("/attributes/{name}", authHandler.Require(data.PermUsersAdmin, attributeHandler.Delete))
+	deleteRouter.Use(authHandler.Authenticate)
 
 	// create a new server
 	s := http.Server{
@@ -106,6 +251,21 @@ func main() {
 	log.Println("Got Signal ", sig)
 
 	// gracefully shutdown the server, waiting max 30 seconds for current operations to complete
-	ctx, _ := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 	s.Shutdown(ctx)
 }
+
+// durationEnv returns the duration in the environment variable or the default if it is not set
+func durationEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Errorf("invalid duration in %s: %w", name, err))
+	}
+	return d
+}
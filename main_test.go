@@ -2,21 +2,35 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
+	"github.com/zzibert/3fs-rest-api/auth"
 	"github.com/zzibert/3fs-rest-api/data"
 	"github.com/zzibert/3fs-rest-api/handlers"
+	"github.com/zzibert/3fs-rest-api/migrations"
 	. "gopkg.in/check.v1"
 )
 
+// testStore is the store the test suites run against
+type testStore interface {
+	data.UserStore
+	data.GroupStore
+	data.AuditStore
+	data.AttributeStore
+	data.Searcher
+}
+
 // Creates group test suite
 type GroupTestSuite struct {
 	groupHandler *handlers.Groups
@@ -24,7 +38,8 @@ type GroupTestSuite struct {
 	writer       *httptest.ResponseRecorder
 	mux          *mux.Router
 	l            *log.Logger
-	db           *gorm.DB
+	newStore     func() testStore
+	store        testStore
 }
 
 // Creates user test suite
@@ -34,22 +49,94 @@ type UserTestSuite struct {
 	writer      *httptest.ResponseRecorder
 	mux         *mux.Router
 	l           *log.Logger
-	db          *gorm.DB
+	newStore    func() testStore
+	store       testStore
+	passwords   *auth.Passwords
+}
+
+// Creates auth test suite
+type AuthTestSuite struct {
+	authHandler *handlers.Auth
+	writer      *httptest.ResponseRecorder
+	mux         *mux.Router
+	l           *log.Logger
+	newStore    func() testStore
+	store       testStore
+	passwords   *auth.Passwords
+	tokens      *auth.Tokens
 }
 
 // Registering test suite
+// The suites run against every store listed in TEST_DB_DRIVER,
+// by default the in-memory store and an in-memory SQLite database
 func init() {
+	l := log.New(os.Stdout, "3fs-rest-api", log.LstdFlags)
+
+	passwords, err := auth.NewPasswords(auth.Bcrypt)
+	if err != nil {
+		panic(err)
+	}
+
+	keys, err := auth.GenerateKeySet()
+	if err != nil {
+		panic(err)
+	}
+	tokens := auth.NewTokens(keys, "3fs-rest-api", time.Minute, time.Hour)
+
+	drivers := os.Getenv("TEST_DB_DRIVER")
+	if drivers == "" {
+		drivers = "memory,sqlite3"
+	}
+
+	for _, driver := range strings.Split(drivers, ",") {
+		var newStore func() testStore
+		switch driver {
+		case "memory":
+			newStore = func() testStore { return data.NewMemoryStore() }
+		case data.DriverSQLite:
+			newStore = newSQLiteStore
+		case data.DriverPostgres:
+			newStore = newPostgresStore()
+		default:
+			panic("unknown test driver " + driver)
+		}
+
+		Suite(&GroupTestSuite{l: l, newStore: newStore})
+		Suite(&UserTestSuite{l: l, newStore: newStore, passwords: passwords})
+		Suite(&AuthTestSuite{l: l, newStore: newStore, passwords: passwords, tokens: tokens})
+	}
+}
+
+// newSQLiteStore returns a store using a new in-memory SQLite database
+func newSQLiteStore() testStore {
+	db, err := data.Open(data.DriverSQLite, ":memory:")
+	if err != nil {
+		panic(err)
+	}
+	if err = migrations.New(db).Up(); err != nil {
+		panic(err)
+	}
+	return data.NewGormStore(db)
+}
+
+// newPostgresStore connects to the docker-compose test database
+// and returns a func that empties it and returns a store using it
+func newPostgresStore() func() testStore {
 	connection := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", "localhost", "5433", "zanzibert", "nekineki", "test")
 
 	// Opening a connection to the postgres database
-	db, err := gorm.Open("postgres", connection)
+	db, err := data.Open(data.DriverPostgres, connection)
 	if err != nil {
 		panic(err)
 	}
-	l := log.New(os.Stdout, "3fs-rest-api", log.LstdFlags)
+	if err = migrations.New(db).Up(); err != nil {
+		panic(err)
+	}
 
-	Suite(&GroupTestSuite{l: l, db: db})
-	Suite(&UserTestSuite{l: l, db: db})
+	return func() testStore {
+		clearDB(db)
+		return data.NewGormStore(db)
+	}
 }
 
 // integrates with testing package
@@ -59,31 +146,72 @@ func (s *GroupTestSuite) SetUpTest(c *C) {
 	s.writer = httptest.NewRecorder()
 	s.group = &data.Group{}
 	s.mux = mux.NewRouter()
-	s.groupHandler = handlers.NewGroups(s.l, s.db)
-	setDB(s.db)
-}
-
-func (s *GroupTestSuite) TearDownTest(c *C) {
-	clearDB(s.db)
+	s.store = s.newStore()
+	s.groupHandler = handlers.NewGroups(s.l, s.store, handlers.DefaultPaging, false)
+	setDB(c, s.store)
 }
 
 func (s *UserTestSuite) SetUpTest(c *C) {
 	s.writer = httptest.NewRecorder()
 	s.user = &data.User{}
 	s.mux = mux.NewRouter()
-	s.userHandler = handlers.NewUsers(s.l, s.db)
-	setDB(s.db)
+	s.store = s.newStore()
+	s.userHandler = handlers.NewUsers(s.l, s.store, s.store, s.passwords, handlers.DefaultPaging, false, handlers.DefaultMaxBatch)
+	setDB(c, s.store)
+}
+
+func (s *AuthTestSuite) SetUpTest(c *C) {
+	s.writer = httptest.NewRecorder()
+	s.mux = mux.NewRouter()
+	s.store = s.newStore()
+	s.authHandler = handlers.NewAuth(s.l, s.store, s.store, s.passwords, s.tokens)
+	setDB(c, s.store)
+
+	s.mux.HandleFunc("/auth/login", s.authHandler.Login).Methods(http.MethodPost)
+	s.mux.HandleFunc("/auth/refresh", s.authHandler.Refresh).Methods(http.MethodPost)
+	s.mux.HandleFunc("/.well-known/jwks.json", s.authHandler.JWKS).Methods(http.MethodGet)
+
+	userHandler := handlers.NewUsers(s.l, s.store, s.store, s.passwords, handlers.DefaultPaging, false, handlers.DefaultMaxBatch)
+	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
+	getRouter.HandleFunc("/users", s.authHandler.Require(data.PermUsersRead, s.authHandler.RequireIncludeDeleted(data.PermUsersAdmin, userHandler.ListAll)))
+	getRouter.Use(s.authHandler.Authenticate)
+
+	deleteRouter := s.mux.Methods(http.MethodDelete).Subrouter()
+	deleteRouter.HandleFunc("/users/{id:[0-9]+}", s.authHandler.Require(data.PermUsersWrite, userHandler.Delete))
+	deleteRouter.Use(s.authHandler.Authenticate)
+
+	c.Assert(s.store.GrantPermission(data.System, 1, data.PermUsersRead), IsNil)
+}
+
+// login logs in as user 1 and returns the issued tokens
+func (s *AuthTestSuite) login(c *C) handlers.Tokens {
+	body := strings.NewReader(`{"name": "user 1", "password": "pass"}`)
+	request, _ := http.NewRequest("POST", "/auth/login", body)
+	writer := httptest.NewRecorder()
+	s.mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, 200)
+
+	var login handlers.Login
+	c.Assert(json.Unmarshal(writer.Body.Bytes(), &login), IsNil)
+	return login.Tokens
 }
 
-func (s *UserTestSuite) TearDownTest(c *C) {
-	clearDB(s.db)
+// getUsers requests all users with the given access token and returns the status code
+func (s *AuthTestSuite) getUsers(token string) int {
+	request, _ := http.NewRequest("GET", "/users", nil)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	writer := httptest.NewRecorder()
+	s.mux.ServeHTTP(writer, request)
+	return writer.Code
 }
 
-func setDB(db *gorm.DB) {
-	db.Exec("INSERT INTO groups(name) VALUES ('group 1')")
-	db.Exec("INSERT INTO groups(name) VALUES ('group 2')")
-	db.Exec("INSERT INTO users(name, password, email, group_id) VALUES ('user 1', 'pass', 'user@email.com', 1)")
-	db.Exec("INSERT INTO users(name, password, email, group_id) VALUES ('user 2', 'pass', 'user2@email.com', 1)")
+func setDB(c *C, store testStore) {
+	c.Assert(store.AddGroup(data.System, &data.Group{Name: "group 1"}), IsNil)
+	c.Assert(store.AddGroup(data.System, &data.Group{Name: "group 2"}), IsNil)
+	c.Assert(store.AddUser(data.System, &data.User{Name: "user 1", Password: "pass", Email: "user@email.com", GroupID: 1}), IsNil)
+	c.Assert(store.AddUser(data.System, &data.User{Name: "user 2", Password: "pass", Email: "user2@email.com", GroupID: 1}), IsNil)
 }
 
 func clearDB(db *gorm.DB) {
@@ -91,6 +219,8 @@ func clearDB(db *gorm.DB) {
 	db.Exec("ALTER SEQUENCE users_id_seq RESTART WITH 1")
 	db.Exec("delete from groups")
 	db.Exec("ALTER SEQUENCE groups_id_seq RESTART WITH 1")
+	db.Exec("TRUNCATE audit_entries RESTART IDENTITY")
+	db.Exec("TRUNCATE attributes RESTART IDENTITY CASCADE")
 }
 
 //GROUP TESTS
@@ -133,6 +263,25 @@ func (s *GroupTestSuite) TestGroupHandlePost(c *C) {
 	c.Check(s.writer.Code, Equals, 200)
 }
 
+// Creates a group with a deletedAt time and a version and checks the group is live at its first version
+func (s *GroupTestSuite) TestGroupHandlePostDeleted(c *C) {
+	s.mux.HandleFunc("/groups", s.groupHandler.Create).Methods(http.MethodPost)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}", s.groupHandler.ListSingle).Methods(http.MethodGet)
+
+	body := strings.NewReader(`{"name": "group 3", "deletedAt": "2020-01-01T00:00:00Z", "version": 7}`)
+	request, _ := http.NewRequest("POST", "/groups", body)
+	s.mux.ServeHTTP(s.writer, request)
+	c.Assert(s.writer.Code, Equals, 200)
+
+	request, _ = http.NewRequest("GET", "/groups/3", nil)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+	c.Assert(s.writer.Code, Equals, 200)
+	json.Unmarshal(s.writer.Body.Bytes(), s.group)
+	c.Check(s.group.DeletedAt, IsNil)
+	c.Check(s.group.Version, Equals, 1)
+}
+
 // Tries to create a group with an existing name
 func (s *GroupTestSuite) TestGroupHandlePostFail(c *C) {
 	postRouter := s.mux.Methods(http.MethodPost).Subrouter()
@@ -142,7 +291,7 @@ func (s *GroupTestSuite) TestGroupHandlePostFail(c *C) {
 	request, _ := http.NewRequest("POST", "/groups", body)
 	s.mux.ServeHTTP(s.writer, request)
 
-	c.Check(s.writer.Code, Equals, 400)
+	checkProblem(c, s.writer, 409, handlers.CodeGroupNameTaken)
 }
 
 // Tries to fetch all groups
@@ -155,6 +304,7 @@ func (s *GroupTestSuite) TestGroupHandleGetAll(c *C) {
 	s.mux.ServeHTTP(s.writer, request)
 
 	c.Check(s.writer.Code, Equals, 200)
+	c.Check(strings.Contains(s.writer.Body.String(), "password"), Equals, false)
 
 	var groups *[]data.Group
 	json.Unmarshal(s.writer.Body.Bytes(), &groups)
@@ -162,6 +312,29 @@ func (s *GroupTestSuite) TestGroupHandleGetAll(c *C) {
 	c.Check((*groups)[1].Name, Equals, "group 2")
 }
 
+// Filters the groups by name prefix sorted by descending name, and tries an unknown operator
+func (s *GroupTestSuite) TestGroupHandleGetAllFiltered(c *C) {
+	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
+	getRouter.HandleFunc("/groups", s.groupHandler.ListAll)
+
+	request, _ := http.NewRequest("GET", "/groups?name[prefix]=group&sort=-name", nil)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 200)
+
+	var groups []data.Group
+	json.Unmarshal(s.writer.Body.Bytes(), &groups)
+	c.Assert(groups, HasLen, 2)
+	c.Check(groups[0].Name, Equals, "group 2")
+	c.Check(groups[1].Name, Equals, "group 1")
+
+	request, _ = http.NewRequest("GET", "/groups?email[domain]=email.com", nil)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 400)
+}
+
 // Trying to update a group with id 1
 func (s *GroupTestSuite) TestGroupHandlePut(c *C) {
 	putRouter := s.mux.Methods(http.MethodPut).Subrouter()
@@ -185,6 +358,45 @@ func (s *GroupTestSuite) TestGroupHandlePut(c *C) {
 	c.Check(s.group.Name, Equals, "new group name")
 }
 
+// Renames a group with a JSON Merge Patch and tries to change its users
+func (s *GroupTestSuite) TestGroupHandlePatch(c *C) {
+	patchRouter := s.mux.Methods(http.MethodPatch).Subrouter()
+	patchRouter.HandleFunc("/groups/{id:[0-9]+}", s.groupHandler.Patch)
+
+	request, _ := http.NewRequest("PATCH", "/groups/1", strings.NewReader(`{"name": "patched"}`))
+	request.Header.Set("Content-Type", handlers.MergePatchType)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 204)
+
+	request, _ = http.NewRequest("PATCH", "/groups/1", strings.NewReader(`[{"op": "remove", "path": "/users/0"}]`))
+	request.Header.Set("Content-Type", handlers.JSONPatchType)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 422)
+
+	group, _ := s.store.GetGroupById(1)
+	c.Check(group.Name, Equals, "patched")
+	c.Check(group.Users, HasLen, 2)
+}
+
+// Trying to add a group with an invalid member
+func (s *GroupTestSuite) TestGroupHandlePostInvalid(c *C) {
+	postRouter := s.mux.Methods(http.MethodPost).Subrouter()
+	postRouter.HandleFunc("/groups", s.groupHandler.Create)
+
+	body := strings.NewReader(`{"name": "group 3", "users": [{"name": "user 3", "email": "user3", "password": "pass"}]}`)
+	request, _ := http.NewRequest("POST", "/groups", body)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 422)
+
+	var validation handlers.Problem
+	json.Unmarshal(s.writer.Body.Bytes(), &validation)
+	c.Check(validation.Errors, DeepEquals, []data.FieldError{{Field: "users[0].email", Message: "must be a valid email address"}})
+}
+
 //trying to delete a group with users referenced to it
 func (s *GroupTestSuite) TestGroupHandleDelete(c *C) {
 	deleteRouter := s.mux.Methods(http.MethodDelete).Subrouter()
@@ -193,7 +405,7 @@ func (s *GroupTestSuite) TestGroupHandleDelete(c *C) {
 	request, _ := http.NewRequest("DELETE", "/groups/1", nil)
 	s.mux.ServeHTTP(s.writer, request)
 
-	c.Check(s.writer.Code, Equals, 400)
+	checkProblem(c, s.writer, 409, handlers.CodeGroupHasUsers)
 }
 
 //trying to delete a group
@@ -207,6 +419,110 @@ func (s *GroupTestSuite) TestGroupHandleDeleteFailOne(c *C) {
 	c.Check(s.writer.Code, Equals, 204)
 }
 
+// Grants and revokes a permission of group 1
+func (s *GroupTestSuite) TestGroupHandlePermissions(c *C) {
+	putRouter := s.mux.Methods(http.MethodPut).Subrouter()
+	putRouter.HandleFunc("/groups/{id:[0-9]+}/permissions/{permission}", s.groupHandler.GrantPermission)
+	deleteRouter := s.mux.Methods(http.MethodDelete).Subrouter()
+	deleteRouter.HandleFunc("/groups/{id:[0-9]+}/permissions/{permission}", s.groupHandler.RevokePermission)
+	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
+	getRouter.HandleFunc("/groups/{id:[0-9]+}", s.groupHandler.ListSingle)
+
+	request, _ := http.NewRequest("PUT", "/groups/1/permissions/users:write", nil)
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 204)
+
+	request, _ = http.NewRequest("GET", "/groups/1", nil)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+	json.Unmarshal(s.writer.Body.Bytes(), s.group)
+	c.Check(s.group.Permissions, DeepEquals, []string{"users:write"})
+
+	request, _ = http.NewRequest("DELETE", "/groups/1/permissions/users:write", nil)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 204)
+
+	request, _ = http.NewRequest("GET", "/groups/1", nil)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+	s.group = &data.Group{}
+	json.Unmarshal(s.writer.Body.Bytes(), s.group)
+	c.Check(s.group.Permissions, DeepEquals, []string{})
+}
+
+// Lists and changes the owners and managers of a group, the user creating a group owns it
+func (s *GroupTestSuite) TestGroupHandleAdmins(c *C) {
+	s.mux.HandleFunc("/groups/{id:[0-9]+}/admins", s.groupHandler.ListAdmins).Methods(http.MethodGet)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}/admins/{userId:[0-9]+}", s.groupHandler.SetAdmin).Methods(http.MethodPut)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}/admins/{userId:[0-9]+}", s.groupHandler.RemoveAdmin).Methods(http.MethodDelete)
+
+	send := func(method, url, body string) {
+		request, _ := http.NewRequest(method, url, strings.NewReader(body))
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+	}
+	admins := func(id int) []data.GroupAdmin {
+		send("GET", fmt.Sprintf("/groups/%d/admins", id), "")
+		c.Assert(s.writer.Code, Equals, 200)
+		var admins []data.GroupAdmin
+		c.Assert(json.Unmarshal(s.writer.Body.Bytes(), &admins), IsNil)
+		return admins
+	}
+
+	group := data.Group{Name: "group 3"}
+	c.Assert(s.store.AddGroup(data.Actor{UserID: 2}, &group), IsNil)
+	c.Check(admins(group.ID), DeepEquals, []data.GroupAdmin{{UserID: 2, Role: data.RoleOwner}})
+	c.Check(admins(1), DeepEquals, []data.GroupAdmin{})
+
+	send("PUT", "/groups/1/admins/1", `{"role": "manager"}`)
+	c.Check(s.writer.Code, Equals, 204)
+	send("PUT", "/groups/1/admins/2", `{"role": "owner"}`)
+	c.Check(s.writer.Code, Equals, 204)
+	send("PUT", "/groups/1/admins/1", `{"role": "owner"}`)
+	c.Check(s.writer.Code, Equals, 204)
+	c.Check(admins(1), DeepEquals, []data.GroupAdmin{{UserID: 1, Role: data.RoleOwner}, {UserID: 2, Role: data.RoleOwner}})
+
+	send("DELETE", "/groups/1/admins/2", "")
+	c.Check(s.writer.Code, Equals, 204)
+	send("DELETE", "/groups/1/admins/2", "")
+	c.Check(s.writer.Code, Equals, 204)
+	c.Check(admins(1), DeepEquals, []data.GroupAdmin{{UserID: 1, Role: data.RoleOwner}})
+
+	send("PUT", "/groups/1/admins/2", `{"role": "admin"}`)
+	checkProblem(c, s.writer, 400, handlers.CodeUnknownRole)
+	send("PUT", "/groups/1/admins/9", `{"role": "owner"}`)
+	checkProblem(c, s.writer, 404, handlers.CodeUserNotFound)
+	send("PUT", "/groups/9/admins/1", `{"role": "owner"}`)
+	checkProblem(c, s.writer, 404, handlers.CodeGroupNotFound)
+	send("GET", "/groups/9/admins", "")
+	checkProblem(c, s.writer, 404, handlers.CodeGroupNotFound)
+
+	// the role changes are recorded and change the version of the group
+	entries, _, err := s.store.GetAuditEntries(data.ListOptions{Filters: []data.Filter{{Field: "entityID", Op: data.OpEq, Value: "1"}, {Field: "action", Op: data.OpEq, Value: data.AuditGrant}}})
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 3)
+	c.Check(fmt.Sprint(entries[2].Changes["manager"].Before, entries[2].Changes["owner"].After), Equals, "1 1")
+	group, err = s.store.GetGroupById(1)
+	c.Assert(err, IsNil)
+	c.Check(group.Version, Equals, 5)
+}
+
+// Tries to grant an unknown permission and a permission of a non-existent group
+func (s *GroupTestSuite) TestGroupHandlePermissionsFail(c *C) {
+	putRouter := s.mux.Methods(http.MethodPut).Subrouter()
+	putRouter.HandleFunc("/groups/{id:[0-9]+}/permissions/{permission}", s.groupHandler.GrantPermission)
+
+	request, _ := http.NewRequest("PUT", "/groups/1/permissions/everything", nil)
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 400)
+
+	request, _ = http.NewRequest("PUT", "/groups/5/permissions/users:read", nil)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 404)
+}
+
 // Trying to delete an non-existend group
 func (s *GroupTestSuite) TestGroupHandleDeleteFailTwo(c *C) {
 	deleteRouter := s.mux.Methods(http.MethodDelete).Subrouter()
@@ -218,6 +534,317 @@ func (s *GroupTestSuite) TestGroupHandleDeleteFailTwo(c *C) {
 	c.Check(s.writer.Code, Equals, 404)
 }
 
+// Checks that the ETag of a group changes with its users and its permissions
+func (s *GroupTestSuite) TestGroupHandleETag(c *C) {
+	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
+	getRouter.HandleFunc("/groups/{id:[0-9]+}", s.groupHandler.ListSingle)
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("GET", "/groups/1", nil)
+		request.Header.Set("If-None-Match", ifNoneMatch)
+		writer := httptest.NewRecorder()
+		s.mux.ServeHTTP(writer, request)
+		return writer
+	}
+
+	etag := get("").Header().Get("ETag")
+	c.Assert(etag, Not(Equals), "")
+	c.Check(get(etag).Code, Equals, 304)
+	c.Check(get("W/"+etag).Code, Equals, 304)
+
+	// a user leaving the group changes its tag
+	c.Assert(s.store.UpdateUser(data.System, 2, 0, map[string]interface{}{"groupID": 2}), IsNil)
+	writer := get(etag)
+	c.Check(writer.Code, Equals, 200)
+	c.Check(writer.Header().Get("ETag"), Not(Equals), etag)
+
+	// so does a granted permission
+	etag = writer.Header().Get("ETag")
+	c.Assert(s.store.GrantPermission(data.System, 1, data.PermUsersRead), IsNil)
+	c.Check(get(etag).Code, Equals, 200)
+}
+
+// Tries to replace a group with the ETag of an older version
+func (s *GroupTestSuite) TestGroupHandlePutPrecondition(c *C) {
+	putRouter := s.mux.Methods(http.MethodPut).Subrouter()
+	putRouter.HandleFunc("/groups/{id:[0-9]+}", s.groupHandler.Update)
+
+	group, _ := s.store.GetGroupById(2)
+	c.Check(group.Version, Equals, 1)
+
+	request, _ := http.NewRequest("PUT", "/groups/2", strings.NewReader(`{"name": "renamed"}`))
+	request.Header.Set("If-Match", `"1-811c9dc5"`)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 204)
+
+	request, _ = http.NewRequest("PUT", "/groups/2", strings.NewReader(`{"name": "renamed again"}`))
+	request.Header.Set("If-Match", `"1-811c9dc5"`)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+
+	checkProblem(c, s.writer, 412, handlers.CodePreconditionFailed)
+	group, _ = s.store.GetGroupById(2)
+	c.Check(group.Name, Equals, "renamed")
+	c.Check(group.Version, Equals, 2)
+}
+
+// Deletes a group once its users are deleted, and restores it after its name was freed again
+func (s *GroupTestSuite) TestGroupHandleDeleteAndRestore(c *C) {
+	s.mux.HandleFunc("/groups", s.groupHandler.ListAll).Methods(http.MethodGet)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}", s.groupHandler.ListSingle).Methods(http.MethodGet)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}", s.groupHandler.Delete).Methods(http.MethodDelete)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}/restore", s.groupHandler.Restore).Methods(http.MethodPost)
+
+	serve := func(method, url string) {
+		request, _ := http.NewRequest(method, url, nil)
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+	}
+
+	c.Assert(s.store.DeleteUser(data.System, 1, 0), IsNil)
+	serve("DELETE", "/groups/1")
+	checkProblem(c, s.writer, 409, handlers.CodeGroupHasUsers)
+
+	// deleted users do not keep a group from being deleted and are not listed as its users
+	serve("GET", "/groups/1")
+	json.Unmarshal(s.writer.Body.Bytes(), s.group)
+	c.Check(s.group.Users, HasLen, 1)
+	c.Assert(s.store.DeleteUser(data.System, 2, 0), IsNil)
+	serve("DELETE", "/groups/1")
+	c.Check(s.writer.Code, Equals, 204)
+
+	serve("GET", "/groups/1")
+	c.Check(s.writer.Code, Equals, 404)
+	serve("GET", "/groups?include_deleted=true")
+	c.Check(s.writer.Header().Get("X-Total-Count"), Equals, "2")
+
+	c.Assert(s.store.AddGroup(data.System, &data.Group{Name: "group 1"}), IsNil)
+	serve("POST", "/groups/1/restore")
+	checkProblem(c, s.writer, 409, handlers.CodeGroupNameTaken)
+
+	c.Assert(s.store.UpdateGroup(data.System, 3, 0, map[string]interface{}{"name": "group 3"}), IsNil)
+	serve("POST", "/groups/1/restore")
+	c.Check(s.writer.Code, Equals, 204)
+	serve("GET", "/groups/1")
+	c.Check(s.writer.Code, Equals, 200)
+}
+
+// Adds user 1 to group 2 and removes it from its primary group 1
+func (s *GroupTestSuite) TestGroupHandleMembers(c *C) {
+	s.mux.HandleFunc("/groups/{id:[0-9]+}", s.groupHandler.ListSingle).Methods(http.MethodGet)
+	s.mux.HandleFunc("/users/{id:[0-9]+}/groups", s.groupHandler.ListUserGroups).Methods(http.MethodGet)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}/members/{userId:[0-9]+}", s.groupHandler.AddMember).Methods(http.MethodPost)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}/members/{userId:[0-9]+}", s.groupHandler.RemoveMember).Methods(http.MethodDelete)
+
+	serve := func(method, url string) {
+		request, _ := http.NewRequest(method, url, nil)
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+	}
+	groupIDs := func() []int {
+		serve("GET", "/users/1/groups")
+		c.Assert(s.writer.Code, Equals, 200)
+		var groups []data.Group
+		json.Unmarshal(s.writer.Body.Bytes(), &groups)
+		ids := []int{}
+		for _, group := range groups {
+			ids = append(ids, group.ID)
+		}
+		return ids
+	}
+
+	serve("POST", "/groups/2/members/1")
+	c.Check(s.writer.Code, Equals, 204)
+	serve("POST", "/groups/2/members/1")
+	c.Check(s.writer.Code, Equals, 204)
+	c.Check(groupIDs(), DeepEquals, []int{1, 2})
+
+	serve("GET", "/groups/2")
+	json.Unmarshal(s.writer.Body.Bytes(), s.group)
+	c.Assert(s.group.Users, HasLen, 1)
+	c.Check(s.group.Users[0].GroupID, Equals, 1)
+
+	// leaving the primary group leaves the user without one
+	serve("DELETE", "/groups/1/members/1")
+	c.Check(s.writer.Code, Equals, 204)
+	c.Check(groupIDs(), DeepEquals, []int{2})
+	user, err := s.store.GetUserById(1)
+	c.Assert(err, IsNil)
+	c.Check(user.GroupID, Equals, 0)
+	c.Check(user.Version, Equals, 2)
+
+	entries, _, err := s.store.GetAuditEntries(data.ListOptions{Filters: []data.Filter{{Field: "entityID", Op: data.OpEq, Value: "1"}}})
+	c.Assert(err, IsNil)
+	var actions []string
+	for _, entry := range entries {
+		if entry.Entity == data.AuditUser {
+			actions = append(actions, entry.Action)
+		}
+	}
+	c.Check(actions, DeepEquals, []string{data.AuditCreate, data.AuditJoin, data.AuditUpdate, data.AuditLeave})
+
+	// the user only moves out of its former primary group when it gets a new one
+	c.Assert(s.store.UpdateUser(data.System, 1, 0, map[string]interface{}{"groupID": 1}), IsNil)
+	c.Check(groupIDs(), DeepEquals, []int{1, 2})
+	c.Assert(s.store.UpdateUser(data.System, 1, 0, map[string]interface{}{"groupID": 2}), IsNil)
+	c.Check(groupIDs(), DeepEquals, []int{2})
+
+	serve("POST", "/groups/5/members/1")
+	checkProblem(c, s.writer, 404, handlers.CodeGroupNotFound)
+	serve("DELETE", "/groups/1/members/5")
+	checkProblem(c, s.writer, 404, handlers.CodeUserNotFound)
+	serve("GET", "/users/5/groups")
+	checkProblem(c, s.writer, 404, handlers.CodeUserNotFound)
+}
+
+// Deletes a group once no member is left, its members need not have it as their primary group
+func (s *GroupTestSuite) TestGroupHandleDeleteMembers(c *C) {
+	s.mux.HandleFunc("/groups/{id:[0-9]+}", s.groupHandler.Delete).Methods(http.MethodDelete)
+
+	c.Assert(s.store.AddMember(data.System, 2, 1), IsNil)
+	request, _ := http.NewRequest("DELETE", "/groups/2", nil)
+	s.mux.ServeHTTP(s.writer, request)
+	checkProblem(c, s.writer, 409, handlers.CodeGroupHasUsers)
+
+	c.Assert(s.store.RemoveMember(data.System, 2, 1), IsNil)
+	request, _ = http.NewRequest("DELETE", "/groups/2", nil)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 204)
+}
+
+// Nests groups below group 2, lists the tree and deletes it with cascade
+func (s *GroupTestSuite) TestGroupHandleHierarchy(c *C) {
+	s.mux.HandleFunc("/groups", s.groupHandler.Create).Methods(http.MethodPost)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}", s.groupHandler.ListSingle).Methods(http.MethodGet)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}", s.groupHandler.Patch).Methods(http.MethodPatch)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}", s.groupHandler.Delete).Methods(http.MethodDelete)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}/restore", s.groupHandler.Restore).Methods(http.MethodPost)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}/ancestors", s.groupHandler.ListAncestors).Methods(http.MethodGet)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}/descendants", s.groupHandler.ListDescendants).Methods(http.MethodGet)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}/members", s.groupHandler.ListMembers).Methods(http.MethodGet)
+
+	serve := func(method, url, body string) {
+		request, _ := http.NewRequest(method, url, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/merge-patch+json")
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+	}
+	ids := func(url string) []int {
+		serve("GET", url, "")
+		c.Assert(s.writer.Code, Equals, 200)
+		var items []struct{ ID int }
+		json.Unmarshal(s.writer.Body.Bytes(), &items)
+		ids := []int{}
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+		return ids
+	}
+
+	serve("POST", "/groups", `{"name": "group 3", "parentID": 2}`)
+	c.Assert(s.writer.Code, Equals, 200)
+	serve("POST", "/groups", `{"name": "group 4", "parentID": 3}`)
+	c.Assert(s.writer.Code, Equals, 200)
+	serve("POST", "/groups", `{"name": "group 5", "parentID": 9}`)
+	checkProblem(c, s.writer, 422, handlers.CodeGroupParentUnknown)
+
+	serve("PATCH", "/groups/2", `{"parentID": 4}`)
+	checkProblem(c, s.writer, 422, handlers.CodeGroupCycle)
+	serve("PATCH", "/groups/2", `{"parentID": 2}`)
+	checkProblem(c, s.writer, 422, handlers.CodeGroupCycle)
+
+	c.Check(ids("/groups/4/ancestors"), DeepEquals, []int{3, 2})
+	c.Check(ids("/groups/2/ancestors"), DeepEquals, []int{})
+	c.Check(ids("/groups/2/descendants"), DeepEquals, []int{3, 4})
+
+	// the members of a group include the members of its descendants
+	c.Assert(s.store.AddMember(data.System, 4, 2), IsNil)
+	c.Check(ids("/groups/2/members"), DeepEquals, []int{2})
+	c.Check(ids("/groups/1/members"), DeepEquals, []int{1, 2})
+
+	serve("DELETE", "/groups/2", "")
+	checkProblem(c, s.writer, 409, handlers.CodeGroupHasChildren)
+	serve("DELETE", "/groups/2?cascade", "")
+	checkProblem(c, s.writer, 409, handlers.CodeGroupHasUsers)
+
+	c.Assert(s.store.RemoveMember(data.System, 4, 2), IsNil)
+	serve("DELETE", "/groups/2?cascade=true", "")
+	c.Check(s.writer.Code, Equals, 204)
+	serve("GET", "/groups/4", "")
+	c.Check(s.writer.Code, Equals, 404)
+
+	// a child can not be restored below its deleted parent
+	serve("POST", "/groups/3/restore", "")
+	checkProblem(c, s.writer, 422, handlers.CodeGroupParentUnknown)
+	serve("POST", "/groups/2/restore", "")
+	c.Check(s.writer.Code, Equals, 204)
+	c.Check(ids("/groups/2/descendants"), DeepEquals, []int{})
+
+	purged, err := s.store.PurgeGroups(time.Now().Add(time.Minute))
+	c.Assert(err, IsNil)
+	c.Check(purged, Equals, 2)
+}
+
+// Computes the members of a dynamic group from its rule and previews the members of a rule
+func (s *GroupTestSuite) TestGroupHandleDynamic(c *C) {
+	s.mux.HandleFunc("/groups", s.groupHandler.Create).Methods(http.MethodPost)
+	s.mux.HandleFunc("/groups:preview", s.groupHandler.PreviewRule).Methods(http.MethodPost)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}", s.groupHandler.Patch).Methods(http.MethodPatch)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}", s.groupHandler.Delete).Methods(http.MethodDelete)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}/members", s.groupHandler.ListMembers).Methods(http.MethodGet)
+	s.mux.HandleFunc("/groups/{id:[0-9]+}/members/{userId:[0-9]+}", s.groupHandler.AddMember).Methods(http.MethodPost)
+
+	serve := func(method, url, body string) {
+		request, _ := http.NewRequest(method, url, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/merge-patch+json")
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+	}
+	ids := func(method, url, body string) []int {
+		serve(method, url, body)
+		c.Assert(s.writer.Code, Equals, 200)
+		var users []data.User
+		json.Unmarshal(s.writer.Body.Bytes(), &users)
+		ids := []int{}
+		for _, user := range users {
+			ids = append(ids, user.ID)
+		}
+		return ids
+	}
+
+	serve("POST", "/groups", `{"name": "dynamic", "rule": "email startsWith \"user2\""}`)
+	c.Assert(s.writer.Code, Equals, 200)
+	c.Check(ids("GET", "/groups/3/members", ""), DeepEquals, []int{2})
+
+	// the members follow the users and can not be changed by hand
+	c.Assert(s.store.UpdateUser(data.System, 1, 0, map[string]interface{}{"email": "user2b@email.com"}), IsNil)
+	c.Assert(s.store.AddUser(data.System, &data.User{Name: "user 3", Password: "pass", Email: "user3@email.com"}), IsNil)
+	c.Check(ids("GET", "/groups/3/members", ""), DeepEquals, []int{1, 2})
+	serve("POST", "/groups/3/members/3", "")
+	checkProblem(c, s.writer, 409, handlers.CodeGroupDynamic)
+
+	err := s.store.AddUser(data.System, &data.User{Name: "user 4", Password: "pass", Email: "user4@email.com", GroupID: 3})
+	c.Check(errors.Is(err, data.ErrDynamicGroup), Equals, true)
+	serve("PATCH", "/groups/1", `{"rule": "id > 0"}`)
+	checkProblem(c, s.writer, 409, handlers.CodeGroupDynamic)
+	serve("PATCH", "/groups/3", `{"rule": "id >"}`)
+	checkProblem(c, s.writer, 422, handlers.CodeValidationFailed)
+
+	serve("PATCH", "/groups/3", `{"rule": "id >= 2"}`)
+	c.Check(s.writer.Code, Equals, 204)
+	c.Check(ids("GET", "/groups/3/members", ""), DeepEquals, []int{2, 3})
+
+	c.Check(ids("POST", "/groups:preview", `{"rule": "name == \"user 1\""}`), DeepEquals, []int{1})
+	serve("POST", "/groups:preview", `{"rule": "name > 1"}`)
+	checkProblem(c, s.writer, 422, handlers.CodeInvalidRule)
+
+	// the members of a dynamic group do not keep it from being deleted
+	serve("DELETE", "/groups/3", "")
+	c.Check(s.writer.Code, Equals, 204)
+}
+
 // USERS TESTS
 
 // Tries to fetch a non-existent user with id 3
@@ -258,68 +885,515 @@ func (s *UserTestSuite) TestUserHandlePost(c *C) {
 	c.Check(s.writer.Code, Equals, 200)
 }
 
-// Tries to create a user with an existing name
-func (s *UserTestSuite) TestUserHandlePostFail(c *C) {
+// Tries to create a new user and checks its password is stored hashed and never returned
+func (s *UserTestSuite) TestUserHandlePostPasswordHashed(c *C) {
 	postRouter := s.mux.Methods(http.MethodPost).Subrouter()
 	postRouter.HandleFunc("/users", s.userHandler.Create)
 
-	body := strings.NewReader(`{"name": "user 1", "password": "pass", "email": "user43@email.com", "groupID": 1}`)
+	body := strings.NewReader(`{"name": "user 3", "password": "secret", "email": "user3@email.com", "groupID": 1}`)
 	request, _ := http.NewRequest("POST", "/users", body)
 	s.mux.ServeHTTP(s.writer, request)
 
-	c.Check(s.writer.Code, Equals, 400)
-}
+	c.Assert(s.writer.Code, Equals, 200)
 
-// Tries to fetch all users
-func (s *UserTestSuite) TestUserHandleGetAll(c *C) {
+	user, err := s.store.GetUserById(3)
+	c.Assert(err, IsNil)
+	c.Check(user.Password, Not(Equals), "secret")
+	ok, rehash := s.passwords.Verify(user.Password, "secret")
+	c.Check(ok, Equals, true)
+	c.Check(rehash, Equals, false)
 
 	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
-	getRouter.HandleFunc("/users", s.userHandler.ListAll)
+	getRouter.HandleFunc("/users/{id:[0-9]+}", s.userHandler.ListSingle)
 
-	request, _ := http.NewRequest("GET", "/users", nil)
+	request, _ = http.NewRequest("GET", "/users/3", nil)
+	s.writer = httptest.NewRecorder()
 	s.mux.ServeHTTP(s.writer, request)
 
 	c.Check(s.writer.Code, Equals, 200)
-
-	var users []data.Group
-	json.Unmarshal(s.writer.Body.Bytes(), &users)
-	c.Check(users[0].Name, Equals, "user 1")
-	c.Check(users[1].Name, Equals, "user 2")
+	c.Check(strings.Contains(s.writer.Body.String(), "password"), Equals, false)
 }
 
-// Trying to update a user with id 1
-func (s *UserTestSuite) TestUserHandlePut(c *C) {
-	putRouter := s.mux.Methods(http.MethodPut).Subrouter()
-	putRouter.HandleFunc("/users/{id:[0-9]+}", s.userHandler.Update)
+// Creates a user with a deletedAt time and a version and checks the user is live at its first version
+func (s *UserTestSuite) TestUserHandlePostDeleted(c *C) {
+	s.mux.HandleFunc("/users", s.userHandler.Create).Methods(http.MethodPost)
+	s.mux.HandleFunc("/users/{id:[0-9]+}", s.userHandler.ListSingle).Methods(http.MethodGet)
 
-	body := strings.NewReader(`{"name": "new user name"}`)
-	request, _ := http.NewRequest("PUT", "/users/1", body)
+	body := strings.NewReader(`{"name": "user 3", "password": "pass", "email": "user3@email.com", "groupID": 1, "deletedAt": "2020-01-01T00:00:00Z", "version": 7}`)
+	request, _ := http.NewRequest("POST", "/users", body)
 	s.mux.ServeHTTP(s.writer, request)
+	c.Assert(s.writer.Code, Equals, 200)
 
-	c.Check(s.writer.Code, Equals, 204)
-
-	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
-	getRouter.HandleFunc("/users/{id:[0-9]+}", s.userHandler.ListSingle)
-
-	request, _ = http.NewRequest("GET", "/users/1", nil)
+	request, _ = http.NewRequest("GET", "/users/3", nil)
 	s.writer = httptest.NewRecorder()
 	s.mux.ServeHTTP(s.writer, request)
-
-	c.Check(s.writer.Code, Equals, 200)
+	c.Assert(s.writer.Code, Equals, 200)
 	json.Unmarshal(s.writer.Body.Bytes(), s.user)
-	c.Check(s.user.Name, Equals, "new user name")
+	c.Check(s.user.DeletedAt, IsNil)
+	c.Check(s.user.Version, Equals, 1)
 }
 
-// Trying to update an users groupID to non-existent group
-func (s *UserTestSuite) TestUserHandlePutFail(c *C) {
-	putRouter := s.mux.Methods(http.MethodPut).Subrouter()
-	putRouter.HandleFunc("/users/{id:[0-9]+}", s.userHandler.Update)
+// Tries to create a user with an existing name
+func (s *UserTestSuite) TestUserHandlePostFail(c *C) {
+	postRouter := s.mux.Methods(http.MethodPost).Subrouter()
+	postRouter.HandleFunc("/users", s.userHandler.Create)
 
-	body := strings.NewReader(`{"groupID": 66}`)
-	request, _ := http.NewRequest("PUT", "/users/1", body)
-	s.mux.ServeHTTP(s.writer, request)
+	body := strings.NewReader(`{"name": "user 1", "password": "pass", "email": "user43@email.com", "groupID": 1}`)
+	request, _ := http.NewRequest("POST", "/users", body)
+	s.mux.ServeHTTP(s.writer, request)
 
-	c.Check(s.writer.Code, Equals, 404)
+	checkProblem(c, s.writer, 409, handlers.CodeUserNameTaken)
+}
+
+// Tries to create a user with an existing email
+func (s *UserTestSuite) TestUserHandlePostFailEmail(c *C) {
+	postRouter := s.mux.Methods(http.MethodPost).Subrouter()
+	postRouter.HandleFunc("/users", s.userHandler.Create)
+
+	body := strings.NewReader(`{"name": "user 3", "password": "pass", "email": "user@email.com", "groupID": 1}`)
+	request, _ := http.NewRequest("POST", "/users", body)
+	s.mux.ServeHTTP(s.writer, request)
+
+	checkProblem(c, s.writer, 409, handlers.CodeUserEmailTaken)
+}
+
+// Tries to create a user in a non-existent group
+func (s *UserTestSuite) TestUserHandlePostFailGroup(c *C) {
+	postRouter := s.mux.Methods(http.MethodPost).Subrouter()
+	postRouter.HandleFunc("/users", s.userHandler.Create)
+
+	body := strings.NewReader(`{"name": "user 3", "password": "pass", "email": "user3@email.com", "groupID": 66}`)
+	request, _ := http.NewRequest("POST", "/users", body)
+	s.mux.ServeHTTP(s.writer, request)
+
+	checkProblem(c, s.writer, 422, handlers.CodeUserGroupUnknown)
+}
+
+// Tries to create a user from a body that is not JSON
+func (s *UserTestSuite) TestUserHandlePostMalformed(c *C) {
+	postRouter := s.mux.Methods(http.MethodPost).Subrouter()
+	postRouter.HandleFunc("/users", s.userHandler.Create)
+
+	request, _ := http.NewRequest("POST", "/users", strings.NewReader(`{"name": `))
+	s.mux.ServeHTTP(s.writer, request)
+
+	problem := checkProblem(c, s.writer, 400, handlers.CodeMalformedBody)
+	c.Check(problem.Type, Equals, "/problems/malformed-body")
+	c.Check(problem.Title, Equals, "Bad Request")
+}
+
+// Tries to create a user with a name longer than 255 characters
+func (s *UserTestSuite) TestUserHandlePostFailLength(c *C) {
+	postRouter := s.mux.Methods(http.MethodPost).Subrouter()
+	postRouter.HandleFunc("/users", s.userHandler.Create)
+
+	body := strings.NewReader(`{"name": "` + strings.Repeat("a", 256) + `", "password": "pass", "email": "user3@email.com", "groupID": 1}`)
+	request, _ := http.NewRequest("POST", "/users", body)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 422)
+}
+
+// Trying to add a user with an empty name, an invalid email and an invalid group
+func (s *UserTestSuite) TestUserHandlePostInvalid(c *C) {
+	postRouter := s.mux.Methods(http.MethodPost).Subrouter()
+	postRouter.HandleFunc("/users", s.userHandler.Create)
+
+	body := strings.NewReader(`{"name": "", "password": "pass", "email": "User <user3@email.com>", "groupID": -1}`)
+	request, _ := http.NewRequest("POST", "/users", body)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 422)
+
+	var validation handlers.Problem
+	json.Unmarshal(s.writer.Body.Bytes(), &validation)
+	c.Check(validation.Errors, DeepEquals, []data.FieldError{
+		{Field: "name", Message: "is required"},
+		{Field: "email", Message: "must be a valid email address"},
+		{Field: "groupID", Message: "must be at least 1"},
+	})
+}
+
+// Tries to fetch all users
+func (s *UserTestSuite) TestUserHandleGetAll(c *C) {
+
+	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
+	getRouter.HandleFunc("/users", s.userHandler.ListAll)
+
+	request, _ := http.NewRequest("GET", "/users", nil)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 200)
+
+	var users []data.Group
+	json.Unmarshal(s.writer.Body.Bytes(), &users)
+	c.Check(users[0].Name, Equals, "user 1")
+	c.Check(users[1].Name, Equals, "user 2")
+}
+
+// Fetches the users one per page, following the cursors of the Link header
+func (s *UserTestSuite) TestUserHandleGetAllPaged(c *C) {
+	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
+	getRouter.HandleFunc("/users", s.userHandler.ListAll)
+
+	request, _ := http.NewRequest("GET", "/users?limit=1", nil)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 200)
+	c.Check(s.writer.Header().Get("X-Total-Count"), Equals, "2")
+
+	var users []data.User
+	json.Unmarshal(s.writer.Body.Bytes(), &users)
+	c.Assert(users, HasLen, 1)
+	c.Check(users[0].Name, Equals, "user 1")
+
+	next := linkRel(s.writer.Header().Get("Link"), "next")
+	c.Assert(next, Not(Equals), "")
+	c.Check(linkRel(s.writer.Header().Get("Link"), "prev"), Equals, "")
+
+	request, _ = http.NewRequest("GET", next, nil)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+
+	users = nil
+	json.Unmarshal(s.writer.Body.Bytes(), &users)
+	c.Assert(users, HasLen, 1)
+	c.Check(users[0].Name, Equals, "user 2")
+	c.Check(linkRel(s.writer.Header().Get("Link"), "next"), Equals, "")
+
+	prev := linkRel(s.writer.Header().Get("Link"), "prev")
+	c.Assert(prev, Not(Equals), "")
+
+	request, _ = http.NewRequest("GET", prev, nil)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+
+	users = nil
+	json.Unmarshal(s.writer.Body.Bytes(), &users)
+	c.Assert(users, HasLen, 1)
+	c.Check(users[0].Name, Equals, "user 1")
+}
+
+// Fetches the second user with an offset
+func (s *UserTestSuite) TestUserHandleGetAllOffset(c *C) {
+	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
+	getRouter.HandleFunc("/users", s.userHandler.ListAll)
+
+	request, _ := http.NewRequest("GET", "/users?limit=1&offset=1", nil)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 200)
+
+	var users []data.User
+	json.Unmarshal(s.writer.Body.Bytes(), &users)
+	c.Assert(users, HasLen, 1)
+	c.Check(users[0].Name, Equals, "user 2")
+	c.Check(linkRel(s.writer.Header().Get("Link"), "prev"), Equals, "/users?limit=1&offset=0")
+}
+
+// Tries to fetch users with invalid pagination parameters
+func (s *UserTestSuite) TestUserHandleGetAllPagedFail(c *C) {
+	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
+	getRouter.HandleFunc("/users", s.userHandler.ListAll)
+
+	for _, query := range []string{"limit=0", "limit=x", "offset=-1", "cursor=invalid", "offset=1&cursor=eyJpZCI6MX0"} {
+		request, _ := http.NewRequest("GET", "/users?"+query, nil)
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+
+		c.Check(s.writer.Code, Equals, 400, Commentf(query))
+	}
+}
+
+// Filters the users by name, email and group
+func (s *UserTestSuite) TestUserHandleGetAllFiltered(c *C) {
+	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
+	getRouter.HandleFunc("/users", s.userHandler.ListAll)
+
+	queries := map[string][]string{
+		"name=user%202":               {"user 2"},
+		"email=user@email.com":        {"user 1"},
+		"email[prefix]=user2":         {"user 2"},
+		"email[domain]=EMAIL.com":     {"user 1", "user 2"},
+		"email[domain]=mail.com":      {},
+		"groupID=1&name[prefix]=user": {"user 1", "user 2"},
+		"groupID=2":                   {},
+	}
+	for query, names := range queries {
+		request, _ := http.NewRequest("GET", "/users?"+query, nil)
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+
+		c.Check(s.writer.Code, Equals, 200, Commentf(query))
+		c.Check(s.writer.Header().Get("X-Total-Count"), Equals, strconv.Itoa(len(names)), Commentf(query))
+
+		var users []data.User
+		json.Unmarshal(s.writer.Body.Bytes(), &users)
+		got := []string{}
+		for _, user := range users {
+			got = append(got, user.Name)
+		}
+		c.Check(got, DeepEquals, names, Commentf(query))
+	}
+}
+
+// Sorts the users by descending name and pages through them
+func (s *UserTestSuite) TestUserHandleGetAllSorted(c *C) {
+	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
+	getRouter.HandleFunc("/users", s.userHandler.ListAll)
+
+	request, _ := http.NewRequest("GET", "/users?sort=-name,id&limit=1", nil)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 200)
+
+	var users []data.User
+	json.Unmarshal(s.writer.Body.Bytes(), &users)
+	c.Assert(users, HasLen, 1)
+	c.Check(users[0].Name, Equals, "user 2")
+
+	request, _ = http.NewRequest("GET", linkRel(s.writer.Header().Get("Link"), "next"), nil)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 200)
+	users = nil
+	json.Unmarshal(s.writer.Body.Bytes(), &users)
+	c.Assert(users, HasLen, 1)
+	c.Check(users[0].Name, Equals, "user 1")
+}
+
+// Tries to filter and sort the users by unknown fields and operators
+func (s *UserTestSuite) TestUserHandleGetAllFilteredFail(c *C) {
+	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
+	getRouter.HandleFunc("/users", s.userHandler.ListAll)
+
+	for _, query := range []string{"password=pass", "name[domain]=email.com", "groupID=x", "name[=x", "sort=password", "sort=name,,id", "sort=name,-name"} {
+		request, _ := http.NewRequest("GET", "/users?"+query, nil)
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+
+		c.Check(s.writer.Code, Equals, 400, Commentf(query))
+	}
+}
+
+// Searches users with a typo and groups by a fragment of their name
+func (s *UserTestSuite) TestUserHandleSearch(c *C) {
+	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
+	getRouter.HandleFunc("/search", handlers.NewSearch(s.l, s.store, handlers.DefaultPaging).Search)
+
+	request, _ := http.NewRequest("GET", "/search?q=usr%202", nil)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 200)
+	c.Check(strings.Contains(s.writer.Body.String(), "password"), Equals, false)
+
+	var results []data.SearchResult
+	json.Unmarshal(s.writer.Body.Bytes(), &results)
+	c.Assert(results, HasLen, 1)
+	c.Check(results[0].Type, Equals, data.SearchUser)
+	c.Check(results[0].User.Name, Equals, "user 2")
+
+	request, _ = http.NewRequest("GET", "/search?q=ROUP&limit=1", nil)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+
+	results = nil
+	json.Unmarshal(s.writer.Body.Bytes(), &results)
+	c.Assert(results, HasLen, 1)
+	c.Check(results[0].Type, Equals, data.SearchGroup)
+	c.Check(results[0].Group.Name, Equals, "group 1")
+	c.Check(results[0].Group.Users, HasLen, 2)
+
+	request, _ = http.NewRequest("GET", "/search?q=", nil)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 400)
+}
+
+// Trying to update a user with id 1
+func (s *UserTestSuite) TestUserHandlePut(c *C) {
+	putRouter := s.mux.Methods(http.MethodPut).Subrouter()
+	putRouter.HandleFunc("/users/{id:[0-9]+}", s.userHandler.Update)
+
+	body := strings.NewReader(`{"id": 1, "name": "new user name", "email": "new@email.com", "groupID": 2}`)
+	request, _ := http.NewRequest("PUT", "/users/1", body)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 204)
+
+	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
+	getRouter.HandleFunc("/users/{id:[0-9]+}", s.userHandler.ListSingle)
+
+	request, _ = http.NewRequest("GET", "/users/1", nil)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 200)
+	json.Unmarshal(s.writer.Body.Bytes(), s.user)
+	c.Check(s.user.Name, Equals, "new user name")
+	c.Check(s.user.Email, Equals, "new@email.com")
+	c.Check(s.user.GroupID, Equals, 2)
+
+	// the password was kept
+	stored, _ := s.store.GetUserById(1)
+	ok, _ := s.passwords.Verify(stored.Password, "pass")
+	c.Check(ok, Equals, true)
+}
+
+// Replaces and patches a user without a primary group, which keeps having none
+func (s *UserTestSuite) TestUserHandlePutWithoutGroup(c *C) {
+	s.mux.HandleFunc("/users/{id:[0-9]+}", s.userHandler.Update).Methods(http.MethodPut)
+	s.mux.HandleFunc("/users/{id:[0-9]+}", s.userHandler.Patch).Methods(http.MethodPatch)
+
+	c.Assert(s.store.AddUser(data.System, &data.User{Name: "user 3", Password: "pass", Email: "user3@email.com"}), IsNil)
+
+	request, _ := http.NewRequest("PUT", "/users/3", strings.NewReader(`{"id": 3, "name": "replaced", "email": "user3@email.com", "groupID": 0}`))
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 204)
+
+	request, _ = http.NewRequest("PATCH", "/users/3", strings.NewReader(`{"name": "patched"}`))
+	request.Header.Set("Content-Type", handlers.MergePatchType)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 204)
+
+	user, err := s.store.GetUserById(3)
+	c.Assert(err, IsNil)
+	c.Check(user.Name, Equals, "patched")
+	c.Check(user.GroupID, Equals, 0)
+}
+
+// Updates a user with keys that are no writable fields, which are rejected or left alone
+func (s *UserTestSuite) TestUserUpdateFields(c *C) {
+	err := s.store.UpdateUser(data.System, 1, 0, map[string]interface{}{"name": "renamed", "deleted_at": "2020-01-01T00:00:00Z"})
+	c.Check(err, DeepEquals, data.ValidationError{{Field: "deleted_at", Message: "is unknown"}})
+	err = s.store.UpdateUser(data.System, 1, 0, map[string]interface{}{"name": "renamed", "version": 9})
+	c.Check(err, DeepEquals, data.ValidationError{{Field: "version", Message: "is unknown"}})
+
+	c.Assert(s.store.UpdateUser(data.System, 1, 0, map[string]interface{}{"name": "renamed", "Group": data.Group{Name: "other"}}), IsNil)
+	user, err := s.store.GetUserById(1)
+	c.Assert(err, IsNil)
+	c.Check(user.Name, Equals, "renamed")
+	c.Check(user.Version, Equals, 2)
+	c.Check(user.GroupID, Equals, 1)
+	c.Check(user.DeletedAt, IsNil)
+
+	group, err := s.store.GetGroupById(1)
+	c.Assert(err, IsNil)
+	c.Check(group.Name, Equals, "group 1")
+}
+
+// Clears the primary group of users with a JSON Merge Patch and a JSON Patch
+func (s *UserTestSuite) TestUserHandlePatchClearGroup(c *C) {
+	s.mux.HandleFunc("/users/{id:[0-9]+}", s.userHandler.Patch).Methods(http.MethodPatch)
+
+	request, _ := http.NewRequest("PATCH", "/users/1", strings.NewReader(`{"groupID": null}`))
+	request.Header.Set("Content-Type", handlers.MergePatchType)
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 204)
+
+	request, _ = http.NewRequest("PATCH", "/users/2", strings.NewReader(`[{"op": "remove", "path": "/groupID"}]`))
+	request.Header.Set("Content-Type", handlers.JSONPatchType)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 204)
+
+	for _, id := range []int{1, 2} {
+		user, err := s.store.GetUserById(id)
+		c.Assert(err, IsNil)
+		c.Check(user.GroupID, Equals, 0)
+	}
+}
+
+// Tries to replace a user with a partial user, another id and an unknown field
+func (s *UserTestSuite) TestUserHandlePutInvalid(c *C) {
+	putRouter := s.mux.Methods(http.MethodPut).Subrouter()
+	putRouter.HandleFunc("/users/{id:[0-9]+}", s.userHandler.Update)
+
+	for _, body := range []string{
+		`{"name": "new user name"}`,
+		`{"id": 2, "name": "user 1", "email": "user@email.com", "groupID": 1}`,
+		`{"name": "user 1", "email": "user@email.com", "groupID": 1, "admin": true}`,
+		`{"name": "user 1", "email": "user@email.com", "groupID": "1"}`,
+	} {
+		request, _ := http.NewRequest("PUT", "/users/1", strings.NewReader(body))
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+
+		c.Check(s.writer.Code, Equals, 422, Commentf(body))
+	}
+}
+
+// Changes the name of a user with a JSON Merge Patch
+func (s *UserTestSuite) TestUserHandleMergePatch(c *C) {
+	patchRouter := s.mux.Methods(http.MethodPatch).Subrouter()
+	patchRouter.HandleFunc("/users/{id:[0-9]+}", s.userHandler.Patch)
+
+	request, _ := http.NewRequest("PATCH", "/users/1", strings.NewReader(`{"name": "patched", "password": "secret"}`))
+	request.Header.Set("Content-Type", handlers.MergePatchType)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 204)
+
+	user, _ := s.store.GetUserById(1)
+	c.Check(user.Name, Equals, "patched")
+	c.Check(user.Email, Equals, "user@email.com")
+	ok, _ := s.passwords.Verify(user.Password, "secret")
+	c.Check(ok, Equals, true)
+
+	request, _ = http.NewRequest("PATCH", "/users/1", strings.NewReader(`{"email": null}`))
+	request.Header.Set("Content-Type", handlers.MergePatchType)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 422)
+
+	request, _ = http.NewRequest("PATCH", "/users/1", strings.NewReader(`{"name": "patched"}`))
+	request.Header.Set("Content-Type", "application/json")
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 415)
+}
+
+// Changes the email of a user with a JSON Patch, and tries patches that must not be applied
+func (s *UserTestSuite) TestUserHandleJSONPatch(c *C) {
+	patchRouter := s.mux.Methods(http.MethodPatch).Subrouter()
+	patchRouter.HandleFunc("/users/{id:[0-9]+}", s.userHandler.Patch)
+
+	patch := func(body string) int {
+		request, _ := http.NewRequest("PATCH", "/users/1", strings.NewReader(body))
+		request.Header.Set("Content-Type", handlers.JSONPatchType)
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+		return s.writer.Code
+	}
+
+	c.Check(patch(`[{"op": "test", "path": "/name", "value": "user 1"}, {"op": "replace", "path": "/email", "value": "new@email.com"}]`), Equals, 204)
+	c.Check(patch(`[{"op": "replace", "path": "/name", "value": "other"}, {"op": "test", "path": "/name", "value": "user 1"}]`), Equals, 409)
+	c.Check(patch(`[{"op": "replace", "path": "/name", "value": "other"}, {"op": "replace", "path": "/id", "value": 5}]`), Equals, 422)
+	c.Check(patch(`[{"op": "add", "path": "/admin", "value": true}]`), Equals, 422)
+	c.Check(patch(`[{"op": "replace", "path": "/email", "value": "not an email"}]`), Equals, 422)
+	c.Check(patch(`[{"op": "remove", "path": "/password"}]`), Equals, 400)
+	c.Check(patch(`[{"op": "copy", "from": "/email", "path": "/name"}]`), Equals, 204)
+
+	user, _ := s.store.GetUserById(1)
+	c.Check(user.Name, Equals, "new@email.com")
+	c.Check(user.Email, Equals, "new@email.com")
+}
+
+// Trying to update an users groupID to non-existent group
+func (s *UserTestSuite) TestUserHandlePutFail(c *C) {
+	putRouter := s.mux.Methods(http.MethodPut).Subrouter()
+	putRouter.HandleFunc("/users/{id:[0-9]+}", s.userHandler.Update)
+
+	body := strings.NewReader(`{"name": "user 1", "email": "user@email.com", "groupID": 66}`)
+	request, _ := http.NewRequest("PUT", "/users/1", body)
+	s.mux.ServeHTTP(s.writer, request)
+
+	checkProblem(c, s.writer, 422, handlers.CodeUserGroupUnknown)
 }
 
 // Trying to delete a user
@@ -341,5 +1415,749 @@ func (s *UserTestSuite) TestUserHandleDeleteFail(c *C) {
 	request, _ := http.NewRequest("DELETE", "/users/14", nil)
 	s.mux.ServeHTTP(s.writer, request)
 
+	problem := checkProblem(c, s.writer, 404, handlers.CodeUserNotFound)
+	c.Check(problem.Instance, Equals, "/users/14")
+}
+
+// Fetches a user with its ETag and again with a matching If-None-Match header
+func (s *UserTestSuite) TestUserHandleGetSingleETag(c *C) {
+	getRouter := s.mux.Methods(http.MethodGet).Subrouter()
+	getRouter.HandleFunc("/users/{id:[0-9]+}", s.userHandler.ListSingle)
+
+	request, _ := http.NewRequest("GET", "/users/1", nil)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 200)
+	c.Check(s.writer.Header().Get("ETag"), Equals, `"1"`)
+	json.Unmarshal(s.writer.Body.Bytes(), s.user)
+	c.Check(s.user.Version, Equals, 1)
+
+	request, _ = http.NewRequest("GET", "/users/1", nil)
+	request.Header.Set("If-None-Match", `"7", "1"`)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 304)
+	c.Check(s.writer.Body.Len(), Equals, 0)
+}
+
+// Two changes sent with the same ETag, the second one fails
+func (s *UserTestSuite) TestUserHandlePatchPrecondition(c *C) {
+	patchRouter := s.mux.Methods(http.MethodPatch).Subrouter()
+	patchRouter.HandleFunc("/users/{id:[0-9]+}", s.userHandler.Patch)
+
+	patch := func(body string) {
+		request, _ := http.NewRequest("PATCH", "/users/1", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/merge-patch+json")
+		request.Header.Set("If-Match", `"1"`)
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+	}
+
+	patch(`{"name": "first admin"}`)
+	c.Check(s.writer.Code, Equals, 204)
+
+	patch(`{"name": "second admin"}`)
+	checkProblem(c, s.writer, 412, handlers.CodePreconditionFailed)
+
+	user, _ := s.store.GetUserById(1)
+	c.Check(user.Name, Equals, "first admin")
+	c.Check(user.Version, Equals, 2)
+}
+
+// Deletes a user with a handler that requires the If-Match header
+func (s *UserTestSuite) TestUserHandleDeleteIfMatchRequired(c *C) {
+	userHandler := handlers.NewUsers(s.l, s.store, s.store, s.passwords, handlers.DefaultPaging, true, handlers.DefaultMaxBatch)
+	deleteRouter := s.mux.Methods(http.MethodDelete).Subrouter()
+	deleteRouter.HandleFunc("/users/{id:[0-9]+}", userHandler.Delete)
+
+	del := func(ifMatch string) {
+		request, _ := http.NewRequest("DELETE", "/users/1", nil)
+		request.Header.Set("If-Match", ifMatch)
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+	}
+
+	del("")
+	checkProblem(c, s.writer, 428, handlers.CodePreconditionRequired)
+
+	del(`"2"`)
+	checkProblem(c, s.writer, 412, handlers.CodePreconditionFailed)
+
+	del(`"1"`)
+	c.Check(s.writer.Code, Equals, 204)
+}
+
+// Deletes a user, which stays listed with include_deleted and frees its name until it is restored
+func (s *UserTestSuite) TestUserHandleDeleteAndRestore(c *C) {
+	s.mux.HandleFunc("/users", s.userHandler.ListAll).Methods(http.MethodGet)
+	s.mux.HandleFunc("/users/{id:[0-9]+}", s.userHandler.ListSingle).Methods(http.MethodGet)
+	s.mux.HandleFunc("/users/{id:[0-9]+}", s.userHandler.Delete).Methods(http.MethodDelete)
+	s.mux.HandleFunc("/users/{id:[0-9]+}/restore", s.userHandler.Restore).Methods(http.MethodPost)
+
+	serve := func(method, url string) {
+		request, _ := http.NewRequest(method, url, nil)
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+	}
+
+	serve("DELETE", "/users/1")
+	c.Check(s.writer.Code, Equals, 204)
+	serve("DELETE", "/users/1")
 	c.Check(s.writer.Code, Equals, 404)
+
+	serve("GET", "/users/1")
+	c.Check(s.writer.Code, Equals, 404)
+	serve("GET", "/users/1?include_deleted=true")
+	c.Check(s.writer.Code, Equals, 200)
+	json.Unmarshal(s.writer.Body.Bytes(), s.user)
+	c.Check(s.user.DeletedAt, NotNil)
+	c.Check(s.user.Version, Equals, 2)
+
+	serve("GET", "/users")
+	c.Check(s.writer.Header().Get("X-Total-Count"), Equals, "1")
+	serve("GET", "/users?include_deleted")
+	c.Check(s.writer.Header().Get("X-Total-Count"), Equals, "2")
+	serve("GET", "/users?include_deleted=maybe")
+	checkProblem(c, s.writer, 400, handlers.CodeInvalidParameter)
+
+	// the name of the deleted user can be taken, which keeps it from being restored
+	taken := &data.User{Name: "user 1", Password: "pass", Email: "other@email.com", GroupID: 2}
+	c.Assert(s.store.AddUser(data.System, taken), IsNil)
+	serve("POST", "/users/1/restore")
+	checkProblem(c, s.writer, 409, handlers.CodeUserNameTaken)
+
+	c.Assert(s.store.DeleteUser(data.System, taken.ID, 0), IsNil)
+	serve("POST", "/users/1/restore")
+	c.Check(s.writer.Code, Equals, 204)
+	serve("POST", "/users/1/restore")
+	c.Check(s.writer.Code, Equals, 204)
+	serve("POST", "/users/14/restore")
+	checkProblem(c, s.writer, 404, handlers.CodeUserNotFound)
+
+	serve("GET", "/users/1")
+	c.Check(s.writer.Code, Equals, 200)
+	c.Check(s.writer.Header().Get("ETag"), Equals, `"3"`)
+}
+
+// Purges the users and groups deleted before a time, a group only once its users are purged
+func (s *UserTestSuite) TestUserPurge(c *C) {
+	c.Assert(s.store.DeleteUser(data.System, 1, 0), IsNil)
+	c.Assert(s.store.DeleteUser(data.System, 2, 0), IsNil)
+	c.Assert(s.store.DeleteGroup(data.System, 1, 0, false), IsNil)
+
+	// a user of a deleted group can not be restored or added
+	c.Check(errors.Is(s.store.RestoreUser(data.System, 1), data.ErrUnknownGroup), Equals, true)
+	err := s.store.AddUser(data.System, &data.User{Name: "user 3", Password: "pass", Email: "user3@email.com", GroupID: 1})
+	c.Check(errors.Is(err, data.ErrUnknownGroup), Equals, true)
+
+	users, groups, err := purgeDeleted(s.store, time.Now().Add(-time.Hour))
+	c.Assert(err, IsNil)
+	c.Check(users+groups, Equals, 0)
+
+	users, groups, err = purgeDeleted(s.store, time.Now().Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Check(users, Equals, 2)
+	c.Check(groups, Equals, 1)
+
+	c.Check(s.store.RestoreUser(data.System, 1), Equals, data.ErrUserNotFound)
+	c.Check(s.store.RestoreGroup(data.System, 1), Equals, data.ErrGroupNotFound)
+}
+
+// Creates, updates and deletes users with an atomic batch
+func (s *UserTestSuite) TestUserHandleBatchAtomic(c *C) {
+	s.mux.HandleFunc("/users:batch", s.userHandler.Batch).Methods(http.MethodPost)
+
+	batch := func(body string) []handlers.BatchResult {
+		request, _ := http.NewRequest("POST", "/users:batch", strings.NewReader(body))
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+
+		var results []handlers.BatchResult
+		json.Unmarshal(s.writer.Body.Bytes(), &results)
+		return results
+	}
+
+	// the taken email fails the batch and nothing else is applied
+	results := batch(`{"operations": [
+		{"op": "create", "user": {"name": "user 3", "email": "user3@email.com", "password": "pass", "groupID": 1}},
+		{"op": "update", "id": 1, "user": {"email": "user2@email.com"}},
+		{"op": "delete", "id": 2}
+	]}`)
+	c.Check(s.writer.Code, Equals, 207)
+	c.Assert(results, HasLen, 3)
+	c.Check(results[0].Status, Equals, 424)
+	c.Check(results[0].Problem.Code, Equals, handlers.CodeBatchAborted)
+	c.Check(results[1].Status, Equals, 409)
+	c.Check(results[1].Problem.Code, Equals, handlers.CodeUserEmailTaken)
+	c.Check(results[2].Status, Equals, 424)
+
+	_, total, _ := s.store.GetUsers(data.ListOptions{})
+	c.Check(total, Equals, 2)
+	user, _ := s.store.GetUserById(1)
+	c.Check(user.Email, Equals, "user@email.com")
+
+	results = batch(`{"mode": "atomic", "operations": [
+		{"op": "create", "user": {"name": "user 3", "email": "user3@email.com", "password": "pass", "groupID": 1}},
+		{"op": "update", "id": 1, "version": 1, "user": {"name": "first"}},
+		{"op": "delete", "id": 2}
+	]}`)
+	c.Check(s.writer.Code, Equals, 200)
+	c.Assert(results, HasLen, 3)
+	c.Check(results[0].Status, Equals, 200)
+	c.Check(results[0].ID, Equals, 3)
+	c.Check(results[1].Status, Equals, 204)
+	c.Check(results[2].Status, Equals, 204)
+
+	user, _ = s.store.GetUserById(1)
+	c.Check(user.Name, Equals, "first")
+	_, err := s.store.GetUserById(2)
+	c.Check(err, Equals, data.ErrUserNotFound)
+}
+
+// Runs every operation of a best-effort batch that succeeds and rejects batches that are too large
+func (s *UserTestSuite) TestUserHandleBatchBestEffort(c *C) {
+	userHandler := handlers.NewUsers(s.l, s.store, s.store, s.passwords, handlers.DefaultPaging, false, 3)
+	s.mux.HandleFunc("/users:batch", userHandler.Batch).Methods(http.MethodPost)
+
+	request, _ := http.NewRequest("POST", "/users:batch", strings.NewReader(`{"mode": "best-effort", "operations": [
+		{"op": "create", "user": {"name": "user 3", "email": "user3@email.com", "password": "pass", "groupID": 1}},
+		{"op": "create", "user": {"name": "user 4", "email": "not an email", "password": "pass", "groupID": 1}},
+		{"op": "delete", "id": 9}
+	]}`))
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 207)
+	var results []handlers.BatchResult
+	c.Assert(json.Unmarshal(s.writer.Body.Bytes(), &results), IsNil)
+	c.Assert(results, HasLen, 3)
+	c.Check(results[0].Status, Equals, 200)
+	c.Check(results[1].Status, Equals, 422)
+	c.Check(results[1].Problem.Code, Equals, handlers.CodeValidationFailed)
+	c.Check(results[2].Status, Equals, 404)
+	c.Check(results[2].Problem.Code, Equals, handlers.CodeUserNotFound)
+
+	_, err := s.store.GetUserByName("user 3")
+	c.Check(err, IsNil)
+
+	request, _ = http.NewRequest("POST", "/users:batch", strings.NewReader(`{"operations": [
+		{"op": "delete", "id": 1}, {"op": "delete", "id": 2}, {"op": "delete", "id": 3}, {"op": "delete", "id": 4}
+	]}`))
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+	checkProblem(c, s.writer, 413, handlers.CodeBatchTooLarge)
+}
+
+// Records the changes of a user made through the handlers in the audit log and lists them
+func (s *UserTestSuite) TestUserAudit(c *C) {
+	s.mux.Use(handlers.RequestID)
+	s.mux.HandleFunc("/users", s.userHandler.Create).Methods(http.MethodPost)
+	s.mux.HandleFunc("/users/{id:[0-9]+}", s.userHandler.Patch).Methods(http.MethodPatch)
+	s.mux.HandleFunc("/users/{id:[0-9]+}", s.userHandler.Delete).Methods(http.MethodDelete)
+	s.mux.HandleFunc("/audit", handlers.NewAudit(s.l, s.store, handlers.DefaultPaging).ListAll).Methods(http.MethodGet)
+
+	send := func(method, url, body string) {
+		request, _ := http.NewRequest(method, url, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/merge-patch+json")
+		request.Header.Set(handlers.RequestIDHeader, "request-1")
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+	}
+
+	send("POST", "/users", `{"name": "user 3", "email": "user3@email.com", "password": "secret", "groupID": 1}`)
+	c.Assert(s.writer.Code, Equals, 200)
+	c.Check(s.writer.Header().Get(handlers.RequestIDHeader), Equals, "request-1")
+	send("PATCH", "/users/3", `{"name": "user three", "password": "changed"}`)
+	c.Assert(s.writer.Code, Equals, 204)
+	send("DELETE", "/users/3", "")
+	c.Assert(s.writer.Code, Equals, 204)
+
+	send("GET", "/audit?entity=user&entityID=3", "")
+	c.Assert(s.writer.Code, Equals, 200)
+	c.Check(s.writer.Header().Get("X-Total-Count"), Equals, "3")
+	c.Check(strings.Contains(s.writer.Body.String(), "secret"), Equals, false)
+	c.Check(strings.Contains(s.writer.Body.String(), "changed"), Equals, false)
+
+	var entries []data.AuditEntry
+	c.Assert(json.Unmarshal(s.writer.Body.Bytes(), &entries), IsNil)
+	c.Assert(entries, HasLen, 3)
+	for i, action := range []string{data.AuditCreate, data.AuditUpdate, data.AuditDelete} {
+		c.Check(entries[i].Action, Equals, action)
+		c.Check(entries[i].RequestID, Equals, "request-1")
+	}
+	c.Check(entries[1].Changes, DeepEquals, data.Changes{
+		"name":     {Before: "user 3", After: "user three"},
+		"password": {Before: "[REDACTED]", After: "[REDACTED]"},
+	})
+	c.Check(entries[2].Changes["deletedAt"].Before, IsNil)
+	c.Check(entries[2].Changes["deletedAt"].After, NotNil)
+
+	send("GET", "/audit?createdAt[from]="+time.Now().Add(time.Hour).UTC().Format(time.RFC3339), "")
+	c.Check(s.writer.Header().Get("X-Total-Count"), Equals, "0")
+
+	send("GET", "/audit?createdAt[from]=yesterday", "")
+	checkProblem(c, s.writer, 400, handlers.CodeInvalidParameter)
+}
+
+// Defines attributes, stores users with values of them, filters by them and deletes them again
+func (s *UserTestSuite) TestUserHandleAttributes(c *C) {
+	attributeHandler := handlers.NewAttributes(s.l, s.store)
+	s.mux.HandleFunc("/attributes", attributeHandler.ListAll).Methods(http.MethodGet)
+	s.mux.HandleFunc("/attributes/{name}", attributeHandler.Put).Methods(http.MethodPut)
+	s.mux.HandleFunc("/attributes/{name}", attributeHandler.Delete).Methods(http.MethodDelete)
+	s.mux.HandleFunc("/users", s.userHandler.Create).Methods(http.MethodPost)
+	s.mux.HandleFunc("/users", s.userHandler.ListAll).Methods(http.MethodGet)
+	s.mux.HandleFunc("/users/{id:[0-9]+}", s.userHandler.ListSingle).Methods(http.MethodGet)
+	s.mux.HandleFunc("/users/{id:[0-9]+}", s.userHandler.Patch).Methods(http.MethodPatch)
+
+	send := func(method, url, body string) {
+		request, _ := http.NewRequest(method, url, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/merge-patch+json")
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+	}
+
+	send("PUT", "/attributes/department", `{"type": "string", "enum": ["sales", "support"]}`)
+	c.Assert(s.writer.Code, Equals, 201)
+	send("PUT", "/attributes/badge", `{"type": "integer", "unique": true}`)
+	c.Assert(s.writer.Code, Equals, 201)
+	send("PUT", "/attributes/badge", `{"type": "integer", "unique": true}`)
+	c.Assert(s.writer.Code, Equals, 200)
+	send("PUT", "/attributes/1st", `{"type": "date", "enum": ["a"]}`)
+	checkProblem(c, s.writer, 422, handlers.CodeValidationFailed)
+
+	send("GET", "/attributes", "")
+	c.Assert(s.writer.Code, Equals, 200)
+	var attributes []data.Attribute
+	c.Assert(json.Unmarshal(s.writer.Body.Bytes(), &attributes), IsNil)
+	c.Assert(attributes, HasLen, 2)
+	c.Check(attributes[0].Name, Equals, "badge")
+	c.Check(attributes[1].Enum, DeepEquals, data.EnumValues{"sales", "support"})
+
+	send("POST", "/users", `{"name": "user 3", "email": "user3@email.com", "password": "pass", "groupID": 1, "attributes": {"department": "sales", "badge": 7}}`)
+	c.Assert(s.writer.Code, Equals, 200)
+	send("POST", "/users", `{"name": "user 4", "email": "user4@email.com", "password": "pass", "groupID": 1, "attributes": {"badge": 7}}`)
+	checkProblem(c, s.writer, 409, handlers.CodeUserAttributeTaken)
+	send("POST", "/users", `{"name": "user 4", "email": "user4@email.com", "password": "pass", "groupID": 1, "attributes": {"department": "hr", "badge": "8", "floor": 2}}`)
+	checkProblem(c, s.writer, 422, handlers.CodeValidationFailed)
+	c.Check(strings.Contains(s.writer.Body.String(), `{"field":"attributes.badge","message":"must be of type integer"}`), Equals, true)
+	c.Check(strings.Contains(s.writer.Body.String(), `{"field":"attributes.department","message":"must be one of sales, support"}`), Equals, true)
+	c.Check(strings.Contains(s.writer.Body.String(), `{"field":"attributes.floor","message":"is unknown"}`), Equals, true)
+
+	send("GET", "/users/3", "")
+	c.Assert(s.writer.Code, Equals, 200)
+	var user data.User
+	c.Assert(json.Unmarshal(s.writer.Body.Bytes(), &user), IsNil)
+	c.Check(user.Attributes, DeepEquals, map[string]interface{}{"department": "sales", "badge": float64(7)})
+
+	send("GET", "/users?attributes.department=sales", "")
+	c.Check(s.writer.Header().Get("X-Total-Count"), Equals, "1")
+	send("GET", "/users?attributes.badge=8", "")
+	c.Check(s.writer.Header().Get("X-Total-Count"), Equals, "0")
+	send("GET", "/users?attributes.floor=2", "")
+	checkProblem(c, s.writer, 400, handlers.CodeInvalidParameter)
+
+	// user 1 and 2 have no department, so it can not become required
+	send("PUT", "/attributes/department", `{"type": "string", "required": true}`)
+	checkProblem(c, s.writer, 409, handlers.CodeAttributeMissing)
+	send("PUT", "/attributes/department", `{"type": "string", "enum": ["support"]}`)
+	checkProblem(c, s.writer, 409, handlers.CodeAttributeMismatch)
+
+	send("PATCH", "/users/3", `{"attributes": {"department": null, "badge": 8}}`)
+	c.Assert(s.writer.Code, Equals, 204)
+	send("GET", "/users?attributes.badge=8", "")
+	c.Check(s.writer.Header().Get("X-Total-Count"), Equals, "1")
+	send("GET", "/users?attributes.department[prefix]=s", "")
+	c.Check(s.writer.Header().Get("X-Total-Count"), Equals, "0")
+
+	send("DELETE", "/attributes/badge", "")
+	c.Assert(s.writer.Code, Equals, 204)
+	send("DELETE", "/attributes/badge", "")
+	checkProblem(c, s.writer, 404, handlers.CodeAttributeNotFound)
+	send("GET", "/users/3", "")
+	user = data.User{}
+	c.Assert(json.Unmarshal(s.writer.Body.Bytes(), &user), IsNil)
+	c.Check(user.Attributes, IsNil)
+	c.Check(user.Version, Equals, 3)
+}
+
+// AUTH TESTS
+
+// Logs in with the name and legacy plain text password of user 1
+func (s *AuthTestSuite) TestAuthLoginName(c *C) {
+	body := strings.NewReader(`{"name": "user 1", "password": "pass"}`)
+	request, _ := http.NewRequest("POST", "/auth/login", body)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 200)
+
+	var login handlers.Login
+	json.Unmarshal(s.writer.Body.Bytes(), &login)
+	c.Check(login.User.Name, Equals, "user 1")
+	c.Check(login.Group.Name, Equals, "group 1")
+	c.Check(strings.Contains(s.writer.Body.String(), "password"), Equals, false)
+
+	// the legacy plain text password is hashed after the login
+	user, err := s.store.GetUserById(1)
+	c.Assert(err, IsNil)
+	c.Check(user.Password, Not(Equals), "pass")
+	ok, rehash := s.passwords.Verify(user.Password, "pass")
+	c.Check(ok, Equals, true)
+	c.Check(rehash, Equals, false)
+
+	// the new hash is recorded as changed by the user without revealing it
+	entries, _, err := s.store.GetAuditEntries(data.ListOptions{Filters: []data.Filter{{Field: "action", Op: data.OpEq, Value: data.AuditUpdate}}})
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].ActorID, Equals, 1)
+	c.Check(entries[0].Changes, DeepEquals, data.Changes{"password": {Before: "[REDACTED]", After: "[REDACTED]"}})
+}
+
+// Logs in with the email of user 2
+func (s *AuthTestSuite) TestAuthLoginEmail(c *C) {
+	body := strings.NewReader(`{"email": "user2@email.com", "password": "pass"}`)
+	request, _ := http.NewRequest("POST", "/auth/login", body)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 200)
+
+	var login handlers.Login
+	json.Unmarshal(s.writer.Body.Bytes(), &login)
+	c.Check(login.User.Name, Equals, "user 2")
+}
+
+// Tries to log in with a wrong password and with an unknown user
+func (s *AuthTestSuite) TestAuthLoginFail(c *C) {
+	body := strings.NewReader(`{"name": "user 1", "password": "wrong"}`)
+	request, _ := http.NewRequest("POST", "/auth/login", body)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 401)
+	wrongPassword := s.writer.Body.String()
+
+	body = strings.NewReader(`{"name": "nobody", "password": "pass"}`)
+	request, _ = http.NewRequest("POST", "/auth/login", body)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 401)
+	c.Check(s.writer.Body.String(), Equals, wrongPassword)
+}
+
+// Uses the access token of a login on a protected route
+func (s *AuthTestSuite) TestAuthAccessToken(c *C) {
+	tokens := s.login(c)
+	c.Check(tokens.TokenType, Equals, "Bearer")
+	c.Check(tokens.ExpiresIn, Equals, 60)
+
+	c.Check(s.getUsers(""), Equals, 401)
+	c.Check(s.getUsers("not a token"), Equals, 401)
+	c.Check(s.getUsers(tokens.RefreshToken), Equals, 401)
+	c.Check(s.getUsers(tokens.AccessToken), Equals, 200)
+}
+
+// Tokens stop working when the password of the user changes or the user is deleted
+func (s *AuthTestSuite) TestAuthTokenRevoked(c *C) {
+	tokens := s.login(c)
+
+	c.Assert(s.store.UpdateUser(data.System, 1, 0, map[string]interface{}{"password": "changed"}), IsNil)
+	c.Check(s.getUsers(tokens.AccessToken), Equals, 401)
+
+	c.Assert(s.store.UpdateUser(data.System, 1, 0, map[string]interface{}{"password": "pass"}), IsNil)
+	tokens = s.login(c)
+	c.Assert(s.store.DeleteUser(data.System, 1, 0), IsNil)
+	c.Check(s.getUsers(tokens.AccessToken), Equals, 401)
+
+	body := strings.NewReader(`{"refreshToken": "` + tokens.RefreshToken + `"}`)
+	request, _ := http.NewRequest("POST", "/auth/refresh", body)
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 401)
+}
+
+// Exchanges a refresh token for new tokens
+func (s *AuthTestSuite) TestAuthRefresh(c *C) {
+	tokens := s.login(c)
+
+	body := strings.NewReader(`{"refreshToken": "` + tokens.AccessToken + `"}`)
+	request, _ := http.NewRequest("POST", "/auth/refresh", body)
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 401)
+
+	body = strings.NewReader(`{"refreshToken": "` + tokens.RefreshToken + `"}`)
+	request, _ = http.NewRequest("POST", "/auth/refresh", body)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+	c.Assert(s.writer.Code, Equals, 200)
+
+	var refreshed handlers.Tokens
+	json.Unmarshal(s.writer.Body.Bytes(), &refreshed)
+	c.Check(s.getUsers(refreshed.AccessToken), Equals, 200)
+}
+
+// Fetches the public signing keys
+func (s *AuthTestSuite) TestAuthJWKS(c *C) {
+	request, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 200)
+
+	var jwks auth.JWKS
+	json.Unmarshal(s.writer.Body.Bytes(), &jwks)
+	c.Assert(jwks.Keys, HasLen, 1)
+	c.Check(jwks.Keys[0].KeyType, Equals, "OKP")
+	c.Check(jwks.Keys[0].KeyID, Not(Equals), "")
+}
+
+// Requests a route that needs a permission the group of the user lacks
+func (s *AuthTestSuite) TestAuthForbidden(c *C) {
+	tokens := s.login(c)
+
+	request, _ := http.NewRequest("DELETE", "/users/2", nil)
+	request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 403)
+
+	c.Assert(s.store.GrantPermission(data.System, 1, data.PermUsersWrite), IsNil)
+
+	request, _ = http.NewRequest("DELETE", "/users/2", nil)
+	request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 204)
+}
+
+// Puts users into groups, which takes groups:write unless the groups grant nothing more than the user holds
+func (s *AuthTestSuite) TestAuthJoinGroup(c *C) {
+	userHandler := handlers.NewUsers(s.l, s.store, s.store, s.passwords, handlers.DefaultPaging, false, handlers.DefaultMaxBatch)
+	router := s.mux.NewRoute().Subrouter()
+	router.HandleFunc("/users", s.authHandler.Require(data.PermUsersWrite, userHandler.Create)).Methods(http.MethodPost)
+	router.HandleFunc("/users/{id:[0-9]+}", s.authHandler.Require(data.PermUsersWrite, userHandler.Update)).Methods(http.MethodPut)
+	router.HandleFunc("/users/{id:[0-9]+}", s.authHandler.Require(data.PermUsersWrite, userHandler.Patch)).Methods(http.MethodPatch)
+	router.Use(s.authHandler.Authenticate)
+
+	c.Assert(s.store.GrantPermission(data.System, 1, data.PermUsersWrite), IsNil)
+	c.Assert(s.store.GrantPermission(data.System, 2, data.PermGroupsAdmin), IsNil)
+	c.Assert(s.store.AddGroup(data.System, &data.Group{Name: "group 3", ParentID: 2}), IsNil)
+	c.Assert(s.store.AddGroup(data.System, &data.Group{Name: "group 4"}), IsNil)
+	c.Assert(s.store.GrantPermission(data.System, 4, data.PermUsersRead), IsNil)
+
+	tokens := s.login(c)
+	send := func(method, url, body string) {
+		request, _ := http.NewRequest(method, url, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		request.Header.Set("Content-Type", "application/merge-patch+json")
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+	}
+
+	// group 2 grants groups:admin and group 3 inherits it
+	send("PATCH", "/users/1", `{"groupID": 2}`)
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+	send("PUT", "/users/1", `{"id": 1, "name": "user 1", "email": "user@email.com", "groupID": 2}`)
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+	send("PATCH", "/users/1", `{"groupID": 3}`)
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+	send("POST", "/users", `{"name": "user 3", "password": "pass", "email": "user3@email.com", "groupID": 2}`)
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+
+	permissions, err := s.store.GetUserPermissions(1)
+	c.Assert(err, IsNil)
+	c.Check(data.HasPermission(permissions, data.PermGroupsAdmin), Equals, false)
+
+	// group 4 grants nothing more than the user holds
+	send("POST", "/users", `{"name": "user 3", "password": "pass", "email": "user3@email.com", "groupID": 4}`)
+	c.Check(s.writer.Code, Equals, 200)
+	send("PATCH", "/users/1", `{"name": "renamed"}`)
+	c.Check(s.writer.Code, Equals, 204)
+
+	c.Assert(s.store.GrantPermission(data.System, 1, data.PermGroupsWrite), IsNil)
+	send("PATCH", "/users/1", `{"groupID": 2}`)
+	c.Check(s.writer.Code, Equals, 204)
+}
+
+// Changes a group as its manager and owner without the groups permissions
+func (s *AuthTestSuite) TestAuthGroupRoles(c *C) {
+	groupHandler := handlers.NewGroups(s.l, s.store, handlers.DefaultPaging, false)
+	router := s.mux.NewRoute().Subrouter()
+	router.HandleFunc("/groups/{id:[0-9]+}", s.authHandler.RequireGroupRole(data.PermGroupsWrite, data.RoleManager, groupHandler.Patch)).Methods(http.MethodPatch)
+	router.HandleFunc("/groups/{id:[0-9]+}", s.authHandler.RequireGroupRole(data.PermGroupsWrite, data.RoleOwner, groupHandler.Delete)).Methods(http.MethodDelete)
+	router.HandleFunc("/groups/{id:[0-9]+}/members/{userId:[0-9]+}", s.authHandler.RequireGroupRole(data.PermGroupsWrite, data.RoleManager, groupHandler.AddMember)).Methods(http.MethodPost)
+	router.HandleFunc("/groups/{id:[0-9]+}/admins/{userId:[0-9]+}", s.authHandler.RequireGroupRole(data.PermGroupsAdmin, data.RoleOwner, groupHandler.SetAdmin)).Methods(http.MethodPut)
+	router.Use(s.authHandler.Authenticate)
+
+	tokens := s.login(c)
+	send := func(method, url, body string) {
+		request, _ := http.NewRequest(method, url, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		request.Header.Set("Content-Type", "application/merge-patch+json")
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+	}
+
+	send("PATCH", "/groups/2", `{"name": "renamed"}`)
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+
+	// a manager renames the group and changes its members, but only while holding what the group grants
+	c.Assert(s.store.SetGroupAdmin(data.System, 2, 1, data.RoleManager), IsNil)
+	c.Assert(s.store.GrantPermission(data.System, 2, data.PermAuditRead), IsNil)
+	send("POST", "/groups/2/members/1", "")
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+	c.Assert(s.store.RevokePermission(data.System, 2, data.PermAuditRead), IsNil)
+	send("PATCH", "/groups/2", `{"name": "renamed"}`)
+	c.Check(s.writer.Code, Equals, 204)
+	send("PATCH", "/groups/2", `{"parentID": 1}`)
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+	send("POST", "/groups/2/members/2", "")
+	c.Check(s.writer.Code, Equals, 204)
+	send("DELETE", "/groups/2", "")
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+	send("PUT", "/groups/2/admins/2", `{"role": "owner"}`)
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+
+	// an owner changes the admins and deletes the group, but neither its descendants nor its parent and rule
+	c.Assert(s.store.SetGroupAdmin(data.System, 2, 1, data.RoleOwner), IsNil)
+	c.Assert(s.store.AddGroup(data.System, &data.Group{Name: "group 3"}), IsNil)
+	c.Assert(s.store.GrantPermission(data.System, 3, data.PermGroupsAdmin), IsNil)
+	send("PATCH", "/groups/2", `{"parentID": 3}`)
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+	send("PATCH", "/groups/2", `{"rule": "id > 0"}`)
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+
+	// the owner joining its group holds no more permissions than before
+	send("POST", "/groups/2/members/1", "")
+	c.Check(s.writer.Code, Equals, 204)
+	permissions, err := s.store.GetUserPermissions(1)
+	c.Assert(err, IsNil)
+	c.Check(permissions, DeepEquals, []string{data.PermUsersRead})
+	c.Assert(s.store.RemoveMember(data.System, 2, 1), IsNil)
+
+	send("PUT", "/groups/2/admins/2", `{"role": "manager"}`)
+	c.Check(s.writer.Code, Equals, 204)
+	send("DELETE", "/groups/2?cascade=true", "")
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+	c.Assert(s.store.RemoveMember(data.System, 2, 2), IsNil)
+	send("DELETE", "/groups/2", "")
+	c.Check(s.writer.Code, Equals, 204)
+
+	// the owner of one group is no admin of another
+	send("PATCH", "/groups/1", `{"name": "renamed"}`)
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+}
+
+// Places groups below parents and gives them rules, which takes groups:admin
+func (s *AuthTestSuite) TestAuthPlaceGroup(c *C) {
+	groupHandler := handlers.NewGroups(s.l, s.store, handlers.DefaultPaging, false)
+	router := s.mux.NewRoute().Subrouter()
+	router.HandleFunc("/groups", s.authHandler.Require(data.PermGroupsWrite, groupHandler.Create)).Methods(http.MethodPost)
+	router.HandleFunc("/groups/{id:[0-9]+}", s.authHandler.RequireGroupRole(data.PermGroupsWrite, data.RoleManager, groupHandler.Patch)).Methods(http.MethodPatch)
+	router.Use(s.authHandler.Authenticate)
+
+	tokens := s.login(c)
+	send := func(method, url, body string) {
+		request, _ := http.NewRequest(method, url, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		request.Header.Set("Content-Type", "application/merge-patch+json")
+		s.writer = httptest.NewRecorder()
+		s.mux.ServeHTTP(s.writer, request)
+	}
+
+	c.Assert(s.store.GrantPermission(data.System, 1, data.PermGroupsWrite), IsNil)
+	send("PATCH", "/groups/2", `{"parentID": 1}`)
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+	send("PATCH", "/groups/2", `{"rule": "id > 0"}`)
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+	send("POST", "/groups", `{"name": "group 3", "parentID": 1}`)
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+	send("POST", "/groups", `{"name": "group 3"}`)
+	c.Check(s.writer.Code, Equals, 200)
+
+	c.Assert(s.store.GrantPermission(data.System, 1, data.PermGroupsAdmin), IsNil)
+	send("PATCH", "/groups/2", `{"parentID": 1}`)
+	c.Check(s.writer.Code, Equals, 204)
+	send("POST", "/groups", `{"name": "group 4", "parentID": 1}`)
+	c.Check(s.writer.Code, Equals, 200)
+}
+
+// Lists deleted users, which only admins of users may do
+func (s *AuthTestSuite) TestAuthIncludeDeleted(c *C) {
+	tokens := s.login(c)
+
+	request, _ := http.NewRequest("GET", "/users?include_deleted=true", nil)
+	request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	s.mux.ServeHTTP(s.writer, request)
+	checkProblem(c, s.writer, 403, handlers.CodePermissionDenied)
+
+	c.Check(s.getUsers(tokens.AccessToken), Equals, 200)
+	c.Assert(s.store.GrantPermission(data.System, 1, data.PermUsersAdmin), IsNil)
+
+	request, _ = http.NewRequest("GET", "/users?include_deleted=true", nil)
+	request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 200)
+}
+
+// A user holds the permissions of every group it belongs to and logs in without a primary group
+func (s *AuthTestSuite) TestAuthMemberPermissions(c *C) {
+	c.Assert(s.store.GrantPermission(data.System, 2, data.PermUsersWrite), IsNil)
+	c.Assert(s.store.AddMember(data.System, 2, 1), IsNil)
+	c.Assert(s.store.RemoveMember(data.System, 1, 1), IsNil)
+
+	request, _ := http.NewRequest("POST", "/auth/login", strings.NewReader(`{"name": "user 1", "password": "pass"}`))
+	s.mux.ServeHTTP(s.writer, request)
+	c.Assert(s.writer.Code, Equals, 200)
+	var login handlers.Login
+	c.Assert(json.Unmarshal(s.writer.Body.Bytes(), &login), IsNil)
+	c.Check(login.Group, IsNil)
+
+	// group 1 no longer grants users:read, group 2 grants users:write
+	c.Check(s.getUsers(login.AccessToken), Equals, 403)
+	request, _ = http.NewRequest("DELETE", "/users/2", nil)
+	request.Header.Set("Authorization", "Bearer "+login.AccessToken)
+	s.writer = httptest.NewRecorder()
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 204)
+}
+
+// The permissions of the ancestors of a group are granted to its members
+func (s *AuthTestSuite) TestAuthInheritedPermissions(c *C) {
+	c.Assert(s.store.GrantPermission(data.System, 2, data.PermUsersWrite), IsNil)
+	c.Assert(s.store.UpdateGroup(data.System, 1, 0, map[string]interface{}{"parentID": 2}), IsNil)
+
+	request, _ := http.NewRequest("DELETE", "/users/2", nil)
+	request.Header.Set("Authorization", "Bearer "+s.login(c).AccessToken)
+	s.mux.ServeHTTP(s.writer, request)
+	c.Check(s.writer.Code, Equals, 204)
+}
+
+// A deleted user can no longer log in
+func (s *AuthTestSuite) TestAuthLoginDeleted(c *C) {
+	c.Assert(s.store.DeleteUser(data.System, 2, 0), IsNil)
+
+	body := strings.NewReader(`{"email": "user2@email.com", "password": "pass"}`)
+	request, _ := http.NewRequest("POST", "/auth/login", body)
+	s.mux.ServeHTTP(s.writer, request)
+
+	c.Check(s.writer.Code, Equals, 401)
+}
+
+// linkRel returns the url of the link with the given relation from a Link header
+func linkRel(header, rel string) string {
+	for _, link := range strings.Split(header, ", ") {
+		if strings.HasSuffix(link, `; rel="`+rel+`"`) {
+			return strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="`+rel+`"`)
+		}
+	}
+	return ""
+}
+
+// checkProblem checks that the response is problem details with the status and code and returns them
+func checkProblem(c *C, writer *httptest.ResponseRecorder, status int, code string) handlers.Problem {
+	c.Check(writer.Code, Equals, status)
+	c.Check(writer.Header().Get("Content-Type"), Equals, handlers.ProblemType)
+
+	var problem handlers.Problem
+	c.Check(json.Unmarshal(writer.Body.Bytes(), &problem), IsNil)
+	c.Check(problem.Status, Equals, status)
+	c.Check(problem.Code, Equals, code)
+	return problem
 }
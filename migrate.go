@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/zzibert/3fs-rest-api/migrations"
+)
+
+// usage of the migrate subcommand
+const migrateUsage = "usage: migrate up|down|status|to N"
+
+// runMigrate runs the migrate subcommand with the given arguments
+func runMigrate(m *migrations.Migrator, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf(migrateUsage)
+	}
+
+	switch args[0] {
+	case "up":
+		if err := m.Up(); err != nil {
+			return err
+		}
+	case "down":
+		if err := m.Down(); err != nil {
+			return err
+		}
+	case "to":
+		if len(args) != 2 {
+			return fmt.Errorf(migrateUsage)
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf(migrateUsage)
+		}
+		if err = m.To(version); err != nil {
+			return err
+		}
+	case "status":
+		status, err := m.Status()
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.Applied {
+				applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%4d  %-40s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		return fmt.Errorf(migrateUsage)
+	}
+
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "schema version %d, latest %d\n", version, m.Latest())
+	return nil
+}
@@ -0,0 +1,615 @@
+package migrations
+
+// All is the ordered list of schema migrations
+// New migrations are appended with the next version number, applied migrations must never change
+var All = []Migration{
+	{
+		Version: 1,
+		Name:    "create users and groups",
+		Up: SQL{
+			// IF NOT EXISTS adopts databases created by the former docker/init.sql
+			Postgres: `
+CREATE TABLE IF NOT EXISTS groups (
+  id serial PRIMARY KEY,
+  name varchar(255) UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users (
+  id serial PRIMARY KEY,
+  name varchar(255) UNIQUE NOT NULL,
+  password varchar(255) NOT NULL,
+  email varchar(255) UNIQUE NOT NULL,
+  group_id integer NOT NULL references groups(id)
+);`,
+			// lengths are checked explicitly because SQLite does not enforce varchar lengths
+			SQLite: `
+CREATE TABLE IF NOT EXISTS groups (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  name varchar(255) UNIQUE NOT NULL CHECK (length(name) <= 255)
+);
+
+CREATE TABLE IF NOT EXISTS users (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  name varchar(255) UNIQUE NOT NULL CHECK (length(name) <= 255),
+  password varchar(255) NOT NULL CHECK (length(password) <= 255),
+  email varchar(255) UNIQUE NOT NULL CHECK (length(email) <= 255),
+  group_id integer NOT NULL REFERENCES groups(id)
+);`,
+		},
+		Down: Both(`
+DROP TABLE users;
+DROP TABLE groups;`),
+	},
+	{
+		Version: 2,
+		Name:    "create group permissions",
+		// existing groups keep reading users and groups, but no group is made an admin,
+		// the first admins are bootstrapped explicitly with adduser -permissions all
+		Up: Both(`
+CREATE TABLE group_permissions (
+  group_id integer NOT NULL REFERENCES groups(id) ON DELETE CASCADE ON UPDATE CASCADE,
+  permission varchar(64) NOT NULL,
+  PRIMARY KEY (group_id, permission)
+);
+
+INSERT INTO group_permissions (group_id, permission) SELECT id, 'users:read' FROM groups;
+INSERT INTO group_permissions (group_id, permission) SELECT id, 'groups:read' FROM groups;`),
+		Down: Both(`
+DROP TABLE group_permissions;`),
+	},
+	{
+		Version: 3,
+		Name:    "create search indexes",
+		Up: SQL{
+			Postgres: `
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX users_name_trgm_idx ON users USING gin (name gin_trgm_ops);
+CREATE INDEX users_email_trgm_idx ON users USING gin (email gin_trgm_ops);
+CREATE INDEX groups_name_trgm_idx ON groups USING gin (name gin_trgm_ops);`,
+			// SQLite has no trigram indexes, the store scores every user and group itself
+			SQLite: NoOp,
+		},
+		Down: SQL{
+			Postgres: `
+DROP INDEX users_name_trgm_idx;
+DROP INDEX users_email_trgm_idx;
+DROP INDEX groups_name_trgm_idx;`,
+			SQLite: NoOp,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "add versions of users and groups",
+		Up: Both(`
+ALTER TABLE users ADD COLUMN version integer NOT NULL DEFAULT 1;
+ALTER TABLE groups ADD COLUMN version integer NOT NULL DEFAULT 1;`),
+		Down: SQL{
+			Postgres: `
+ALTER TABLE users DROP COLUMN version;
+ALTER TABLE groups DROP COLUMN version;`,
+			// SQLite can not drop columns, the tables are copied without them
+			// Foreign keys are checked at commit and the permissions that the copy of groups cascades away are restored
+			SQLite: `
+PRAGMA defer_foreign_keys = ON;
+
+CREATE TEMP TABLE users_copy AS SELECT id, name, password, email, group_id FROM users;
+CREATE TEMP TABLE groups_copy AS SELECT id, name FROM groups;
+CREATE TEMP TABLE group_permissions_copy AS SELECT group_id, permission FROM group_permissions;
+
+DROP TABLE users;
+DROP TABLE groups;
+
+CREATE TABLE groups (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  name varchar(255) UNIQUE NOT NULL CHECK (length(name) <= 255)
+);
+
+CREATE TABLE users (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  name varchar(255) UNIQUE NOT NULL CHECK (length(name) <= 255),
+  password varchar(255) NOT NULL CHECK (length(password) <= 255),
+  email varchar(255) UNIQUE NOT NULL CHECK (length(email) <= 255),
+  group_id integer NOT NULL REFERENCES groups(id)
+);
+
+INSERT INTO groups SELECT * FROM groups_copy;
+INSERT INTO users SELECT * FROM users_copy;
+INSERT INTO group_permissions SELECT * FROM group_permissions_copy;
+
+DROP TABLE users_copy;
+DROP TABLE groups_copy;
+DROP TABLE group_permissions_copy;`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "add soft deletes of users and groups",
+		// names and emails only have to be unique among the rows that are not deleted,
+		// the unique indexes keep the names of the former constraints that the store maps to errors
+		// Groups that administer groups also administer users, which now has a permission of its own
+		Up: SQL{
+			Postgres: `
+ALTER TABLE users ADD COLUMN deleted_at timestamptz;
+ALTER TABLE groups ADD COLUMN deleted_at timestamptz;
+
+ALTER TABLE users DROP CONSTRAINT users_name_key;
+ALTER TABLE users DROP CONSTRAINT users_email_key;
+ALTER TABLE groups DROP CONSTRAINT groups_name_key;
+
+CREATE UNIQUE INDEX users_name_key ON users (name) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX users_email_key ON users (email) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX groups_name_key ON groups (name) WHERE deleted_at IS NULL;
+
+INSERT INTO group_permissions (group_id, permission) SELECT group_id, 'users:admin' FROM group_permissions WHERE permission = 'groups:admin';`,
+			// SQLite can not drop the unique constraints, the tables are copied without them
+			SQLite: `
+PRAGMA defer_foreign_keys = ON;
+
+CREATE TEMP TABLE users_copy AS SELECT id, name, password, email, group_id, version FROM users;
+CREATE TEMP TABLE groups_copy AS SELECT id, name, version FROM groups;
+CREATE TEMP TABLE group_permissions_copy AS SELECT group_id, permission FROM group_permissions;
+
+DROP TABLE users;
+DROP TABLE groups;
+
+CREATE TABLE groups (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  name varchar(255) NOT NULL CHECK (length(name) <= 255),
+  version integer NOT NULL DEFAULT 1,
+  deleted_at datetime
+);
+
+CREATE TABLE users (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  name varchar(255) NOT NULL CHECK (length(name) <= 255),
+  password varchar(255) NOT NULL CHECK (length(password) <= 255),
+  email varchar(255) NOT NULL CHECK (length(email) <= 255),
+  group_id integer NOT NULL REFERENCES groups(id),
+  version integer NOT NULL DEFAULT 1,
+  deleted_at datetime
+);
+
+CREATE UNIQUE INDEX users_name_key ON users (name) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX users_email_key ON users (email) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX groups_name_key ON groups (name) WHERE deleted_at IS NULL;
+
+INSERT INTO groups (id, name, version) SELECT * FROM groups_copy;
+INSERT INTO users (id, name, password, email, group_id, version) SELECT * FROM users_copy;
+INSERT INTO group_permissions SELECT * FROM group_permissions_copy;
+INSERT INTO group_permissions (group_id, permission) SELECT group_id, 'users:admin' FROM group_permissions WHERE permission = 'groups:admin';
+
+DROP TABLE users_copy;
+DROP TABLE groups_copy;
+DROP TABLE group_permissions_copy;`,
+		},
+		// deleted users and groups are purged, they would violate the unique constraints
+		Down: SQL{
+			Postgres: `
+DELETE FROM users WHERE deleted_at IS NOT NULL;
+DELETE FROM groups WHERE deleted_at IS NOT NULL;
+DELETE FROM group_permissions WHERE permission = 'users:admin';
+
+DROP INDEX users_name_key;
+DROP INDEX users_email_key;
+DROP INDEX groups_name_key;
+
+ALTER TABLE users ADD CONSTRAINT users_name_key UNIQUE (name);
+ALTER TABLE users ADD CONSTRAINT users_email_key UNIQUE (email);
+ALTER TABLE groups ADD CONSTRAINT groups_name_key UNIQUE (name);
+
+ALTER TABLE users DROP COLUMN deleted_at;
+ALTER TABLE groups DROP COLUMN deleted_at;`,
+			SQLite: `
+PRAGMA defer_foreign_keys = ON;
+
+DELETE FROM users WHERE deleted_at IS NOT NULL;
+DELETE FROM groups WHERE deleted_at IS NOT NULL;
+DELETE FROM group_permissions WHERE permission = 'users:admin';
+
+CREATE TEMP TABLE users_copy AS SELECT id, name, password, email, group_id, version FROM users;
+CREATE TEMP TABLE groups_copy AS SELECT id, name, version FROM groups;
+CREATE TEMP TABLE group_permissions_copy AS SELECT group_id, permission FROM group_permissions;
+
+DROP TABLE users;
+DROP TABLE groups;
+
+CREATE TABLE groups (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  name varchar(255) UNIQUE NOT NULL CHECK (length(name) <= 255),
+  version integer NOT NULL DEFAULT 1
+);
+
+CREATE TABLE users (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  name varchar(255) UNIQUE NOT NULL CHECK (length(name) <= 255),
+  password varchar(255) NOT NULL CHECK (length(password) <= 255),
+  email varchar(255) UNIQUE NOT NULL CHECK (length(email) <= 255),
+  group_id integer NOT NULL REFERENCES groups(id),
+  version integer NOT NULL DEFAULT 1
+);
+
+INSERT INTO groups SELECT * FROM groups_copy;
+INSERT INTO users SELECT * FROM users_copy;
+INSERT INTO group_permissions SELECT * FROM group_permissions_copy;
+
+DROP TABLE users_copy;
+DROP TABLE groups_copy;
+DROP TABLE group_permissions_copy;`,
+		},
+	},
+	{
+		Version: 6,
+		Name:    "create the audit log",
+		// the audit log is append-only, triggers reject updates and deletes of its entries
+		// Actors and entities are not foreign keys, entries outlive purged users and groups
+		// Groups that administer groups may read the audit log
+		Up: SQL{
+			Postgres: `
+CREATE TABLE audit_entries (
+  id serial PRIMARY KEY,
+  created_at timestamptz NOT NULL,
+  actor_id integer NOT NULL,
+  request_id varchar(255) NOT NULL,
+  action varchar(32) NOT NULL,
+  entity varchar(32) NOT NULL,
+  entity_id integer NOT NULL,
+  changes text NOT NULL
+);
+
+CREATE INDEX audit_entries_entity_idx ON audit_entries (entity, entity_id);
+CREATE INDEX audit_entries_actor_idx ON audit_entries (actor_id);
+CREATE INDEX audit_entries_created_at_idx ON audit_entries (created_at);
+
+CREATE FUNCTION audit_entries_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'the audit log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_entries_append_only BEFORE UPDATE OR DELETE ON audit_entries
+  FOR EACH ROW EXECUTE PROCEDURE audit_entries_append_only();
+
+INSERT INTO group_permissions (group_id, permission) SELECT group_id, 'audit:read' FROM group_permissions WHERE permission = 'groups:admin';`,
+			SQLite: `
+CREATE TABLE audit_entries (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  created_at datetime NOT NULL,
+  actor_id integer NOT NULL,
+  request_id varchar(255) NOT NULL,
+  action varchar(32) NOT NULL,
+  entity varchar(32) NOT NULL,
+  entity_id integer NOT NULL,
+  changes text NOT NULL
+);
+
+CREATE INDEX audit_entries_entity_idx ON audit_entries (entity, entity_id);
+CREATE INDEX audit_entries_actor_idx ON audit_entries (actor_id);
+CREATE INDEX audit_entries_created_at_idx ON audit_entries (created_at);
+
+CREATE TRIGGER audit_entries_no_update BEFORE UPDATE ON audit_entries
+BEGIN
+  SELECT RAISE(ABORT, 'the audit log is append-only');
+END;
+
+CREATE TRIGGER audit_entries_no_delete BEFORE DELETE ON audit_entries
+BEGIN
+  SELECT RAISE(ABORT, 'the audit log is append-only');
+END;
+
+INSERT INTO group_permissions (group_id, permission) SELECT group_id, 'audit:read' FROM group_permissions WHERE permission = 'groups:admin';`,
+		},
+		Down: SQL{
+			Postgres: `
+DELETE FROM group_permissions WHERE permission = 'audit:read';
+
+DROP TABLE audit_entries;
+DROP FUNCTION audit_entries_append_only();`,
+			SQLite: `
+DELETE FROM group_permissions WHERE permission = 'audit:read';
+
+DROP TABLE audit_entries;`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "create memberships",
+		// users belong to any number of groups, the group of a user becomes its optional primary group
+		// which is one of its memberships
+		Up: SQL{
+			Postgres: `
+CREATE TABLE memberships (
+  user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+  group_id integer NOT NULL REFERENCES groups(id),
+  PRIMARY KEY (user_id, group_id)
+);
+
+CREATE INDEX memberships_group_id_idx ON memberships (group_id);
+
+INSERT INTO memberships (user_id, group_id) SELECT id, group_id FROM users;
+
+ALTER TABLE users ALTER COLUMN group_id DROP NOT NULL;`,
+			// SQLite can not drop the not null constraint, the users are copied into a new table
+			SQLite: `
+CREATE TEMP TABLE users_copy AS SELECT id, name, password, email, group_id, version, deleted_at FROM users;
+
+DROP TABLE users;
+
+CREATE TABLE users (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  name varchar(255) NOT NULL CHECK (length(name) <= 255),
+  password varchar(255) NOT NULL CHECK (length(password) <= 255),
+  email varchar(255) NOT NULL CHECK (length(email) <= 255),
+  group_id integer REFERENCES groups(id),
+  version integer NOT NULL DEFAULT 1,
+  deleted_at datetime
+);
+
+CREATE UNIQUE INDEX users_name_key ON users (name) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX users_email_key ON users (email) WHERE deleted_at IS NULL;
+
+INSERT INTO users SELECT * FROM users_copy;
+
+DROP TABLE users_copy;
+
+CREATE TABLE memberships (
+  user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+  group_id integer NOT NULL REFERENCES groups(id),
+  PRIMARY KEY (user_id, group_id)
+);
+
+CREATE INDEX memberships_group_id_idx ON memberships (group_id);
+
+INSERT INTO memberships (user_id, group_id) SELECT id, group_id FROM users;`,
+		},
+		// users without a primary group take their first group, users without any group are removed
+		Down: SQL{
+			Postgres: `
+UPDATE users SET group_id = (SELECT min(group_id) FROM memberships WHERE user_id = users.id) WHERE group_id IS NULL;
+DELETE FROM users WHERE group_id IS NULL;
+
+DROP TABLE memberships;
+
+ALTER TABLE users ALTER COLUMN group_id SET NOT NULL;`,
+			SQLite: `
+UPDATE users SET group_id = (SELECT min(group_id) FROM memberships WHERE user_id = users.id) WHERE group_id IS NULL;
+DELETE FROM users WHERE group_id IS NULL;
+
+DROP TABLE memberships;
+
+CREATE TEMP TABLE users_copy AS SELECT id, name, password, email, group_id, version, deleted_at FROM users;
+
+DROP TABLE users;
+
+CREATE TABLE users (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  name varchar(255) NOT NULL CHECK (length(name) <= 255),
+  password varchar(255) NOT NULL CHECK (length(password) <= 255),
+  email varchar(255) NOT NULL CHECK (length(email) <= 255),
+  group_id integer NOT NULL REFERENCES groups(id),
+  version integer NOT NULL DEFAULT 1,
+  deleted_at datetime
+);
+
+CREATE UNIQUE INDEX users_name_key ON users (name) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX users_email_key ON users (email) WHERE deleted_at IS NULL;
+
+INSERT INTO users SELECT * FROM users_copy;
+
+DROP TABLE users_copy;`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "nest groups",
+		// the parent of a group is optional, cycles are prevented by the stores
+		Up: SQL{
+			Postgres: `
+ALTER TABLE groups ADD COLUMN parent_id integer REFERENCES groups(id) ON UPDATE CASCADE;
+
+CREATE INDEX groups_parent_id_idx ON groups (parent_id);`,
+			SQLite: `
+ALTER TABLE groups ADD COLUMN parent_id integer REFERENCES groups(id) ON UPDATE CASCADE;
+
+CREATE INDEX groups_parent_id_idx ON groups (parent_id);`,
+		},
+		Down: SQL{
+			Postgres: `
+DROP INDEX groups_parent_id_idx;
+
+ALTER TABLE groups DROP COLUMN parent_id;`,
+			// SQLite can not drop the column, the groups are copied into a new table
+			// and their permissions, which would be removed with them, are copied as well
+			SQLite: `
+PRAGMA defer_foreign_keys = ON;
+
+CREATE TEMP TABLE groups_copy AS SELECT id, name, version, deleted_at FROM groups;
+CREATE TEMP TABLE group_permissions_copy AS SELECT group_id, permission FROM group_permissions;
+
+DROP TABLE groups;
+
+CREATE TABLE groups (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  name varchar(255) NOT NULL CHECK (length(name) <= 255),
+  version integer NOT NULL DEFAULT 1,
+  deleted_at datetime
+);
+
+CREATE UNIQUE INDEX groups_name_key ON groups (name) WHERE deleted_at IS NULL;
+
+INSERT INTO groups SELECT * FROM groups_copy;
+INSERT INTO group_permissions SELECT * FROM group_permissions_copy;
+
+DROP TABLE groups_copy;
+DROP TABLE group_permissions_copy;`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "add group rules",
+		// the memberships of a dynamic group are kept in sync with its rule by the stores
+		Up: SQL{
+			Postgres: `
+ALTER TABLE groups ADD COLUMN rule varchar(1024) NOT NULL DEFAULT '';`,
+			SQLite: `
+ALTER TABLE groups ADD COLUMN rule varchar(1024) NOT NULL DEFAULT '' CHECK (length(rule) <= 1024);`,
+		},
+		Down: SQL{
+			Postgres: `
+ALTER TABLE groups DROP COLUMN rule;`,
+			// SQLite can not drop the column, the groups are copied into a new table like in version 8
+			// the members of dynamic groups stay members
+			SQLite: `
+PRAGMA defer_foreign_keys = ON;
+
+CREATE TEMP TABLE groups_copy AS SELECT id, name, version, deleted_at, parent_id FROM groups;
+CREATE TEMP TABLE group_permissions_copy AS SELECT group_id, permission FROM group_permissions;
+
+DROP TABLE groups;
+
+CREATE TABLE groups (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  name varchar(255) NOT NULL CHECK (length(name) <= 255),
+  version integer NOT NULL DEFAULT 1,
+  deleted_at datetime,
+  parent_id integer REFERENCES groups(id) ON UPDATE CASCADE
+);
+
+CREATE UNIQUE INDEX groups_name_key ON groups (name) WHERE deleted_at IS NULL;
+CREATE INDEX groups_parent_id_idx ON groups (parent_id);
+
+INSERT INTO groups SELECT * FROM groups_copy;
+INSERT INTO group_permissions SELECT * FROM group_permissions_copy;
+
+DROP TABLE groups_copy;
+DROP TABLE group_permissions_copy;`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "create user attributes",
+		// the values of attributes are stored as text, unique_value holds the value of a unique attribute
+		// of a user that is not deleted, so that the unique index only covers these values
+		Up: SQL{
+			Postgres: `
+CREATE TABLE attributes (
+  id serial PRIMARY KEY,
+  name varchar(64) UNIQUE NOT NULL,
+  type varchar(16) NOT NULL,
+  required boolean NOT NULL DEFAULT false,
+  is_unique boolean NOT NULL DEFAULT false,
+  enum_values text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE user_attributes (
+  user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+  attribute_id integer NOT NULL REFERENCES attributes(id) ON DELETE CASCADE,
+  value varchar(1024) NOT NULL,
+  unique_value varchar(1024),
+  PRIMARY KEY (user_id, attribute_id)
+);
+
+CREATE UNIQUE INDEX user_attributes_unique_key ON user_attributes (attribute_id, unique_value);
+CREATE INDEX user_attributes_value_idx ON user_attributes (attribute_id, value);`,
+			SQLite: `
+CREATE TABLE attributes (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  name varchar(64) UNIQUE NOT NULL CHECK (length(name) <= 64),
+  type varchar(16) NOT NULL CHECK (length(type) <= 16),
+  required boolean NOT NULL DEFAULT false,
+  is_unique boolean NOT NULL DEFAULT false,
+  enum_values text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE user_attributes (
+  user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+  attribute_id integer NOT NULL REFERENCES attributes(id) ON DELETE CASCADE,
+  value varchar(1024) NOT NULL CHECK (length(value) <= 1024),
+  unique_value varchar(1024),
+  PRIMARY KEY (user_id, attribute_id)
+);
+
+CREATE UNIQUE INDEX user_attributes_unique_key ON user_attributes (attribute_id, unique_value);
+CREATE INDEX user_attributes_value_idx ON user_attributes (attribute_id, value);`,
+		},
+		Down: Both(`
+DROP TABLE user_attributes;
+DROP TABLE attributes;`),
+	},
+	{
+		Version: 11,
+		Name:    "create group admins",
+		// owners and managers administer a group without holding the groups permissions
+		Up: SQL{
+			Postgres: `
+CREATE TABLE group_admins (
+  group_id integer NOT NULL REFERENCES groups(id) ON UPDATE CASCADE ON DELETE CASCADE,
+  user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+  role varchar(16) NOT NULL CHECK (role IN ('owner', 'manager')),
+  PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX group_admins_user_id_idx ON group_admins (user_id);`,
+			SQLite: `
+CREATE TABLE group_admins (
+  group_id integer NOT NULL REFERENCES groups(id) ON UPDATE CASCADE ON DELETE CASCADE,
+  user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+  role varchar(16) NOT NULL CHECK (role IN ('owner', 'manager')),
+  PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX group_admins_user_id_idx ON group_admins (user_id);`,
+		},
+		Down: Both(`
+DROP TABLE group_admins;`),
+	},
+	{
+		Version: 12,
+		Name:    "cascade memberships of groups",
+		// the memberships of a group are removed with it and follow a changed id like the memberships of a user,
+		// the stores still keep groups with members from being deleted or purged
+		Up: SQL{
+			Postgres: `
+ALTER TABLE memberships DROP CONSTRAINT memberships_group_id_fkey,
+  ADD CONSTRAINT memberships_group_id_fkey FOREIGN KEY (group_id) REFERENCES groups(id) ON UPDATE CASCADE ON DELETE CASCADE;`,
+			// SQLite can not change a foreign key, the memberships are copied into a new table
+			SQLite: `
+CREATE TEMP TABLE memberships_copy AS SELECT user_id, group_id FROM memberships;
+
+DROP TABLE memberships;
+
+CREATE TABLE memberships (
+  user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+  group_id integer NOT NULL REFERENCES groups(id) ON UPDATE CASCADE ON DELETE CASCADE,
+  PRIMARY KEY (user_id, group_id)
+);
+
+CREATE INDEX memberships_group_id_idx ON memberships (group_id);
+
+INSERT INTO memberships SELECT * FROM memberships_copy;
+
+DROP TABLE memberships_copy;`,
+		},
+		Down: SQL{
+			Postgres: `
+ALTER TABLE memberships DROP CONSTRAINT memberships_group_id_fkey,
+  ADD CONSTRAINT memberships_group_id_fkey FOREIGN KEY (group_id) REFERENCES groups(id);`,
+			SQLite: `
+CREATE TEMP TABLE memberships_copy AS SELECT user_id, group_id FROM memberships;
+
+DROP TABLE memberships;
+
+CREATE TABLE memberships (
+  user_id integer NOT NULL REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+  group_id integer NOT NULL REFERENCES groups(id),
+  PRIMARY KEY (user_id, group_id)
+);
+
+CREATE INDEX memberships_group_id_idx ON memberships (group_id);
+
+INSERT INTO memberships SELECT * FROM memberships_copy;
+
+DROP TABLE memberships_copy;`,
+		},
+	},
+}
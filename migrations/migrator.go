@@ -0,0 +1,227 @@
+// Package migrations contains the versioned database schema migrations
+// and a Migrator that applies and rolls them back
+package migrations
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrUnknownVersion is an error raised when migrating to a version that does not exist
+var ErrUnknownVersion = fmt.Errorf("unknown schema version")
+
+// ErrVersionMismatch is an error raised when the database schema is not at the latest version
+var ErrVersionMismatch = fmt.Errorf("schema version mismatch")
+
+// ErrUnsupportedDriver is an error raised when a migration has no statements for the database driver
+var ErrUnsupportedDriver = fmt.Errorf("migration does not support the database driver")
+
+// SQL holds the statements of a migration step for each supported database driver
+type SQL struct {
+	Postgres string
+	SQLite   string
+}
+
+// NoOp are the statements of a migration step that changes nothing for a driver
+const NoOp = "-- no-op"
+
+// Both returns SQL that uses the same statements for every driver
+func Both(statements string) SQL {
+	return SQL{Postgres: statements, SQLite: statements}
+}
+
+// Migration is a single versioned change of the database schema
+type Migration struct {
+	Version int
+	Name    string
+	Up      SQL
+	Down    SQL
+}
+
+// Status describes whether a migration is applied to the database
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies migrations to a database and records them in the schema_migrations table
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+// New returns a migrator for all migrations on the given database
+func New(db *gorm.DB) *Migrator {
+	return &Migrator{db, All}
+}
+
+// Latest returns the version of the newest known migration
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Version returns the version of the newest migration applied to the database
+func (m *Migrator) Version() (version int, err error) {
+	if err = m.init(); err != nil {
+		return
+	}
+
+	row := m.db.Raw("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Row()
+	err = row.Scan(&version)
+	return
+}
+
+// Status returns all known migrations and whether they are applied
+func (m *Migrator) Status() ([]Status, error) {
+	if err := m.init(); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.Raw("SELECT version, applied_at FROM schema_migrations").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err = rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	status := make([]Status, len(m.migrations))
+	for i, migration := range m.migrations {
+		at, ok := applied[migration.Version]
+		status[i] = Status{Migration: migration, Applied: ok, AppliedAt: at}
+	}
+	return status, nil
+}
+
+// Up applies all pending migrations
+func (m *Migrator) Up() error {
+	return m.To(m.Latest())
+}
+
+// Down rolls back the newest applied migration
+func (m *Migrator) Down() error {
+	version, err := m.Version()
+	if err != nil || version == 0 {
+		return err
+	}
+
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		if m.migrations[i].Version < version {
+			return m.To(m.migrations[i].Version)
+		}
+	}
+	return m.To(0)
+}
+
+// To applies or rolls back migrations until the database is at the given version
+// Version 0 rolls back every migration
+func (m *Migrator) To(target int) error {
+	if target != 0 && m.find(target) < 0 {
+		return ErrUnknownVersion
+	}
+
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+
+	// apply pending migrations in order
+	for _, migration := range m.migrations {
+		if migration.Version > version && migration.Version <= target {
+			if err = m.apply(migration, migration.Up, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	// roll back applied migrations in reverse order
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if migration.Version <= version && migration.Version > target {
+			if err = m.apply(migration, migration.Down, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Check returns an ErrVersionMismatch error if the database is not at the latest version
+func (m *Migrator) Check() error {
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	if version != m.Latest() {
+		return fmt.Errorf("%w: database is at version %d, expected %d", ErrVersionMismatch, version, m.Latest())
+	}
+	return nil
+}
+
+// init creates the schema_migrations table if it does not exist
+func (m *Migrator) init() error {
+	return m.db.Exec(`
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version integer PRIMARY KEY,
+  name varchar(255) NOT NULL,
+  applied_at timestamp NOT NULL
+)`).Error
+}
+
+// apply runs one step of a migration and records it within a single transaction
+func (m *Migrator) apply(migration Migration, sql SQL, up bool) error {
+	statements := sql.Postgres
+	if m.db.Dialect().GetName() == "sqlite3" {
+		statements = sql.SQLite
+	}
+	if statements == "" {
+		return fmt.Errorf("%w: version %d", ErrUnsupportedDriver, migration.Version)
+	}
+
+	tx := m.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	var err error
+	if statements != NoOp {
+		err = tx.Exec(statements).Error
+	}
+	if err == nil && up {
+		err = tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", migration.Version, migration.Name, time.Now().UTC()).Error
+	} else if err == nil {
+		err = tx.Exec("DELETE FROM schema_migrations WHERE version = ?", migration.Version).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d %q: %w", migration.Version, migration.Name, err)
+	}
+	return tx.Commit().Error
+}
+
+// find returns the index of the migration with the given version or -1
+func (m *Migrator) find(version int) int {
+	for i, migration := range m.migrations {
+		if migration.Version == version {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,270 @@
+package migrations
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zzibert/3fs-rest-api/data"
+	. "gopkg.in/check.v1"
+)
+
+// Creates migrator test suite
+type MigratorTestSuite struct {
+	migrator *Migrator
+}
+
+// Registering test suite
+func init() {
+	Suite(&MigratorTestSuite{})
+}
+
+// integrates with testing package
+func Test(t *testing.T) { TestingT(t) }
+
+func (s *MigratorTestSuite) SetUpTest(c *C) {
+	db, err := data.Open(data.DriverSQLite, ":memory:")
+	c.Assert(err, IsNil)
+	s.migrator = New(db)
+}
+
+// Applies every migration to an empty database
+func (s *MigratorTestSuite) TestUp(c *C) {
+	c.Assert(s.migrator.Check(), ErrorMatches, "schema version mismatch.*")
+
+	c.Assert(s.migrator.Up(), IsNil)
+
+	version, err := s.migrator.Version()
+	c.Assert(err, IsNil)
+	c.Check(version, Equals, s.migrator.Latest())
+	c.Check(s.migrator.Check(), IsNil)
+
+	status, err := s.migrator.Status()
+	c.Assert(err, IsNil)
+	for _, migration := range status {
+		c.Check(migration.Applied, Equals, true)
+	}
+}
+
+// Rolls back every migration one by one and applies them again
+func (s *MigratorTestSuite) TestDownAndUp(c *C) {
+	c.Assert(s.migrator.Up(), IsNil)
+
+	for i := len(All) - 1; i >= 0; i-- {
+		c.Assert(s.migrator.Down(), IsNil)
+	}
+
+	version, err := s.migrator.Version()
+	c.Assert(err, IsNil)
+	c.Check(version, Equals, 0)
+
+	c.Assert(s.migrator.Up(), IsNil)
+}
+
+// Migrates to a version that does not exist
+func (s *MigratorTestSuite) TestToUnknownVersion(c *C) {
+	c.Check(s.migrator.To(s.migrator.Latest()+1), Equals, ErrUnknownVersion)
+}
+
+// Creates group permissions, which lets existing groups read but makes none of them an admin
+func (s *MigratorTestSuite) TestGroupPermissions(c *C) {
+	c.Assert(s.migrator.To(1), IsNil)
+
+	db := s.migrator.db
+	c.Assert(db.Exec("INSERT INTO groups (name) VALUES ('staff')").Error, IsNil)
+
+	c.Assert(s.migrator.Up(), IsNil)
+
+	var permissions []string
+	c.Assert(db.Table("group_permissions").Where("group_id = 1").Order("permission").Pluck("permission", &permissions).Error, IsNil)
+	c.Check(permissions, DeepEquals, []string{"groups:read", "users:read"})
+}
+
+// Migrates a database with users to soft deletes, which keeps the rows and grants users:admin to admins of groups
+func (s *MigratorTestSuite) TestSoftDeletes(c *C) {
+	c.Assert(s.migrator.To(4), IsNil)
+
+	db := s.migrator.db
+	c.Assert(db.Exec("INSERT INTO groups (name) VALUES ('admins')").Error, IsNil)
+	c.Assert(db.Exec("INSERT INTO users (name, password, email, group_id) VALUES ('admin', 'pass', 'admin@3fs.si', 1)").Error, IsNil)
+	c.Assert(db.Exec("INSERT INTO group_permissions (group_id, permission) VALUES (1, 'groups:admin')").Error, IsNil)
+
+	c.Assert(s.migrator.To(5), IsNil)
+
+	var count int
+	c.Assert(db.Table("group_permissions").Where("group_id = 1").Count(&count).Error, IsNil)
+	c.Check(count, Equals, 2)
+
+	// a name is only taken by a user that is not deleted
+	c.Check(db.Exec("INSERT INTO users (name, password, email, group_id) VALUES ('admin', 'pass', 'other@3fs.si', 1)").Error, NotNil)
+	c.Assert(db.Exec("UPDATE users SET deleted_at = CURRENT_TIMESTAMP").Error, IsNil)
+	c.Check(db.Exec("INSERT INTO users (name, password, email, group_id) VALUES ('admin', 'pass', 'other@3fs.si', 1)").Error, IsNil)
+
+	// rolling back purges the deleted user
+	c.Assert(s.migrator.To(4), IsNil)
+	c.Assert(db.Table("users").Count(&count).Error, IsNil)
+	c.Check(count, Equals, 1)
+}
+
+// Creates the audit log, whose entries can not be changed, and lets admins of groups read it
+func (s *MigratorTestSuite) TestAuditLog(c *C) {
+	c.Assert(s.migrator.To(5), IsNil)
+
+	db := s.migrator.db
+	c.Assert(db.Exec("INSERT INTO groups (name) VALUES ('admins')").Error, IsNil)
+	c.Assert(db.Exec("INSERT INTO group_permissions (group_id, permission) VALUES (1, 'groups:admin')").Error, IsNil)
+
+	c.Assert(s.migrator.Up(), IsNil)
+
+	var count int
+	c.Assert(db.Table("group_permissions").Where("permission = 'audit:read'").Count(&count).Error, IsNil)
+	c.Check(count, Equals, 1)
+
+	c.Assert(db.Exec(`INSERT INTO audit_entries (created_at, actor_id, request_id, action, entity, entity_id, changes)
+VALUES (CURRENT_TIMESTAMP, 0, '', 'create', 'group', 1, '{}')`).Error, IsNil)
+	c.Check(db.Exec("UPDATE audit_entries SET actor_id = 1").Error, ErrorMatches, ".*append-only.*")
+	c.Check(db.Exec("DELETE FROM audit_entries").Error, ErrorMatches, ".*append-only.*")
+}
+
+// Migrates the groups of users to memberships, which makes the group of a user optional
+func (s *MigratorTestSuite) TestMemberships(c *C) {
+	c.Assert(s.migrator.To(6), IsNil)
+
+	db := s.migrator.db
+	c.Assert(db.Exec("INSERT INTO groups (name) VALUES ('admins'), ('staff')").Error, IsNil)
+	c.Assert(db.Exec("INSERT INTO users (name, password, email, group_id) VALUES ('admin', 'pass', 'admin@3fs.si', 1)").Error, IsNil)
+
+	c.Assert(s.migrator.Up(), IsNil)
+
+	var count int
+	c.Assert(db.Table("memberships").Where("user_id = 1 AND group_id = 1").Count(&count).Error, IsNil)
+	c.Check(count, Equals, 1)
+
+	// a user may belong to no group at all or to several
+	c.Check(db.Exec("INSERT INTO users (name, password, email) VALUES ('nobody', 'pass', 'nobody@3fs.si')").Error, IsNil)
+	c.Check(db.Exec("INSERT INTO users (name, password, email) VALUES ('staff', 'pass', 'staff@3fs.si')").Error, IsNil)
+	c.Check(db.Exec("INSERT INTO memberships (user_id, group_id) VALUES (1, 2), (3, 2)").Error, IsNil)
+	c.Check(db.Exec("INSERT INTO memberships (user_id, group_id) VALUES (1, 3)").Error, NotNil)
+
+	// rolling back gives the user without a primary group its first group and removes the user without any group
+	c.Assert(s.migrator.To(6), IsNil)
+	var groups []int
+	c.Assert(db.Table("users").Order("id").Pluck("group_id", &groups).Error, IsNil)
+	c.Check(groups, DeepEquals, []int{1, 2})
+}
+
+// Nests groups and rolls back, which keeps the groups and their permissions
+func (s *MigratorTestSuite) TestNestedGroups(c *C) {
+	c.Assert(s.migrator.To(7), IsNil)
+
+	db := s.migrator.db
+	c.Assert(db.Exec("INSERT INTO groups (name) VALUES ('admins'), ('staff')").Error, IsNil)
+	c.Assert(db.Exec("INSERT INTO group_permissions (group_id, permission) VALUES (1, 'groups:admin')").Error, IsNil)
+	c.Assert(db.Exec("INSERT INTO users (name, password, email, group_id) VALUES ('admin', 'pass', 'admin@3fs.si', 1)").Error, IsNil)
+	c.Assert(db.Exec("INSERT INTO memberships (user_id, group_id) VALUES (1, 1)").Error, IsNil)
+
+	c.Assert(s.migrator.Up(), IsNil)
+
+	c.Check(db.Exec("UPDATE groups SET parent_id = 1 WHERE id = 2").Error, IsNil)
+	c.Check(db.Exec("UPDATE groups SET parent_id = 3 WHERE id = 1").Error, NotNil)
+
+	c.Assert(s.migrator.To(7), IsNil)
+	var count int
+	c.Assert(db.Table("groups").Count(&count).Error, IsNil)
+	c.Check(count, Equals, 2)
+	c.Assert(db.Table("group_permissions").Count(&count).Error, IsNil)
+	c.Check(count, Equals, 1)
+	c.Assert(db.Table("memberships").Count(&count).Error, IsNil)
+	c.Check(count, Equals, 1)
+}
+
+// Adds rules to groups and drops them again without losing the parents of the groups
+func (s *MigratorTestSuite) TestGroupRules(c *C) {
+	c.Assert(s.migrator.To(8), IsNil)
+
+	db := s.migrator.db
+	c.Assert(db.Exec("INSERT INTO groups (name) VALUES ('staff')").Error, IsNil)
+	c.Assert(db.Exec("INSERT INTO groups (name, parent_id) VALUES ('developers', 1)").Error, IsNil)
+
+	c.Assert(s.migrator.Up(), IsNil)
+
+	c.Check(db.Exec(`UPDATE groups SET rule = 'email endsWith "@3fs.si"' WHERE id = 1`).Error, IsNil)
+	c.Check(db.Exec("UPDATE groups SET rule = ? WHERE id = 2", strings.Repeat("a", 1025)).Error, NotNil)
+
+	c.Assert(s.migrator.To(8), IsNil)
+	var parents int
+	c.Assert(db.Table("groups").Where("parent_id = 1").Count(&parents).Error, IsNil)
+	c.Check(parents, Equals, 1)
+}
+
+// Stores attribute values of users, unique values are only unique among the values in unique_value
+func (s *MigratorTestSuite) TestUserAttributes(c *C) {
+	c.Assert(s.migrator.To(9), IsNil)
+
+	db := s.migrator.db
+	c.Assert(db.Exec("INSERT INTO users (name, password, email) VALUES ('ana', 'pass', 'ana@3fs.si'), ('bob', 'pass', 'bob@3fs.si')").Error, IsNil)
+
+	c.Assert(s.migrator.Up(), IsNil)
+
+	c.Assert(db.Exec("INSERT INTO attributes (name, type, is_unique) VALUES ('badge', 'string', true)").Error, IsNil)
+	c.Check(db.Exec("INSERT INTO user_attributes (user_id, attribute_id, value, unique_value) VALUES (1, 1, 'A1', 'A1')").Error, IsNil)
+	c.Check(db.Exec("INSERT INTO user_attributes (user_id, attribute_id, value, unique_value) VALUES (2, 1, 'A1', 'A1')").Error, NotNil)
+	c.Check(db.Exec("INSERT INTO user_attributes (user_id, attribute_id, value) VALUES (2, 1, 'A1')").Error, IsNil)
+
+	// the values go away with their user and attribute
+	c.Assert(db.Exec("DELETE FROM users WHERE id = 1").Error, IsNil)
+	var count int
+	c.Assert(db.Table("user_attributes").Count(&count).Error, IsNil)
+	c.Check(count, Equals, 1)
+	c.Assert(db.Exec("DELETE FROM attributes").Error, IsNil)
+	c.Assert(db.Table("user_attributes").Count(&count).Error, IsNil)
+	c.Check(count, Equals, 0)
+
+	c.Assert(s.migrator.To(9), IsNil)
+	c.Assert(db.Table("users").Count(&count).Error, IsNil)
+	c.Check(count, Equals, 1)
+}
+
+// Creates the group admins that go away with their group or user
+func (s *MigratorTestSuite) TestGroupAdmins(c *C) {
+	c.Assert(s.migrator.To(10), IsNil)
+
+	db := s.migrator.db
+	c.Assert(db.Exec("INSERT INTO groups (name) VALUES ('staff'), ('admins')").Error, IsNil)
+	c.Assert(db.Exec("INSERT INTO users (name, password, email) VALUES ('ana', 'pass', 'ana@3fs.si'), ('bob', 'pass', 'bob@3fs.si')").Error, IsNil)
+
+	c.Assert(s.migrator.Up(), IsNil)
+
+	c.Check(db.Exec("INSERT INTO group_admins (group_id, user_id, role) VALUES (1, 1, 'owner'), (1, 2, 'manager'), (2, 2, 'owner')").Error, IsNil)
+	c.Check(db.Exec("INSERT INTO group_admins (group_id, user_id, role) VALUES (2, 1, 'admin')").Error, NotNil)
+
+	c.Assert(db.Exec("DELETE FROM users WHERE id = 1").Error, IsNil)
+	c.Assert(db.Exec("DELETE FROM groups WHERE id = 2").Error, IsNil)
+	var count int
+	c.Assert(db.Table("group_admins").Count(&count).Error, IsNil)
+	c.Check(count, Equals, 1)
+
+	c.Assert(s.migrator.To(10), IsNil)
+	c.Check(db.HasTable("group_admins"), Equals, false)
+}
+
+// Cascades the memberships of a group, which are removed with it
+func (s *MigratorTestSuite) TestCascadeMemberships(c *C) {
+	c.Assert(s.migrator.To(11), IsNil)
+
+	db := s.migrator.db
+	c.Assert(db.Exec("INSERT INTO groups (name) VALUES ('staff')").Error, IsNil)
+	c.Assert(db.Exec("INSERT INTO users (name, password, email) VALUES ('staff', 'pass', 'staff@3fs.si')").Error, IsNil)
+	c.Assert(db.Exec("INSERT INTO memberships (user_id, group_id) VALUES (1, 1)").Error, IsNil)
+	c.Check(db.Exec("DELETE FROM groups WHERE id = 1").Error, NotNil)
+
+	c.Assert(s.migrator.Up(), IsNil)
+
+	var count int
+	c.Assert(db.Table("memberships").Count(&count).Error, IsNil)
+	c.Check(count, Equals, 1)
+	c.Check(db.Exec("INSERT INTO memberships (user_id, group_id) VALUES (1, 2)").Error, NotNil)
+
+	c.Assert(db.Exec("DELETE FROM groups WHERE id = 1").Error, IsNil)
+	c.Assert(db.Table("memberships").Count(&count).Error, IsNil)
+	c.Check(count, Equals, 0)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// purgeStore is the store whose deleted users and groups are purged
+type purgeStore interface {
+	PurgeUsers(before time.Time) (int, error)
+	PurgeGroups(before time.Time) (int, error)
+}
+
+// purgeDeleted removes the users and groups deleted before the given time for good,
+// users go first so that the groups they belonged to can go in the same run
+func purgeDeleted(store purgeStore, before time.Time) (users, groups int, err error) {
+	if users, err = store.PurgeUsers(before); err != nil {
+		return
+	}
+	groups, err = store.PurgeGroups(before)
+	return
+}
+
+// runPurger purges the users and groups that were deleted longer than after ago, once every interval
+func runPurger(l *log.Logger, store purgeStore, after, interval time.Duration) {
+	for {
+		users, groups, err := purgeDeleted(store, time.Now().Add(-after))
+		if err != nil {
+			l.Println("Error purging deleted users and groups", err)
+		} else if users+groups > 0 {
+			l.Println("Purged", users, "deleted users and", groups, "deleted groups")
+		}
+
+		time.Sleep(interval)
+	}
+}